@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/kunterbunt/calendarium-server/controller"
+	"github.com/kunterbunt/calendarium-server/logging"
+	"github.com/kunterbunt/calendarium-server/model"
+	"golang.org/x/term"
+)
+
+// readPassword reads a password from the first line of stdin. If stdin is a terminal, it prompts and does not echo.
+// Reading from stdin keeps passwords out of the process list and the shell history.
+func readPassword() (string, error) {
+	if term.IsTerminal(int(os.Stdin.Fd())) {
+		fmt.Fprint(os.Stderr, "Password: ")
+		password, err := term.ReadPassword(int(os.Stdin.Fd()))
+		fmt.Fprintln(os.Stderr)
+		if err != nil {
+			return "", err
+		}
+		return string(password), nil
+	}
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && line == "" {
+		return "", errors.New("no password given on stdin")
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// adminUserCommand parses the flags of a command that changes one admin user and sets up the server.
+func adminUserCommand(flags *flag.FlagSet, args []string) (*controller.Server, string, int) {
+	username := flags.String("username", "", "username of the admin user (required)")
+	config, code := parseFlags(flags, args)
+	if code != exitOK {
+		return nil, "", code
+	}
+	if *username == "" {
+		fmt.Fprintln(os.Stderr, "-username is required")
+		return nil, "", exitUsage
+	}
+	server, err := setup(config, false)
+	if err != nil {
+		logging.Error(err.Error())
+		return nil, "", exitFailure
+	}
+	return server, *username, exitOK
+}
+
+// createAdminUser creates an admin user.
+func createAdminUser(args []string) int {
+	flags := flag.NewFlagSet("admin create", flag.ContinueOnError)
+	role := flags.String("role", controller.RoleViewer, "role of the user: "+strings.Join(controller.Roles(), ", "))
+	server, username, code := adminUserCommand(flags, args)
+	if code != exitOK {
+		return code
+	}
+	password, err := readPassword()
+	if err != nil {
+		logging.Error(err.Error())
+		return exitFailure
+	}
+	_, err = server.CreateAdminUser(cliContext(), username, password, *role, time.Now())
+	if err != nil {
+		logging.Error(err.Error())
+		return exitFailure
+	}
+	fmt.Println("Created admin user '" + username + "' with role " + *role + ".")
+	return exitOK
+}
+
+// setAdminUserRole changes the role of an admin user.
+func setAdminUserRole(args []string) int {
+	flags := flag.NewFlagSet("admin set-role", flag.ContinueOnError)
+	role := flags.String("role", "", "new role of the user: "+strings.Join(controller.Roles(), ", ")+" (required)")
+	server, username, code := adminUserCommand(flags, args)
+	if code != exitOK {
+		return code
+	}
+	err := server.SetAdminUserRole(cliContext(), username, *role)
+	if err != nil {
+		logging.Error(err.Error())
+		return exitFailure
+	}
+	fmt.Println("Admin user '" + username + "' has role " + *role + " now.")
+	return exitOK
+}
+
+// disableAdminUser disables an admin user.
+func disableAdminUser(args []string) int {
+	server, username, code := adminUserCommand(flag.NewFlagSet("admin disable", flag.ContinueOnError), args)
+	if code != exitOK {
+		return code
+	}
+	err := server.SetAdminUserDisabled(cliContext(), username, true)
+	if err != nil {
+		logging.Error(err.Error())
+		return exitFailure
+	}
+	fmt.Println("Disabled admin user '" + username + "'.")
+	return exitOK
+}
+
+// enableAdminUser enables a disabled admin user.
+func enableAdminUser(args []string) int {
+	server, username, code := adminUserCommand(flag.NewFlagSet("admin enable", flag.ContinueOnError), args)
+	if code != exitOK {
+		return code
+	}
+	err := server.SetAdminUserDisabled(cliContext(), username, false)
+	if err != nil {
+		logging.Error(err.Error())
+		return exitFailure
+	}
+	fmt.Println("Enabled admin user '" + username + "'.")
+	return exitOK
+}
+
+// resetAdminPassword sets a new password for an admin user.
+func resetAdminPassword(args []string) int {
+	server, username, code := adminUserCommand(flag.NewFlagSet("admin reset-password", flag.ContinueOnError), args)
+	if code != exitOK {
+		return code
+	}
+	password, err := readPassword()
+	if err != nil {
+		logging.Error(err.Error())
+		return exitFailure
+	}
+	err = server.ResetAdminPassword(cliContext(), username, password)
+	if err != nil {
+		logging.Error(err.Error())
+		return exitFailure
+	}
+	fmt.Println("Reset the password of admin user '" + username + "'.")
+	return exitOK
+}
+
+// listAdminUsers lists all admin users.
+func listAdminUsers(args []string) int {
+	flags := flag.NewFlagSet("admin list", flag.ContinueOnError)
+	config, code := parseFlags(flags, args)
+	if code != exitOK {
+		return code
+	}
+	server, err := setup(config, false)
+	if err != nil {
+		logging.Error(err.Error())
+		return exitFailure
+	}
+	users, err := model.GetAdminUsers(server.Db, &server.Mutex)
+	if err != nil {
+		logging.Error(err.Error())
+		return exitFailure
+	}
+	for _, user := range users {
+		status := "enabled"
+		if user.Disabled {
+			status = "disabled"
+		} else if user.LockedUntil > time.Now().UTC().Format(time.RFC3339) {
+			status = "locked"
+		}
+		lastLogin := user.LastLogin
+		if lastLogin == "" {
+			lastLogin = "never"
+		}
+		fmt.Printf("%-24s %-11s %-8s last login %s\n", user.Username, user.Role, status, lastLogin)
+	}
+	if len(users) == 0 {
+		fmt.Println("No admin users exist.")
+	}
+	return exitOK
+}
@@ -0,0 +1,362 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/user"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kunterbunt/calendarium-server/controller"
+	"github.com/kunterbunt/calendarium-server/logging"
+	"github.com/kunterbunt/calendarium-server/model"
+)
+
+// parseFlags parses the flags of a command and loads the configuration.
+// It returns a non-zero exit code if the command should stop.
+func parseFlags(flags *flag.FlagSet, args []string) (*Config, int) {
+	configFile := configFlag(flags)
+	err := flags.Parse(args)
+	if err != nil {
+		return nil, exitUsage
+	}
+	if flags.NArg() > 0 {
+		fmt.Fprintln(os.Stderr, "unexpected arguments: "+strings.Join(flags.Args(), " "))
+		return nil, exitUsage
+	}
+	config, err := loadConfig(*configFile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return nil, exitUsage
+	}
+	level, _ := logging.ParseLevel(config.LogLevel)
+	logging.Configure(os.Stderr, level)
+	return config, exitOK
+}
+
+// cliContext attributes changes made by a command to the user running it.
+func cliContext() context.Context {
+	actor := "cli"
+	if current, err := user.Current(); err == nil {
+		actor += ":" + current.Username
+	}
+	return controller.WithActor(context.Background(), actor)
+}
+
+// serve starts the REST API server.
+func serve(args []string) int {
+	flags := flag.NewFlagSet("serve", flag.ContinueOnError)
+	config, code := parseFlags(flags, args)
+	if code != exitOK {
+		return code
+	}
+	server, err := setup(config, true)
+	if err != nil {
+		logging.Error(err.Error())
+		return exitFailure
+	}
+	_, err = ensureProducts(context.Background(), server, false)
+	if err != nil {
+		logging.Error(err.Error())
+		return exitFailure
+	}
+	if config.Metrics.Enabled && config.Metrics.Listen != "" {
+		err = server.ServeMetrics(config.Metrics.Listen)
+		if err != nil {
+			logging.Error(err.Error())
+			return exitFailure
+		}
+	}
+	if server.RetentionPolicy.Enabled() && config.Retention.IntervalHours > 0 {
+		server.ScheduleRetentionPolicy(time.Duration(config.Retention.IntervalHours) * time.Hour)
+	}
+	if server.RateLimiter != nil {
+		server.ScheduleSavingBlockedClients(time.Minute)
+	}
+	if server.SEPACreditor != nil {
+		server.ScheduleDirectDebitSettlement(time.Hour)
+	}
+	if server.DunningPolicy.Enabled() && config.Dunning.IntervalHours > 0 {
+		server.ScheduleDunning(time.Duration(config.Dunning.IntervalHours) * time.Hour)
+	}
+	err = server.ListenAndServe(listenOptions(config))
+	server.Db.Close()
+	if err != nil {
+		logging.Error(err.Error())
+		return exitFailure
+	}
+	return exitOK
+}
+
+// migrate applies pending database migrations.
+func migrate(args []string) int {
+	flags := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	dryRun := flags.Bool("dry-run", false, "only list pending migrations")
+	config, code := parseFlags(flags, args)
+	if code != exitOK {
+		return code
+	}
+	var mutex sync.Mutex
+	if *dryRun {
+		db, err := openReadOnly(config.Database)
+		if err != nil {
+			logging.Error(err.Error())
+			return exitFailure
+		}
+		defer db.Close()
+		pending, err := model.PendingMigrations(db, &mutex)
+		if err != nil {
+			logging.Error(err.Error())
+			return exitFailure
+		}
+		for _, migration := range pending {
+			fmt.Printf("Pending migration %d: %s.\n", migration.Version, migration.Description)
+		}
+		fmt.Println(strconv.Itoa(len(pending)) + " pending migrations.")
+		return exitOK
+	}
+	db, err := model.OpenDb(config.Database)
+	if err != nil {
+		logging.Error(err.Error())
+		return exitFailure
+	}
+	defer db.Close()
+	applied, err := model.Migrate(db, &mutex)
+	for _, migration := range applied {
+		fmt.Printf("Applied migration %d: %s.\n", migration.Version, migration.Description)
+	}
+	if err != nil {
+		logging.Error(err.Error())
+		return exitFailure
+	}
+	fmt.Println(strconv.Itoa(len(applied)) + " migrations applied.")
+	return exitOK
+}
+
+// openReadOnly opens the database for a dry run. A database that does not exist yet is not created, an empty
+// in-memory database stands in for it.
+func openReadOnly(filename string) (*sql.DB, error) {
+	_, err := os.Stat(filename)
+	if os.IsNotExist(err) {
+		return model.OpenDb(":memory:")
+	}
+	return model.OpenDbReadOnly(filename)
+}
+
+// ensureProducts creates the products that should exist and returns the names of the created ones.
+func ensureProducts(ctx context.Context, server *controller.Server, dryRun bool) ([]string, error) {
+	created := make([]string, 0)
+	for _, product := range model.GetProductsThatShouldExist() {
+		productInDb, err := model.GetProduct(server.Db, product.Name, &server.Mutex)
+		if err != nil {
+			return created, err
+		}
+		if productInDb.ID != model.InvalidID {
+			continue
+		}
+		if !dryRun {
+			err = server.AddProduct(ctx, &product)
+			if err != nil {
+				return created, err
+			}
+		}
+		created = append(created, product.Name)
+	}
+	return created, nil
+}
+
+// seedProducts creates the products that should exist.
+func seedProducts(args []string) int {
+	flags := flag.NewFlagSet("products seed", flag.ContinueOnError)
+	dryRun := flags.Bool("dry-run", false, "only list the products that would be created")
+	config, code := parseFlags(flags, args)
+	if code != exitOK {
+		return code
+	}
+	server, err := setup(config, false)
+	if err != nil {
+		logging.Error(err.Error())
+		return exitFailure
+	}
+	created, err := ensureProducts(cliContext(), server, *dryRun)
+	for _, name := range created {
+		if *dryRun {
+			fmt.Println("Would create product '" + name + "'.")
+		} else {
+			fmt.Println("Created product '" + name + "'.")
+		}
+	}
+	if err != nil {
+		logging.Error(err.Error())
+		return exitFailure
+	}
+	if len(created) == 0 {
+		fmt.Println("All products exist.")
+	}
+	return exitOK
+}
+
+// resendFailedOrders forwards orders again whose last forward to a sink failed.
+func resendFailedOrders(args []string) int {
+	flags := flag.NewFlagSet("orders resend-failed", flag.ContinueOnError)
+	dryRun := flags.Bool("dry-run", false, "only list the orders that would be forwarded again")
+	sinkName := flags.String("sink", "", "only resend to the sink with this name")
+	includeTestOrders := flags.Bool("include-test-orders", false, "also resend orders whose delivery first name is 'Test'")
+	config, code := parseFlags(flags, args)
+	if code != exitOK {
+		return code
+	}
+	server, err := setup(config, false)
+	if err != nil {
+		logging.Error(err.Error())
+		return exitFailure
+	}
+
+	failed, err := model.GetFailedOrderForwards(server.Db, &server.Mutex)
+	if err != nil {
+		logging.Error(err.Error())
+		return exitFailure
+	}
+	// Orders placed before forwards were recorded only have the billbee response, which was the error if billbee rejected them.
+	orders, err := model.GetOrders(server.Db, &server.Mutex)
+	if err != nil {
+		logging.Error(err.Error())
+		return exitFailure
+	}
+	for _, order := range orders {
+		if !strings.HasPrefix(order.BillbeeResponse, controller.BillbeeErrorPrefix) {
+			continue
+		}
+		forwards, err := model.GetOrderForwards(server.Db, order.ID, &server.Mutex)
+		if err != nil {
+			logging.Error(err.Error())
+			return exitFailure
+		}
+		if len(forwards) == 0 {
+			failed = append(failed, model.OrderForward{OrderID: order.ID, Sink: "billbee", Response: order.BillbeeResponse})
+		}
+	}
+
+	exitCode := exitOK
+	for _, forward := range failed {
+		if *sinkName != "" && forward.Sink != *sinkName {
+			continue
+		}
+		order, err := model.GetOrder(server.Db, forward.OrderID, &server.Mutex)
+		if err != nil {
+			logging.Error(err.Error())
+			return exitFailure
+		}
+		if (order.FirstNameDelivery == "Test" && !*includeTestOrders) || order.Quarantined {
+			continue
+		}
+		sink := server.Sink(forward.Sink)
+		if sink == nil {
+			fmt.Println(controller.ToOrderId(order.ID) + ": sink " + forward.Sink + " is not configured, skipping.")
+			continue
+		}
+		if *dryRun {
+			fmt.Println(controller.ToOrderId(order.ID) + ": would forward to " + sink.Name() + " again, last error: " + forward.Response)
+			continue
+		}
+		err = server.ForwardOrderTo(cliContext(), order, sink)
+		if err != nil {
+			fmt.Println(controller.ToOrderId(order.ID) + ": forwarding to " + sink.Name() + " failed again: " + err.Error())
+			exitCode = exitFailure
+		} else {
+			fmt.Println(controller.ToOrderId(order.ID) + ": forwarded to " + sink.Name() + ".")
+		}
+	}
+	return exitCode
+}
+
+// exportOrders writes all orders as JSON or CSV.
+func exportOrders(args []string) int {
+	flags := flag.NewFlagSet("orders export", flag.ContinueOnError)
+	format := flags.String("format", "json", "json or csv")
+	outFile := flags.String("out", "", "output file (default: stdout)")
+	config, code := parseFlags(flags, args)
+	if code != exitOK {
+		return code
+	}
+	if *format != "json" && *format != "csv" {
+		fmt.Fprintln(os.Stderr, "unknown format '"+*format+"'")
+		return exitUsage
+	}
+	server, err := setup(config, false)
+	if err != nil {
+		logging.Error(err.Error())
+		return exitFailure
+	}
+	orders, err := model.GetOrders(server.Db, &server.Mutex)
+	if err != nil {
+		logging.Error(err.Error())
+		return exitFailure
+	}
+	var out io.Writer = os.Stdout
+	if *outFile != "" {
+		file, err := os.Create(*outFile)
+		if err != nil {
+			logging.Error(err.Error())
+			return exitFailure
+		}
+		defer file.Close()
+		out = file
+	}
+	if *format == "json" {
+		encoder := json.NewEncoder(out)
+		encoder.SetIndent("", "  ")
+		err = encoder.Encode(orders)
+	} else {
+		err = writeOrdersCsv(out, orders)
+	}
+	if err != nil {
+		logging.Error(err.Error())
+		return exitFailure
+	}
+	logging.Info("exported orders", logging.Fields{"count": len(orders)})
+	return exitOK
+}
+
+// writeOrdersCsv writes one line per order with the JSON field names as header.
+func writeOrdersCsv(out io.Writer, orders []model.Order) error {
+	writer := csv.NewWriter(out)
+	orderType := reflect.TypeOf(model.Order{})
+	header := make([]string, 0, orderType.NumField())
+	fields := make([]int, 0, orderType.NumField())
+	for i := 0; i < orderType.NumField(); i++ {
+		tag := strings.Split(orderType.Field(i).Tag.Get("json"), ",")
+		// Fields that are only sent by the order form are omitted if empty and never saved.
+		if len(tag) > 1 && tag[1] == "omitempty" {
+			continue
+		}
+		header = append(header, tag[0])
+		fields = append(fields, i)
+	}
+	err := writer.Write(header)
+	if err != nil {
+		return err
+	}
+	for _, order := range orders {
+		value := reflect.ValueOf(order)
+		line := make([]string, len(fields))
+		for i, field := range fields {
+			line[i] = fmt.Sprint(value.Field(field).Interface())
+		}
+		err = writer.Write(line)
+		if err != nil {
+			return err
+		}
+	}
+	writer.Flush()
+	return writer.Error()
+}
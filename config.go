@@ -0,0 +1,411 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/kunterbunt/calendarium-server/controller"
+	"github.com/kunterbunt/calendarium-server/logging"
+	"github.com/kunterbunt/calendarium-server/model"
+)
+
+// Config is read from a JSON file shared by all commands.
+type Config struct {
+	Database string `json:"database"`
+	Port     int    `json:"port"`
+	// LogLevel is "debug", "info", "warn" or "error".
+	LogLevel string `json:"log_level"`
+	HTTP     struct {
+		// UnixSocket or Systemd socket activation replace the TCP port.
+		UnixSocket string `json:"unix_socket"`
+		Systemd    bool   `json:"systemd"`
+		// TLS is enabled if both files are given.
+		TLSCert                  string `json:"tls_cert"`
+		TLSKey                   string `json:"tls_key"`
+		ReadTimeoutSeconds       int    `json:"read_timeout_seconds"`
+		ReadHeaderTimeoutSeconds int    `json:"read_header_timeout_seconds"`
+		WriteTimeoutSeconds      int    `json:"write_timeout_seconds"`
+		IdleTimeoutSeconds       int    `json:"idle_timeout_seconds"`
+		ShutdownTimeoutSeconds   int    `json:"shutdown_timeout_seconds"`
+	} `json:"http"`
+	Admin struct {
+		// Username and Password are accepted as basic auth until the first admin user is created.
+		Username     string `json:"username"`
+		Password     string `json:"password"`
+		SessionHours int    `json:"session_hours"`
+	} `json:"admin"`
+	Billbee struct {
+		Enabled  bool   `json:"enabled"`
+		APIKey   string `json:"api_key"`
+		Username string `json:"username"`
+		Password string `json:"password"`
+		URL      string `json:"url"`
+	} `json:"billbee"`
+	PayPal struct {
+		Enabled bool `json:"enabled"`
+		// URL of the PayPal REST API, the sandbox by default.
+		URL          string `json:"url"`
+		ClientID     string `json:"client_id"`
+		ClientSecret string `json:"client_secret"`
+		WebhookID    string `json:"webhook_id"`
+		// ReturnURL and CancelURL are the frontend pages that buyers return to from PayPal.
+		ReturnURL string `json:"return_url"`
+		CancelURL string `json:"cancel_url"`
+	} `json:"paypal"`
+	// BankAccount receives bank transfers. If an IBAN is given, receipts and confirmations of such orders contain a GiroCode.
+	BankAccount struct {
+		Name string `json:"name"`
+		IBAN string `json:"iban"`
+		BIC  string `json:"bic"`
+	} `json:"bank_account"`
+	// SEPA enables payment by direct debit onto the bank account.
+	SEPA struct {
+		Enabled bool `json:"enabled"`
+		// CreditorID is the SEPA creditor identifier assigned by the Bundesbank, e.g. "DE98ZZZ09999999999".
+		CreditorID string `json:"creditor_id"`
+	} `json:"sepa"`
+	// CustomerEmail sends order confirmations to customers.
+	CustomerEmail struct {
+		Enabled  bool   `json:"enabled"`
+		Address  string `json:"address"`
+		Password string `json:"password"`
+		SMTPHost string `json:"smtp_host"`
+		SMTPPort string `json:"smtp_port"`
+	} `json:"customer_email"`
+	ErrorEmail struct {
+		Enabled      bool     `json:"enabled"`
+		Address      string   `json:"address"`
+		Password     string   `json:"password"`
+		SMTPHost     string   `json:"smtp_host"`
+		SMTPPort     string   `json:"smtp_port"`
+		Destinations []string `json:"destinations"`
+		Locale       string   `json:"locale"` // "de" or "en"
+	} `json:"error_email"`
+	RateLimit struct {
+		Enabled bool `json:"enabled"`
+		// Rates are in requests per second.
+		PerIPRate      float64  `json:"per_ip_rate"`
+		PerIPBurst     float64  `json:"per_ip_burst"`
+		GlobalRate     float64  `json:"global_rate"`
+		GlobalBurst    float64  `json:"global_burst"`
+		TrustedProxies []string `json:"trusted_proxies"`
+	} `json:"rate_limit"`
+	Spam struct {
+		Enabled bool `json:"enabled"`
+		// Secret signs form tokens and is required, so that tokens stay valid across restarts.
+		Secret         string `json:"secret"`
+		MinFillSeconds int    `json:"min_fill_seconds"`
+		MaxTokenHours  int    `json:"max_token_hours"`
+		PowDifficulty  int    `json:"pow_difficulty"`
+		// RequireToken rejects orders without a form token instead of quarantining them.
+		RequireToken bool `json:"require_token"`
+	} `json:"spam"`
+	Readiness struct {
+		MaxForwardBacklog      *int `json:"max_forward_backlog"`
+		MaxForwardSuccessHours int  `json:"max_forward_success_hours"`
+	} `json:"readiness"`
+	Metrics struct {
+		Enabled bool `json:"enabled"`
+		// Listen serves /metrics without authentication on a separate address, e.g. "127.0.0.1:9100".
+		// If empty, /metrics is served on the API with admin authentication.
+		Listen string `json:"listen"`
+	} `json:"metrics"`
+	Retention struct {
+		// StatutoryYears that orders are kept for accounting after the end of their calendar year.
+		StatutoryYears int `json:"statutory_years"`
+		// EraseAfterStatutory pseudonymizes orders once their statutory retention ended.
+		EraseAfterStatutory bool `json:"erase_after_statutory"`
+		// AnonymizeAfterMonths removes personal data that is not needed for accounting, 0 disables this.
+		AnonymizeAfterMonths int `json:"anonymize_after_months"`
+		// PurgeSpamAfterDays deletes quarantined orders, 0 disables this.
+		PurgeSpamAfterDays int `json:"purge_spam_after_days"`
+		// IntervalHours between scheduled runs of the policy while serving, 0 disables the schedule.
+		IntervalHours int `json:"interval_hours"`
+	} `json:"retention"`
+	// Dunning reminds customers of unpaid orders by email and needs customer_email.
+	Dunning struct {
+		Enabled bool `json:"enabled"`
+		// ReminderDays after an order was placed at which the escalating reminders are sent.
+		ReminderDays []int `json:"reminder_days"`
+		// FinalDays after an order was placed, a still unpaid order is cancelled or flagged for review
+		// according to FinalAction ("cancel" or "review"). 0 disables this.
+		FinalDays   int    `json:"final_days"`
+		FinalAction string `json:"final_action"`
+		// Payments lists the payment methods of the orders that are reminded.
+		Payments []string `json:"payments"`
+		// IntervalHours between scheduled runs while serving, 0 disables the schedule.
+		IntervalHours int `json:"interval_hours"`
+	} `json:"dunning"`
+	// EmailTypoCheck asks customers to confirm email addresses with likely misspelled provider domains such as "gmial.com".
+	EmailTypoCheck *bool `json:"email_typo_check"`
+	// Sinks lists additional order sinks, see controller.ParseOrderSink.
+	Sinks []string `json:"sinks"`
+	// WebhookSecret signs the orders posted to webhook sinks, $CALENDARIUM_WEBHOOK_SECRET takes precedence.
+	WebhookSecret string `json:"webhook_secret"`
+}
+
+const defaultConfigFile = "calendarium.json"
+
+// loadConfig reads the configuration file and applies defaults.
+func loadConfig(filename string) (*Config, error) {
+	var config Config
+	config.Port = 8000
+	config.LogLevel = "info"
+	config.HTTP.ReadTimeoutSeconds = 15
+	config.HTTP.ReadHeaderTimeoutSeconds = 5
+	config.HTTP.WriteTimeoutSeconds = 30
+	config.HTTP.IdleTimeoutSeconds = 120
+	config.HTTP.ShutdownTimeoutSeconds = 30
+	config.ErrorEmail.Locale = model.DefaultLocale
+	config.Retention.StatutoryYears = controller.DefaultRetentionYears
+	config.Retention.IntervalHours = 24
+	config.Dunning.ReminderDays = []int{14, 28}
+	config.Dunning.FinalDays = 42
+	config.Dunning.FinalAction = controller.DunningReview
+	config.Dunning.Payments = []string{controller.PaymentBankTransfer}
+	config.Dunning.IntervalHours = 24
+	config.Admin.SessionHours = int(controller.DefaultSessionLifetime / time.Hour)
+	config.PayPal.URL = controller.PayPalSandboxURL
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	decoder := json.NewDecoder(file)
+	decoder.DisallowUnknownFields()
+	err = decoder.Decode(&config)
+	if err != nil {
+		return nil, errors.New("error reading " + filename + ": " + err.Error())
+	}
+	if config.Database == "" {
+		return nil, errors.New(filename + ": 'database' is required")
+	}
+	if secret := os.Getenv("CALENDARIUM_WEBHOOK_SECRET"); secret != "" {
+		config.WebhookSecret = secret
+	}
+	_, err = logging.ParseLevel(config.LogLevel)
+	if err != nil {
+		return nil, errors.New(filename + ": " + err.Error())
+	}
+	if model.NormalizeLocale(config.ErrorEmail.Locale) != config.ErrorEmail.Locale {
+		return nil, errors.New(filename + ": unsupported error_email locale '" + config.ErrorEmail.Locale + "'")
+	}
+	if config.Admin.SessionHours <= 0 {
+		return nil, errors.New(filename + ": 'admin.session_hours' must be positive")
+	}
+	if config.PayPal.Enabled && (config.PayPal.ClientID == "" || config.PayPal.ClientSecret == "" || config.PayPal.WebhookID == "" || config.PayPal.ReturnURL == "" || config.PayPal.CancelURL == "") {
+		return nil, errors.New(filename + ": 'paypal' needs client_id, client_secret, webhook_id, return_url and cancel_url")
+	}
+	if config.BankAccount.IBAN != "" && config.BankAccount.Name == "" {
+		return nil, errors.New(filename + ": 'bank_account' needs the name of the account holder")
+	}
+	if config.SEPA.Enabled && !model.ValidIBAN(model.NormalizeIBAN(config.BankAccount.IBAN)) {
+		return nil, errors.New(filename + ": 'sepa' needs a valid IBAN in 'bank_account'")
+	}
+	if config.SEPA.Enabled && !model.ValidCreditorID(config.SEPA.CreditorID) {
+		return nil, errors.New(filename + ": 'sepa' needs a valid creditor_id")
+	}
+	if config.Retention.StatutoryYears < 0 || config.Retention.AnonymizeAfterMonths < 0 || config.Retention.PurgeSpamAfterDays < 0 || config.Retention.IntervalHours < 0 {
+		return nil, errors.New(filename + ": 'retention' values must not be negative")
+	}
+	if config.Dunning.Enabled {
+		err = checkDunning(&config)
+		if err != nil {
+			return nil, errors.New(filename + ": " + err.Error())
+		}
+	}
+	return &config, nil
+}
+
+// checkDunning validates the dunning configuration.
+func checkDunning(config *Config) error {
+	if !config.CustomerEmail.Enabled {
+		return errors.New("'dunning' needs 'customer_email' to be enabled")
+	}
+	last := 0
+	for _, days := range config.Dunning.ReminderDays {
+		if days <= last {
+			return errors.New("'dunning.reminder_days' must be positive and ascending")
+		}
+		last = days
+	}
+	if config.Dunning.FinalDays < 0 || (config.Dunning.FinalDays > 0 && config.Dunning.FinalDays <= last) {
+		return errors.New("'dunning.final_days' must be 0 or after the last reminder")
+	}
+	if config.Dunning.FinalAction != controller.DunningCancel && config.Dunning.FinalAction != controller.DunningReview {
+		return errors.New("'dunning.final_action' must be \"cancel\" or \"review\"")
+	}
+	if config.Dunning.IntervalHours < 0 {
+		return errors.New("'dunning.interval_hours' must not be negative")
+	}
+	return nil
+}
+
+// configFlag adds the -config flag that every command understands.
+func configFlag(flags *flag.FlagSet) *string {
+	defaultFile := os.Getenv("CALENDARIUM_CONFIG")
+	if defaultFile == "" {
+		defaultFile = defaultConfigFile
+	}
+	return flags.String("config", defaultFile, "configuration file (default from $CALENDARIUM_CONFIG)")
+}
+
+// setup opens the database and creates a server with all configured order sinks.
+// Unless migrate is set, the database schema must be up to date.
+func setup(config *Config, migrate bool) (*controller.Server, error) {
+	db, err := model.OpenDb(config.Database)
+	if err != nil {
+		return nil, err
+	}
+	return setupWithDb(config, db, migrate)
+}
+
+// setupReadOnly is setup for dry runs, the database cannot be changed.
+func setupReadOnly(config *Config) (*controller.Server, error) {
+	db, err := openReadOnly(config.Database)
+	if err != nil {
+		return nil, err
+	}
+	return setupWithDb(config, db, false)
+}
+
+// setupWithDb creates the server on an opened database.
+func setupWithDb(config *Config, db *sql.DB, migrate bool) (*controller.Server, error) {
+	server := controller.NewServer(db, config.Admin.Username, config.Admin.Password)
+	server.SessionLifetime = time.Duration(config.Admin.SessionHours) * time.Hour
+	if config.Admin.Username != "" {
+		logging.Warn("admin basic auth is deprecated and only accepted until the first admin user is created with 'admin create'")
+	}
+	if config.EmailTypoCheck != nil {
+		model.EmailTypoCheck = *config.EmailTypoCheck
+	}
+	if config.HTTP.WriteTimeoutSeconds > 0 {
+		// A request that has not finished within the write timeout has failed for the client, which may retry it.
+		model.IdempotencyReservationTimeout = time.Duration(config.HTTP.WriteTimeoutSeconds) * time.Second
+	}
+	if migrate {
+		applied, err := model.Migrate(db, &server.Mutex)
+		for _, migration := range applied {
+			logging.Info("applied migration", logging.Fields{"version": migration.Version, "description": migration.Description})
+		}
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		pending, err := model.PendingMigrations(db, &server.Mutex)
+		if err != nil {
+			return nil, err
+		}
+		if len(pending) > 0 {
+			return nil, fmt.Errorf("database schema is out of date (%d pending migrations), please run 'migrate' first", len(pending))
+		}
+	}
+
+	if config.Billbee.Enabled {
+		logging.Info("billbee forwarding enabled")
+		server.AttachBillbeeForwarder(config.Billbee.APIKey, config.Billbee.Username, config.Billbee.Password, config.Billbee.URL)
+		if config.ErrorEmail.Enabled {
+			logging.Info("emails upon error enabled")
+			server.AttachEmailer(config.ErrorEmail.Address, config.ErrorEmail.Password, config.ErrorEmail.SMTPHost, config.ErrorEmail.SMTPPort, config.ErrorEmail.Destinations, config.ErrorEmail.Locale)
+		}
+	} else {
+		logging.Info("billbee forwarding disabled")
+	}
+	if config.PayPal.Enabled {
+		logging.Info("PayPal payments enabled", logging.Fields{"url": config.PayPal.URL})
+		server.AttachPayPal(controller.NewPayPalClient(config.PayPal.URL, config.PayPal.ClientID, config.PayPal.ClientSecret, config.PayPal.WebhookID, config.PayPal.ReturnURL, config.PayPal.CancelURL))
+	}
+	if config.BankAccount.IBAN != "" {
+		server.AttachBankAccount(controller.BankAccount{Name: config.BankAccount.Name, IBAN: config.BankAccount.IBAN, BIC: config.BankAccount.BIC})
+	}
+	if config.SEPA.Enabled {
+		logging.Info("SEPA direct debit enabled")
+		server.AttachSEPACreditor(controller.SEPACreditor{Name: config.BankAccount.Name, IBAN: config.BankAccount.IBAN, BIC: config.BankAccount.BIC, CreditorID: config.SEPA.CreditorID})
+	}
+	if config.CustomerEmail.Enabled {
+		logging.Info("customer emails enabled")
+		server.AttachCustomerEmailer(controller.NewEmailer(config.CustomerEmail.Address, config.CustomerEmail.Password, config.CustomerEmail.SMTPHost, config.CustomerEmail.SMTPPort))
+	}
+	if config.RateLimit.Enabled {
+		limiter, err := controller.NewRateLimiter(config.RateLimit.PerIPRate, config.RateLimit.PerIPBurst, config.RateLimit.GlobalRate, config.RateLimit.GlobalBurst, config.RateLimit.TrustedProxies)
+		if err != nil {
+			return nil, err
+		}
+		server.AttachRateLimiter(limiter)
+	}
+	if config.Spam.Enabled {
+		maxTokenAge := time.Duration(config.Spam.MaxTokenHours) * time.Hour
+		if maxTokenAge == 0 {
+			maxTokenAge = 24 * time.Hour
+		}
+		guard, err := controller.NewSpamGuard(config.Spam.Secret, time.Duration(config.Spam.MinFillSeconds)*time.Second, maxTokenAge, config.Spam.PowDifficulty, config.Spam.RequireToken)
+		if err != nil {
+			return nil, err
+		}
+		server.AttachSpamGuard(guard)
+	}
+	for _, spec := range config.Sinks {
+		if spec == "billbee" && server.BillbeeForwarder != nil {
+			continue // already attached
+		}
+		sink, err := controller.ParseOrderSink(spec, server.BillbeeForwarder, config.WebhookSecret)
+		if err != nil {
+			return nil, err
+		}
+		logging.Info("forwarding orders", logging.Fields{"sink": sink.Name()})
+		server.AttachSink(sink)
+	}
+	if config.Readiness.MaxForwardBacklog != nil {
+		server.MaxForwardBacklog = *config.Readiness.MaxForwardBacklog
+	}
+	server.MaxForwardSuccessAge = time.Duration(config.Readiness.MaxForwardSuccessHours) * time.Hour
+	server.RetentionYears = config.Retention.StatutoryYears
+	server.RetentionPolicy = controller.RetentionPolicy{
+		AnonymizeAfterMonths: config.Retention.AnonymizeAfterMonths,
+		PurgeSpamAfterDays:   config.Retention.PurgeSpamAfterDays,
+		EraseAfterRetention:  config.Retention.EraseAfterStatutory,
+	}
+	if config.Dunning.Enabled {
+		// Checked here since whether a payment method is enabled depends on what is attached.
+		for _, payment := range config.Dunning.Payments {
+			if !server.PaymentMethodEnabled(payment) {
+				return nil, errors.New("'dunning.payments' contains '" + payment + "', which is not an enabled payment method")
+			}
+		}
+		server.DunningPolicy = controller.DunningPolicy{
+			ReminderDays: config.Dunning.ReminderDays,
+			FinalDays:    config.Dunning.FinalDays,
+			FinalAction:  config.Dunning.FinalAction,
+			Payments:     config.Dunning.Payments,
+		}
+	}
+	// Attached last so that the emailer exists.
+	if config.Metrics.Enabled {
+		server.AttachMetrics(controller.NewMetrics(), config.Metrics.Listen != "")
+	}
+	return server, nil
+}
+
+// listenOptions converts the HTTP configuration.
+func listenOptions(config *Config) controller.ListenOptions {
+	seconds := func(n int) time.Duration {
+		return time.Duration(n) * time.Second
+	}
+	return controller.ListenOptions{
+		Port:              config.Port,
+		UnixSocket:        config.HTTP.UnixSocket,
+		Systemd:           config.HTTP.Systemd,
+		TLSCert:           config.HTTP.TLSCert,
+		TLSKey:            config.HTTP.TLSKey,
+		ReadTimeout:       seconds(config.HTTP.ReadTimeoutSeconds),
+		ReadHeaderTimeout: seconds(config.HTTP.ReadHeaderTimeoutSeconds),
+		WriteTimeout:      seconds(config.HTTP.WriteTimeoutSeconds),
+		IdleTimeout:       seconds(config.HTTP.IdleTimeoutSeconds),
+		ShutdownTimeout:   seconds(config.HTTP.ShutdownTimeoutSeconds),
+	}
+}
@@ -0,0 +1,401 @@
+package controller
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kunterbunt/calendarium-server/logging"
+	"github.com/kunterbunt/calendarium-server/model"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// MinPasswordLength of admin users.
+const MinPasswordLength = 12
+
+// DefaultSessionLifetime is how long a login is valid.
+const DefaultSessionLifetime = 12 * time.Hour
+
+// passwordCost of the bcrypt hashes.
+const passwordCost = 12
+
+// MaxFailedLogins in a row lock an admin user out for LoginLockout.
+// Each further failure after the lockout ended locks the user out again, until a login succeeds.
+const MaxFailedLogins = 5
+
+// LoginLockout is how long an admin user cannot log in after MaxFailedLogins.
+const LoginLockout = 15 * time.Minute
+
+// ErrInvalidCredentials is returned for unknown users, wrong passwords and disabled users alike.
+var ErrInvalidCredentials = errors.New("invalid username or password")
+
+// ErrLockedOut is returned when an admin user logs in during its lockout, even with the right password.
+// Clients get the same response as for ErrInvalidCredentials, so that it does not tell which users exist.
+var ErrLockedOut = errors.New("too many failed logins")
+
+var usernamePattern = regexp.MustCompile(`^[A-Za-z0-9._@-]{1,64}$`)
+
+// dummyHash is compared against when a user does not exist, so that the response time does not tell.
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("calendarium"), passwordCost)
+
+// Session is the response to a successful login. The token is sent as "Authorization: Bearer <token>".
+type Session struct {
+	Token     string `json:"token"`
+	ExpiresAt string `json:"expires_at"`
+	Username  string `json:"username"`
+}
+
+// loginRequest is the body of POST /api/admin/login.
+type loginRequest struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+type adminContextKey struct{}
+
+// adminFromContext returns the admin user that authenticated the request, or nil.
+func adminFromContext(ctx context.Context) *model.AdminUser {
+	user, _ := ctx.Value(adminContextKey{}).(*model.AdminUser)
+	return user
+}
+
+// hashToken returns the hex-encoded SHA-256 hash under which a session token is stored.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// checkPassword enforces the password policy.
+func checkPassword(password string) error {
+	if len(password) < MinPasswordLength {
+		return errors.New("the password must have at least " + strconv.Itoa(MinPasswordLength) + " characters")
+	}
+	return nil
+}
+
+// CreateAdminUser adds an admin user with a bcrypt hash of the password.
+func (server *Server) CreateAdminUser(ctx context.Context, username string, password string, role string, now time.Time) (*model.AdminUser, error) {
+	if !usernamePattern.MatchString(username) {
+		return nil, errors.New("invalid username '" + username + "'")
+	}
+	err := checkRole(role)
+	if err != nil {
+		return nil, err
+	}
+	err = checkPassword(password)
+	if err != nil {
+		return nil, err
+	}
+	existing, err := model.GetAdminUser(server.Db, username, &server.Mutex)
+	if err != nil {
+		return nil, err
+	}
+	if existing.ID != int64(model.InvalidID) {
+		return nil, errors.New("admin user '" + username + "' already exists")
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), passwordCost)
+	if err != nil {
+		return nil, err
+	}
+	user := model.AdminUser{Username: username, PasswordHash: string(hash), Role: role, Created: now.UTC().Format(time.RFC3339)}
+	err = model.Transaction(server.Db, &server.Mutex, func(tx model.Queryer) error {
+		err := model.AddAdminUser(tx, &user, nil)
+		if err != nil {
+			return err
+		}
+		return server.audit(ctx, tx, "admin_user.create", AuditTargetAdminUser, user.ID, nil, &user)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// getExistingAdminUser returns the admin user with the given username, or an error if there is none.
+func (server *Server) getExistingAdminUser(username string) (*model.AdminUser, error) {
+	user, err := model.GetAdminUser(server.Db, username, &server.Mutex)
+	if err != nil {
+		return nil, err
+	}
+	if user.ID == int64(model.InvalidID) {
+		return nil, errors.New("admin user '" + username + "' does not exist")
+	}
+	return user, nil
+}
+
+// ResetAdminPassword sets a new password and ends all sessions of the user.
+func (server *Server) ResetAdminPassword(ctx context.Context, username string, password string) error {
+	user, err := server.getExistingAdminUser(username)
+	if err != nil {
+		return err
+	}
+	err = checkPassword(password)
+	if err != nil {
+		return err
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), passwordCost)
+	if err != nil {
+		return err
+	}
+	return model.Transaction(server.Db, &server.Mutex, func(tx model.Queryer) error {
+		err := model.SetAdminUserPassword(tx, user.ID, string(hash), nil)
+		if err != nil {
+			return err
+		}
+		return server.auditChanges(ctx, tx, "admin_user.reset_password", AuditTargetAdminUser, user.ID, map[string]AuditChange{
+			"password": {logging.Redacted, logging.Redacted},
+		})
+	})
+}
+
+// SetAdminUserRole changes the role of a user.
+func (server *Server) SetAdminUserRole(ctx context.Context, username string, role string) error {
+	user, err := server.getExistingAdminUser(username)
+	if err != nil {
+		return err
+	}
+	err = checkRole(role)
+	if err != nil {
+		return err
+	}
+	updated := *user
+	updated.Role = role
+	return model.Transaction(server.Db, &server.Mutex, func(tx model.Queryer) error {
+		err := model.SetAdminUserRole(tx, user.ID, role, nil)
+		if err != nil {
+			return err
+		}
+		return server.audit(ctx, tx, "admin_user.set_role", AuditTargetAdminUser, user.ID, user, &updated)
+	})
+}
+
+// SetAdminUserDisabled disables a user, ending all of its sessions, or enables it again.
+func (server *Server) SetAdminUserDisabled(ctx context.Context, username string, disabled bool) error {
+	user, err := server.getExistingAdminUser(username)
+	if err != nil {
+		return err
+	}
+	updated := *user
+	updated.Disabled = disabled
+	action := "admin_user.enable"
+	if disabled {
+		action = "admin_user.disable"
+	}
+	return model.Transaction(server.Db, &server.Mutex, func(tx model.Queryer) error {
+		err := model.SetAdminUserDisabled(tx, user.ID, disabled, nil)
+		if err != nil {
+			return err
+		}
+		return server.audit(ctx, tx, action, AuditTargetAdminUser, user.ID, user, &updated)
+	})
+}
+
+// Login checks the password of an admin user and starts a session.
+// After MaxFailedLogins wrong passwords in a row, the user is locked out for LoginLockout;
+// resetting its password lifts the lockout. Logins and lockouts are recorded in the audit log.
+func (server *Server) Login(ctx context.Context, username string, password string, now time.Time) (*Session, error) {
+	user, err := model.GetAdminUser(server.Db, username, &server.Mutex)
+	if err != nil {
+		return nil, err
+	}
+	hash := dummyHash
+	if user.ID != int64(model.InvalidID) {
+		hash = []byte(user.PasswordHash)
+	}
+	wrongPassword := bcrypt.CompareHashAndPassword(hash, []byte(password)) != nil
+	if user.ID == int64(model.InvalidID) || user.Disabled {
+		return nil, ErrInvalidCredentials
+	}
+	if user.LockedUntil > now.UTC().Format(time.RFC3339) {
+		return nil, ErrLockedOut
+	}
+	ctx = WithActor(ctx, "admin:"+user.Username)
+	if wrongPassword {
+		lockedUntil := now.UTC().Add(LoginLockout).Format(time.RFC3339)
+		locked := false
+		err = model.Transaction(server.Db, &server.Mutex, func(tx model.Queryer) error {
+			var err error
+			locked, err = model.AddFailedAdminLogin(tx, user.ID, MaxFailedLogins, lockedUntil, nil)
+			if err != nil || !locked {
+				return err
+			}
+			return server.auditChanges(ctx, tx, "admin_user.lockout", AuditTargetAdminUser, user.ID, map[string]AuditChange{
+				"locked_until": {user.LockedUntil, lockedUntil},
+			})
+		})
+		if err != nil {
+			return nil, err
+		}
+		if locked {
+			return nil, ErrLockedOut
+		}
+		return nil, ErrInvalidCredentials
+	}
+	random := make([]byte, 32)
+	_, err = rand.Read(random)
+	if err != nil {
+		return nil, err
+	}
+	token := hex.EncodeToString(random)
+	expires := now.UTC().Add(server.SessionLifetime)
+	err = model.DeleteExpiredAdminSessions(server.Db, now.UTC().Format(time.RFC3339), &server.Mutex)
+	if err != nil {
+		return nil, err
+	}
+	session := model.AdminSession{TokenHash: hashToken(token), UserID: user.ID, Created: now.UTC().Format(time.RFC3339), Expires: expires.Format(time.RFC3339)}
+	err = model.Transaction(server.Db, &server.Mutex, func(tx model.Queryer) error {
+		err := model.AddAdminSession(tx, &session, nil)
+		if err != nil {
+			return err
+		}
+		return server.auditChanges(ctx, tx, "admin_user.login", AuditTargetAdminUser, user.ID, map[string]AuditChange{
+			"last_login": {user.LastLogin, session.Created},
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &Session{Token: token, ExpiresAt: session.Expires, Username: user.Username}, nil
+}
+
+// bearerToken returns the token of an "Authorization: Bearer" header, or "".
+func bearerToken(request *http.Request) string {
+	header := request.Header.Get("Authorization")
+	if len(header) > 7 && strings.EqualFold(header[:7], "Bearer ") {
+		return strings.TrimSpace(header[7:])
+	}
+	return ""
+}
+
+// authenticate returns the admin user of a request, or nil if the request is not authenticated.
+// Besides session tokens, the configured basic auth credentials are accepted until the first admin user exists.
+func (server *Server) authenticate(request *http.Request) (*model.AdminUser, error) {
+	logger := logging.FromContext(request.Context())
+	if token := bearerToken(request); token != "" {
+		user, err := model.GetAdminSessionUser(server.Db, hashToken(token), time.Now().UTC().Format(time.RFC3339), &server.Mutex)
+		if err != nil || user.ID == int64(model.InvalidID) {
+			return nil, err
+		}
+		return user, nil
+	}
+	username, password, ok := request.BasicAuth()
+	if !ok || server.BasicAuthUsername == "" || server.BasicAuthPassword == "" {
+		return nil, nil
+	}
+	if subtle.ConstantTimeCompare([]byte(username), []byte(server.BasicAuthUsername)) != 1 || subtle.ConstantTimeCompare([]byte(password), []byte(server.BasicAuthPassword)) != 1 {
+		return nil, nil
+	}
+	count, err := model.CountAdminUsers(server.Db, &server.Mutex)
+	if err != nil {
+		return nil, err
+	}
+	if count > 0 {
+		logger.Warn("rejected basic auth because admin users exist, please log in with a user")
+		return nil, nil
+	}
+	return &model.AdminUser{ID: int64(model.InvalidID), Username: username, Role: RoleAdmin}, nil
+}
+
+// requireLogin only passes authenticated requests to a handler
+// and adds the admin user to the request context and its log entries.
+func (server *Server) requireLogin(handler http.HandlerFunc) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		user, err := server.authenticate(request)
+		if err != nil {
+			logging.FromContext(request.Context()).Error("authentication failed", logging.Fields{"error": err})
+			writeError(writer, http.StatusInternalServerError, ErrorInternal, err.Error())
+			return
+		}
+		if user == nil {
+			writer.Header().Add("WWW-Authenticate", `Bearer realm="calendarium"`)
+			if server.BasicAuthUsername != "" {
+				writer.Header().Add("WWW-Authenticate", `Basic realm="Please enter your username and password for this site"`)
+			}
+			writeError(writer, http.StatusUnauthorized, ErrorUnauthorized, "Unauthorized")
+			return
+		}
+		ctx := context.WithValue(request.Context(), adminContextKey{}, user)
+		ctx = logging.NewLoggerContext(ctx, logging.FromContext(ctx).With(logging.Fields{"admin": user.Username}))
+		handler(writer, request.WithContext(ctx))
+	}
+}
+
+// login starts a session for an admin user.
+func (server *Server) login(writer http.ResponseWriter, request *http.Request) {
+	logger := logging.FromContext(request.Context())
+	logger.Debug("login API call")
+	var body loginRequest
+	err := json.NewDecoder(request.Body).Decode(&body)
+	if err != nil {
+		writeError(writer, http.StatusBadRequest, ErrorInvalidRequest, "invalid JSON: "+err.Error())
+		return
+	}
+	session, err := server.Login(request.Context(), body.Username, body.Password, time.Now())
+	if err == ErrInvalidCredentials || err == ErrLockedOut {
+		logger.Warn("failed login", logging.Fields{"username": body.Username, "reason": err.Error()})
+		writeError(writer, http.StatusUnauthorized, ErrorUnauthorized, ErrInvalidCredentials.Error())
+		return
+	}
+	if err != nil {
+		logger.Error("login failed", logging.Fields{"error": err})
+		writeError(writer, http.StatusInternalServerError, ErrorInternal, err.Error())
+		return
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	writer.Header().Set("Cache-Control", "no-store")
+	err = json.NewEncoder(writer).Encode(session)
+	if err != nil {
+		logger.Error("login failed", logging.Fields{"error": err})
+		return
+	}
+	logger.Info("logged in", logging.Fields{"username": session.Username})
+}
+
+// logout ends the session of the request.
+func (server *Server) logout(writer http.ResponseWriter, request *http.Request) {
+	logger := logging.FromContext(request.Context())
+	logger.Debug("logout API call")
+	token := bearerToken(request)
+	if token == "" {
+		writeError(writer, http.StatusBadRequest, ErrorInvalidRequest, "only sessions can be logged out")
+		return
+	}
+	user := adminFromContext(request.Context())
+	err := model.Transaction(server.Db, &server.Mutex, func(tx model.Queryer) error {
+		err := model.DeleteAdminSession(tx, hashToken(token), nil)
+		if err != nil {
+			return err
+		}
+		return server.auditChanges(request.Context(), tx, "admin_user.logout", AuditTargetAdminUser, user.ID, map[string]AuditChange{})
+	})
+	if err != nil {
+		logger.Error("logout failed", logging.Fields{"error": err})
+		writeError(writer, http.StatusInternalServerError, ErrorInternal, err.Error())
+		return
+	}
+	writer.WriteHeader(http.StatusNoContent)
+	logger.Info("logged out")
+}
+
+// getCurrentAdmin returns the admin user of the request.
+func (server *Server) getCurrentAdmin(writer http.ResponseWriter, request *http.Request) {
+	logger := logging.FromContext(request.Context())
+	logger.Debug("getCurrentAdmin API call")
+	writer.Header().Set("Content-Type", "application/json")
+	writer.Header().Set("Cache-Control", "no-store")
+	err := json.NewEncoder(writer).Encode(adminFromContext(request.Context()))
+	if err != nil {
+		logger.Error("getCurrentAdmin failed", logging.Fields{"error": err})
+		return
+	}
+	logger.Debug("sent reply")
+}
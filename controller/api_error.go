@@ -0,0 +1,66 @@
+package controller
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/kunterbunt/calendarium-server/logging"
+	"github.com/kunterbunt/calendarium-server/model"
+)
+
+// Machine-readable codes of error responses.
+const (
+	ErrorInvalidRequest    = "invalid_request"
+	ErrorValidationFailed  = "validation_failed"
+	ErrorNeedsConfirmation = "confirmation_required"
+	ErrorNotFound          = "not_found"
+	ErrorConflict          = "conflict"
+	ErrorUnauthorized      = "unauthorized"
+	ErrorForbidden         = "forbidden"
+	ErrorRateLimited       = "rate_limited"
+	ErrorInternal          = "internal_error"
+)
+
+// APIError is the JSON document of every error response.
+// Fields lists every invalid field if Code is ErrorValidationFailed. Warnings list the fields whose values look
+// wrong, they have to be corrected or confirmed if Code is ErrorNeedsConfirmation.
+type APIError struct {
+	Status   int                `json:"-"`
+	Code     string             `json:"code"`
+	Message  string             `json:"message"`
+	Fields   []model.FieldError `json:"fields,omitempty"`
+	Warnings []model.FieldError `json:"warnings,omitempty"`
+}
+
+// Error returns the message.
+func (err *APIError) Error() string {
+	return err.Message
+}
+
+// newAPIError instantiates an error response.
+func newAPIError(status int, code string, message string) *APIError {
+	return &APIError{Status: status, Code: code, Message: message}
+}
+
+// newValidationError turns the invalid fields of a request into a 400 Bad Request response.
+func newValidationError(invalid *model.ValidationError) *APIError {
+	apiErr := newAPIError(http.StatusBadRequest, ErrorValidationFailed, invalid.Error())
+	apiErr.Fields = invalid.Fields
+	return apiErr
+}
+
+// writeAPIError sends an error response.
+func writeAPIError(writer http.ResponseWriter, apiErr *APIError) {
+	writer.Header().Set("Content-Type", "application/json; charset=utf-8")
+	writer.Header().Set("X-Content-Type-Options", "nosniff")
+	writer.WriteHeader(apiErr.Status)
+	err := json.NewEncoder(writer).Encode(apiErr)
+	if err != nil {
+		logging.Warn("error while sending error response", logging.Fields{"error": err})
+	}
+}
+
+// writeError sends an error response without field errors.
+func writeError(writer http.ResponseWriter, status int, code string, message string) {
+	writeAPIError(writer, newAPIError(status, code, message))
+}
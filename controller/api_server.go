@@ -1,15 +1,23 @@
 package controller
 
 import (
-	"crypto/subtle"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
 	"database/sql"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"github.com/gorilla/mux"
+	"github.com/kunterbunt/calendarium-server/logging"
 	"github.com/kunterbunt/calendarium-server/model"
 	"github.com/rs/cors"
-	"log"
+	"io/ioutil"
+	"net"
 	"net/http"
+	"regexp"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 )
@@ -21,141 +29,552 @@ type Server struct {
 	Db               *sql.DB
 	Mutex            sync.Mutex
 	BillbeeForwarder *BillbeeHandler
+	Sinks            []OrderSink
+	RateLimiter      *RateLimiter
+	SpamGuard        *SpamGuard
+	Metrics          *Metrics
+	PayPal           *PayPalClient
+	BankAccount      *BankAccount
+	// SEPACreditor collects orders paid by direct debit.
+	SEPACreditor *SEPACreditor
+	// CustomerEmailer sends order confirmations and payment reminders to customers.
+	CustomerEmailer *Emailer
+	// Readiness fails if more orders than MaxForwardBacklog wait to be forwarded to a sink,
+	// or if orders wait and the last successful forward is older than MaxForwardSuccessAge (0 disables this check).
+	MaxForwardBacklog    int
+	MaxForwardSuccessAge time.Duration
+	// RetentionYears after the end of the calendar year of an order, its personal data may be erased.
+	RetentionYears  int
+	RetentionPolicy RetentionPolicy
+	DunningPolicy   DunningPolicy
+	SessionLifetime time.Duration
+	// BasicAuthUsername and BasicAuthPassword are only accepted until the first admin user exists.
 	BasicAuthUsername string
 	BasicAuthPassword string
+	workers           sync.WaitGroup
+	stop              chan struct{}
 }
 
 // getProducts gets all products.
 func (server *Server) getProducts(writer http.ResponseWriter, request *http.Request) {
-	log.Print("getProducts API call...")
+	logger := logging.FromContext(request.Context())
+	logger.Debug("getProducts API call")
 	products, err := model.GetProducts(server.Db, &server.Mutex)
 	if err != nil {
-		log.Println("\tError: " + err.Error())
-		http.Error(writer, err.Error(), http.StatusBadRequest)
+		logger.Error("getProducts failed", logging.Fields{"error": err})
+		writeError(writer, http.StatusInternalServerError, ErrorInternal, err.Error())
 		return
 	}
 	writer.Header().Set("Content-Type", "application/json")
 	err = json.NewEncoder(writer).Encode(products)
 	if err != nil {
-		log.Println("\tError: " + err.Error())
-		http.Error(writer, err.Error(), http.StatusBadRequest)
+		logger.Error("getProducts failed", logging.Fields{"error": err})
+		writeError(writer, http.StatusInternalServerError, ErrorInternal, err.Error())
 		return
 	}
-	log.Println("\tsent reply.")
+	logger.Debug("sent reply")
 }
 
 // getOrders gets all orders.
 func (server *Server) getOrders(writer http.ResponseWriter, request *http.Request) {
-	log.Print("getOrders API call...")
+	logger := logging.FromContext(request.Context())
+	logger.Debug("getOrders API call")
 	orders, err := model.GetOrders(server.Db, &server.Mutex)
 	if err != nil {
-		log.Println("\tError: " + err.Error())
-		http.Error(writer, err.Error(), http.StatusBadRequest)
+		logger.Error("getOrders failed", logging.Fields{"error": err})
+		writeError(writer, http.StatusInternalServerError, ErrorInternal, err.Error())
 		return
 	}
 	writer.Header().Set("Content-Type", "application/json")
-	err = json.NewEncoder(writer).Encode(orders)
+	err = json.NewEncoder(writer).Encode(visibleTo(request, orders))
 	if err != nil {
-		log.Println("\tError: " + err.Error())
-		http.Error(writer, err.Error(), http.StatusBadRequest)
+		logger.Error("getOrders failed", logging.Fields{"error": err})
+		writeError(writer, http.StatusInternalServerError, ErrorInternal, err.Error())
 		return
 	}
-	log.Println("\tsent reply.")
+	logger.Debug("sent reply")
 }
 
 // getProduct gets a single product.
 func (server *Server) getProduct(writer http.ResponseWriter, request *http.Request) {
-	log.Print("getProduct API call...")
+	logger := logging.FromContext(request.Context())
+	logger.Debug("getProduct API call")
 	params := mux.Vars(request)
 	product, err := model.GetProduct(server.Db, params["name"], &server.Mutex)
 	if err != nil {
-		log.Println("\tError: " + err.Error())
-		http.Error(writer, err.Error(), http.StatusBadRequest)
+		logger.Error("getProduct failed", logging.Fields{"error": err})
+		writeError(writer, http.StatusInternalServerError, ErrorInternal, err.Error())
 		return
 	}
 	writer.Header().Set("Content-Type", "application/json")
 	err = json.NewEncoder(writer).Encode(product)
 	if err != nil {
-		log.Println("\tError: " + err.Error())
-		http.Error(writer, err.Error(), http.StatusBadRequest)
+		logger.Error("getProduct failed", logging.Fields{"error": err})
+		writeError(writer, http.StatusInternalServerError, ErrorInternal, err.Error())
 		return
 	}
-	log.Print("\tQuery for product with name '" + params["name"] + "'.")
+	logger.Debug("sent product", logging.Fields{"name": params["name"]})
 }
 
 // createOrder places an order.
+// Requests with an Idempotency-Key header are only processed once; repeating them returns the original response.
 func (server *Server) createOrder(writer http.ResponseWriter, request *http.Request) {
-	log.Print("createOrder API call...")
-	var order model.Order
-	err := json.NewDecoder(request.Body).Decode(&order)
+	logger := logging.FromContext(request.Context())
+	logger.Debug("createOrder API call")
+	body, err := ioutil.ReadAll(request.Body)
 	if err != nil {
-		log.Println("\tError: " + err.Error())
-		http.Error(writer, err.Error(), http.StatusBadRequest)
+		logger.Error("createOrder failed", logging.Fields{"error": err})
+		writeError(writer, http.StatusBadRequest, ErrorInvalidRequest, err.Error())
 		return
 	}
+	locale := model.NegotiateLocale(request.Header.Get("Accept-Language"))
+	idempotencyKey := request.Header.Get("Idempotency-Key")
+	if idempotencyKey != "" {
+		if len(idempotencyKey) > 255 {
+			writeError(writer, http.StatusBadRequest, ErrorInvalidRequest, model.Message(locale, "idempotency.too_long"))
+			return
+		}
+		bodyHash := sha256.Sum256(body)
+		record := model.IdempotencyRecord{Key: idempotencyKey, BodyHash: hex.EncodeToString(bodyHash[:])}
+		existing, reserved, err := model.ReserveIdempotencyKey(server.Db, &record, &server.Mutex)
+		if err != nil {
+			logger.Error("createOrder failed", logging.Fields{"error": err})
+			writeError(writer, http.StatusInternalServerError, ErrorInternal, err.Error())
+			return
+		}
+		if !reserved {
+			server.replayIdempotentResponse(writer, request, existing, record.BodyHash, locale)
+			return
+		}
+	}
+
+	receipt, orderID, apiErr := server.placeOrder(request.Context(), body, locale)
+
+	if idempotencyKey != "" {
+		if apiErr == nil {
+			var response []byte
+			response, err = json.Marshal(receipt.saved())
+			if err == nil {
+				err = model.CompleteIdempotencyKey(server.Db, idempotencyKey, orderID, http.StatusOK, string(response), &server.Mutex)
+			}
+		} else {
+			// Let the client fix its request and retry with the same key.
+			err = model.DeleteIdempotencyKey(server.Db, idempotencyKey, &server.Mutex)
+		}
+		if err != nil {
+			logger.Error("error while saving idempotency key", logging.Fields{"error": err})
+		}
+	}
+	if apiErr != nil {
+		writeAPIError(writer, apiErr)
+		return
+	}
+	writeReceipt(writer, request, http.StatusOK, receipt)
+}
+
+// OrderReceipt is the response to a placed order.
+type OrderReceipt struct {
+	Message     string `json:"message"`
+	OrderNumber string `json:"order_number"`
+	// PayPalApprovalURL is where the buyer approves the payment of orders paid with PayPal.
+	PayPalApprovalURL string `json:"paypal_approval_url,omitempty"`
+	// BankTransfer tells how to pay orders paid by bank transfer.
+	BankTransfer *BankTransferDetails `json:"bank_transfer,omitempty"`
+	// DirectDebit tells when and how orders paid by direct debit are collected.
+	DirectDebit *DirectDebitDetails `json:"direct_debit,omitempty"`
+	locale      string
+}
+
+// text returns the receipt as the plain text shown to customers.
+func (receipt *OrderReceipt) text() string {
+	text := receipt.Message
+	if receipt.PayPalApprovalURL != "" {
+		text += "\n" + model.Message(receipt.locale, "order.paypal", receipt.PayPalApprovalURL)
+	}
+	if receipt.BankTransfer != nil {
+		text += "\n" + receipt.BankTransfer.text(receipt.locale)
+	}
+	if receipt.DirectDebit != nil {
+		text += "\n" + receipt.DirectDebit.text(receipt.locale)
+	}
+	return text
+}
+
+// saved returns the receipt as kept for replays, without the rendered QR codes that replays render again.
+func (receipt *OrderReceipt) saved() *OrderReceipt {
+	saved := *receipt
+	if receipt.BankTransfer != nil {
+		details := *receipt.BankTransfer
+		details.GiroCodePNG = ""
+		details.GiroCodeSVG = ""
+		saved.BankTransfer = &details
+	}
+	return &saved
+}
+
+// writeReceipt writes a receipt as JSON if the client accepts it, and as plain text otherwise.
+func writeReceipt(writer http.ResponseWriter, request *http.Request, status int, receipt *OrderReceipt) {
+	var response []byte
+	if strings.Contains(request.Header.Get("Accept"), "application/json") {
+		writer.Header().Set("Content-Type", "application/json")
+		response, _ = json.Marshal(receipt)
+	} else {
+		writer.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		response = []byte(receipt.text())
+	}
+	writer.WriteHeader(status)
+	_, err := writer.Write(response)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// replayIdempotentResponse answers a repeated request with the response to the original one.
+func (server *Server) replayIdempotentResponse(writer http.ResponseWriter, request *http.Request, record *model.IdempotencyRecord, bodyHash string, locale string) {
+	logger := logging.FromContext(request.Context())
+	if record.BodyHash != bodyHash {
+		logger.Warn("Idempotency-Key reused with a different body", logging.Fields{"idempotency_key": record.Key})
+		writeError(writer, http.StatusConflict, ErrorConflict, model.Message(locale, "idempotency.reused"))
+		return
+	}
+	if record.Status == 0 {
+		logger.Warn("Idempotency-Key is still being processed", logging.Fields{"idempotency_key": record.Key})
+		writeError(writer, http.StatusConflict, ErrorConflict, model.Message(locale, "idempotency.in_progress"))
+		return
+	}
+	logger.Info("replaying response", logging.Fields{"order_number": ToOrderId(record.OrderID)})
+	writer.Header().Set("Idempotent-Replayed", "true")
+	receipt := OrderReceipt{locale: locale}
+	if json.Unmarshal([]byte(record.Response), &receipt) != nil {
+		// Responses saved before receipts were introduced are plain text.
+		receipt = OrderReceipt{Message: record.Response, OrderNumber: ToOrderId(record.OrderID), locale: locale}
+	}
+	if receipt.BankTransfer != nil && receipt.BankTransfer.GiroCode != "" && receipt.BankTransfer.GiroCodePNG == "" {
+		err := receipt.BankTransfer.renderGiroCode()
+		if err != nil {
+			logger.Error("error while creating GiroCode", logging.Fields{"error": err, "order_number": ToOrderId(record.OrderID)})
+		}
+	}
+	writeReceipt(writer, request, record.Status, &receipt)
+}
+
+// placeOrder verifies, saves and forwards the order in the request body.
+// The order's locale field takes precedence over the locale negotiated from the Accept-Language header.
+// Orders paid with PayPal get a PayPal order if PayPal is attached.
+// It returns the receipt and the ID of the new order, or the error response.
+func (server *Server) placeOrder(ctx context.Context, body []byte, locale string) (*OrderReceipt, int64, *APIError) {
+	logger := logging.FromContext(ctx)
+	var order model.Order
+	err := json.Unmarshal(body, &order)
+	if err != nil {
+		logger.Warn("invalid order JSON", logging.Fields{"error": err})
+		return nil, 0, newAPIError(http.StatusBadRequest, ErrorInvalidRequest, err.Error())
+	}
 	order.Date = time.Now().Format(time.RFC3339)
+	// The quarantine and the responses of the sinks are only set by the server.
+	order.Quarantined, order.SpamReason, order.BillbeeResponse = false, "", ""
+	// The payment state is only set by the server.
+	order.PayPalOrderID, order.PaidAt, order.PaymentReference = "", "", ""
+	order.ReminderLevel, order.RemindedAt, order.CancelledAt, order.ReviewReason, order.ReviewResolvedAt = 0, "", "", "", ""
+	order.SEPAMandateReference, order.SEPAMandateDate, order.SEPAMandateText, order.SEPAExportedAt = "", "", "", ""
+	clearPaymentFields(&order)
+	order.Locale = model.NormalizeLocale(order.Locale)
+	if order.Locale == "" {
+		order.Locale = locale
+	}
 
 	// Check that product exists.
 	product, err := model.GetProductByID(server.Db, order.ProductID, &server.Mutex)
 	if err != nil {
-		log.Println("\tError: " + err.Error())
-		http.Error(writer, err.Error(), http.StatusBadRequest)
-		return
+		logger.Error("error while looking up product", logging.Fields{"error": err})
+		return nil, 0, newAPIError(http.StatusInternalServerError, ErrorInternal, err.Error())
 	}
+	var invalid model.ValidationError
 	if product.ID == model.InvalidID {
-		log.Println("\tinvalid product ID.")
-		http.Error(writer, "Bitte wählen Sie ein existierendes Produkt.", http.StatusBadRequest)
-		return
+		invalid.Add("product_id", model.CodeUnknown, model.Message(order.Locale, "product.unknown"))
 	}
 	err = model.VerifyOrder(&order)
-	if err != nil {
-		log.Println("\tError: " + err.Error())
-		http.Error(writer, err.Error(), http.StatusBadRequest)
-		return
+	var orderInvalid *model.ValidationError
+	if errors.As(err, &orderInvalid) {
+		invalid.Fields = append(invalid.Fields, orderInvalid.Fields...)
+	} else if err != nil {
+		logger.Error("error while verifying order", logging.Fields{"error": err})
+		return nil, 0, newAPIError(http.StatusInternalServerError, ErrorInternal, err.Error())
+	}
+	server.verifyPayment(&invalid, &order)
+	if server.SpamGuard != nil && server.SpamGuard.RejectsMissingToken() && order.FormToken == "" {
+		invalid.Add("form_token", model.CodeRequired, model.Message(order.Locale, "form_token.required"))
+	}
+	var warnings []model.FieldError
+	if warning := model.EmailWarning(&order); warning != nil {
+		warnings = append(warnings, *warning)
+	}
+	if len(invalid.Fields) > 0 {
+		logger.Info("invalid order", logging.Fields{"fields": invalid.Fields})
+		apiErr := newValidationError(&invalid)
+		apiErr.Warnings = warnings
+		return nil, 0, apiErr
+	}
+	if len(warnings) > 0 {
+		// The warnings contain the email address, so they are not logged.
+		logger.Info("order needs confirmation", logging.Fields{"warnings": len(warnings)})
+		apiErr := newAPIError(http.StatusBadRequest, ErrorNeedsConfirmation, warnings[0].Message)
+		apiErr.Warnings = warnings
+		return nil, 0, apiErr
 	}
 
-	err = model.AddOrder(server.Db, &order, &server.Mutex)
-	if err != nil {
-		log.Println("\tError: " + err.Error())
-		http.Error(writer, err.Error(), http.StatusBadRequest)
-		return
+	if order.Payment == PaymentSEPA {
+		// The consent is recorded with the exact text that the customer agreed to.
+		order.SEPAMandateDate = time.Now().Format("2006-01-02")
+		order.SEPAMandateText = server.SEPACreditor.MandateText(order.Locale)
 	}
-	log.Printf("Placed order: %+v", order)
 
-	if server.BillbeeForwarder != nil {
-		billbeeResponse, err := server.BillbeeForwarder.ForwardOrder(&order)
-		additionalErr := ""
+	if server.SpamGuard != nil {
+		order.SpamReason = server.SpamGuard.Check(&order, time.Now())
+		order.Quarantined = order.SpamReason != ""
+	}
+
+	err = model.Transaction(server.Db, &server.Mutex, func(tx model.Queryer) error {
+		err := model.AddOrder(tx, &order, nil)
 		if err != nil {
-			log.Println("\tBillbee forwarding error: " + err.Error())
-			billbeeResponse = err.Error()
-			additionalErr = "Deine Bestellung ist eingegangen, aber es gab einen Fehler beim Weiterleiten an unsere Bestellverwaltung. Bitte teil uns diesen Fehler mit, damit wir ihn beseitigen können. Der Fehler: " + err.Error()
+			return err
 		}
-		err = model.AddBillbeeResponseToOrder(order.ID, billbeeResponse, server.Db, &server.Mutex)
+		if order.SEPAMandateDate != "" {
+			order.SEPAMandateReference = MandateReference(order.ID)
+			err = model.SetOrderMandateReference(tx, order.ID, order.SEPAMandateReference, nil)
+			if err != nil {
+				return err
+			}
+		}
+		return server.audit(WithActor(ctx, ActorCustomer), tx, "order.create", AuditTargetOrder, order.ID, nil, &order)
+	})
+	if err != nil {
+		logger.Error("error while saving order", logging.Fields{"error": err})
+		return nil, 0, newAPIError(http.StatusInternalServerError, ErrorInternal, err.Error())
+	}
+	logger.Info("placed order", logging.Fields{"order_number": ToOrderId(order.ID), "order": order})
+	server.Metrics.OrderPlaced(&order)
+
+	// Quarantined orders get the usual reply so that bots learn nothing, but are not forwarded.
+	if order.Quarantined {
+		logger.Warn("quarantined order", logging.Fields{"order_number": ToOrderId(order.ID), "spam_reason": order.SpamReason})
+	} else {
+		server.forwardOrder(ctx, &order)
+	}
+
+	receipt := server.newReceipt(WithActor(ctx, ActorCustomer), &order)
+	if !order.Quarantined {
+		server.sendConfirmation(ctx, &order, receipt)
+	}
+	return receipt, order.ID, nil
+}
+
+// forwardOrder hands an order to every attached order sink.
+func (server *Server) forwardOrder(ctx context.Context, order *model.Order) {
+	for _, sink := range server.Sinks {
+		server.ForwardOrderTo(ctx, order, sink)
+	}
+}
+
+// ForwardOrderTo hands an order to a single order sink and records the sink's response.
+// The context carries the request ID and logger.
+func (server *Server) ForwardOrderTo(ctx context.Context, order *model.Order, sink OrderSink) error {
+	logger := logging.FromContext(ctx).With(logging.Fields{"order_number": ToOrderId(order.ID), "sink": sink.Name()})
+	start := time.Now()
+	response, forwardErr := sink.ForwardOrder(ctx, order)
+	server.Metrics.OrderForwarded(sink.Name(), time.Since(start), forwardErr)
+	if forwardErr != nil {
+		logger.Error("forwarding failed", logging.Fields{"error": forwardErr})
+		response = forwardErr.Error()
+	}
+	forward := model.OrderForward{
+		OrderID:  order.ID,
+		Sink:     sink.Name(),
+		Date:     time.Now().Format(time.RFC3339),
+		Success:  forwardErr == nil,
+		Response: response,
+	}
+	_, isBillbee := sink.(*BillbeeHandler)
+	err := model.Transaction(server.Db, &server.Mutex, func(tx model.Queryer) error {
+		err := model.AddOrderForward(tx, &forward, nil)
 		if err != nil {
-			log.Fatal("\terror while saving billbee response: " + additionalErr + err.Error())
-		} else {
-			log.Println("\tsaved billbee response.")
+			return err
 		}
+		if isBillbee {
+			err = model.AddBillbeeResponseToOrder(order.ID, response, tx, nil)
+			if err != nil {
+				return err
+			}
+		}
+		// The response may contain personal data, so the audit log refers to the forward that keeps it.
+		return server.auditChanges(ctx, tx, "order.forward", AuditTargetOrder, order.ID, map[string]AuditChange{
+			"forward_id": {nil, forward.ID},
+			"sink":       {nil, forward.Sink},
+			"success":    {nil, forward.Success},
+		})
+	})
+	if err != nil {
+		logger.Error("error while saving forward", logging.Fields{"error": err})
+	} else if isBillbee {
+		logger.Debug("saved billbee response")
+		order.BillbeeResponse = response
 	}
+	return forwardErr
+}
 
+// Sink returns the attached order sink with the given name, or nil.
+func (server *Server) Sink(name string) OrderSink {
+	for _, sink := range server.Sinks {
+		if sink.Name() == name {
+			return sink
+		}
+	}
+	return nil
+}
+
+// getFormToken issues a token that the order form sends back with the order.
+func (server *Server) getFormToken(writer http.ResponseWriter, request *http.Request) {
+	logger := logging.FromContext(request.Context())
+	logger.Debug("getFormToken API call")
+	if server.SpamGuard == nil {
+		writeError(writer, http.StatusNotFound, ErrorNotFound, "Spam protection is disabled.")
+		return
+	}
+	token, err := server.SpamGuard.IssueToken(time.Now())
+	if err != nil {
+		logger.Error("getFormToken failed", logging.Fields{"error": err})
+		writeError(writer, http.StatusInternalServerError, ErrorInternal, err.Error())
+		return
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	writer.Header().Set("Cache-Control", "no-store")
+	err = json.NewEncoder(writer).Encode(token)
+	if err != nil {
+		logger.Error("getFormToken failed", logging.Fields{"error": err})
+		writeError(writer, http.StatusInternalServerError, ErrorInternal, err.Error())
+		return
+	}
+	logger.Debug("sent reply")
+}
+
+// releaseOrder lifts the spam quarantine of an order and forwards it.
+func (server *Server) releaseOrder(writer http.ResponseWriter, request *http.Request) {
+	logger := logging.FromContext(request.Context())
+	logger.Debug("releaseOrder API call")
+	id, err := strconv.ParseInt(mux.Vars(request)["id"], 10, 64)
+	if err != nil {
+		writeError(writer, http.StatusBadRequest, ErrorInvalidRequest, "invalid order ID")
+		return
+	}
+	order, err := model.GetOrder(server.Db, id, &server.Mutex)
+	if err != nil {
+		logger.Error("releaseOrder failed", logging.Fields{"error": err})
+		writeError(writer, http.StatusInternalServerError, ErrorInternal, err.Error())
+		return
+	}
+	if order.ID == int64(model.InvalidID) {
+		writeError(writer, http.StatusNotFound, ErrorNotFound, "order not found")
+		return
+	}
+	if !order.Quarantined {
+		writeError(writer, http.StatusConflict, ErrorConflict, ToOrderId(order.ID)+" is not quarantined")
+		return
+	}
+	released := *order
+	released.Quarantined = false
+	err = model.Transaction(server.Db, &server.Mutex, func(tx model.Queryer) error {
+		err := model.ReleaseOrder(order.ID, tx, nil)
+		if err != nil {
+			return err
+		}
+		return server.audit(request.Context(), tx, "order.release", AuditTargetOrder, order.ID, order, &released)
+	})
+	if err != nil {
+		logger.Error("releaseOrder failed", logging.Fields{"error": err})
+		writeError(writer, http.StatusInternalServerError, ErrorInternal, err.Error())
+		return
+	}
+	order = &released
+	server.forwardOrder(request.Context(), order)
+	server.sendConfirmation(request.Context(), order, server.newReceipt(request.Context(), order))
 	writer.WriteHeader(http.StatusOK)
-	_, err = writer.Write([]byte("Vielen Dank für Deine Bestellung mit Bestellnr. '" + ToOrderId(order.ID) + "'."))
-	//_, err = writer.Write([]byte("Vielen Dank für Deine Bestellung. " + additionalErr))
+	_, err = writer.Write([]byte(ToOrderId(order.ID) + " released."))
 	if err != nil {
 		panic(err)
 	}
+	logger.Info("released order", logging.Fields{"order_number": ToOrderId(order.ID)})
 }
 
-// BasicAuth from https://stackoverflow.com/questions/21936332/idiomatic-way-of-requiring-http-basic-auth-in-go
-func BasicAuth(handler http.HandlerFunc, username, password, realm string) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		user, pass, ok := r.BasicAuth()
-		if !ok || subtle.ConstantTimeCompare([]byte(user), []byte(username)) != 1 || subtle.ConstantTimeCompare([]byte(pass), []byte(password)) != 1 {
-			w.Header().Set("WWW-Authenticate", `Basic realm="`+realm+`"`)
-			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+// getBlockedClients lists the clients that were rate limited.
+func (server *Server) getBlockedClients(writer http.ResponseWriter, request *http.Request) {
+	logger := logging.FromContext(request.Context())
+	logger.Debug("getBlockedClients API call")
+	if server.RateLimiter != nil {
+		err := server.saveBlockedClients(time.Now())
+		if err != nil {
+			logger.Error("getBlockedClients failed", logging.Fields{"error": err})
+			writeError(writer, http.StatusInternalServerError, ErrorInternal, err.Error())
 			return
 		}
-		handler(w, r)
+	}
+	clients, err := model.GetBlockedClients(server.Db, &server.Mutex)
+	if err != nil {
+		logger.Error("getBlockedClients failed", logging.Fields{"error": err})
+		writeError(writer, http.StatusInternalServerError, ErrorInternal, err.Error())
+		return
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(writer).Encode(clients)
+	if err != nil {
+		logger.Error("getBlockedClients failed", logging.Fields{"error": err})
+		writeError(writer, http.StatusInternalServerError, ErrorInternal, err.Error())
+		return
+	}
+	logger.Debug("sent reply")
+}
+
+// requestIDPattern limits the X-Request-ID header values accepted from clients and proxies.
+var requestIDPattern = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// logRequests assigns every request an ID, taken from the X-Request-ID header or generated,
+// puts a logger adding it to every entry into the request context and logs the request once it is answered.
+func (server *Server) logRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		requestID := request.Header.Get("X-Request-ID")
+		if !requestIDPattern.MatchString(requestID) {
+			random := make([]byte, 8)
+			rand.Read(random)
+			requestID = hex.EncodeToString(random)
+		}
+		writer.Header().Set("X-Request-ID", requestID)
+		request = request.WithContext(logging.NewRequestContext(request.Context(), requestID))
+		recorder := &statusRecorder{ResponseWriter: writer, status: http.StatusOK}
+		start := time.Now()
+		next.ServeHTTP(recorder, request)
+		logging.FromContext(request.Context()).Info("request", logging.Fields{
+			"method":      request.Method,
+			"path":        request.URL.Path,
+			"status":      recorder.status,
+			"duration_ms": time.Since(start).Milliseconds(),
+		})
+	})
+}
+
+// observeRequests feeds the attached metrics, if any.
+func (server *Server) observeRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		server.Metrics.Middleware(next).ServeHTTP(writer, request)
+	})
+}
+
+// rateLimited applies the attached rate limiter, if any, to a handler.
+func (server *Server) rateLimited(handler http.HandlerFunc) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		if server.RateLimiter == nil {
+			handler(writer, request)
+			return
+		}
+		server.RateLimiter.Limit(handler)(writer, request)
 	}
 }
 
@@ -164,30 +583,107 @@ func NewServer(db *sql.DB, BasicAuthUsername string, BasicAuthPassword string) *
 	var server Server
 	server.router = mux.NewRouter()
 	server.Db = db
+	server.stop = make(chan struct{})
+	server.MaxForwardBacklog = 10
+	server.RetentionYears = DefaultRetentionYears
+	server.SessionLifetime = DefaultSessionLifetime
 	server.BasicAuthUsername = BasicAuthUsername
 	server.BasicAuthPassword = BasicAuthPassword
+	server.router.Use(server.observeRequests)
 	// Init handlers.
+	server.router.HandleFunc("/healthz", server.getHealth).Methods("GET", "HEAD")
+	server.router.HandleFunc("/readyz", server.getReadiness).Methods("GET", "HEAD")
 	server.router.HandleFunc("/api/products", server.getProducts).Methods("GET")
 	server.router.HandleFunc("/api/products/{id}", server.getProduct).Methods("GET")
-	server.router.HandleFunc("/api/orders", server.createOrder).Methods("POST")
-	server.router.HandleFunc("/api/orders", BasicAuth(server.getOrders, server.BasicAuthUsername, server.BasicAuthPassword, "Please enter your username and password for this site"))
+	server.router.HandleFunc("/api/orders", server.rateLimited(server.createOrder)).Methods("POST")
+	server.router.HandleFunc("/api/payment-methods", server.getPaymentMethods).Methods("GET")
+	server.router.HandleFunc("/api/orders/form-token", server.rateLimited(server.getFormToken)).Methods("GET")
+	server.router.HandleFunc("/api/admin/login", server.rateLimited(server.login)).Methods("POST")
+	server.router.HandleFunc("/api/admin/logout", server.requireLogin(server.logout)).Methods("POST")
+	server.router.HandleFunc("/api/admin/me", server.requireLogin(server.getCurrentAdmin)).Methods("GET")
+	server.router.HandleFunc("/api/orders", server.requirePermission(PermissionReadOrders, server.getOrders))
+	server.router.HandleFunc("/api/admin/orders/{id}/release", server.requirePermission(PermissionReleaseOrders, server.releaseOrder)).Methods("POST")
+	server.router.HandleFunc("/api/admin/readiness", server.requirePermission(PermissionReadMetrics, server.getReadinessDetails)).Methods("GET")
+	server.router.HandleFunc("/api/admin/rate-limit", server.requirePermission(PermissionReadRateLimit, server.getBlockedClients)).Methods("GET")
+	server.router.HandleFunc("/api/admin/audit", server.requirePermission(PermissionReadAudit, server.getAuditLog)).Methods("GET")
+	server.router.HandleFunc("/api/admin/payments/bank-statements", server.requirePermission(PermissionReconcile, server.importBankStatement)).Methods("POST")
+	server.router.HandleFunc("/api/admin/orders/{id}/review/resolve", server.requirePermission(PermissionReconcile, server.resolveOrderReview)).Methods("POST")
+	server.router.HandleFunc("/api/admin/payments/open", server.requirePermission(PermissionReconcile, server.getOpenBankPayments)).Methods("GET")
+	server.router.HandleFunc("/api/admin/gdpr/export", server.requirePermission(PermissionPersonalData, server.exportPersonalData)).Methods("GET")
+	server.router.HandleFunc("/api/admin/gdpr/erase", server.requirePermission(PermissionPersonalData, server.erasePersonalData)).Methods("POST")
 
-	server.handler = cors.Default().Handler(server.router)
+	server.handler = cors.New(cors.Options{
+		AllowedHeaders: []string{"Origin", "Accept", "Authorization", "Content-Type", "X-Requested-With", "Idempotency-Key", "Accept-Language", "X-Request-ID"},
+		ExposedHeaders: []string{"Idempotent-Replayed", "Retry-After", "X-Request-ID"},
+	}).Handler(server.logRequests(server.router))
 	return &server
 }
 
-// ListenAndServe starts the HTTP server.
-func (server *Server) ListenAndServe(port int) {
-	log.Fatal(http.ListenAndServe(":"+strconv.Itoa(port), server.handler))
-}
-
+// AttachBillbeeForwarder creates the billbee handler and attaches it as an order sink.
 func (server *Server) AttachBillbeeForwarder(billbeeAPIKey string, billbeeAuthUsername string, billbeeAuthPw string, billbeeUrl string) {
 	server.BillbeeForwarder = NewBillbeeHandler(billbeeAPIKey, billbeeAuthUsername, billbeeAuthPw, billbeeUrl)
+	server.AttachSink(server.BillbeeForwarder)
+}
+
+// AttachRateLimiter limits the requests to the public order endpoint.
+func (server *Server) AttachRateLimiter(limiter *RateLimiter) {
+	server.RateLimiter = limiter
+}
+
+// AttachSpamGuard quarantines orders that look like spam instead of forwarding them.
+func (server *Server) AttachSpamGuard(guard *SpamGuard) {
+	server.SpamGuard = guard
+}
+
+// AttachMetrics collects metrics of requests, orders, forwards, emails and database operations.
+// Unless they are served on a separate address, GET /metrics requires admin authentication.
+func (server *Server) AttachMetrics(metrics *Metrics, separateAddress bool) {
+	server.Metrics = metrics
+	model.ObserveQuery = metrics.observeQuery
+	model.ObserveMutexWait = metrics.observeMutexWait
+	if server.BillbeeForwarder != nil && server.BillbeeForwarder.Emailer != nil {
+		server.BillbeeForwarder.Emailer.metrics = metrics
+	}
+	if server.CustomerEmailer != nil {
+		server.CustomerEmailer.metrics = metrics
+	}
+	if !separateAddress {
+		server.router.HandleFunc("/metrics", server.requirePermission(PermissionReadMetrics, metrics.ServeHTTP)).Methods("GET")
+	}
+}
+
+// ServeMetrics serves GET /metrics without authentication on a separate address, e.g. "127.0.0.1:9100", until the server shuts down.
+func (server *Server) ServeMetrics(address string) error {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+	router := http.NewServeMux()
+	router.Handle("/metrics", server.Metrics)
+	metricsServer := &http.Server{Handler: router, ReadHeaderTimeout: 5 * time.Second}
+	logging.Info("serving metrics", logging.Fields{"address": listener.Addr().String()})
+	server.Go(func(stop <-chan struct{}) {
+		go func() {
+			// The API keeps serving without metrics.
+			err := metricsServer.Serve(listener)
+			if err != nil && err != http.ErrServerClosed {
+				logging.Error("serving metrics failed", logging.Fields{"address": address, "error": err})
+			}
+		}()
+		<-stop
+		metricsServer.Close()
+	})
+	return nil
+}
+
+// AttachSink adds an order sink that every placed order is forwarded to.
+func (server *Server) AttachSink(sink OrderSink) {
+	server.Sinks = append(server.Sinks, sink)
 }
 
-func (server *Server) AttachEmailer(emailAddr string, emailPassword string, smtpHost string, smtpPort string, destEmails []string) {
+func (server *Server) AttachEmailer(emailAddr string, emailPassword string, smtpHost string, smtpPort string, destEmails []string, locale string) {
 	if server.BillbeeForwarder != nil {
-		server.BillbeeForwarder.AttachEmailer(emailAddr, emailPassword, smtpHost, smtpPort, destEmails)
+		server.BillbeeForwarder.AttachEmailer(emailAddr, emailPassword, smtpHost, smtpPort, destEmails, locale)
 	} else {
 		panic("Called AttachEmailer before AttachBillbeeForwarder!")
 	}
@@ -0,0 +1,255 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kunterbunt/calendarium-server/logging"
+	"github.com/kunterbunt/calendarium-server/model"
+)
+
+// Actors of changes that were not made by an admin user.
+const (
+	ActorSystem   = "system"
+	ActorCustomer = "customer"
+)
+
+// Types of audited targets.
+const (
+	AuditTargetOrder     = "order"
+	AuditTargetUzOrder   = "uz_order"
+	AuditTargetProduct   = "product"
+	AuditTargetAdminUser = "admin_user"
+)
+
+// MaxAuditEntries is the most entries returned by one query of the audit log.
+const MaxAuditEntries = 1000
+
+// AuditChange holds the values of a field before and after a change.
+// Personal data, i.e. fields tagged `log:"redact"`, is replaced by logging.Redacted so that erasure also covers the audit log.
+type AuditChange struct {
+	Before interface{} `json:"before"`
+	After  interface{} `json:"after"`
+}
+
+type actorContextKey struct{}
+
+// WithActor returns a context whose changes are attributed to the given actor, e.g. "cli:alice".
+// Changes made in requests of admin users are attributed to "admin:<username>".
+func WithActor(ctx context.Context, actor string) context.Context {
+	return context.WithValue(ctx, actorContextKey{}, actor)
+}
+
+// actorOf returns who makes the changes in a context.
+func actorOf(ctx context.Context) string {
+	if user := adminFromContext(ctx); user != nil {
+		return "admin:" + user.Username
+	}
+	if actor, ok := ctx.Value(actorContextKey{}).(string); ok {
+		return actor
+	}
+	return ActorSystem
+}
+
+// auditField is a field of an audited value.
+type auditField struct {
+	value  interface{}
+	redact bool
+}
+
+// auditFields flattens a struct into its exported fields keyed by their JSON names, like encoding/json.
+func auditFields(value reflect.Value, fields map[string]auditField) {
+	for value.Kind() == reflect.Ptr || value.Kind() == reflect.Interface {
+		if value.IsNil() {
+			return
+		}
+		value = value.Elem()
+	}
+	if value.Kind() != reflect.Struct {
+		return
+	}
+	structType := value.Type()
+	for i := 0; i < structType.NumField(); i++ {
+		field := structType.Field(i)
+		if field.PkgPath != "" {
+			continue // unexported
+		}
+		if field.Anonymous && field.Type.Kind() == reflect.Struct {
+			auditFields(value.Field(i), fields)
+			continue
+		}
+		tag := strings.Split(field.Tag.Get("json"), ",")
+		name := tag[0]
+		// Fields that are only sent by the order form are omitted if empty and never saved.
+		if name == "-" || (len(tag) > 1 && tag[1] == "omitempty") {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		fields[name] = auditField{value.Field(i).Interface(), field.Tag.Get("log") == "redact"}
+	}
+}
+
+// auditValue returns the value of a field as it is stored in the audit log.
+func auditValue(field auditField, ok bool) interface{} {
+	if !ok {
+		return nil
+	}
+	if field.redact && !reflect.ValueOf(field.value).IsZero() {
+		return logging.Redacted
+	}
+	return field.value
+}
+
+// diffFields returns the changed fields of two values of the same struct type. Either value may be nil
+// for created and deleted targets.
+func diffFields(before interface{}, after interface{}) map[string]AuditChange {
+	beforeFields := make(map[string]auditField)
+	afterFields := make(map[string]auditField)
+	if before != nil {
+		auditFields(reflect.ValueOf(before), beforeFields)
+	}
+	if after != nil {
+		auditFields(reflect.ValueOf(after), afterFields)
+	}
+	changes := make(map[string]AuditChange)
+	for name, beforeField := range beforeFields {
+		afterField, ok := afterFields[name]
+		if !ok || !reflect.DeepEqual(beforeField.value, afterField.value) {
+			changes[name] = AuditChange{auditValue(beforeField, true), auditValue(afterField, ok)}
+		}
+	}
+	for name, afterField := range afterFields {
+		if _, ok := beforeFields[name]; !ok {
+			changes[name] = AuditChange{nil, auditValue(afterField, true)}
+		}
+	}
+	return changes
+}
+
+// audit appends a change to the audit log. It is called in the transaction of the change, see model.Transaction,
+// so that a change is only saved together with its audit entry.
+func (server *Server) audit(ctx context.Context, tx model.Queryer, action string, targetType string, targetID int64, before interface{}, after interface{}) error {
+	return server.auditChanges(ctx, tx, action, targetType, targetID, diffFields(before, after))
+}
+
+// auditChanges appends a change to the audit log, for changes that cannot be computed by diffFields.
+func (server *Server) auditChanges(ctx context.Context, tx model.Queryer, action string, targetType string, targetID int64, changes map[string]AuditChange) error {
+	encoded, err := json.Marshal(changes)
+	if err != nil {
+		return err
+	}
+	entry := model.AuditEntry{
+		Date:       time.Now().UTC().Format(time.RFC3339),
+		Actor:      actorOf(ctx),
+		Action:     action,
+		TargetType: targetType,
+		TargetID:   targetID,
+		Changes:    encoded,
+		RequestID:  logging.RequestID(ctx),
+	}
+	return model.AddAuditEntry(tx, &entry, nil)
+}
+
+// AddProduct saves a new product and records it in the audit log.
+func (server *Server) AddProduct(ctx context.Context, product *model.Product) error {
+	return model.Transaction(server.Db, &server.Mutex, func(tx model.Queryer) error {
+		err := model.AddProduct(tx, product, nil)
+		if err != nil {
+			return err
+		}
+		saved, err := model.GetProduct(tx, product.Name, nil)
+		if err != nil {
+			return err
+		}
+		return server.audit(ctx, tx, "product.create", AuditTargetProduct, int64(saved.ID), nil, saved)
+	})
+}
+
+// auditOrder appends the change of an order to the audit log, reading its new state from the transaction of the change.
+func (server *Server) auditOrder(ctx context.Context, tx model.Queryer, action string, before *model.Order) error {
+	after, err := model.GetOrder(tx, before.ID, nil)
+	if err != nil {
+		return err
+	}
+	if after.ID == int64(model.InvalidID) {
+		after = nil
+	}
+	return server.audit(ctx, tx, action, AuditTargetOrder, before.ID, before, after)
+}
+
+// auditUzOrder appends the change of an Unterstützer order to the audit log, reading its new state from the transaction of the change.
+func (server *Server) auditUzOrder(ctx context.Context, tx model.Queryer, action string, before *model.UzOrder) error {
+	after, err := model.GetUzOrder(tx, before.ID, nil)
+	if err != nil {
+		return err
+	}
+	if after.ID == int64(model.InvalidID) {
+		after = nil
+	}
+	return server.audit(ctx, tx, action, AuditTargetUzOrder, before.ID, before, after)
+}
+
+// getAuditLog returns the audit entries matching the query parameters
+// actor, action, target_type, target_id, since, until (RFC 3339) and limit.
+func (server *Server) getAuditLog(writer http.ResponseWriter, request *http.Request) {
+	logger := logging.FromContext(request.Context())
+	logger.Debug("getAuditLog API call")
+	query := request.URL.Query()
+	filter := model.AuditFilter{
+		Actor:      query.Get("actor"),
+		Action:     query.Get("action"),
+		TargetType: query.Get("target_type"),
+		Limit:      100,
+	}
+	var err error
+	if value := query.Get("target_id"); value != "" {
+		filter.TargetID, err = strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			writeError(writer, http.StatusBadRequest, ErrorInvalidRequest, "invalid target_id")
+			return
+		}
+	}
+	for _, date := range []struct {
+		name  string
+		value *string
+	}{{"since", &filter.Since}, {"until", &filter.Until}} {
+		value := query.Get(date.name)
+		if value == "" {
+			continue
+		}
+		parsed, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			writeError(writer, http.StatusBadRequest, ErrorInvalidRequest, date.name+" must be an RFC 3339 date")
+			return
+		}
+		*date.value = parsed.UTC().Format(time.RFC3339)
+	}
+	if value := query.Get("limit"); value != "" {
+		filter.Limit, err = strconv.Atoi(value)
+		if err != nil || filter.Limit < 1 || filter.Limit > MaxAuditEntries {
+			writeError(writer, http.StatusBadRequest, ErrorInvalidRequest, "limit must be between 1 and "+strconv.Itoa(MaxAuditEntries))
+			return
+		}
+	}
+	entries, err := model.GetAuditEntries(server.Db, filter, &server.Mutex)
+	if err != nil {
+		logger.Error("getAuditLog failed", logging.Fields{"error": err})
+		writeError(writer, http.StatusInternalServerError, ErrorInternal, err.Error())
+		return
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	writer.Header().Set("Cache-Control", "no-store")
+	err = json.NewEncoder(writer).Encode(entries)
+	if err != nil {
+		logger.Error("getAuditLog failed", logging.Fields{"error": err})
+		return
+	}
+	logger.Debug("sent reply")
+}
@@ -0,0 +1,423 @@
+package controller
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Formats of bank statements.
+const (
+	FormatCAMT053 = "camt053"
+	FormatMT940   = "mt940"
+	FormatCSV     = "csv"
+)
+
+// BankCredit is a credit booked on our bank account, read from a bank statement.
+type BankCredit struct {
+	BookingDate   string // YYYY-MM-DD
+	AmountCents   int64
+	Currency      string
+	Reference     string // remittance information
+	Counterparty  string
+	IBAN          string
+	BankReference string // e.g. the AcctSvcrRef or end-to-end ID, may be empty
+	// Occurrence counts the earlier credits of the statement with the same fields, e.g. two identical
+	// payments of one customer on the same day, whose statement has no bank references.
+	Occurrence int
+}
+
+// Key identifies the booking across overlapping statements.
+func (credit *BankCredit) Key() string {
+	fields := []string{credit.BookingDate, strconv.FormatInt(credit.AmountCents, 10), credit.Currency,
+		credit.Reference, credit.Counterparty, credit.IBAN, credit.BankReference}
+	// The first occurrence keeps the key it had before occurrences were counted.
+	if credit.Occurrence > 0 {
+		fields = append(fields, strconv.Itoa(credit.Occurrence))
+	}
+	hash := sha256.Sum256([]byte(strings.Join(fields, "\x00")))
+	return hex.EncodeToString(hash[:])
+}
+
+// countOccurrences sets the Occurrence of each credit, so that identical credits get different keys.
+func countOccurrences(credits []BankCredit) {
+	seen := make(map[string]int)
+	for i := range credits {
+		key := credits[i].Key()
+		credits[i].Occurrence = seen[key]
+		seen[key]++
+	}
+}
+
+// DetectStatementFormat guesses the format of a bank statement from its content.
+func DetectStatementFormat(data []byte) string {
+	trimmed := bytes.TrimSpace(bytes.TrimPrefix(data, []byte("\xef\xbb\xbf")))
+	if bytes.HasPrefix(trimmed, []byte("<")) {
+		return FormatCAMT053
+	}
+	if bytes.Contains(data, []byte(":61:")) && bytes.Contains(data, []byte(":20:")) {
+		return FormatMT940
+	}
+	return FormatCSV
+}
+
+// ParseBankStatement reads the booked credits of a bank statement. An empty format is detected from the content.
+func ParseBankStatement(data []byte, format string) ([]BankCredit, error) {
+	if format == "" {
+		format = DetectStatementFormat(data)
+	}
+	var credits []BankCredit
+	var err error
+	switch format {
+	case FormatCAMT053:
+		credits, err = parseCAMT053(data)
+	case FormatMT940:
+		credits, err = parseMT940(data)
+	case FormatCSV:
+		credits, err = parseStatementCSV(data)
+	default:
+		return nil, errors.New("unknown bank statement format '" + format + "', use " + FormatCAMT053 + ", " + FormatMT940 + " or " + FormatCSV)
+	}
+	if err != nil {
+		return nil, err
+	}
+	countOccurrences(credits)
+	return credits, nil
+}
+
+// parseCents converts a decimal amount like "1234.5", "1.234,50", "1,234.50" or "1234,50" to cents.
+// The last dot or comma separates the decimals, unless it separates thousands as in "1.234" or "1,234,567".
+func parseCents(amount string) (int64, error) {
+	amount = strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(amount), "+"))
+	integer, fraction := amount, "0"
+	if i := strings.LastIndexAny(amount, ".,"); i >= 0 {
+		separator, other := amount[i:i+1], ","
+		if separator == "," {
+			other = "."
+		}
+		thousands := strings.Count(amount, separator) > 1 || (len(amount)-i-1 == 3 && !strings.Contains(amount, other))
+		if thousands && strings.Contains(amount, other) {
+			return 0, errors.New("invalid amount '" + amount + "'")
+		}
+		if !thousands {
+			integer, fraction = amount[:i], amount[i+1:]+"0"
+		}
+	}
+	integer = strings.NewReplacer(".", "", ",", "").Replace(integer)
+	value, err := strconv.ParseFloat(integer+"."+fraction, 64)
+	if err != nil || integer == "" && fraction == "0" || strings.ContainsAny(fraction, ".,+-") {
+		return 0, errors.New("invalid amount '" + amount + "'")
+	}
+	return int64(math.Round(value * 100)), nil
+}
+
+// camtDocument is the part of a CAMT.053 document that is read, for all versions since camt.053.001.02.
+// Elements are matched by their local names, so the namespace of the version does not matter.
+type camtDocument struct {
+	Statements []struct {
+		Entries []camtEntry `xml:"Ntry"`
+	} `xml:"BkToCstmrStmt>Stmt"`
+}
+
+type camtAmount struct {
+	Value    string `xml:",chardata"`
+	Currency string `xml:"Ccy,attr"`
+}
+
+type camtEntry struct {
+	Amount      camtAmount `xml:"Amt"`
+	CreditDebit string     `xml:"CdtDbtInd"`
+	Reversal    bool       `xml:"RvslInd"`
+	Status      struct {
+		Text string `xml:",chardata"` // up to camt.053.001.04
+		Code string `xml:"Cd"`
+	} `xml:"Sts"`
+	BookingDate  string `xml:"BookgDt>Dt"`
+	BookingTime  string `xml:"BookgDt>DtTm"`
+	BankRef      string `xml:"AcctSvcrRef"`
+	Transactions []struct {
+		Amount         camtAmount `xml:"Amt"`
+		TxAmount       camtAmount `xml:"AmtDtls>TxAmt>Amt"`
+		BankRef        string     `xml:"Refs>AcctSvcrRef"`
+		EndToEndID     string     `xml:"Refs>EndToEndId"`
+		Debtor         string     `xml:"RltdPties>Dbtr>Nm"`
+		DebtorParty    string     `xml:"RltdPties>Dbtr>Pty>Nm"`
+		DebtorIBAN     string     `xml:"RltdPties>DbtrAcct>Id>IBAN"`
+		Unstructured   []string   `xml:"RmtInf>Ustrd"`
+		CreditorRef    []string   `xml:"RmtInf>Strd>CdtrRefInf>Ref"`
+		AdditionalInfo string     `xml:"AddtlTxInf"`
+	} `xml:"NtryDtls>TxDtls"`
+}
+
+func parseCAMT053(data []byte) ([]BankCredit, error) {
+	var document camtDocument
+	err := xml.Unmarshal(data, &document)
+	if err != nil {
+		return nil, errors.New("invalid CAMT.053 statement: " + err.Error())
+	}
+	credits := make([]BankCredit, 0)
+	for _, statement := range document.Statements {
+		for _, entry := range statement.Entries {
+			status := strings.TrimSpace(entry.Status.Text)
+			if entry.Status.Code != "" {
+				status = entry.Status.Code
+			}
+			if entry.CreditDebit != "CRDT" || entry.Reversal || (status != "" && status != "BOOK") {
+				continue
+			}
+			date := entry.BookingDate
+			if date == "" && len(entry.BookingTime) >= 10 {
+				date = entry.BookingTime[:10]
+			}
+			if len(entry.Transactions) == 0 {
+				cents, err := parseCents(entry.Amount.Value)
+				if err != nil {
+					return nil, err
+				}
+				credits = append(credits, BankCredit{BookingDate: date, AmountCents: cents, Currency: entry.Amount.Currency, BankReference: entry.BankRef})
+				continue
+			}
+			// Batch bookings list one transaction per payment.
+			for _, transaction := range entry.Transactions {
+				amount := entry.Amount
+				if transaction.Amount.Value != "" {
+					amount = transaction.Amount
+				} else if transaction.TxAmount.Value != "" {
+					amount = transaction.TxAmount
+				} else if len(entry.Transactions) > 1 {
+					return nil, errors.New("CAMT.053 batch entry " + entry.BankRef + " lacks transaction amounts")
+				}
+				cents, err := parseCents(amount.Value)
+				if err != nil {
+					return nil, err
+				}
+				reference := strings.Join(append(transaction.Unstructured, transaction.CreditorRef...), " ")
+				if reference == "" {
+					reference = transaction.AdditionalInfo
+				}
+				counterparty := transaction.Debtor
+				if counterparty == "" {
+					counterparty = transaction.DebtorParty
+				}
+				bankRef := transaction.BankRef
+				if bankRef == "" {
+					bankRef = entry.BankRef
+				}
+				if transaction.EndToEndID != "" && transaction.EndToEndID != "NOTPROVIDED" {
+					bankRef = strings.TrimSpace(bankRef + " " + transaction.EndToEndID)
+				}
+				credits = append(credits, BankCredit{
+					BookingDate:   date,
+					AmountCents:   cents,
+					Currency:      amount.Currency,
+					Reference:     strings.TrimSpace(reference),
+					Counterparty:  strings.TrimSpace(counterparty),
+					IBAN:          strings.TrimSpace(transaction.DebtorIBAN),
+					BankReference: bankRef,
+				})
+			}
+		}
+	}
+	return credits, nil
+}
+
+// mt940Line is a statement line (tag :61:), e.g. "2310151015CR51,00NTRFNONREF//B3J15CI1F00A001".
+// The transaction type is N, F or S followed by a three character code, e.g. "NTRF" or "FCHG".
+var mt940Line = regexp.MustCompile(`^(\d{6})(\d{4})?(RC|RD|C|D)[A-Z]?(\d+,\d{0,2})[NFS][A-Z0-9]{3}([^/]*)(?://(.*))?`)
+
+// mt940Field is a subfield of structured German information to the account owner (tag :86:), e.g. "?20".
+var mt940Field = regexp.MustCompile(`\?(\d\d)`)
+
+// parseMT940 reads an MT940 statement, as exported by most German banks.
+func parseMT940(data []byte) ([]BankCredit, error) {
+	// Join continuation lines to their tags.
+	var fields [][2]string
+	for _, line := range strings.Split(strings.Replace(string(data), "\r\n", "\n", -1), "\n") {
+		if len(line) > 3 && line[0] == ':' && strings.Index(line[1:], ":") > 0 && strings.Index(line[1:], ":") <= 3 {
+			end := strings.Index(line[1:], ":") + 1
+			fields = append(fields, [2]string{line[1:end], line[end+1:]})
+		} else if len(fields) > 0 && line != "-" {
+			fields[len(fields)-1][1] += "\n" + line
+		}
+	}
+	credits := make([]BankCredit, 0)
+	currency := "EUR"
+	var credit *BankCredit
+	for _, field := range fields {
+		tag, value := field[0], field[1]
+		switch tag {
+		case "60F", "60M":
+			// Opening balance, e.g. "C231014EUR1234,56".
+			if len(value) >= 10 {
+				currency = value[7:10]
+			}
+		case "61":
+			credit = nil
+			match := mt940Line.FindStringSubmatch(strings.SplitN(value, "\n", 2)[0])
+			if match == nil {
+				return nil, errors.New("invalid MT940 statement line ':61:" + value + "'")
+			}
+			if match[3] != "C" {
+				continue // debits and reversals
+			}
+			date, err := time.Parse("060102", match[1])
+			if err != nil {
+				return nil, errors.New("invalid MT940 booking date '" + match[1] + "'")
+			}
+			cents, err := parseCents(match[4])
+			if err != nil {
+				return nil, err
+			}
+			bankRef := strings.TrimSpace(match[6])
+			if customerRef := strings.TrimSpace(match[5]); customerRef != "" && customerRef != "NONREF" {
+				bankRef = strings.TrimSpace(customerRef + " " + bankRef)
+			}
+			credits = append(credits, BankCredit{BookingDate: date.Format("2006-01-02"), AmountCents: cents, Currency: currency, BankReference: bankRef})
+			credit = &credits[len(credits)-1]
+		case "86":
+			if credit == nil {
+				continue
+			}
+			credit.Reference, credit.Counterparty, credit.IBAN = parseMT940Information(strings.Replace(value, "\n", "", -1))
+			credit = nil
+		}
+	}
+	return credits, nil
+}
+
+// parseMT940Information splits structured information to the account owner into the remittance text,
+// the name and the IBAN of the counterparty. Unstructured information is returned as remittance text.
+func parseMT940Information(value string) (string, string, string) {
+	indexes := mt940Field.FindAllStringSubmatchIndex(value, -1)
+	if len(indexes) == 0 {
+		return strings.TrimSpace(value), "", ""
+	}
+	var reference, name, iban string
+	for i, index := range indexes {
+		end := len(value)
+		if i+1 < len(indexes) {
+			end = indexes[i+1][0]
+		}
+		code, _ := strconv.Atoi(value[index[2]:index[3]])
+		content := value[index[1]:end]
+		switch {
+		case code >= 20 && code <= 29, code >= 60 && code <= 63:
+			reference += content
+		case code == 31:
+			iban = content
+		case code == 32 || code == 33:
+			name += content
+		}
+	}
+	// SEPA prefixes like "SVWZ+" mark the remittance text between other references.
+	if i := strings.Index(reference, "SVWZ+"); i >= 0 {
+		reference = reference[i+len("SVWZ+"):]
+	}
+	return strings.TrimSpace(reference), strings.TrimSpace(name), strings.TrimSpace(iban)
+}
+
+// csvColumns lists the accepted header names of each column of CSV bank statements, in lower case.
+// They cover the exports of common German banks as well as English names.
+var csvColumns = map[string][]string{
+	"date":         {"buchungstag", "buchungsdatum", "booking date", "date", "datum"},
+	"amount":       {"betrag", "betrag (€)", "betrag (eur)", "amount", "umsatz"},
+	"currency":     {"währung", "waehrung", "currency"},
+	"reference":    {"verwendungszweck", "reference", "remittance information", "purpose"},
+	"counterparty": {"beguenstigter/zahlungspflichtiger", "begünstigter/zahlungspflichtiger", "name zahlungsbeteiligter", "auftraggeber/empfänger", "name", "counterparty"},
+	"iban":         {"kontonummer/iban", "iban zahlungsbeteiligter", "iban", "counterparty iban"},
+	"bank_ref":     {"kundenreferenz (end-to-end)", "end-to-end reference", "bank reference", "referenz"},
+}
+
+// parseStatementCSV reads a CSV statement with a header row, separated by semicolons or commas.
+// Negative amounts are debits and skipped.
+func parseStatementCSV(data []byte) ([]BankCredit, error) {
+	data = bytes.TrimPrefix(data, []byte("\xef\xbb\xbf"))
+	firstLine := string(data)
+	if i := strings.IndexByte(firstLine, '\n'); i >= 0 {
+		firstLine = firstLine[:i]
+	}
+	reader := csv.NewReader(bytes.NewReader(data))
+	if strings.Count(firstLine, ";") > strings.Count(firstLine, ",") {
+		reader.Comma = ';'
+	}
+	reader.FieldsPerRecord = -1
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, errors.New("invalid CSV statement: " + err.Error())
+	}
+	if len(records) == 0 {
+		return nil, errors.New("empty CSV statement")
+	}
+	columns := make(map[string]int)
+	for i, name := range records[0] {
+		name = strings.ToLower(strings.TrimSpace(name))
+		for column, names := range csvColumns {
+			if _, found := columns[column]; !found && contains(names, name) {
+				columns[column] = i
+			}
+		}
+	}
+	for _, required := range []string{"date", "amount", "reference"} {
+		if _, found := columns[required]; !found {
+			return nil, fmt.Errorf("CSV statement lacks a %s column, e.g. '%s'", required, csvColumns[required][0])
+		}
+	}
+	get := func(record []string, column string) string {
+		i, found := columns[column]
+		if !found || i >= len(record) {
+			return ""
+		}
+		return strings.TrimSpace(record[i])
+	}
+	credits := make([]BankCredit, 0)
+	for row, record := range records[1:] {
+		if len(record) == 1 && strings.TrimSpace(record[0]) == "" {
+			continue
+		}
+		cents, err := parseCents(get(record, "amount"))
+		if err != nil {
+			return nil, fmt.Errorf("row %d: %s", row+2, err)
+		}
+		if cents <= 0 {
+			continue
+		}
+		date, err := parseStatementDate(get(record, "date"))
+		if err != nil {
+			return nil, fmt.Errorf("row %d: %s", row+2, err)
+		}
+		currency := get(record, "currency")
+		if currency == "" {
+			currency = "EUR"
+		}
+		credits = append(credits, BankCredit{
+			BookingDate:   date,
+			AmountCents:   cents,
+			Currency:      currency,
+			Reference:     get(record, "reference"),
+			Counterparty:  get(record, "counterparty"),
+			IBAN:          strings.Replace(get(record, "iban"), " ", "", -1),
+			BankReference: get(record, "bank_ref"),
+		})
+	}
+	return credits, nil
+}
+
+// parseStatementDate converts the date formats of CSV statements to YYYY-MM-DD.
+func parseStatementDate(value string) (string, error) {
+	for _, layout := range []string{"2006-01-02", "02.01.2006", "02.01.06", "01/02/2006"} {
+		date, err := time.Parse(layout, value)
+		if err == nil {
+			return date.Format("2006-01-02"), nil
+		}
+	}
+	return "", errors.New("invalid date '" + value + "'")
+}
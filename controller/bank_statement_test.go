@@ -0,0 +1,164 @@
+package controller
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseCents(t *testing.T) {
+	tests := []struct {
+		amount string
+		cents  int64
+	}{
+		{"1.234,50", 123450},
+		{"1,234.50", 123450},
+		{"1234,5", 123450},
+		{"1234.5", 123450},
+		{"1.234", 123400},
+		{"1,234", 123400},
+		{"1,234,567", 123456700},
+		{"1.234.567,89", 123456789},
+		{"12,34", 1234},
+		{"51,", 5100},
+		{"0.99", 99},
+		{"42", 4200},
+		{"+42,00", 4200},
+		{"-12,50", -1250},
+		{" 54,00 ", 5400},
+	}
+	for _, test := range tests {
+		cents, err := parseCents(test.amount)
+		if err != nil {
+			t.Errorf("parseCents(%q) failed: %s", test.amount, err)
+		} else if cents != test.cents {
+			t.Errorf("parseCents(%q) = %d, want %d", test.amount, cents, test.cents)
+		}
+	}
+	for _, amount := range []string{"", "abc", "1,2,3.4.5", "12,-5"} {
+		if cents, err := parseCents(amount); err == nil {
+			t.Errorf("parseCents(%q) = %d, want an error", amount, cents)
+		}
+	}
+}
+
+func TestFindOrderIDs(t *testing.T) {
+	tests := []struct {
+		reference string
+		ids       []int64
+	}{
+		{"CC-000042", []int64{42}},
+		{"Kalender cc42 und CC 000043", []int64{42, 43}},
+		{"CC_000042 CC.42", []int64{42}},
+		{"Bestellung CC-000000", []int64{}},
+		{"ACC-000042 Kalender", []int64{}},
+		{"Kalender 2024", []int64{}},
+	}
+	for _, test := range tests {
+		if ids := findOrderIDs(test.reference); !reflect.DeepEqual(ids, test.ids) {
+			t.Errorf("findOrderIDs(%q) = %v, want %v", test.reference, ids, test.ids)
+		}
+	}
+}
+
+func TestParseMT940Information(t *testing.T) {
+	tests := []struct {
+		value                         string
+		reference, counterparty, iban string
+	}{
+		{
+			"166?00GUTSCHR. UEBERW.?109310?20EREF+NOTPROVIDED?21SVWZ+CC-000042 Kale?22nder?30BYLADEM1001?31DE02120300000000202051?32ERIKA MUSTERMANN",
+			"CC-000042 Kalender", "ERIKA MUSTERMANN", "DE02120300000000202051",
+		},
+		{"166?20CC-000042?32MUSTERMANN?33ERIKA", "CC-000042", "MUSTERMANNERIKA", ""},
+		{"Kalender CC-000042", "Kalender CC-000042", "", ""},
+	}
+	for _, test := range tests {
+		reference, counterparty, iban := parseMT940Information(test.value)
+		if reference != test.reference || counterparty != test.counterparty || iban != test.iban {
+			t.Errorf("parseMT940Information(%q) = %q, %q, %q, want %q, %q, %q", test.value, reference, counterparty, iban, test.reference, test.counterparty, test.iban)
+		}
+	}
+}
+
+func TestParseBankStatement(t *testing.T) {
+	tests := []struct {
+		name    string
+		format  string
+		data    string
+		credits []BankCredit
+	}{
+		{
+			name:   "CAMT.053 batch entry",
+			format: FormatCAMT053,
+			data: `<?xml version="1.0" encoding="UTF-8"?>
+<Document xmlns="urn:iso:std:iso:20022:tech:xsd:camt.053.001.08"><BkToCstmrStmt><Stmt>
+<Ntry><Amt Ccy="EUR">74.00</Amt><CdtDbtInd>CRDT</CdtDbtInd><Sts><Cd>BOOK</Cd></Sts><BookgDt><Dt>2023-10-15</Dt></BookgDt><AcctSvcrRef>BATCH1</AcctSvcrRef>
+<NtryDtls>
+<TxDtls><Refs><EndToEndId>E2E-1</EndToEndId></Refs><Amt Ccy="EUR">20.00</Amt><RltdPties><Dbtr><Nm>Erika Mustermann</Nm></Dbtr><DbtrAcct><Id><IBAN>DE02120300000000202051</IBAN></Id></DbtrAcct></RltdPties><RmtInf><Ustrd>CC-000042</Ustrd></RmtInf></TxDtls>
+<TxDtls><Refs><EndToEndId>NOTPROVIDED</EndToEndId></Refs><AmtDtls><TxAmt><Amt Ccy="EUR">54.00</Amt></TxAmt></AmtDtls><RltdPties><Dbtr><Pty><Nm>Max Muster</Nm></Pty></Dbtr></RltdPties><RmtInf><Strd><CdtrRefInf><Ref>CC-000043</Ref></CdtrRefInf></Strd></RmtInf></TxDtls>
+</NtryDtls></Ntry>
+<Ntry><Amt Ccy="EUR">10.00</Amt><CdtDbtInd>DBIT</CdtDbtInd><Sts><Cd>BOOK</Cd></Sts><BookgDt><Dt>2023-10-15</Dt></BookgDt></Ntry>
+<Ntry><Amt Ccy="EUR">30.00</Amt><CdtDbtInd>CRDT</CdtDbtInd><Sts><Cd>PDNG</Cd></Sts><BookgDt><Dt>2023-10-15</Dt></BookgDt></Ntry>
+</Stmt></BkToCstmrStmt></Document>`,
+			credits: []BankCredit{
+				{BookingDate: "2023-10-15", AmountCents: 2000, Currency: "EUR", Reference: "CC-000042", Counterparty: "Erika Mustermann", IBAN: "DE02120300000000202051", BankReference: "BATCH1 E2E-1"},
+				{BookingDate: "2023-10-15", AmountCents: 5400, Currency: "EUR", Reference: "CC-000043", Counterparty: "Max Muster", BankReference: "BATCH1"},
+			},
+		},
+		{
+			name:   "MT940 with SVWZ+ and a charge",
+			format: FormatMT940,
+			data: ":20:STARTUMS\r\n:25:12030000/0000202051\r\n:28C:0\r\n:60F:C231014EUR1234,56\r\n" +
+				":61:2310151015CR51,NTRFNONREF//B3J15CI1F00A001\r\n" +
+				":86:166?00GUTSCHR. UEBERW.?20EREF+NOTPROVIDED?21SVWZ+CC-000042?31DE0212030000\r\n0000202051?32ERIKA MUSTERMANN\r\n" +
+				":61:2310161016DR5,00NCHGNONREF\r\n:86:805?00ENTGELT\r\n" +
+				":61:2310161016CR20,00FCHKKREF1//B3J15CI1F00A002\r\n:86:Kalender CC 43\r\n" +
+				":62F:C231016EUR1300,56\r\n-",
+			credits: []BankCredit{
+				{BookingDate: "2023-10-15", AmountCents: 5100, Currency: "EUR", Reference: "CC-000042", Counterparty: "ERIKA MUSTERMANN", IBAN: "DE02120300000000202051", BankReference: "B3J15CI1F00A001"},
+				{BookingDate: "2023-10-16", AmountCents: 2000, Currency: "EUR", Reference: "Kalender CC 43", BankReference: "KREF1 B3J15CI1F00A002"},
+			},
+		},
+		{
+			name:   "CSV with semicolons and BOM",
+			format: FormatCSV,
+			data: "\xef\xbb\xbfBuchungstag;Verwendungszweck;Beguenstigter/Zahlungspflichtiger;Kontonummer/IBAN;Betrag;Waehrung\n" +
+				"15.10.2023;CC-000042 Kalender;Erika Mustermann;DE02 1203 0000 0000 2020 51;1.234,50;EUR\n" +
+				"16.10.2023;Miete;Vermieter;DE89370400440532013000;-500,00;EUR\n",
+			credits: []BankCredit{
+				{BookingDate: "2023-10-15", AmountCents: 123450, Currency: "EUR", Reference: "CC-000042 Kalender", Counterparty: "Erika Mustermann", IBAN: "DE02120300000000202051"},
+			},
+		},
+		{
+			name:   "identical credits",
+			format: FormatCSV,
+			data:   "date,amount,reference\n2023-10-15,20.00,CC-000042\n2023-10-15,20.00,CC-000042\n",
+			credits: []BankCredit{
+				{BookingDate: "2023-10-15", AmountCents: 2000, Currency: "EUR", Reference: "CC-000042"},
+				{BookingDate: "2023-10-15", AmountCents: 2000, Currency: "EUR", Reference: "CC-000042", Occurrence: 1},
+			},
+		},
+	}
+	for _, test := range tests {
+		if format := DetectStatementFormat([]byte(test.data)); format != test.format {
+			t.Errorf("%s: detected format %s, want %s", test.name, format, test.format)
+		}
+		credits, err := ParseBankStatement([]byte(test.data), "")
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(credits, test.credits) {
+			t.Errorf("%s: got credits\n%+v\nwant\n%+v", test.name, credits, test.credits)
+		}
+	}
+}
+
+func TestBankCreditKey(t *testing.T) {
+	credit := BankCredit{BookingDate: "2023-10-15", AmountCents: 2000, Currency: "EUR", Reference: "CC-000042"}
+	second := credit
+	second.Occurrence = 1
+	if credit.Key() == second.Key() {
+		t.Error("identical credits have the same key")
+	}
+}
@@ -2,16 +2,16 @@ package controller
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io/ioutil"
-	"log"
 	"net/http"
-	"strconv"
 	"sync"
 	"time"
 
+	"github.com/kunterbunt/calendarium-server/logging"
 	"github.com/kunterbunt/calendarium-server/model"
 )
 
@@ -25,6 +25,7 @@ type billbeeInvoiceAddress struct {
 	Zip         string `json:"Zip"`
 	City        string `json:"City"`
 	Country     string `json:"Country"`
+	CountryISO2 string `json:"CountryISO2"`
 	Email       string `json:"Email"`
 }
 
@@ -37,6 +38,7 @@ type billbeeShippingAddress struct {
 	Zip         string `json:"Zip"`
 	City        string `json:"City"`
 	Country     string `json:"Country"`
+	CountryISO2 string `json:"CountryISO2"`
 	Email       string `json:"Email"`
 }
 
@@ -77,6 +79,15 @@ type billbeeBody struct {
 	Tags            []string               `json:"Tags"`
 }
 
+// countryName returns the German name of the country with the given ISO code, or the code itself if it is unknown.
+func countryName(code string) string {
+	country, known := model.GetCountry(code)
+	if !known {
+		return code
+	}
+	return country.NameGerman
+}
+
 func ToOrderId(id int64) string {
 	return "CC-" + fmt.Sprintf("%06d", id)
 }
@@ -85,13 +96,17 @@ func ToUzOrderId(id int64) string {
 	return "UZ-" + fmt.Sprintf("%06d", id)
 }
 
-func newBillbeeOrderBody(order *model.Order) billbeeBody {
+// billbeeFallbackPayment is the Billbee payment method of orders with an unknown payment method: PayPal,
+// which Billbee charges itself.
+const billbeeFallbackPayment = 3
+
+func newBillbeeOrderBody(ctx context.Context, order *model.Order) billbeeBody {
 	// Payment type.
-	var payment int
-	if order.Payment == "banktransfer" {
-		payment = 1
+	payment := billbeeFallbackPayment
+	if method := LookupPaymentMethod(order.Payment); method != nil {
+		payment = method.BillbeeCode
 	} else {
-		payment = 3 // PayPal
+		logging.FromContext(ctx).Error("unknown payment method, forwarding with the fallback", logging.Fields{"order_number": ToOrderId(order.ID), "payment": order.Payment, "billbee_payment": payment})
 	}
 	// Tags
 	var tags []string
@@ -114,7 +129,8 @@ func newBillbeeOrderBody(order *model.Order) billbeeBody {
 			HouseNumber: order.AddressStreetNoInvoice,
 			Zip:         order.AddressCodeInvoice,
 			City:        order.AddressCityInvoice,
-			Country:     order.AddressCountryInvoice,
+			Country:     countryName(order.AddressCountryInvoice),
+			CountryISO2: order.AddressCountryInvoice,
 			Email:       order.Email,
 		},
 		ShippingAddress: billbeeShippingAddress{
@@ -125,7 +141,8 @@ func newBillbeeOrderBody(order *model.Order) billbeeBody {
 			HouseNumber: order.AddressStreetNoDelivery,
 			Zip:         order.AddressCodeDelivery,
 			City:        order.AddressCityDelivery,
-			Country:     order.AddressCountryDelivery,
+			Country:     countryName(order.AddressCountryDelivery),
+			CountryISO2: order.AddressCountryDelivery,
 			Email:       order.Email,
 		},
 		PaymentMethod: payment,
@@ -153,7 +170,7 @@ func newBillbeeOrderBody(order *model.Order) billbeeBody {
 }
 
 func newBillbeeUzOrderBody(order *model.Order, convivium string) billbeeBody {
-	payment := 6 // Gutschein
+	payment := LookupPaymentMethod(PaymentVoucher).BillbeeCode
 	var tags []string
 	if order.Reseller {
 		tags = append(tags, "reseller")
@@ -175,7 +192,8 @@ func newBillbeeUzOrderBody(order *model.Order, convivium string) billbeeBody {
 			HouseNumber: order.AddressStreetNoInvoice,
 			Zip:         order.AddressCodeInvoice,
 			City:        order.AddressCityInvoice,
-			Country:     order.AddressCountryInvoice,
+			Country:     countryName(order.AddressCountryInvoice),
+			CountryISO2: order.AddressCountryInvoice,
 			Email:       order.Email,
 		},
 		ShippingAddress: billbeeShippingAddress{
@@ -186,7 +204,8 @@ func newBillbeeUzOrderBody(order *model.Order, convivium string) billbeeBody {
 			HouseNumber: order.AddressStreetNoDelivery,
 			Zip:         order.AddressCodeDelivery,
 			City:        order.AddressCityDelivery,
-			Country:     order.AddressCountryDelivery,
+			Country:     countryName(order.AddressCountryDelivery),
+			CountryISO2: order.AddressCountryDelivery,
 			Email:       order.Email,
 		},
 		PaymentMethod: payment,
@@ -214,6 +233,10 @@ func newBillbeeUzOrderBody(order *model.Order, convivium string) billbeeBody {
 	return body
 }
 
+// BillbeeErrorPrefix starts the error of a forward that billbee rejected, which was saved as billbee response
+// before forwards were recorded.
+const BillbeeErrorPrefix = "Billbee returned HTTP status: "
+
 // BillbeeHandler can forward orders to billbee.
 type BillbeeHandler struct {
 	apiKey          string
@@ -222,8 +245,10 @@ type BillbeeHandler struct {
 	url             string
 	mutex           sync.Mutex
 	lastRequestTime time.Time
+	client          *http.Client
 	Emailer         *Emailer
 	destEmails      []string
+	locale          string // of the error emails
 }
 
 // NewBillbeeHandler instantiates a new forwarder.
@@ -234,58 +259,32 @@ func NewBillbeeHandler(apiKey string, authUsername string, authPassword string,
 	handler.authPassword = authPassword
 	handler.url = url
 	handler.lastRequestTime = time.Now()
+	// Without a timeout, a hanging billbee would block the graceful shutdown forever.
+	handler.client = &http.Client{Timeout: 30 * time.Second}
 	handler.Emailer = nil
 	return &handler
 }
 
-func (billbee *BillbeeHandler) AttachEmailer(emailAddr string, emailPassword string, smtpHost string, smtpPort string, destEmails []string) {
+func (billbee *BillbeeHandler) AttachEmailer(emailAddr string, emailPassword string, smtpHost string, smtpPort string, destEmails []string, locale string) {
 	billbee.Emailer = NewEmailer(emailAddr, emailPassword, smtpHost, smtpPort)
 	billbee.destEmails = destEmails
+	billbee.locale = locale
 }
 
 // ForwardOrder forwards an order to billbee.
-func (billbee *BillbeeHandler) ForwardOrder(order *model.Order) (string, error) {
+func (billbee *BillbeeHandler) ForwardOrder(ctx context.Context, order *model.Order) (string, error) {
+	logger := logging.FromContext(ctx).With(logging.Fields{"order_number": ToOrderId(order.ID)})
 	billbee.mutex.Lock()
 	defer billbee.mutex.Unlock()
-	timeDifference := time.Now().Sub(billbee.lastRequestTime)
-	if timeDifference.Milliseconds() < 500 {
-		wantedDifference := time.Duration(500 - timeDifference.Milliseconds())
-		timeToSleep := wantedDifference * time.Millisecond
-		log.Print("billbee handler waiting for " + strconv.Itoa(int(timeToSleep.Milliseconds())) + " ms... ")
-		time.Sleep(timeToSleep)
-	}
-	billbee.lastRequestTime = time.Now()
-	jsonContent, err := json.Marshal(newBillbeeOrderBody(order))
+	billbee.throttle(logger)
+	jsonContent, err := json.Marshal(newBillbeeOrderBody(ctx, order))
 	if err != nil {
-		fmt.Println("error creating json: ")
-		fmt.Println(err.Error())
-		if billbee.Emailer != nil {
-			fmt.Println("sending error email")
-			err2 := billbee.Emailer.SendEmail(billbee.destEmails, "Fehler beim Bestellung erstellen", err.Error()+"\r\n\r\nBei Bestellung mit ID "+strconv.Itoa(int(order.ID))+"\r\nHier Bestelldetails einsehen: https://calendariumculinarium.de/api/orders")
-			if err2 != nil {
-				fmt.Println("error!")
-				fmt.Println(err2.Error())
-				log.Fatal(err2)
-			}
-		}
+		billbee.reportError(ctx, logger, "billbee.subject.create", "error creating json", err, order)
 		return "", err
 	}
 	request, err := http.NewRequest("POST", billbee.url, bytes.NewBuffer(jsonContent))
 	if err != nil {
-		fmt.Println("error creating request, error is printed in next line: ")
-		fmt.Println(err.Error())
-		fmt.Println("billbee URL in next line: ")
-		fmt.Println(billbee.url)
-
-		if billbee.Emailer != nil {
-			fmt.Println("trying to send email")
-			err2 := billbee.Emailer.SendEmail(billbee.destEmails, "Fehler beim Bestellung erstellen", err.Error()+"\r\n\r\nBei Bestellung mit ID "+strconv.Itoa(int(order.ID))+"\r\nHier Bestelldetails einsehen: https://calendariumculinarium.de/api/orders")
-			if err2 != nil {
-				fmt.Println("error")
-				fmt.Println(err2.Error())
-				log.Fatal(err2)
-			}
-		}
+		billbee.reportError(ctx, logger, "billbee.subject.create", "error creating request for "+billbee.url, err, order)
 		return "", err
 	}
 
@@ -293,68 +292,68 @@ func (billbee *BillbeeHandler) ForwardOrder(order *model.Order) (string, error)
 	request.Header.Set("Content-Type", "application/json")
 	request.Header.Set("X-Billbee-Api-Key", billbee.apiKey)
 
-	client := &http.Client{}
-	response, err := client.Do(request)
+	response, err := billbee.client.Do(request)
 	if err != nil {
-		fmt.Println("error sending request, printing request in next line")
-		fmt.Println(request)
-		fmt.Println("printing json")
-		fmt.Println(string(jsonContent))
-		if billbee.Emailer != nil {
-			err2 := billbee.Emailer.SendEmail(billbee.destEmails, "Fehler beim Bestellung weiterleiten", err.Error()+"\r\n\r\nBei Bestellung mit ID "+strconv.Itoa(int(order.ID))+"\r\nHier Bestelldetails einsehen: https://calendariumculinarium.de/api/orders")
-			if err2 != nil {
-				log.Fatal(err2)
-			}
-		}
+		billbee.reportError(ctx, logger, "billbee.subject.forward", "error sending request", err, order)
 		return "", err
 	}
 
 	if response.StatusCode != 201 {
-		errorString := "Billbee returned HTTP status: " + response.Status
-		defer response.Body.Close()
-		body, err := ioutil.ReadAll(response.Body)
-		if err != nil {
-			errorString = errorString + " and error reading response body: " + err.Error()
-		} else {
-			errorString = errorString + " with error message: " + string(body)
-		}
-		if billbee.Emailer != nil {
-			err2 := billbee.Emailer.SendEmail(billbee.destEmails, "Fehler bei billbee", errorString+"\r\n\r\nBei Bestellung mit ID "+strconv.Itoa(int(order.ID))+"\r\nHier Bestelldetails einsehen: https://calendariumculinarium.de/api/orders")
-			if err2 != nil {
-				log.Fatal(err2)
-			}
-		}
-		return "", errors.New(errorString)
+		err = billbeeRejected(response)
+		billbee.reportError(ctx, logger, "billbee.subject.status", "billbee rejected order", err, order)
+		return "", err
 	}
 
 	defer response.Body.Close()
 	body, err := ioutil.ReadAll(response.Body)
 	if err != nil {
-		if billbee.Emailer != nil {
-			err2 := billbee.Emailer.SendEmail(billbee.destEmails, "Fehler beim Response lesen", err.Error()+"\r\n\r\nBei Bestellung mit ID "+strconv.Itoa(int(order.ID))+"\r\nHier Bestelldetails einsehen: https://calendariumculinarium.de/api/orders")
-			if err2 != nil {
-				log.Fatal(err2)
-			}
-		}
+		billbee.reportError(ctx, logger, "billbee.subject.response", "error reading response", err, order)
 		return "", err
 	}
+	logger.Debug("forwarded order to billbee")
 	return string(body), nil
-
-	//return "", nil
 }
 
-// ForwardOrder forwards an Unterstuetzer order to billbee.
-func (billbee *BillbeeHandler) ForwardUzOrder(order *model.Order, convivium string) (string, error) {
-	billbee.mutex.Lock()
-	defer billbee.mutex.Unlock()
+// throttle waits until at least 500 ms have passed since the last request to billbee. The caller holds the mutex.
+func (billbee *BillbeeHandler) throttle(logger *logging.Logger) {
 	timeDifference := time.Now().Sub(billbee.lastRequestTime)
 	if timeDifference.Milliseconds() < 500 {
 		wantedDifference := time.Duration(500 - timeDifference.Milliseconds())
 		timeToSleep := wantedDifference * time.Millisecond
-		log.Print("billbee handler waiting for " + strconv.Itoa(int(timeToSleep.Milliseconds())) + " ms... ")
+		logger.Debug("billbee handler waiting", logging.Fields{"wait_ms": timeToSleep.Milliseconds()})
 		time.Sleep(timeToSleep)
 	}
 	billbee.lastRequestTime = time.Now()
+}
+
+// billbeeRejected returns the error for a response of billbee that rejects an order.
+func billbeeRejected(response *http.Response) error {
+	defer response.Body.Close()
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return errors.New(BillbeeErrorPrefix + response.Status + " and error reading response body: " + err.Error())
+	}
+	return &rejectedError{BillbeeErrorPrefix + response.Status, string(body)}
+}
+
+// reportError logs a forwarding error and emails it to the admins if an emailer is attached.
+// The email has the full error, the log only its redacted message.
+func (billbee *BillbeeHandler) reportError(ctx context.Context, logger *logging.Logger, subjectKey string, message string, forwardErr error, order *model.Order) {
+	logger.Error(message, logging.Fields{"error": forwardErr})
+	if billbee.Emailer == nil {
+		return
+	}
+	err := billbee.Emailer.SendEmail(ctx, billbee.destEmails, model.Message(billbee.locale, subjectKey), model.Message(billbee.locale, "billbee.body", forwardErr.Error(), order.ID))
+	if err != nil {
+		logger.Error("error sending error email", logging.Fields{"error": err})
+	}
+}
+
+// ForwardOrder forwards an Unterstuetzer order to billbee.
+func (billbee *BillbeeHandler) ForwardUzOrder(order *model.Order, convivium string) (string, error) {
+	billbee.mutex.Lock()
+	defer billbee.mutex.Unlock()
+	billbee.throttle(logging.Default())
 	jsonContent, err := json.Marshal(newBillbeeUzOrderBody(order, convivium))
 	if err != nil {
 		return "", err
@@ -368,22 +367,13 @@ func (billbee *BillbeeHandler) ForwardUzOrder(order *model.Order, convivium stri
 	request.Header.Set("Content-Type", "application/json")
 	request.Header.Set("X-Billbee-Api-Key", billbee.apiKey)
 
-	client := &http.Client{}
-	response, err := client.Do(request)
+	response, err := billbee.client.Do(request)
 	if err != nil {
 		return "", err
 	}
 
 	if response.StatusCode != 201 {
-		errorString := "Billbee returned HTTP status: " + response.Status
-		defer response.Body.Close()
-		body, err := ioutil.ReadAll(response.Body)
-		if err != nil {
-			errorString = errorString + " and error reading response body: " + err.Error()
-		} else {
-			errorString = errorString + " with error message: " + string(body)
-		}
-		return "", errors.New(errorString)
+		return "", billbeeRejected(response)
 	}
 
 	defer response.Body.Close()
@@ -0,0 +1,66 @@
+package controller
+
+import (
+	"context"
+	"strings"
+
+	"github.com/kunterbunt/calendarium-server/logging"
+	"github.com/kunterbunt/calendarium-server/model"
+)
+
+// AttachCustomerEmailer sends a confirmation email to the customer of every order that is not quarantined.
+func (server *Server) AttachCustomerEmailer(emailer *Emailer) {
+	server.CustomerEmailer = emailer
+	if server.Metrics != nil {
+		emailer.metrics = server.Metrics
+	}
+}
+
+// text returns the bank transfer details as shown to customers.
+func (details *BankTransferDetails) text(locale string) string {
+	account := "IBAN " + details.IBAN
+	if details.BIC != "" {
+		account += ", BIC " + details.BIC
+	}
+	return model.Message(locale, "order.banktransfer", details.Amount, details.Name, account, details.Reference)
+}
+
+// newReceipt returns the receipt of a saved order with the payment instructions of its payment method.
+func (server *Server) newReceipt(ctx context.Context, order *model.Order) *OrderReceipt {
+	receipt := OrderReceipt{Message: model.Message(order.Locale, "order.thanks", ToOrderId(order.ID)), OrderNumber: ToOrderId(order.ID), locale: order.Locale}
+	method := LookupPaymentMethod(order.Payment)
+	if method != nil && method.Instructions != nil {
+		err := method.Instructions(ctx, server, order, &receipt)
+		if err != nil {
+			logging.FromContext(ctx).Error("error while creating payment instructions", logging.Fields{"error": err, "order_number": ToOrderId(order.ID), "payment": order.Payment})
+		}
+	}
+	return &receipt
+}
+
+// sendConfirmation emails the receipt of an order to its customer in the background,
+// with the GiroCode attached for bank transfers.
+func (server *Server) sendConfirmation(ctx context.Context, order *model.Order, receipt *OrderReceipt) {
+	if server.CustomerEmailer == nil || order.Email == "" {
+		return
+	}
+	subject := model.Message(order.Locale, "confirmation.subject", receipt.OrderNumber)
+	details := strings.Replace(receipt.text(), "\n", "\r\n\r\n", -1)
+	var attachments []EmailAttachment
+	if receipt.BankTransfer != nil {
+		png, err := GiroCodePNG(receipt.BankTransfer.GiroCode)
+		if err != nil {
+			logging.FromContext(ctx).Error("error while creating GiroCode", logging.Fields{"error": err, "order_number": receipt.OrderNumber})
+		} else {
+			details += "\r\n\r\n" + model.Message(order.Locale, "confirmation.girocode")
+			attachments = append(attachments, EmailAttachment{Filename: "GiroCode-" + receipt.OrderNumber + ".png", ContentType: "image/png", Data: png})
+		}
+	}
+	body := model.Message(order.Locale, "confirmation.body", details, order.Amount, formatEuros(priceCents(order)))
+	to := []string{order.Email}
+	// The request context ends with the response, only its logger is kept.
+	logger := logging.FromContext(ctx).With(logging.Fields{"order_number": receipt.OrderNumber})
+	server.Go(func(stop <-chan struct{}) {
+		server.CustomerEmailer.SendEmailWithAttachments(logging.NewLoggerContext(context.Background(), logger), to, subject, body, attachments)
+	})
+}
@@ -0,0 +1,363 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/kunterbunt/calendarium-server/logging"
+	"github.com/kunterbunt/calendarium-server/model"
+)
+
+// Errors of ResolveOrderReview.
+var (
+	ErrUnknownOrder = errors.New("unknown order")
+	ErrNotFlagged   = errors.New("order is not flagged for review")
+)
+
+// Final actions of the dunning policy for orders that stay unpaid after all reminders.
+const (
+	DunningCancel = "cancel" // cancel the order and tell the customer
+	DunningReview = "review" // flag the order for manual review
+)
+
+// DunningPolicy says when unpaid orders are reminded of their payment.
+type DunningPolicy struct {
+	// ReminderDays after an order was placed at which the escalating reminders are sent, in ascending order.
+	ReminderDays []int
+	// FinalDays after an order was placed, an order that is still unpaid is handled by FinalAction. 0 disables this.
+	FinalDays   int
+	FinalAction string
+	// Payments lists the payment methods of the orders that are reminded, e.g. "banktransfer".
+	Payments []string
+}
+
+// Enabled reports whether the policy reminds or handles any orders.
+func (policy DunningPolicy) Enabled() bool {
+	return len(policy.Payments) > 0 && (len(policy.ReminderDays) > 0 || policy.FinalDays > 0)
+}
+
+// gracePeriod is how long a customer has to pay after the last reminder before the final action.
+func (policy DunningPolicy) gracePeriod() time.Duration {
+	days := policy.FinalDays
+	if len(policy.ReminderDays) > 0 {
+		days -= policy.ReminderDays[len(policy.ReminderDays)-1]
+	}
+	return time.Duration(days) * 24 * time.Hour
+}
+
+// DunningReminder is a payment reminder sent for an order.
+type DunningReminder struct {
+	OrderNumber string `json:"order_number"`
+	Level       int    `json:"level"`
+}
+
+// DunningReport lists the orders handled by one run of the dunning policy.
+type DunningReport struct {
+	DryRun    bool              `json:"dry_run"`
+	Date      string            `json:"date"`
+	Reminded  []DunningReminder `json:"reminded"`
+	Cancelled []string          `json:"cancelled"`
+	Review    []string          `json:"review"`
+	// Failed lists the orders whose reminder could not be sent, they are retried in the next run.
+	Failed []string `json:"failed"`
+}
+
+// Changes counts the handled orders.
+func (report *DunningReport) Changes() int {
+	return len(report.Reminded) + len(report.Cancelled) + len(report.Review)
+}
+
+// ApplyDunning sends the due payment reminders of unpaid orders and cancels or flags the orders that
+// are still unpaid after all reminders, according to the attached dunning policy. With dryRun, nothing
+// is sent or changed.
+func (server *Server) ApplyDunning(ctx context.Context, now time.Time, dryRun bool) (*DunningReport, error) {
+	policy := server.DunningPolicy
+	report := DunningReport{DryRun: dryRun, Date: now.UTC().Format(time.RFC3339), Reminded: make([]DunningReminder, 0), Cancelled: make([]string, 0), Review: make([]string, 0), Failed: make([]string, 0)}
+	if !policy.Enabled() {
+		return &report, nil
+	}
+	if server.CustomerEmailer == nil && !dryRun {
+		return &report, errors.New("payment reminders need customer emails to be enabled")
+	}
+	logger := logging.FromContext(ctx)
+	first := policy.FinalDays
+	if len(policy.ReminderDays) > 0 {
+		first = policy.ReminderDays[0]
+	}
+	orders, err := model.GetUnpaidOrders(server.Db, now.AddDate(0, 0, -first).Format(time.RFC3339), policy.Payments, &server.Mutex)
+	if err != nil {
+		return &report, err
+	}
+	date := now.UTC().Format(time.RFC3339)
+	for _, order := range orders {
+		order := order
+		orderNumber := ToOrderId(order.ID)
+		placed, err := time.Parse(time.RFC3339, order.Date)
+		if err != nil {
+			logger.Warn("skipping order with invalid date", logging.Fields{"order_number": orderNumber, "error": err})
+			continue
+		}
+		level := 0
+		for _, days := range policy.ReminderDays {
+			if !now.Before(placed.AddDate(0, 0, days)) {
+				level++
+			}
+		}
+
+		// Orders whose review was resolved were handled by hand and are only reminded.
+		resolved := order.ReviewResolvedAt != ""
+		final := !resolved && policy.FinalDays > 0 && !now.Before(placed.AddDate(0, 0, policy.FinalDays)) && order.ReminderLevel >= len(policy.ReminderDays)
+		if final && order.RemindedAt != "" {
+			// Reminders that were sent late still give the customer the full grace period.
+			remindedAt, err := time.Parse(time.RFC3339, order.RemindedAt)
+			final = err != nil || !now.Before(remindedAt.Add(policy.gracePeriod()))
+		}
+		switch {
+		case final && policy.FinalAction == DunningCancel && order.Email != "":
+			if !dryRun {
+				cancelled := false
+				var forwardedTo []string
+				err = model.Transaction(server.Db, &server.Mutex, func(tx model.Queryer) error {
+					var err error
+					cancelled, err = model.CancelOrder(tx, order.ID, date, nil)
+					if err != nil || !cancelled {
+						return err
+					}
+					// The sinks cannot be told, whoever fulfills the order there has to cancel it by hand.
+					forwardedTo, err = forwardedSinks(tx, order.ID)
+					if err != nil {
+						return err
+					}
+					if len(forwardedTo) > 0 {
+						err = model.FlagOrderForReview(tx, order.ID, "cancelled after forwarding to "+strings.Join(forwardedTo, ", "), nil)
+						if err != nil {
+							return err
+						}
+					}
+					return server.auditOrder(ctx, tx, "order.cancel", &order)
+				})
+				if err != nil {
+					return &report, err
+				}
+				if !cancelled {
+					continue
+				}
+				if len(forwardedTo) > 0 {
+					logger.Warn("cancelled order must be cancelled in its sinks", logging.Fields{"order_number": orderNumber, "sinks": forwardedTo})
+					report.Review = append(report.Review, orderNumber)
+				}
+				subject := model.Message(order.Locale, "cancellation.subject", orderNumber)
+				body := model.Message(order.Locale, "cancellation.body", orderNumber, formatDate(order.Locale, placed))
+				// The order is cancelled either way, the customer would only get the notice once.
+				err = server.CustomerEmailer.SendEmail(logging.NewLoggerContext(ctx, logger.With(logging.Fields{"order_number": orderNumber})), []string{order.Email}, subject, body)
+				if err != nil {
+					logger.Error("error while sending cancellation", logging.Fields{"order_number": orderNumber, "error": err})
+				}
+			}
+			report.Cancelled = append(report.Cancelled, orderNumber)
+
+		case final || (level > order.ReminderLevel && order.Email == "" && !resolved):
+			reason := fmt.Sprintf("unpaid after %d reminders", order.ReminderLevel)
+			if order.Email == "" {
+				reason = "unpaid and no email address for reminders"
+			}
+			if !dryRun {
+				err = model.Transaction(server.Db, &server.Mutex, func(tx model.Queryer) error {
+					err := model.FlagOrderForReview(tx, order.ID, reason, nil)
+					if err != nil {
+						return err
+					}
+					return server.auditOrder(ctx, tx, "order.review", &order)
+				})
+				if err != nil {
+					return &report, err
+				}
+			}
+			report.Review = append(report.Review, orderNumber)
+
+		case level > order.ReminderLevel && order.Email != "":
+			// Reminders that are overdue at once, e.g. after a downtime, are sent as one of the highest level.
+			if !dryRun {
+				err = server.sendReminder(ctx, &order, placed, level, now)
+				if err != nil {
+					report.Failed = append(report.Failed, orderNumber)
+					continue
+				}
+				err = model.Transaction(server.Db, &server.Mutex, func(tx model.Queryer) error {
+					err := model.SetOrderReminder(tx, order.ID, level, date, nil)
+					if err != nil {
+						return err
+					}
+					return server.auditOrder(ctx, tx, "order.reminder", &order)
+				})
+				if err != nil {
+					return &report, err
+				}
+			}
+			report.Reminded = append(report.Reminded, DunningReminder{orderNumber, level})
+		}
+	}
+	logger.Info("applied dunning policy", logging.Fields{"dry_run": dryRun, "reminded": len(report.Reminded), "cancelled": report.Cancelled, "review": report.Review, "failed": report.Failed})
+	return &report, nil
+}
+
+// forwardedSinks returns the names of the sinks that an order was forwarded to successfully.
+func forwardedSinks(db model.Queryer, orderID int64) ([]string, error) {
+	forwards, err := model.GetOrderForwards(db, orderID, nil)
+	if err != nil {
+		return nil, err
+	}
+	var sinks []string
+	for _, forward := range forwards {
+		if forward.Success && !contains(sinks, forward.Sink) {
+			sinks = append(sinks, forward.Sink)
+		}
+	}
+	return sinks, nil
+}
+
+// markOrderPaid marks an order paid within a transaction and audits it. It returns false if the order was already
+// paid. Orders cancelled meanwhile are flagged for review, since the customer has to be refunded or the
+// cancellation lifted.
+func (server *Server) markOrderPaid(ctx context.Context, tx model.Queryer, order *model.Order, paidAt string, reference string) (bool, error) {
+	marked, err := model.MarkOrderPaid(tx, order.ID, paidAt, reference, nil)
+	if err != nil || !marked {
+		return marked, err
+	}
+	current, err := model.GetOrder(tx, order.ID, nil)
+	if err != nil {
+		return true, err
+	}
+	if current.CancelledAt != "" {
+		logging.FromContext(ctx).Warn("cancelled order was paid", logging.Fields{"order_number": ToOrderId(order.ID), "cancelled_at": current.CancelledAt})
+		err = model.FlagOrderForReview(tx, order.ID, "paid after cancellation on "+current.CancelledAt, nil)
+		if err != nil {
+			return true, err
+		}
+	}
+	return true, server.auditOrder(ctx, tx, "order.paid", order)
+}
+
+// ResolveOrderReview clears the review flag of an order once it was handled by hand.
+// It returns ErrNotFlagged if the order was not flagged.
+func (server *Server) ResolveOrderReview(ctx context.Context, id int64) (*model.Order, error) {
+	order, err := model.GetOrder(server.Db, id, &server.Mutex)
+	if err != nil {
+		return nil, err
+	}
+	if order.ID == int64(model.InvalidID) {
+		return nil, ErrUnknownOrder
+	}
+	err = model.Transaction(server.Db, &server.Mutex, func(tx model.Queryer) error {
+		cleared, err := model.ClearOrderReview(tx, id, time.Now().UTC().Format(time.RFC3339), nil)
+		if err != nil {
+			return err
+		}
+		if !cleared {
+			return ErrNotFlagged
+		}
+		return server.auditOrder(ctx, tx, "order.review_resolve", order)
+	})
+	if err != nil {
+		return nil, err
+	}
+	logging.FromContext(ctx).Info("resolved order review", logging.Fields{"order_number": ToOrderId(id), "reason": order.ReviewReason})
+	return model.GetOrder(server.Db, id, &server.Mutex)
+}
+
+// resolveOrderReview clears the review flag of the order with the ID in the path.
+func (server *Server) resolveOrderReview(writer http.ResponseWriter, request *http.Request) {
+	logger := logging.FromContext(request.Context())
+	logger.Debug("resolveOrderReview API call")
+	id, err := strconv.ParseInt(mux.Vars(request)["id"], 10, 64)
+	if err != nil {
+		writeError(writer, http.StatusBadRequest, ErrorInvalidRequest, "invalid order ID")
+		return
+	}
+	_, err = server.ResolveOrderReview(request.Context(), id)
+	if err == ErrUnknownOrder {
+		writeError(writer, http.StatusNotFound, ErrorNotFound, "order not found")
+		return
+	}
+	if err == ErrNotFlagged {
+		writeError(writer, http.StatusConflict, ErrorConflict, ToOrderId(id)+" is not flagged for review")
+		return
+	}
+	if err != nil {
+		logger.Error("resolveOrderReview failed", logging.Fields{"error": err})
+		writeError(writer, http.StatusInternalServerError, ErrorInternal, err.Error())
+		return
+	}
+	writer.WriteHeader(http.StatusOK)
+	_, err = writer.Write([]byte(ToOrderId(id) + " resolved."))
+	if err != nil {
+		panic(err)
+	}
+}
+
+// sendReminder emails the payment reminder of the given level for an order, with the payment instructions.
+// The last reminder tells the customer when the order is cancelled.
+func (server *Server) sendReminder(ctx context.Context, order *model.Order, placed time.Time, level int, now time.Time) error {
+	policy := server.DunningPolicy
+	orderNumber := ToOrderId(order.ID)
+	logger := logging.FromContext(ctx).With(logging.Fields{"order_number": orderNumber})
+	key := "again"
+	switch {
+	case level == len(policy.ReminderDays) && policy.FinalDays > 0:
+		key = "last"
+	case level == 1:
+		key = "first"
+	}
+	instructions := model.Message(order.Locale, "reminder.reference", orderNumber)
+	var attachments []EmailAttachment
+	if server.BankAccount != nil {
+		details, err := server.bankTransferDetails(order)
+		if err != nil {
+			logger.Error("error while creating GiroCode", logging.Fields{"error": err})
+		} else {
+			instructions = details.text(order.Locale)
+			png, err := GiroCodePNG(details.GiroCode)
+			if err == nil {
+				instructions += "\r\n\r\n" + model.Message(order.Locale, "confirmation.girocode")
+				attachments = append(attachments, EmailAttachment{Filename: "GiroCode-" + orderNumber + ".png", ContentType: "image/png", Data: png})
+			}
+		}
+	}
+	if key == "last" && policy.FinalAction == DunningCancel {
+		instructions += "\r\n\r\n" + model.Message(order.Locale, "reminder.cancel_notice", formatDate(order.Locale, now.Add(policy.gracePeriod())))
+	}
+	subject := model.Message(order.Locale, "reminder.subject."+key, orderNumber)
+	body := model.Message(order.Locale, "reminder.body."+key, orderNumber, formatDate(order.Locale, placed), formatEuros(priceCents(order)), instructions)
+	return server.CustomerEmailer.SendEmailWithAttachments(logging.NewLoggerContext(ctx, logger), []string{order.Email}, subject, body, attachments)
+}
+
+// formatDate formats a date as customary in a locale.
+func formatDate(locale string, date time.Time) string {
+	return date.Format(model.Message(locale, "date.format"))
+}
+
+// ScheduleDunning applies the dunning policy now and then every interval until the server shuts down.
+func (server *Server) ScheduleDunning(interval time.Duration) {
+	logging.Info("scheduled payment reminders", logging.Fields{"interval": interval.String()})
+	server.Go(func(stop <-chan struct{}) {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			_, err := server.ApplyDunning(WithActor(context.Background(), "dunning"), time.Now(), false)
+			if err != nil {
+				logging.Error("payment reminders failed", logging.Fields{"error": err})
+			}
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+		}
+	})
+}
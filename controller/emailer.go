@@ -1,8 +1,19 @@
 package controller
 
 import (
+	"bytes"
+	"context"
+	"encoding/base64"
 	"fmt"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
 	"net/smtp"
+	"net/textproto"
+	"strings"
+	"time"
+
+	"github.com/kunterbunt/calendarium-server/logging"
 )
 
 type Emailer struct {
@@ -10,6 +21,7 @@ type Emailer struct {
 	emailPassword	string
 	smtpHost		string
 	smtpPort		string
+	metrics		*Metrics
 }
 
 func NewEmailer(emailAddr string, emailPassword string, smtpHost string, smtpPort string) *Emailer {
@@ -21,16 +33,107 @@ func NewEmailer(emailAddr string, emailPassword string, smtpHost string, smtpPor
 	return &emailer
 }
 
-func (emailer *Emailer) SendEmail(destEmail []string, subject string, message string) error {
-	auth := smtp.PlainAuth("", emailer.emailAddr, emailer.emailPassword, emailer.smtpHost)
+// EmailAttachment is a file attached to an email.
+type EmailAttachment struct {
+	Filename    string
+	ContentType string
+	Data        []byte
+}
 
-	fromStr := fmt.Sprintf("From: <%s>\r\n", "hallo@calendariumculinarium.de")
-	toStr := fmt.Sprintf("To: <%s>\r\n", "sebastian@slowfoodyouthh.de")
-	subjectStr := "Subject: " + subject + "\r\n"
-	body := message + "\r\n"
+func (emailer *Emailer) SendEmail(ctx context.Context, destEmail []string, subject string, message string) error {
+	return emailer.SendEmailWithAttachments(ctx, destEmail, subject, message, nil)
+}
+
+// SendEmailWithAttachments sends a plain text email with attached files.
+func (emailer *Emailer) SendEmailWithAttachments(ctx context.Context, destEmail []string, subject string, message string, attachments []EmailAttachment) error {
+	auth := smtp.PlainAuth("", emailer.emailAddr, emailer.emailPassword, emailer.smtpHost)
 
-	msg := []byte(fromStr+toStr+subjectStr+"\r\n"+body)
+	// The From header must be the authenticated address, or servers reject the email as spoofed.
+	msg, err := composeEmail(emailer.emailAddr, destEmail, subject, message, attachments)
+	if err != nil {
+		return err
+	}
 
-	err := smtp.SendMail(emailer.smtpHost + ":" + emailer.smtpPort, auth, emailer.emailAddr, destEmail, msg)
+	err = smtp.SendMail(emailer.smtpHost + ":" + emailer.smtpPort, auth, emailer.emailAddr, destEmail, msg)
+	emailer.metrics.EmailSent(err)
+	if err != nil {
+		logging.FromContext(ctx).Error("error sending email", logging.Fields{"subject": subject, "error": err})
+	} else {
+		logging.FromContext(ctx).Info("sent email", logging.Fields{"subject": subject, "recipients": len(destEmail), "attachments": len(attachments)})
+	}
 	return err
 }
+
+// composeEmail builds a UTF-8 encoded MIME message. Attachments make it multipart/mixed.
+func composeEmail(from string, to []string, subject string, message string, attachments []EmailAttachment) ([]byte, error) {
+	var buffer bytes.Buffer
+	recipients := make([]string, len(to))
+	for i, address := range to {
+		recipients[i] = "<" + address + ">"
+	}
+	fmt.Fprintf(&buffer, "From: <%s>\r\n", from)
+	fmt.Fprintf(&buffer, "To: %s\r\n", strings.Join(recipients, ", "))
+	fmt.Fprintf(&buffer, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&buffer, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	buffer.WriteString("MIME-Version: 1.0\r\n")
+
+	writeText := func(header func(key string, value string)) ([]byte, error) {
+		var text bytes.Buffer
+		encoder := quotedprintable.NewWriter(&text)
+		_, err := encoder.Write([]byte(message + "\r\n"))
+		if err == nil {
+			err = encoder.Close()
+		}
+		header("Content-Type", "text/plain; charset=utf-8")
+		header("Content-Transfer-Encoding", "quoted-printable")
+		return text.Bytes(), err
+	}
+
+	if len(attachments) == 0 {
+		text, err := writeText(func(key string, value string) {
+			fmt.Fprintf(&buffer, "%s: %s\r\n", key, value)
+		})
+		if err != nil {
+			return nil, err
+		}
+		buffer.WriteString("\r\n")
+		buffer.Write(text)
+		return buffer.Bytes(), nil
+	}
+
+	var body bytes.Buffer
+	parts := multipart.NewWriter(&body)
+	fmt.Fprintf(&buffer, "Content-Type: multipart/mixed; boundary=%s\r\n\r\n", parts.Boundary())
+	textHeader := make(textproto.MIMEHeader)
+	text, err := writeText(textHeader.Set)
+	if err != nil {
+		return nil, err
+	}
+	part, err := parts.CreatePart(textHeader)
+	if err != nil {
+		return nil, err
+	}
+	part.Write(text)
+	for _, attachment := range attachments {
+		header := make(textproto.MIMEHeader)
+		header.Set("Content-Type", attachment.ContentType)
+		header.Set("Content-Transfer-Encoding", "base64")
+		header.Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": attachment.Filename}))
+		part, err = parts.CreatePart(header)
+		if err != nil {
+			return nil, err
+		}
+		encoded := base64.StdEncoding.EncodeToString(attachment.Data)
+		for len(encoded) > 76 {
+			part.Write([]byte(encoded[:76] + "\r\n"))
+			encoded = encoded[76:]
+		}
+		part.Write([]byte(encoded + "\r\n"))
+	}
+	err = parts.Close()
+	if err != nil {
+		return nil, err
+	}
+	buffer.Write(body.Bytes())
+	return buffer.Bytes(), nil
+}
@@ -0,0 +1,243 @@
+package controller
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/kunterbunt/calendarium-server/logging"
+	"github.com/kunterbunt/calendarium-server/model"
+)
+
+// DefaultRetentionYears is how long orders are kept for accounting (§ 147 AO, § 257 HGB).
+const DefaultRetentionYears = 10
+
+// OrderExport is an order together with its order number, forwards and bank payments.
+type OrderExport struct {
+	model.Order
+	OrderNumber  string               `json:"order_number"`
+	Forwards     []model.OrderForward `json:"forwards"`
+	BankPayments []model.BankPayment  `json:"bank_payments"`
+}
+
+// UzOrderExport is an Unterstützer order together with its order number.
+type UzOrderExport struct {
+	model.UzOrder
+	OrderNumber string `json:"order_number"`
+}
+
+// DataExport holds every record stored about an email address.
+type DataExport struct {
+	Email      string          `json:"email" log:"redact"`
+	ExportedAt string          `json:"exported_at"`
+	Orders     []OrderExport   `json:"orders"`
+	UzOrders   []UzOrderExport `json:"uz_orders"`
+}
+
+// RetainedOrder is an order whose personal data must be kept until the end of its retention period.
+type RetainedOrder struct {
+	OrderNumber   string `json:"order_number"`
+	RetainedUntil string `json:"retained_until"`
+}
+
+// ErasureResult reports which orders of an email address were pseudonymized and which are still retained.
+type ErasureResult struct {
+	Email    string          `json:"email" log:"redact"`
+	DryRun   bool            `json:"dry_run"`
+	Erased   []string        `json:"erased"`
+	Retained []RetainedOrder `json:"retained"`
+}
+
+// erasureRequest is the body of POST /api/admin/gdpr/erase.
+type erasureRequest struct {
+	Email  string `json:"email"`
+	DryRun bool   `json:"dry_run"`
+}
+
+// ExportPersonalData collects every order, Unterstützer order, forward and bank payment stored for an email address.
+func (server *Server) ExportPersonalData(email string, now time.Time) (*DataExport, error) {
+	export := DataExport{Email: email, ExportedAt: now.UTC().Format(time.RFC3339), Orders: make([]OrderExport, 0), UzOrders: make([]UzOrderExport, 0)}
+	orders, err := model.GetOrdersByEmail(server.Db, email, &server.Mutex)
+	if err != nil {
+		return nil, err
+	}
+	for _, order := range orders {
+		forwards, err := model.GetOrderForwards(server.Db, order.ID, &server.Mutex)
+		if err != nil {
+			return nil, err
+		}
+		payments, err := model.GetBankPaymentsOfOrder(server.Db, order.ID, &server.Mutex)
+		if err != nil {
+			return nil, err
+		}
+		export.Orders = append(export.Orders, OrderExport{Order: order, OrderNumber: ToOrderId(order.ID), Forwards: forwards, BankPayments: payments})
+	}
+	uzOrders, err := model.GetUzOrdersByEmail(server.Db, email, &server.Mutex)
+	if err != nil {
+		return nil, err
+	}
+	for _, order := range uzOrders {
+		export.UzOrders = append(export.UzOrders, UzOrderExport{UzOrder: order, OrderNumber: ToUzOrderId(order.ID)})
+	}
+	return &export, nil
+}
+
+// RetentionEnd returns when the retention period of an order placed at date ends:
+// at the end of the calendar year of the order plus the retention years.
+func (server *Server) RetentionEnd(date string) (time.Time, error) {
+	placed, err := time.Parse(time.RFC3339, date)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Date(placed.Year()+1+server.RetentionYears, time.January, 1, 0, 0, 0, 0, time.UTC), nil
+}
+
+// newPseudonym returns a random name that replaces the names of a data subject.
+func newPseudonym() (string, error) {
+	random := make([]byte, 4)
+	_, err := rand.Read(random)
+	if err != nil {
+		return "", err
+	}
+	return "erased-" + hex.EncodeToString(random), nil
+}
+
+// ErasePersonalData pseudonymizes the orders of an email address whose retention period ended.
+// Amounts, dates, payment, countries and order numbers are kept, all other personal fields are replaced,
+// also those of the bank payments of the orders.
+// With dryRun, nothing is changed.
+func (server *Server) ErasePersonalData(ctx context.Context, email string, now time.Time, dryRun bool) (*ErasureResult, error) {
+	result := ErasureResult{Email: email, DryRun: dryRun, Erased: make([]string, 0), Retained: make([]RetainedOrder, 0)}
+	pseudonym, err := newPseudonym()
+	if err != nil {
+		return nil, err
+	}
+	erasedAt := now.UTC().Format(time.RFC3339)
+
+	orders, err := model.GetOrdersByEmail(server.Db, email, &server.Mutex)
+	if err != nil {
+		return nil, err
+	}
+	for _, order := range orders {
+		if order.ErasedAt != "" {
+			continue
+		}
+		retainedUntil, err := server.RetentionEnd(order.Date)
+		if err != nil {
+			return nil, err
+		}
+		if now.Before(retainedUntil) {
+			result.Retained = append(result.Retained, RetainedOrder{ToOrderId(order.ID), retainedUntil.Format("2006-01-02")})
+			continue
+		}
+		if !dryRun {
+			err = model.Transaction(server.Db, &server.Mutex, func(tx model.Queryer) error {
+				err := model.PseudonymizeOrder(tx, order.ID, pseudonym, erasedAt, nil)
+				if err != nil {
+					return err
+				}
+				return server.auditOrder(ctx, tx, "order.erase", &order)
+			})
+			if err != nil {
+				return nil, err
+			}
+		}
+		result.Erased = append(result.Erased, ToOrderId(order.ID))
+	}
+
+	uzOrders, err := model.GetUzOrdersByEmail(server.Db, email, &server.Mutex)
+	if err != nil {
+		return nil, err
+	}
+	for _, order := range uzOrders {
+		if order.ErasedAt != "" {
+			continue
+		}
+		retainedUntil, err := server.RetentionEnd(order.Date)
+		if err != nil {
+			return nil, err
+		}
+		if now.Before(retainedUntil) {
+			result.Retained = append(result.Retained, RetainedOrder{ToUzOrderId(order.ID), retainedUntil.Format("2006-01-02")})
+			continue
+		}
+		if !dryRun {
+			err = model.Transaction(server.Db, &server.Mutex, func(tx model.Queryer) error {
+				err := model.PseudonymizeUzOrder(tx, order.ID, pseudonym, erasedAt, nil)
+				if err != nil {
+					return err
+				}
+				return server.auditUzOrder(ctx, tx, "uz_order.erase", &order)
+			})
+			if err != nil {
+				return nil, err
+			}
+		}
+		result.Erased = append(result.Erased, ToUzOrderId(order.ID))
+	}
+
+	logging.FromContext(ctx).Info("erased personal data", logging.Fields{"dry_run": dryRun, "erased": result.Erased, "retained": len(result.Retained)})
+	return &result, nil
+}
+
+// exportPersonalData answers an access request for the email address given as query parameter.
+func (server *Server) exportPersonalData(writer http.ResponseWriter, request *http.Request) {
+	logger := logging.FromContext(request.Context())
+	logger.Debug("exportPersonalData API call")
+	email := strings.TrimSpace(request.URL.Query().Get("email"))
+	if email == "" {
+		writeError(writer, http.StatusBadRequest, ErrorInvalidRequest, "email is required")
+		return
+	}
+	export, err := server.ExportPersonalData(email, time.Now())
+	if err != nil {
+		logger.Error("exportPersonalData failed", logging.Fields{"error": err})
+		writeError(writer, http.StatusInternalServerError, ErrorInternal, err.Error())
+		return
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	writer.Header().Set("Cache-Control", "no-store")
+	err = json.NewEncoder(writer).Encode(export)
+	if err != nil {
+		logger.Error("exportPersonalData failed", logging.Fields{"error": err})
+		writeError(writer, http.StatusInternalServerError, ErrorInternal, err.Error())
+		return
+	}
+	logger.Info("exported personal data", logging.Fields{"orders": len(export.Orders), "uz_orders": len(export.UzOrders)})
+}
+
+// erasePersonalData answers a deletion request.
+func (server *Server) erasePersonalData(writer http.ResponseWriter, request *http.Request) {
+	logger := logging.FromContext(request.Context())
+	logger.Debug("erasePersonalData API call")
+	var body erasureRequest
+	err := json.NewDecoder(request.Body).Decode(&body)
+	if err != nil {
+		writeError(writer, http.StatusBadRequest, ErrorInvalidRequest, "invalid JSON: "+err.Error())
+		return
+	}
+	body.Email = strings.TrimSpace(body.Email)
+	if body.Email == "" {
+		writeError(writer, http.StatusBadRequest, ErrorInvalidRequest, "email is required")
+		return
+	}
+	result, err := server.ErasePersonalData(request.Context(), body.Email, time.Now(), body.DryRun)
+	if err != nil {
+		logger.Error("erasePersonalData failed", logging.Fields{"error": err})
+		writeError(writer, http.StatusInternalServerError, ErrorInternal, err.Error())
+		return
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	writer.Header().Set("Cache-Control", "no-store")
+	err = json.NewEncoder(writer).Encode(result)
+	if err != nil {
+		logger.Error("erasePersonalData failed", logging.Fields{"error": err})
+		writeError(writer, http.StatusInternalServerError, ErrorInternal, err.Error())
+		return
+	}
+	logger.Debug("sent reply")
+}
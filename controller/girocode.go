@@ -0,0 +1,148 @@
+package controller
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/kunterbunt/calendarium-server/model"
+	qrcode "github.com/skip2/go-qrcode"
+)
+
+// GiroCodeSize is the width and height in pixels of GiroCode PNGs.
+const GiroCodeSize = 256
+
+// BankAccount is the account that customers transfer their payments to.
+type BankAccount struct {
+	Name string
+	IBAN string
+	BIC  string // optional within the EEA
+}
+
+// BankTransferDetails tell customers how to pay an order by bank transfer.
+type BankTransferDetails struct {
+	Name      string `json:"name"`
+	IBAN      string `json:"iban"`
+	BIC       string `json:"bic,omitempty"`
+	Amount    string `json:"amount"` // e.g. "54.00"
+	Currency  string `json:"currency"`
+	Reference string `json:"reference"`
+	// GiroCode is the EPC069-12 payload, GiroCodePNG a data URL of its QR code and GiroCodeSVG the markup of its QR code.
+	// Saved receipts only keep the payload, see renderGiroCode.
+	GiroCode    string `json:"giro_code"`
+	GiroCodePNG string `json:"giro_code_png,omitempty"`
+	GiroCodeSVG string `json:"giro_code_svg,omitempty"`
+}
+
+// renderGiroCode renders the QR codes of the GiroCode payload.
+func (details *BankTransferDetails) renderGiroCode() error {
+	png, err := GiroCodePNG(details.GiroCode)
+	if err != nil {
+		return err
+	}
+	svg, err := GiroCodeSVG(details.GiroCode)
+	if err != nil {
+		return err
+	}
+	details.GiroCodePNG = "data:image/png;base64," + base64.StdEncoding.EncodeToString(png)
+	details.GiroCodeSVG = svg
+	return nil
+}
+
+// formatEuros formats an amount in cents like "54.00".
+func formatEuros(cents int64) string {
+	return fmt.Sprintf("%d.%02d", cents/100, cents%100)
+}
+
+// EPCPayload returns the content of a GiroCode (EPC QR code) for a SEPA credit transfer, see EPC069-12 version 002.
+func EPCPayload(account BankAccount, amountCents int64, reference string) (string, error) {
+	if account.Name == "" || utf8.RuneCountInString(account.Name) > 70 {
+		return "", errors.New("the GiroCode needs a payee name of at most 70 characters")
+	}
+	iban := strings.ToUpper(strings.Replace(account.IBAN, " ", "", -1))
+	if iban == "" || len(iban) > 34 {
+		return "", errors.New("the GiroCode needs an IBAN of at most 34 characters")
+	}
+	if amountCents < 1 || amountCents > 99999999999 {
+		return "", errors.New("the GiroCode amount must be between 0.01 and 999999999.99 EUR")
+	}
+	if utf8.RuneCountInString(reference) > 140 {
+		return "", errors.New("the GiroCode reference must be at most 140 characters long")
+	}
+	lines := []string{
+		"BCD", // service tag
+		"002", // version
+		"1",   // UTF-8
+		"SCT", // SEPA credit transfer
+		account.BIC,
+		account.Name,
+		iban,
+		"EUR" + formatEuros(amountCents),
+		"", // purpose
+		"", // structured creditor reference, exclusive with the unstructured one
+		reference,
+	}
+	return strings.Join(lines, "\n"), nil
+}
+
+// GiroCodePNG renders a GiroCode as PNG. EPC069-12 demands error correction level M.
+func GiroCodePNG(payload string) ([]byte, error) {
+	code, err := qrcode.New(payload, qrcode.Medium)
+	if err != nil {
+		return nil, err
+	}
+	return code.PNG(GiroCodeSize)
+}
+
+// GiroCodeSVG renders a GiroCode as SVG, one unit per module.
+func GiroCodeSVG(payload string) (string, error) {
+	code, err := qrcode.New(payload, qrcode.Medium)
+	if err != nil {
+		return "", err
+	}
+	bitmap := code.Bitmap() // including the quiet zone
+	var path strings.Builder
+	for y, row := range bitmap {
+		for x, dark := range row {
+			if dark {
+				fmt.Fprintf(&path, "M%d %dh1v1h-1z", x, y)
+			}
+		}
+	}
+	size := len(bitmap)
+	return fmt.Sprintf(`<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 %d %d" shape-rendering="crispEdges">`+
+		`<rect width="%d" height="%d" fill="#fff"/><path fill="#000" d="%s"/></svg>`, size, size, size, size, path.String()), nil
+}
+
+// AttachBankAccount includes the details and the GiroCode of the bank account in the receipts and
+// confirmation emails of orders paid by bank transfer.
+func (server *Server) AttachBankAccount(account BankAccount) {
+	server.BankAccount = &account
+}
+
+// bankTransferDetails returns how to pay an order by bank transfer to the attached bank account.
+func (server *Server) bankTransferDetails(order *model.Order) (*BankTransferDetails, error) {
+	account := *server.BankAccount
+	amount := priceCents(order)
+	reference := ToOrderId(order.ID)
+	payload, err := EPCPayload(account, amount, reference)
+	if err != nil {
+		return nil, err
+	}
+	details := BankTransferDetails{
+		Name:      account.Name,
+		IBAN:      account.IBAN,
+		BIC:       account.BIC,
+		Amount:    formatEuros(amount),
+		Currency:  "EUR",
+		Reference: reference,
+		GiroCode:  payload,
+	}
+	err = details.renderGiroCode()
+	if err != nil {
+		return nil, err
+	}
+	return &details, nil
+}
@@ -0,0 +1,136 @@
+package controller
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/kunterbunt/calendarium-server/logging"
+	"github.com/kunterbunt/calendarium-server/model"
+)
+
+// Statuses of health checks.
+const (
+	StatusOK       = "ok"
+	StatusDegraded = "degraded"
+)
+
+// HealthCheck is the result of a single readiness check.
+type HealthCheck struct {
+	Status  string      `json:"status"`
+	Message string      `json:"message,omitempty"`
+	Details interface{} `json:"details,omitempty"`
+}
+
+// Readiness is the JSON document returned by /readyz.
+type Readiness struct {
+	Status string                 `json:"status"`
+	Checks map[string]HealthCheck `json:"checks,omitempty"`
+}
+
+// forwardingDetails reports the state of one order sink.
+type forwardingDetails struct {
+	model.ForwardStatus
+	LastSuccessAgeSeconds *int64 `json:"last_success_age_seconds,omitempty"`
+}
+
+// getHealth answers as long as the process is alive.
+func (server *Server) getHealth(writer http.ResponseWriter, request *http.Request) {
+	writer.Header().Set("Content-Type", "application/json")
+	writer.Header().Set("Cache-Control", "no-store")
+	_, err := writer.Write([]byte(`{"status":"ok"}` + "\n"))
+	if err != nil {
+		logging.FromContext(request.Context()).Warn("getHealth failed", logging.Fields{"error": err})
+	}
+}
+
+// Ready runs the readiness checks: the database answers, migrations are current and orders are being forwarded.
+func (server *Server) Ready(now time.Time) Readiness {
+	readiness := Readiness{Status: StatusOK, Checks: make(map[string]HealthCheck)}
+	check := func(name string, result HealthCheck) {
+		readiness.Checks[name] = result
+		if result.Status != StatusOK {
+			readiness.Status = StatusDegraded
+		}
+	}
+
+	err := model.Ping(server.Db, &server.Mutex)
+	if err != nil {
+		check("database", HealthCheck{Status: StatusDegraded, Message: err.Error()})
+		return readiness
+	}
+	check("database", HealthCheck{Status: StatusOK})
+
+	pending, err := model.PendingMigrations(server.Db, &server.Mutex)
+	if err != nil {
+		check("migrations", HealthCheck{Status: StatusDegraded, Message: err.Error()})
+	} else if len(pending) > 0 {
+		check("migrations", HealthCheck{Status: StatusDegraded, Message: strconv.Itoa(len(pending)) + " pending migrations"})
+	} else {
+		check("migrations", HealthCheck{Status: StatusOK})
+	}
+
+	if len(server.Sinks) == 0 {
+		return readiness
+	}
+	forwarding := HealthCheck{Status: StatusOK}
+	sinks := make([]forwardingDetails, 0, len(server.Sinks))
+	for _, sink := range server.Sinks {
+		status, err := model.GetForwardStatus(server.Db, sink.Name(), &server.Mutex)
+		if err != nil {
+			forwarding = HealthCheck{Status: StatusDegraded, Message: err.Error()}
+			break
+		}
+		details := forwardingDetails{ForwardStatus: *status}
+		var age time.Duration
+		if lastSuccess, err := time.Parse(time.RFC3339, status.LastSuccess); err == nil {
+			age = now.Sub(lastSuccess)
+			seconds := int64(age.Seconds())
+			details.LastSuccessAgeSeconds = &seconds
+		}
+		if status.Backlog > server.MaxForwardBacklog {
+			forwarding.Status = StatusDegraded
+			forwarding.Message = sink.Name() + ": " + strconv.Itoa(status.Backlog) + " orders not forwarded"
+		} else if status.Backlog > 0 && server.MaxForwardSuccessAge > 0 {
+			if details.LastSuccessAgeSeconds == nil {
+				forwarding.Status = StatusDegraded
+				forwarding.Message = sink.Name() + ": no successful forward yet"
+			} else if age > server.MaxForwardSuccessAge {
+				forwarding.Status = StatusDegraded
+				forwarding.Message = sink.Name() + ": no successful forward for " + age.Round(time.Minute).String()
+			}
+		}
+		sinks = append(sinks, details)
+	}
+	forwarding.Details = sinks
+	check("forwarding", forwarding)
+	return readiness
+}
+
+// getReadiness answers with the overall readiness status, and 503 Service Unavailable if a check failed.
+// The checks reveal sink names and error messages, so only getReadinessDetails shows them to admins.
+func (server *Server) getReadiness(writer http.ResponseWriter, request *http.Request) {
+	readiness := server.Ready(time.Now())
+	server.writeReadiness(writer, request, readiness, Readiness{Status: readiness.Status})
+}
+
+// getReadinessDetails answers like getReadiness, with the result of every check.
+func (server *Server) getReadinessDetails(writer http.ResponseWriter, request *http.Request) {
+	readiness := server.Ready(time.Now())
+	server.writeReadiness(writer, request, readiness, readiness)
+}
+
+// writeReadiness sends the response of a readiness check and logs the full readiness if it is degraded.
+func (server *Server) writeReadiness(writer http.ResponseWriter, request *http.Request, readiness Readiness, response Readiness) {
+	writer.Header().Set("Content-Type", "application/json")
+	writer.Header().Set("Cache-Control", "no-store")
+	if readiness.Status != StatusOK {
+		logging.FromContext(request.Context()).Warn("readiness check degraded", logging.Fields{"readiness": readiness})
+		writer.WriteHeader(http.StatusServiceUnavailable)
+	}
+	err := json.NewEncoder(writer).Encode(response)
+	if err != nil {
+		logging.FromContext(request.Context()).Warn("getReadiness failed", logging.Fields{"error": err})
+	}
+}
@@ -0,0 +1,168 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/kunterbunt/calendarium-server/logging"
+)
+
+// ListenOptions configures where and how the HTTP server listens.
+type ListenOptions struct {
+	// Port is used unless a Unix socket or systemd socket activation is configured.
+	Port int
+	// UnixSocket is the path of a Unix domain socket to listen on.
+	UnixSocket string
+	// Systemd listens on the sockets passed by systemd socket activation.
+	Systemd bool
+	// TLSCert and TLSKey are the paths of the certificate and key files, TLS is off if they are empty.
+	TLSCert           string
+	TLSKey            string
+	ReadTimeout       time.Duration
+	ReadHeaderTimeout time.Duration
+	WriteTimeout      time.Duration
+	IdleTimeout       time.Duration
+	// ShutdownTimeout bounds how long in-flight requests and background workers may take after SIGTERM.
+	ShutdownTimeout time.Duration
+}
+
+// systemdListenFdsStart is the first file descriptor passed by systemd, see sd_listen_fds(3).
+const systemdListenFdsStart = 3
+
+// systemdListeners returns the sockets passed by systemd socket activation.
+func systemdListeners() ([]net.Listener, error) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, errors.New("no sockets passed by systemd (LISTEN_PID is not set to our PID)")
+	}
+	count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || count < 1 {
+		return nil, errors.New("no sockets passed by systemd (LISTEN_FDS is not set)")
+	}
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+	listeners := make([]net.Listener, 0, count)
+	for fd := systemdListenFdsStart; fd < systemdListenFdsStart+count; fd++ {
+		file := os.NewFile(uintptr(fd), "systemd-socket-"+strconv.Itoa(fd))
+		listener, err := net.FileListener(file)
+		file.Close()
+		if err != nil {
+			return nil, errors.New("invalid socket passed by systemd: " + err.Error())
+		}
+		listeners = append(listeners, listener)
+	}
+	return listeners, nil
+}
+
+// listen opens the listeners configured by options.
+func listen(options ListenOptions) ([]net.Listener, error) {
+	if options.Systemd {
+		return systemdListeners()
+	}
+	if options.UnixSocket != "" {
+		// Remove a socket left behind by a crash.
+		if info, err := os.Stat(options.UnixSocket); err == nil && info.Mode()&os.ModeSocket != 0 {
+			os.Remove(options.UnixSocket)
+		}
+		listener, err := net.Listen("unix", options.UnixSocket)
+		if err != nil {
+			return nil, err
+		}
+		return []net.Listener{listener}, nil
+	}
+	listener, err := net.Listen("tcp", ":"+strconv.Itoa(options.Port))
+	if err != nil {
+		return nil, err
+	}
+	return []net.Listener{listener}, nil
+}
+
+// Go runs a background worker that has to return once stop is closed.
+// The server waits for all workers when shutting down.
+func (server *Server) Go(worker func(stop <-chan struct{})) {
+	server.workers.Add(1)
+	go func() {
+		defer server.workers.Done()
+		worker(server.stop)
+	}()
+}
+
+// ListenAndServe serves the API until SIGTERM or SIGINT is received.
+// It then stops accepting connections, lets in-flight requests finish, stops the background workers and waits for them.
+func (server *Server) ListenAndServe(options ListenOptions) error {
+	if (options.TLSCert == "") != (options.TLSKey == "") {
+		return errors.New("both a TLS certificate and a key are needed")
+	}
+	listeners, err := listen(options)
+	if err != nil {
+		return err
+	}
+	httpServer := &http.Server{
+		Handler:           server.handler,
+		ErrorLog:          log.New(logging.Writer(logging.LevelWarn), "", 0),
+		ReadTimeout:       options.ReadTimeout,
+		ReadHeaderTimeout: options.ReadHeaderTimeout,
+		WriteTimeout:      options.WriteTimeout,
+		IdleTimeout:       options.IdleTimeout,
+	}
+	serveErrors := make(chan error, len(listeners))
+	for _, listener := range listeners {
+		logging.Info("listening", logging.Fields{"network": listener.Addr().Network(), "address": listener.Addr().String(), "tls": options.TLSCert != ""})
+		go func(listener net.Listener) {
+			if options.TLSCert != "" {
+				serveErrors <- httpServer.ServeTLS(listener, options.TLSCert, options.TLSKey)
+			} else {
+				serveErrors <- httpServer.Serve(listener)
+			}
+		}(listener)
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	defer signal.Stop(signals)
+	select {
+	case err = <-serveErrors:
+		logging.Error("server stopped", logging.Fields{"error": err})
+	case received := <-signals:
+		logging.Info("shutting down", logging.Fields{"signal": received.String()})
+	}
+
+	ctx := context.Background()
+	if options.ShutdownTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, options.ShutdownTimeout)
+		defer cancel()
+	}
+	shutdownErr := httpServer.Shutdown(ctx)
+	if shutdownErr != nil {
+		logging.Error("error while draining requests", logging.Fields{"error": shutdownErr})
+	}
+	close(server.stop)
+	workersDone := make(chan struct{})
+	go func() {
+		server.workers.Wait()
+		close(workersDone)
+	}()
+	select {
+	case <-workersDone:
+	case <-ctx.Done():
+		logging.Error("background workers did not stop in time")
+		if shutdownErr == nil {
+			shutdownErr = ctx.Err()
+		}
+	}
+	logging.Info("server shut down")
+	if err != nil && err != http.ErrServerClosed {
+		return err
+	}
+	return shutdownErr
+}
@@ -0,0 +1,242 @@
+package controller
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/kunterbunt/calendarium-server/logging"
+	"github.com/kunterbunt/calendarium-server/model"
+)
+
+// defaultBuckets are the upper bounds in seconds of latency histograms.
+var defaultBuckets = []float64{.001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// metricFamily is a counter or histogram with labels, written in the Prometheus text format.
+type metricFamily struct {
+	name    string
+	help    string
+	kind    string // "counter" or "histogram"
+	labels  []string
+	buckets []float64
+	series  map[string]*series
+}
+
+type series struct {
+	labelValues []string
+	value       float64  // counter value or histogram sum
+	count       uint64   // histogram only
+	counts      []uint64 // per bucket, histogram only
+}
+
+// Metrics collects the metrics of the server and serves them to Prometheus.
+// All methods do nothing on a nil *Metrics.
+type Metrics struct {
+	mutex    sync.Mutex
+	families []*metricFamily
+
+	httpRequests    *metricFamily
+	httpDuration    *metricFamily
+	orders          *metricFamily
+	forwards        *metricFamily
+	forwardDuration *metricFamily
+	emails          *metricFamily
+	queryDuration   *metricFamily
+	mutexWait       *metricFamily
+}
+
+// NewMetrics instantiates the metrics of the server.
+func NewMetrics() *Metrics {
+	var metrics Metrics
+	metrics.httpRequests = metrics.add("calendarium_http_requests_total", "HTTP requests by route, method and status.", "counter", nil, "route", "method", "status")
+	metrics.httpDuration = metrics.add("calendarium_http_request_duration_seconds", "Duration of HTTP requests by route.", "histogram", defaultBuckets, "route")
+	metrics.orders = metrics.add("calendarium_orders_total", "Placed orders by payment method, reseller status and spam quarantine.", "counter", nil, "payment", "reseller", "quarantined")
+	metrics.forwards = metrics.add("calendarium_order_forwards_total", "Order forwards by sink and outcome.", "counter", nil, "sink", "outcome")
+	metrics.forwardDuration = metrics.add("calendarium_order_forward_duration_seconds", "Duration of order forwards by sink.", "histogram", defaultBuckets, "sink")
+	metrics.emails = metrics.add("calendarium_emails_sent_total", "Sent emails by outcome.", "counter", nil, "outcome")
+	metrics.queryDuration = metrics.add("calendarium_db_query_duration_seconds", "Duration of SQLite operations by operation.", "histogram", defaultBuckets, "operation")
+	metrics.mutexWait = metrics.add("calendarium_db_mutex_wait_seconds", "Time spent waiting for the database mutex.", "histogram", defaultBuckets)
+	return &metrics
+}
+
+func (metrics *Metrics) add(name string, help string, kind string, buckets []float64, labels ...string) *metricFamily {
+	family := &metricFamily{name: name, help: help, kind: kind, labels: labels, buckets: buckets, series: make(map[string]*series)}
+	metrics.families = append(metrics.families, family)
+	return family
+}
+
+// get returns the series with the given label values, creating it if needed. The caller holds the mutex.
+func (family *metricFamily) get(labelValues []string) *series {
+	key := strings.Join(labelValues, "\xff")
+	s, exists := family.series[key]
+	if !exists {
+		s = &series{labelValues: labelValues}
+		if family.kind == "histogram" {
+			s.counts = make([]uint64, len(family.buckets))
+		}
+		family.series[key] = s
+	}
+	return s
+}
+
+func (metrics *Metrics) inc(family *metricFamily, labelValues ...string) {
+	if metrics == nil {
+		return
+	}
+	metrics.mutex.Lock()
+	defer metrics.mutex.Unlock()
+	family.get(labelValues).value++
+}
+
+func (metrics *Metrics) observe(family *metricFamily, value float64, labelValues ...string) {
+	if metrics == nil {
+		return
+	}
+	metrics.mutex.Lock()
+	defer metrics.mutex.Unlock()
+	s := family.get(labelValues)
+	s.value += value
+	s.count++
+	for i, bound := range family.buckets {
+		if value <= bound {
+			s.counts[i]++
+		}
+	}
+}
+
+// OrderPlaced counts a saved order.
+func (metrics *Metrics) OrderPlaced(order *model.Order) {
+	if metrics == nil {
+		return
+	}
+	metrics.inc(metrics.orders, order.Payment, strconv.FormatBool(order.Reseller), strconv.FormatBool(order.Quarantined))
+}
+
+// OrderForwarded records the duration and outcome of forwarding an order to a sink.
+func (metrics *Metrics) OrderForwarded(sink string, duration time.Duration, err error) {
+	if metrics == nil {
+		return
+	}
+	outcome := "success"
+	if err != nil {
+		outcome = "failure"
+	}
+	metrics.inc(metrics.forwards, sink, outcome)
+	metrics.observe(metrics.forwardDuration, duration.Seconds(), sink)
+}
+
+// EmailSent counts a sent email.
+func (metrics *Metrics) EmailSent(err error) {
+	if metrics == nil {
+		return
+	}
+	outcome := "success"
+	if err != nil {
+		outcome = "failure"
+	}
+	metrics.inc(metrics.emails, outcome)
+}
+
+// observeQuery and observeMutexWait are installed as model.ObserveQuery and model.ObserveMutexWait.
+func (metrics *Metrics) observeQuery(operation string, duration time.Duration) {
+	metrics.observe(metrics.queryDuration, duration.Seconds(), operation)
+}
+
+func (metrics *Metrics) observeMutexWait(wait time.Duration) {
+	metrics.observe(metrics.mutexWait, wait.Seconds())
+}
+
+// statusRecorder remembers the status code written by a handler.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (recorder *statusRecorder) WriteHeader(status int) {
+	recorder.status = status
+	recorder.ResponseWriter.WriteHeader(status)
+}
+
+// Middleware counts requests and measures their duration by route template, e.g. "/api/products/{id}".
+func (metrics *Metrics) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if metrics == nil {
+			next.ServeHTTP(writer, request)
+			return
+		}
+		route := "unknown"
+		if current := mux.CurrentRoute(request); current != nil {
+			if template, err := current.GetPathTemplate(); err == nil {
+				route = template
+			}
+		}
+		recorder := &statusRecorder{ResponseWriter: writer, status: http.StatusOK}
+		start := time.Now()
+		next.ServeHTTP(recorder, request)
+		metrics.observe(metrics.httpDuration, time.Since(start).Seconds(), route)
+		metrics.inc(metrics.httpRequests, route, request.Method, strconv.Itoa(recorder.status))
+	})
+}
+
+// escapeLabelValue escapes a label value for the Prometheus text format.
+func escapeLabelValue(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+// formatLabels formats label pairs like {route="/api/orders",status="200"}, or "" if there are none.
+func formatLabels(names []string, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		pairs[i] = name + `="` + escapeLabelValue(values[i]) + `"`
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatFloat(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+// ServeHTTP writes all metrics in the Prometheus text exposition format.
+func (metrics *Metrics) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	writer.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	out := bufio.NewWriter(writer)
+	metrics.mutex.Lock()
+	for _, family := range metrics.families {
+		fmt.Fprintf(out, "# HELP %s %s\n# TYPE %s %s\n", family.name, family.help, family.name, family.kind)
+		keys := make([]string, 0, len(family.series))
+		for key := range family.series {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			s := family.series[key]
+			if family.kind == "counter" {
+				fmt.Fprintf(out, "%s%s %s\n", family.name, formatLabels(family.labels, s.labelValues), formatFloat(s.value))
+				continue
+			}
+			names := append(append([]string{}, family.labels...), "le")
+			for i, bound := range family.buckets {
+				values := append(append([]string{}, s.labelValues...), formatFloat(bound))
+				fmt.Fprintf(out, "%s_bucket%s %d\n", family.name, formatLabels(names, values), s.counts[i])
+			}
+			values := append(append([]string{}, s.labelValues...), "+Inf")
+			fmt.Fprintf(out, "%s_bucket%s %d\n", family.name, formatLabels(names, values), s.count)
+			fmt.Fprintf(out, "%s_sum%s %s\n", family.name, formatLabels(family.labels, s.labelValues), formatFloat(s.value))
+			fmt.Fprintf(out, "%s_count%s %d\n", family.name, formatLabels(family.labels, s.labelValues), s.count)
+		}
+	}
+	metrics.mutex.Unlock()
+	err := out.Flush()
+	if err != nil {
+		logging.FromContext(request.Context()).Warn("error while sending metrics", logging.Fields{"error": err})
+	}
+}
@@ -0,0 +1,207 @@
+package controller
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kunterbunt/calendarium-server/logging"
+	"github.com/kunterbunt/calendarium-server/model"
+)
+
+// rejectedError is returned if a sink rejects an order. The response body can echo the order, so it is saved
+// with the forward but not logged.
+type rejectedError struct {
+	message string
+	body    string
+}
+
+// Error returns the message with the response body.
+func (err *rejectedError) Error() string {
+	return err.message + " with error message: " + err.body
+}
+
+// RedactedError returns the message without the response body.
+func (err *rejectedError) RedactedError() string {
+	return err.message + " with error message: " + logging.Redacted
+}
+
+// OrderSink receives placed orders for fulfillment.
+// ForwardOrder returns a response that is saved with the order for later debugging purposes.
+// The context carries the request ID and logger of the request that placed the order.
+type OrderSink interface {
+	Name() string
+	ForwardOrder(ctx context.Context, order *model.Order) (string, error)
+}
+
+// Name identifies billbee as an order sink.
+func (billbee *BillbeeHandler) Name() string {
+	return "billbee"
+}
+
+// JSONDirectorySink writes every order as a JSON file into a directory.
+type JSONDirectorySink struct {
+	dir string
+}
+
+// NewJSONDirectorySink instantiates a sink that writes to the given directory, which is created if-need-be.
+func NewJSONDirectorySink(dir string) (*JSONDirectorySink, error) {
+	err := os.MkdirAll(dir, 0750)
+	if err != nil {
+		return nil, err
+	}
+	return &JSONDirectorySink{dir}, nil
+}
+
+// Name identifies the sink.
+func (sink *JSONDirectorySink) Name() string {
+	return "dir:" + sink.dir
+}
+
+// ForwardOrder writes the order to <dir>/<order number>.json.
+func (sink *JSONDirectorySink) ForwardOrder(ctx context.Context, order *model.Order) (string, error) {
+	jsonContent, err := json.MarshalIndent(order, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	filename := filepath.Join(sink.dir, ToOrderId(order.ID)+".json")
+	// Write to a temporary file first so that readers never see half-written orders.
+	err = ioutil.WriteFile(filename+".tmp", jsonContent, 0640)
+	if err != nil {
+		return "", err
+	}
+	err = os.Rename(filename+".tmp", filename)
+	if err != nil {
+		return "", err
+	}
+	return "written to " + filename, nil
+}
+
+// WebhookSink posts every order as JSON to a URL.
+// The body is signed with HMAC-SHA256 over "<timestamp>.<body>" so that the receiver can verify its origin.
+type WebhookSink struct {
+	url    string
+	secret string
+	client *http.Client
+}
+
+type webhookBody struct {
+	OrderNumber string       `json:"order_number"`
+	Order       *model.Order `json:"order"`
+}
+
+// NewWebhookSink instantiates a sink that posts to the given URL.
+func NewWebhookSink(url string, secret string) *WebhookSink {
+	return &WebhookSink{url, secret, &http.Client{Timeout: 30 * time.Second}}
+}
+
+// Name identifies the sink.
+func (sink *WebhookSink) Name() string {
+	return "webhook:" + sink.url
+}
+
+// SignWebhookBody computes the value of the X-Calendarium-Signature header.
+func SignWebhookBody(secret string, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// ForwardOrder posts the order to the webhook URL, passing on the request ID in the X-Request-ID header.
+func (sink *WebhookSink) ForwardOrder(ctx context.Context, order *model.Order) (string, error) {
+	jsonContent, err := json.Marshal(webhookBody{ToOrderId(order.ID), order})
+	if err != nil {
+		return "", err
+	}
+	request, err := http.NewRequest("POST", sink.url, bytes.NewBuffer(jsonContent))
+	if err != nil {
+		return "", err
+	}
+	if requestID := logging.RequestID(ctx); requestID != "" {
+		request.Header.Set("X-Request-ID", requestID)
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("X-Calendarium-Timestamp", timestamp)
+	request.Header.Set("X-Calendarium-Signature", SignWebhookBody(sink.secret, timestamp, jsonContent))
+
+	response, err := sink.client.Do(request)
+	if err != nil {
+		return "", err
+	}
+	defer response.Body.Close()
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return "", err
+	}
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return "", &rejectedError{"Webhook returned HTTP status: " + response.Status, string(body)}
+	}
+	return string(body), nil
+}
+
+// NoopSink accepts every order and does nothing, e.g. for local development.
+type NoopSink struct{}
+
+// Name identifies the sink.
+func (sink NoopSink) Name() string {
+	return "noop"
+}
+
+// ForwardOrder does nothing.
+func (sink NoopSink) ForwardOrder(ctx context.Context, order *model.Order) (string, error) {
+	return "", nil
+}
+
+// ParseOrderSink creates a sink from a specification of the form
+//
+//	billbee        forward to the given billbee handler
+//	dir:<path>     write JSON files into <path>
+//	webhook:<url>  post JSON signed with webhookSecret to <url>
+//	noop           discard
+//
+// The webhook secret is not part of the specification so that it does not show up in process listings.
+func ParseOrderSink(spec string, billbee *BillbeeHandler, webhookSecret string) (OrderSink, error) {
+	parts := strings.SplitN(spec, ":", 2)
+	kind := parts[0]
+	arg := ""
+	if len(parts) == 2 {
+		arg = parts[1]
+	}
+	switch kind {
+	case "billbee":
+		if billbee == nil {
+			return nil, errors.New("order sink 'billbee' requires billbee forwarding to be configured")
+		}
+		return billbee, nil
+	case "dir":
+		if arg == "" {
+			return nil, errors.New("order sink 'dir' requires a path: dir:<path>")
+		}
+		return NewJSONDirectorySink(arg)
+	case "webhook":
+		if arg == "" {
+			return nil, errors.New("order sink 'webhook' requires a URL: webhook:<url>")
+		}
+		if webhookSecret == "" {
+			return nil, errors.New("order sink 'webhook' requires a secret in 'webhook_secret' or $CALENDARIUM_WEBHOOK_SECRET")
+		}
+		return NewWebhookSink(arg, webhookSecret), nil
+	case "noop":
+		return NoopSink{}, nil
+	default:
+		return nil, errors.New("unknown order sink '" + kind + "'")
+	}
+}
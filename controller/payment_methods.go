@@ -0,0 +1,213 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strings"
+
+	"github.com/kunterbunt/calendarium-server/logging"
+	"github.com/kunterbunt/calendarium-server/model"
+)
+
+// Names of the payment methods, the values of model.Order.Payment.
+const (
+	PaymentBankTransfer = "banktransfer"
+	PaymentPayPal       = "paypal"
+	PaymentSEPA         = "sepa"
+	PaymentVoucher      = "voucher" // Unterstützer orders, not offered to customers
+)
+
+// PaymentMethod is a way to pay orders.
+type PaymentMethod struct {
+	Name string
+	// BillbeeCode is the Billbee payment method that orders are forwarded with.
+	BillbeeCode int
+	// Fields lists the order fields that customers fill in for this method.
+	Fields []string
+	// Enabled reports whether customers can choose this method, nil if they never can.
+	Enabled func(server *Server) bool
+	// Verify checks the Fields of an order, nil if there are none.
+	Verify func(invalid *model.ValidationError, locale string, order *model.Order)
+	// Terms returns the text that customers agree to with this method, nil if there is none.
+	Terms func(server *Server, locale string) string
+	// Instructions adds to the receipt of a saved order how to pay it, nil if there is nothing to add.
+	Instructions func(ctx context.Context, server *Server, order *model.Order, receipt *OrderReceipt) error
+}
+
+func always(server *Server) bool {
+	return true
+}
+
+// paymentMethods lists all payment methods in the order in which they are offered.
+var paymentMethods = []*PaymentMethod{
+	{
+		Name:        PaymentBankTransfer,
+		BillbeeCode: 1,
+		Enabled:     always,
+		Instructions: func(ctx context.Context, server *Server, order *model.Order, receipt *OrderReceipt) error {
+			if server.BankAccount == nil {
+				return nil
+			}
+			var err error
+			receipt.BankTransfer, err = server.bankTransferDetails(order)
+			return err
+		},
+	},
+	{
+		Name:        PaymentPayPal,
+		BillbeeCode: 3,
+		// Without the PayPal API, orders are charged through Billbee.
+		Enabled: always,
+		Instructions: func(ctx context.Context, server *Server, order *model.Order, receipt *OrderReceipt) error {
+			if server.PayPal == nil || order.Quarantined {
+				return nil
+			}
+			// The order is placed even if PayPal fails, it can still be paid by bank transfer.
+			var err error
+			receipt.PayPalApprovalURL, err = server.createPayPalPayment(ctx, order)
+			return err
+		},
+	},
+	{
+		Name:        PaymentSEPA,
+		BillbeeCode: 5, // Lastschrift
+		Fields:      []string{"sepa_account_holder", "sepa_iban", "sepa_bic", "sepa_mandate_consent"},
+		Enabled: func(server *Server) bool {
+			return server.SEPACreditor != nil
+		},
+		Verify: model.VerifyDirectDebit,
+		Terms: func(server *Server, locale string) string {
+			return server.SEPACreditor.MandateText(locale)
+		},
+		Instructions: func(ctx context.Context, server *Server, order *model.Order, receipt *OrderReceipt) error {
+			// Orders placed before SEPA was disabled are still confirmed, without the pre-notification.
+			if server.SEPACreditor == nil {
+				return nil
+			}
+			receipt.DirectDebit = server.directDebitDetails(order)
+			return nil
+		},
+	},
+	{
+		Name:        PaymentVoucher,
+		BillbeeCode: 6, // Gutschein
+	},
+}
+
+// LookupPaymentMethod returns the payment method with the given name, or nil if there is none.
+func LookupPaymentMethod(name string) *PaymentMethod {
+	for _, method := range paymentMethods {
+		if method.Name == name {
+			return method
+		}
+	}
+	return nil
+}
+
+// enabledPaymentMethods returns the payment methods that customers can choose.
+func (server *Server) enabledPaymentMethods() []*PaymentMethod {
+	enabled := make([]*PaymentMethod, 0, len(paymentMethods))
+	for _, method := range paymentMethods {
+		if method.Enabled != nil && method.Enabled(server) {
+			enabled = append(enabled, method)
+		}
+	}
+	return enabled
+}
+
+// PaymentMethodEnabled reports whether customers can choose the payment method with the given name.
+func (server *Server) PaymentMethodEnabled(name string) bool {
+	for _, method := range server.enabledPaymentMethods() {
+		if method.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// verifyPayment checks that an order is paid with an enabled payment method and verifies the fields of that method.
+func (server *Server) verifyPayment(invalid *model.ValidationError, order *model.Order) {
+	enabled := server.enabledPaymentMethods()
+	names := make([]string, len(enabled))
+	for i, method := range enabled {
+		names[i] = method.Name
+	}
+	if order.Payment == "" {
+		invalid.Add("payment", model.CodeRequired, model.Message(order.Locale, "payment.required", strings.Join(names, ", ")))
+		return
+	}
+	for _, method := range enabled {
+		if method.Name == order.Payment {
+			if method.Verify != nil {
+				method.Verify(invalid, order.Locale, order)
+			}
+			return
+		}
+	}
+	invalid.Add("payment", model.CodeInvalidChoice, model.Message(order.Locale, "payment.invalid_choice", strings.Join(names, ", ")))
+}
+
+// clearPaymentFields zeroes the Fields of all payment methods except the one an order is paid with, so that
+// e.g. the bank account of a customer who switched to PayPal in the order form is not saved.
+func clearPaymentFields(order *model.Order) {
+	cleared := make(map[string]bool)
+	for _, method := range paymentMethods {
+		if method.Name != order.Payment {
+			for _, field := range method.Fields {
+				cleared[field] = true
+			}
+		}
+	}
+	value := reflect.ValueOf(order).Elem()
+	for i := 0; i < value.NumField(); i++ {
+		name := strings.Split(value.Type().Field(i).Tag.Get("json"), ",")[0]
+		if cleared[name] {
+			value.Field(i).Set(reflect.Zero(value.Field(i).Type()))
+		}
+	}
+}
+
+// requestLocale returns the locale of the query parameter locale or, if it is missing, of the Accept-Language header.
+func requestLocale(request *http.Request) string {
+	locale := model.NormalizeLocale(request.URL.Query().Get("locale"))
+	if locale == "" {
+		locale = model.NegotiateLocale(request.Header.Get("Accept-Language"))
+	}
+	return locale
+}
+
+// PaymentMethodInfo describes a payment method to the order form.
+type PaymentMethodInfo struct {
+	Name   string   `json:"name"`
+	Label  string   `json:"label"`
+	Fields []string `json:"fields"`
+	Terms  string   `json:"terms,omitempty"`
+}
+
+// getPaymentMethods returns the payment methods that customers can choose, in the locale of the
+// query parameter locale or the Accept-Language header.
+func (server *Server) getPaymentMethods(writer http.ResponseWriter, request *http.Request) {
+	logger := logging.FromContext(request.Context())
+	logger.Debug("getPaymentMethods API call")
+	locale := requestLocale(request)
+	methods := make([]PaymentMethodInfo, 0, len(paymentMethods))
+	for _, method := range server.enabledPaymentMethods() {
+		info := PaymentMethodInfo{Name: method.Name, Label: model.Message(locale, "payment."+method.Name), Fields: method.Fields}
+		if info.Fields == nil {
+			info.Fields = []string{}
+		}
+		if method.Terms != nil {
+			info.Terms = method.Terms(server, locale)
+		}
+		methods = append(methods, info)
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(writer).Encode(methods)
+	if err != nil {
+		logger.Error("getPaymentMethods failed", logging.Fields{"error": err})
+		return
+	}
+	logger.Debug("sent reply")
+}
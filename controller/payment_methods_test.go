@@ -0,0 +1,26 @@
+package controller
+
+import (
+	"testing"
+
+	"github.com/kunterbunt/calendarium-server/model"
+)
+
+func TestClearPaymentFields(t *testing.T) {
+	mandate := model.Order{Payment: PaymentSEPA, SEPAAccountHolder: "Erika Mustermann", SEPAIBAN: "DE02120300000000202051", SEPABIC: "BYLADEM1001", SEPAMandateConsent: true}
+
+	order := mandate
+	clearPaymentFields(&order)
+	if order != mandate {
+		t.Errorf("the mandate of a SEPA order was changed to %+v", order)
+	}
+
+	for _, payment := range []string{PaymentBankTransfer, PaymentPayPal, "unknown"} {
+		order := mandate
+		order.Payment = payment
+		clearPaymentFields(&order)
+		if order.SEPAAccountHolder != "" || order.SEPAIBAN != "" || order.SEPABIC != "" || order.SEPAMandateConsent {
+			t.Errorf("the mandate of a %s order was kept: %+v", payment, order)
+		}
+	}
+}
@@ -0,0 +1,563 @@
+package controller
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/kunterbunt/calendarium-server/logging"
+	"github.com/kunterbunt/calendarium-server/model"
+)
+
+// Base URLs of the PayPal REST API.
+const (
+	PayPalSandboxURL = "https://api-m.sandbox.paypal.com"
+	PayPalLiveURL    = "https://api-m.paypal.com"
+)
+
+// ActorPayPal is the actor of changes made by PayPal webhooks.
+const ActorPayPal = "paypal"
+
+// maxWebhookSize limits the body of webhook requests.
+const maxWebhookSize = 1 << 20
+
+// ErrUnknownPayPalOrder is returned for PayPal orders that do not belong to any order.
+var ErrUnknownPayPalOrder = errors.New("unknown PayPal order")
+
+// ErrOrderCancelled is returned instead of capturing the payment of a cancelled order.
+var ErrOrderCancelled = errors.New("order was cancelled")
+
+// PayPalAmount is an amount of money in the PayPal API, e.g. {"currency_code": "EUR", "value": "51.00"}.
+type PayPalAmount struct {
+	CurrencyCode string `json:"currency_code"`
+	Value        string `json:"value"`
+}
+
+// PayPalCapture is a captured payment of a PayPal order.
+type PayPalCapture struct {
+	ID                string       `json:"id"`
+	Status            string       `json:"status"`
+	Amount            PayPalAmount `json:"amount"`
+	InvoiceID         string       `json:"invoice_id,omitempty"`
+	CustomID          string       `json:"custom_id,omitempty"`
+	SupplementaryData struct {
+		RelatedIDs struct {
+			OrderID string `json:"order_id,omitempty"`
+		} `json:"related_ids"`
+	} `json:"supplementary_data"`
+}
+
+// PayPalPurchaseUnit is the part of a PayPal order that is paid to us.
+type PayPalPurchaseUnit struct {
+	ReferenceID string       `json:"reference_id,omitempty"`
+	InvoiceID   string       `json:"invoice_id,omitempty"`
+	CustomID    string       `json:"custom_id,omitempty"`
+	Description string       `json:"description,omitempty"`
+	Amount      PayPalAmount `json:"amount"`
+	Payments    *struct {
+		Captures []PayPalCapture `json:"captures"`
+	} `json:"payments,omitempty"`
+}
+
+// PayPalLink is a HATEOAS link of the PayPal API.
+type PayPalLink struct {
+	Href   string `json:"href"`
+	Rel    string `json:"rel"`
+	Method string `json:"method,omitempty"`
+}
+
+// PayPalOrder is an order of the PayPal Orders v2 API.
+type PayPalOrder struct {
+	ID            string               `json:"id"`
+	Status        string               `json:"status"`
+	PurchaseUnits []PayPalPurchaseUnit `json:"purchase_units"`
+	Links         []PayPalLink         `json:"links,omitempty"`
+}
+
+// ApprovalURL returns the URL that the buyer has to visit to approve the payment, or "".
+func (order *PayPalOrder) ApprovalURL() string {
+	for _, link := range order.Links {
+		if link.Rel == "payer-action" || link.Rel == "approve" {
+			return link.Href
+		}
+	}
+	return ""
+}
+
+// Captures returns the captured payments of all purchase units.
+func (order *PayPalOrder) Captures() []PayPalCapture {
+	var captures []PayPalCapture
+	for _, unit := range order.PurchaseUnits {
+		if unit.Payments != nil {
+			captures = append(captures, unit.Payments.Captures...)
+		}
+	}
+	return captures
+}
+
+// PayPalError is an error response of the PayPal API.
+type PayPalError struct {
+	Status  int    `json:"-"`
+	Name    string `json:"name"`
+	Message string `json:"message"`
+	Details []struct {
+		Issue       string `json:"issue"`
+		Description string `json:"description"`
+	} `json:"details"`
+}
+
+func (err *PayPalError) Error() string {
+	message := fmt.Sprintf("PayPal returned HTTP status %d: %s %s", err.Status, err.Name, err.Message)
+	for _, detail := range err.Details {
+		message += " " + detail.Issue + ": " + detail.Description
+	}
+	return message
+}
+
+// hasIssue reports whether the error details name an issue, e.g. "ORDER_NOT_APPROVED".
+func (err *PayPalError) hasIssue(issue string) bool {
+	for _, detail := range err.Details {
+		if detail.Issue == issue {
+			return true
+		}
+	}
+	return false
+}
+
+// PayPalClient creates and captures PayPal orders and verifies webhooks with the PayPal REST API.
+type PayPalClient struct {
+	url          string
+	clientID     string
+	clientSecret string
+	webhookID    string
+	returnURL    string
+	cancelURL    string
+	client       *http.Client
+	mutex        sync.Mutex
+	token        string
+	tokenExpires time.Time
+}
+
+// NewPayPalClient instantiates a client of the PayPal REST API at url, e.g. PayPalSandboxURL.
+// Buyers are sent to returnURL after approving a payment and to cancelURL if they cancel it.
+// webhookID is the ID of the webhook registered for the app, as shown in the PayPal developer dashboard.
+func NewPayPalClient(url string, clientID string, clientSecret string, webhookID string, returnURL string, cancelURL string) *PayPalClient {
+	return &PayPalClient{
+		url:          strings.TrimRight(url, "/"),
+		clientID:     clientID,
+		clientSecret: clientSecret,
+		webhookID:    webhookID,
+		returnURL:    returnURL,
+		cancelURL:    cancelURL,
+		client:       &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// accessToken returns a cached OAuth access token, requesting a new one if it expires soon.
+func (paypal *PayPalClient) accessToken(ctx context.Context) (string, error) {
+	paypal.mutex.Lock()
+	defer paypal.mutex.Unlock()
+	if paypal.token != "" && time.Now().Before(paypal.tokenExpires) {
+		return paypal.token, nil
+	}
+	request, err := http.NewRequestWithContext(ctx, "POST", paypal.url+"/v1/oauth2/token", strings.NewReader("grant_type=client_credentials"))
+	if err != nil {
+		return "", err
+	}
+	request.SetBasicAuth(paypal.clientID, paypal.clientSecret)
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	request.Header.Set("Accept", "application/json")
+	var token struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	err = paypal.send(request, &token)
+	if err != nil {
+		return "", err
+	}
+	paypal.token = token.AccessToken
+	// Renew the token a minute before it expires.
+	paypal.tokenExpires = time.Now().Add(time.Duration(token.ExpiresIn)*time.Second - time.Minute)
+	return paypal.token, nil
+}
+
+// call sends a JSON request to the API and decodes the response into result.
+// requestID makes retried POST requests idempotent, see the PayPal-Request-Id header.
+func (paypal *PayPalClient) call(ctx context.Context, method string, path string, body interface{}, requestID string, result interface{}) error {
+	token, err := paypal.accessToken(ctx)
+	if err != nil {
+		return err
+	}
+	var content []byte
+	if body != nil {
+		content, err = json.Marshal(body)
+		if err != nil {
+			return err
+		}
+	}
+	request, err := http.NewRequestWithContext(ctx, method, paypal.url+path, bytes.NewReader(content))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Authorization", "Bearer "+token)
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("Accept", "application/json")
+	if requestID != "" {
+		request.Header.Set("PayPal-Request-Id", requestID)
+	}
+	err = paypal.send(request, result)
+	var paypalErr *PayPalError
+	if errors.As(err, &paypalErr) && paypalErr.Status == http.StatusUnauthorized {
+		// The token was revoked or expired early, request a new one next time.
+		paypal.mutex.Lock()
+		paypal.token = ""
+		paypal.mutex.Unlock()
+	}
+	return err
+}
+
+// send sends a request and decodes the JSON response into result. Error responses become a *PayPalError.
+func (paypal *PayPalClient) send(request *http.Request, result interface{}) error {
+	response, err := paypal.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return err
+	}
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		paypalErr := PayPalError{Status: response.StatusCode}
+		if json.Unmarshal(body, &paypalErr) != nil || paypalErr.Name == "" {
+			paypalErr.Message = string(body)
+		}
+		return &paypalErr
+	}
+	if result == nil {
+		return nil
+	}
+	return json.Unmarshal(body, result)
+}
+
+// CreateOrder creates a PayPal order for the total price of an order. The buyer approves it at its ApprovalURL.
+func (paypal *PayPalClient) CreateOrder(ctx context.Context, order *model.Order) (*PayPalOrder, error) {
+	orderNumber := ToOrderId(order.ID)
+	locale := "de-DE"
+	if order.Locale == "en" {
+		locale = "en-US"
+	}
+	body := map[string]interface{}{
+		"intent": "CAPTURE",
+		"purchase_units": []PayPalPurchaseUnit{{
+			ReferenceID: orderNumber,
+			InvoiceID:   orderNumber,
+			CustomID:    orderNumber,
+			Description: "Calendarium Culinarium",
+			Amount:      PayPalAmount{CurrencyCode: "EUR", Value: formatAmount(model.ComputePrice(order))},
+		}},
+		"payment_source": map[string]interface{}{
+			"paypal": map[string]interface{}{
+				"experience_context": map[string]string{
+					"brand_name":          "Calendarium Culinarium",
+					"locale":              locale,
+					"shipping_preference": "NO_SHIPPING",
+					"user_action":         "PAY_NOW",
+					"return_url":          paypal.returnURL,
+					"cancel_url":          paypal.cancelURL,
+				},
+			},
+		},
+	}
+	var created PayPalOrder
+	err := paypal.call(ctx, "POST", "/v2/checkout/orders", body, "create-"+orderNumber, &created)
+	if err != nil {
+		return nil, err
+	}
+	return &created, nil
+}
+
+// GetOrder reads a PayPal order.
+func (paypal *PayPalClient) GetOrder(ctx context.Context, id string) (*PayPalOrder, error) {
+	var order PayPalOrder
+	err := paypal.call(ctx, "GET", "/v2/checkout/orders/"+url.PathEscape(id), nil, "", &order)
+	if err != nil {
+		return nil, err
+	}
+	return &order, nil
+}
+
+// CaptureOrder captures the payment of a PayPal order that the buyer approved.
+// Orders that were captured before are returned as they are.
+func (paypal *PayPalClient) CaptureOrder(ctx context.Context, id string) (*PayPalOrder, error) {
+	var order PayPalOrder
+	err := paypal.call(ctx, "POST", "/v2/checkout/orders/"+url.PathEscape(id)+"/capture", nil, "capture-"+id, &order)
+	var paypalErr *PayPalError
+	if errors.As(err, &paypalErr) && paypalErr.hasIssue("ORDER_ALREADY_CAPTURED") {
+		return paypal.GetOrder(ctx, id)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &order, nil
+}
+
+// VerifyWebhook asks PayPal whether a webhook request was sent by PayPal for our webhook.
+func (paypal *PayPalClient) VerifyWebhook(ctx context.Context, header http.Header, event []byte) (bool, error) {
+	body := map[string]interface{}{
+		"auth_algo":         header.Get("PAYPAL-AUTH-ALGO"),
+		"cert_url":          header.Get("PAYPAL-CERT-URL"),
+		"transmission_id":   header.Get("PAYPAL-TRANSMISSION-ID"),
+		"transmission_sig":  header.Get("PAYPAL-TRANSMISSION-SIG"),
+		"transmission_time": header.Get("PAYPAL-TRANSMISSION-TIME"),
+		"webhook_id":        paypal.webhookID,
+		"webhook_event":     json.RawMessage(event),
+	}
+	var result struct {
+		VerificationStatus string `json:"verification_status"`
+	}
+	err := paypal.call(ctx, "POST", "/v1/notifications/verify-webhook-signature", body, "", &result)
+	if err != nil {
+		return false, err
+	}
+	return result.VerificationStatus == "SUCCESS", nil
+}
+
+// formatAmount formats a price in euros like the PayPal API, e.g. "51.00".
+func formatAmount(euros float64) string {
+	return fmt.Sprintf("%.2f", euros)
+}
+
+// AttachPayPal creates a PayPal payment for every order paid with PayPal
+// and serves the capture endpoint and the webhook that mark orders paid.
+func (server *Server) AttachPayPal(paypal *PayPalClient) {
+	server.PayPal = paypal
+	server.router.HandleFunc("/api/payments/paypal/orders/{id}/capture", server.rateLimited(server.capturePayPalOrder)).Methods("POST")
+	server.router.HandleFunc("/api/payments/paypal/webhook", server.paypalWebhook).Methods("POST")
+}
+
+// createPayPalPayment creates the PayPal order for an order and returns its approval URL.
+func (server *Server) createPayPalPayment(ctx context.Context, order *model.Order) (string, error) {
+	created, err := server.PayPal.CreateOrder(ctx, order)
+	if err != nil {
+		return "", err
+	}
+	err = model.Transaction(server.Db, &server.Mutex, func(tx model.Queryer) error {
+		err := model.SetOrderPayPalOrderID(tx, order.ID, created.ID, nil)
+		if err != nil {
+			return err
+		}
+		return server.auditOrder(ctx, tx, "order.paypal_create", order)
+	})
+	if err != nil {
+		return "", err
+	}
+	order.PayPalOrderID = created.ID
+	approvalURL := created.ApprovalURL()
+	if approvalURL == "" {
+		return "", errors.New("PayPal order " + created.ID + " has no approval link")
+	}
+	logging.FromContext(ctx).Info("created PayPal order", logging.Fields{"order_number": ToOrderId(order.ID), "paypal_order_id": created.ID})
+	return approvalURL, nil
+}
+
+// CapturePayPalOrder captures the payment of an approved PayPal order and marks the order paid.
+func (server *Server) CapturePayPalOrder(ctx context.Context, paypalOrderID string) (*model.Order, error) {
+	order, err := model.GetOrderByPayPalOrderID(server.Db, paypalOrderID, &server.Mutex)
+	if err != nil {
+		return nil, err
+	}
+	if order.ID == int64(model.InvalidID) {
+		return nil, ErrUnknownPayPalOrder
+	}
+	if order.PaidAt != "" {
+		return order, nil
+	}
+	if order.CancelledAt != "" {
+		// The buyer approved the payment of an order that was cancelled for lack of payment. Capturing would
+		// charge for an order that is not delivered, whoever reviews it decides.
+		if order.ReviewReason == "" {
+			err = model.Transaction(server.Db, &server.Mutex, func(tx model.Queryer) error {
+				err := model.FlagOrderForReview(tx, order.ID, "PayPal payment approved after cancellation", nil)
+				if err != nil {
+					return err
+				}
+				return server.auditOrder(ctx, tx, "order.review", order)
+			})
+			if err != nil {
+				return nil, err
+			}
+		}
+		return nil, ErrOrderCancelled
+	}
+	captured, err := server.PayPal.CaptureOrder(ctx, paypalOrderID)
+	if err != nil {
+		return nil, err
+	}
+	for _, capture := range captured.Captures() {
+		err = server.completePayPalCapture(ctx, order, capture)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return model.GetOrder(server.Db, order.ID, &server.Mutex)
+}
+
+// completePayPalCapture marks an order paid if the capture completed with the order's total price.
+func (server *Server) completePayPalCapture(ctx context.Context, order *model.Order, capture PayPalCapture) error {
+	logger := logging.FromContext(ctx).With(logging.Fields{"order_number": ToOrderId(order.ID), "capture_id": capture.ID})
+	if capture.Status != "COMPLETED" {
+		logger.Info("PayPal capture not completed", logging.Fields{"status": capture.Status})
+		return nil
+	}
+	expected := PayPalAmount{CurrencyCode: "EUR", Value: formatAmount(model.ComputePrice(order))}
+	if capture.Amount != expected {
+		logger.Error("PayPal capture amount differs from order total", logging.Fields{"amount": capture.Amount, "expected": expected})
+		return fmt.Errorf("captured %s %s for %s, expected %s %s", capture.Amount.Value, capture.Amount.CurrencyCode, ToOrderId(order.ID), expected.Value, expected.CurrencyCode)
+	}
+	marked := false
+	err := model.Transaction(server.Db, &server.Mutex, func(tx model.Queryer) error {
+		var err error
+		marked, err = server.markOrderPaid(ctx, tx, order, time.Now().Format(time.RFC3339), "paypal:"+capture.ID)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if marked {
+		logger.Info("order paid")
+	}
+	return nil
+}
+
+// paymentStatus is the response of the PayPal capture endpoint.
+type paymentStatus struct {
+	OrderNumber string `json:"order_number"`
+	Paid        bool   `json:"paid"`
+	PaidAt      string `json:"paid_at,omitempty"`
+}
+
+// capturePayPalOrder is called by the frontend once the buyer returns from approving the payment,
+// with the PayPal order ID from the token query parameter of the return URL.
+func (server *Server) capturePayPalOrder(writer http.ResponseWriter, request *http.Request) {
+	logger := logging.FromContext(request.Context())
+	logger.Debug("capturePayPalOrder API call")
+	ctx := WithActor(request.Context(), ActorCustomer)
+	order, err := server.CapturePayPalOrder(ctx, mux.Vars(request)["id"])
+	if err == ErrUnknownPayPalOrder {
+		writeError(writer, http.StatusNotFound, ErrorNotFound, err.Error())
+		return
+	}
+	if err == ErrOrderCancelled {
+		logger.Warn("capturePayPalOrder of cancelled order")
+		writeError(writer, http.StatusConflict, ErrorConflict, err.Error())
+		return
+	}
+	var paypalErr *PayPalError
+	if errors.As(err, &paypalErr) && paypalErr.Status == http.StatusUnprocessableEntity {
+		// E.g. the buyer did not approve the payment.
+		logger.Warn("capturePayPalOrder rejected", logging.Fields{"error": err})
+		writeError(writer, http.StatusConflict, ErrorConflict, paypalErr.Error())
+		return
+	}
+	if err != nil {
+		logger.Error("capturePayPalOrder failed", logging.Fields{"error": err})
+		writeError(writer, http.StatusInternalServerError, ErrorInternal, err.Error())
+		return
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(writer).Encode(paymentStatus{OrderNumber: ToOrderId(order.ID), Paid: order.PaidAt != "", PaidAt: order.PaidAt})
+	if err != nil {
+		logger.Error("capturePayPalOrder failed", logging.Fields{"error": err})
+		return
+	}
+	logger.Debug("sent reply")
+}
+
+// paypalWebhook receives the events of the PayPal webhook. Approved orders are captured and completed captures mark their order paid.
+// Other events are acknowledged and ignored.
+func (server *Server) paypalWebhook(writer http.ResponseWriter, request *http.Request) {
+	logger := logging.FromContext(request.Context())
+	logger.Debug("paypalWebhook API call")
+	ctx := WithActor(request.Context(), ActorPayPal)
+	body, err := ioutil.ReadAll(http.MaxBytesReader(writer, request.Body, maxWebhookSize))
+	if err != nil {
+		writeError(writer, http.StatusBadRequest, ErrorInvalidRequest, err.Error())
+		return
+	}
+	verified, err := server.PayPal.VerifyWebhook(ctx, request.Header, body)
+	if err != nil {
+		logger.Error("paypalWebhook failed", logging.Fields{"error": err})
+		writeError(writer, http.StatusInternalServerError, ErrorInternal, "could not verify webhook signature")
+		return
+	}
+	if !verified {
+		logger.Warn("invalid PayPal webhook signature", logging.Fields{"transmission_id": request.Header.Get("PAYPAL-TRANSMISSION-ID")})
+		writeError(writer, http.StatusUnauthorized, ErrorUnauthorized, "invalid webhook signature")
+		return
+	}
+	var event struct {
+		ID        string          `json:"id"`
+		EventType string          `json:"event_type"`
+		Resource  json.RawMessage `json:"resource"`
+	}
+	err = json.Unmarshal(body, &event)
+	if err != nil {
+		writeError(writer, http.StatusBadRequest, ErrorInvalidRequest, err.Error())
+		return
+	}
+	logger = logger.With(logging.Fields{"event_id": event.ID, "event_type": event.EventType})
+	switch event.EventType {
+	case "CHECKOUT.ORDER.APPROVED":
+		var approved PayPalOrder
+		err = json.Unmarshal(event.Resource, &approved)
+		if err == nil {
+			_, err = server.CapturePayPalOrder(ctx, approved.ID)
+		}
+	case "PAYMENT.CAPTURE.COMPLETED":
+		var capture PayPalCapture
+		err = json.Unmarshal(event.Resource, &capture)
+		if err == nil {
+			err = server.completeCaptureEvent(ctx, capture)
+		}
+	default:
+		logger.Debug("ignored PayPal webhook event")
+	}
+	if err == ErrUnknownPayPalOrder {
+		// Retrying will not help, e.g. the order was placed on another installation.
+		logger.Warn("PayPal webhook for unknown order")
+	} else if err == ErrOrderCancelled {
+		logger.Warn("PayPal webhook for cancelled order, flagged for review")
+	} else if err != nil {
+		// PayPal retries failed deliveries.
+		logger.Error("paypalWebhook failed", logging.Fields{"error": err})
+		writeError(writer, http.StatusInternalServerError, ErrorInternal, err.Error())
+		return
+	}
+	writer.WriteHeader(http.StatusNoContent)
+}
+
+// completeCaptureEvent marks the order of a completed capture paid.
+func (server *Server) completeCaptureEvent(ctx context.Context, capture PayPalCapture) error {
+	paypalOrderID := capture.SupplementaryData.RelatedIDs.OrderID
+	if paypalOrderID == "" {
+		return ErrUnknownPayPalOrder
+	}
+	order, err := model.GetOrderByPayPalOrderID(server.Db, paypalOrderID, &server.Mutex)
+	if err != nil {
+		return err
+	}
+	if order.ID == int64(model.InvalidID) {
+		return ErrUnknownPayPalOrder
+	}
+	return server.completePayPalCapture(ctx, order, capture)
+}
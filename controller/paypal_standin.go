@@ -0,0 +1,310 @@
+package controller
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/kunterbunt/calendarium-server/logging"
+)
+
+// PayPalStandInSignature is the only webhook signature that the stand-in verifies successfully.
+const PayPalStandInSignature = "stand-in-signature"
+
+// PayPalStandIn imitates the parts of the PayPal REST API used by PayPalClient, for trying out payments locally.
+// Any client credentials are accepted. Visiting the approval URL of an order approves it and redirects to the
+// order's return URL. If a webhook URL is given, the approval and the capture are also sent as webhook events.
+type PayPalStandIn struct {
+	router     *mux.Router
+	base       string
+	webhookURL string
+	mutex      sync.Mutex
+	orders     map[string]*standInOrder
+	requests   map[string]string // PayPal-Request-Id to order ID
+	client     *http.Client
+}
+
+type standInOrder struct {
+	order     PayPalOrder
+	returnURL string
+	cancelURL string
+}
+
+// NewPayPalStandIn instantiates a stand-in reachable at base, e.g. "http://127.0.0.1:8099", that sends
+// webhook events to webhookURL unless it is empty.
+func NewPayPalStandIn(base string, webhookURL string) *PayPalStandIn {
+	standIn := PayPalStandIn{
+		router:     mux.NewRouter(),
+		base:       strings.TrimRight(base, "/"),
+		webhookURL: webhookURL,
+		orders:     make(map[string]*standInOrder),
+		requests:   make(map[string]string),
+		client:     &http.Client{Timeout: 30 * time.Second},
+	}
+	standIn.router.HandleFunc("/v1/oauth2/token", standIn.token).Methods("POST")
+	standIn.router.HandleFunc("/v2/checkout/orders", standIn.requireToken(standIn.createOrder)).Methods("POST")
+	standIn.router.HandleFunc("/v2/checkout/orders/{id}", standIn.requireToken(standIn.getOrder)).Methods("GET")
+	standIn.router.HandleFunc("/v2/checkout/orders/{id}/capture", standIn.requireToken(standIn.captureOrder)).Methods("POST")
+	standIn.router.HandleFunc("/v1/notifications/verify-webhook-signature", standIn.requireToken(standIn.verifyWebhook)).Methods("POST")
+	standIn.router.HandleFunc("/checkoutnow", standIn.approve).Methods("GET")
+	return &standIn
+}
+
+func (standIn *PayPalStandIn) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	logging.Info("PayPal stand-in request", logging.Fields{"method": request.Method, "path": request.URL.Path})
+	standIn.router.ServeHTTP(writer, request)
+}
+
+// standInID returns a random ID in the format of PayPal IDs.
+func standInID() string {
+	id := make([]byte, 9)
+	_, err := rand.Read(id)
+	if err != nil {
+		panic(err)
+	}
+	return strings.ToUpper(hex.EncodeToString(id))[:17]
+}
+
+// writePayPalJSON writes a response of the stand-in.
+func writePayPalJSON(writer http.ResponseWriter, status int, value interface{}) {
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(status)
+	json.NewEncoder(writer).Encode(value)
+}
+
+// writePayPalError writes an error response like the PayPal API does.
+func writePayPalError(writer http.ResponseWriter, status int, name string, issue string) {
+	paypalErr := PayPalError{Name: name, Message: "The requested action could not be performed."}
+	if issue != "" {
+		paypalErr.Details = append(paypalErr.Details, struct {
+			Issue       string `json:"issue"`
+			Description string `json:"description"`
+		}{issue, issue})
+	}
+	writePayPalJSON(writer, status, paypalErr)
+}
+
+func (standIn *PayPalStandIn) token(writer http.ResponseWriter, request *http.Request) {
+	if _, _, ok := request.BasicAuth(); !ok {
+		writePayPalJSON(writer, http.StatusUnauthorized, map[string]string{"error": "invalid_client"})
+		return
+	}
+	writePayPalJSON(writer, http.StatusOK, map[string]interface{}{
+		"access_token": "A21AA" + standInID(),
+		"token_type":   "Bearer",
+		"expires_in":   32400,
+	})
+}
+
+func (standIn *PayPalStandIn) requireToken(handler http.HandlerFunc) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		if !strings.HasPrefix(request.Header.Get("Authorization"), "Bearer ") {
+			writePayPalError(writer, http.StatusUnauthorized, "AUTHENTICATION_FAILURE", "")
+			return
+		}
+		handler(writer, request)
+	}
+}
+
+func (standIn *PayPalStandIn) createOrder(writer http.ResponseWriter, request *http.Request) {
+	var body struct {
+		Intent        string               `json:"intent"`
+		PurchaseUnits []PayPalPurchaseUnit `json:"purchase_units"`
+		PaymentSource struct {
+			PayPal struct {
+				ExperienceContext struct {
+					ReturnURL string `json:"return_url"`
+					CancelURL string `json:"cancel_url"`
+				} `json:"experience_context"`
+			} `json:"paypal"`
+		} `json:"payment_source"`
+	}
+	err := json.NewDecoder(request.Body).Decode(&body)
+	if err != nil || body.Intent != "CAPTURE" || len(body.PurchaseUnits) == 0 {
+		writePayPalError(writer, http.StatusBadRequest, "INVALID_REQUEST", "MALFORMED_REQUEST_JSON")
+		return
+	}
+	standIn.mutex.Lock()
+	defer standIn.mutex.Unlock()
+	// Like PayPal, repeated requests with the same PayPal-Request-Id return the same order.
+	requestID := request.Header.Get("PayPal-Request-Id")
+	if existing, ok := standIn.orders[standIn.requests[requestID]]; ok && requestID != "" {
+		writePayPalJSON(writer, http.StatusOK, standIn.public(existing))
+		return
+	}
+	id := standInID()
+	created := standInOrder{
+		order:     PayPalOrder{ID: id, Status: "PAYER_ACTION_REQUIRED", PurchaseUnits: body.PurchaseUnits},
+		returnURL: body.PaymentSource.PayPal.ExperienceContext.ReturnURL,
+		cancelURL: body.PaymentSource.PayPal.ExperienceContext.CancelURL,
+	}
+	standIn.orders[id] = &created
+	standIn.requests[requestID] = id
+	writePayPalJSON(writer, http.StatusOK, standIn.public(&created))
+}
+
+// public returns an order as the API shows it.
+func (standIn *PayPalStandIn) public(order *standInOrder) PayPalOrder {
+	public := order.order
+	public.Links = []PayPalLink{{Href: standIn.base + "/v2/checkout/orders/" + public.ID, Rel: "self", Method: "GET"}}
+	switch public.Status {
+	case "PAYER_ACTION_REQUIRED":
+		public.Links = append(public.Links, PayPalLink{Href: standIn.base + "/checkoutnow?token=" + public.ID, Rel: "payer-action", Method: "GET"})
+	case "APPROVED":
+		public.Links = append(public.Links, PayPalLink{Href: standIn.base + "/v2/checkout/orders/" + public.ID + "/capture", Rel: "capture", Method: "POST"})
+	}
+	return public
+}
+
+func (standIn *PayPalStandIn) getOrder(writer http.ResponseWriter, request *http.Request) {
+	standIn.mutex.Lock()
+	defer standIn.mutex.Unlock()
+	order, ok := standIn.orders[mux.Vars(request)["id"]]
+	if !ok {
+		writePayPalError(writer, http.StatusNotFound, "RESOURCE_NOT_FOUND", "INVALID_RESOURCE_ID")
+		return
+	}
+	writePayPalJSON(writer, http.StatusOK, standIn.public(order))
+}
+
+// approve imitates the buyer approving the payment on the PayPal website.
+func (standIn *PayPalStandIn) approve(writer http.ResponseWriter, request *http.Request) {
+	id := request.URL.Query().Get("token")
+	standIn.mutex.Lock()
+	order, ok := standIn.orders[id]
+	if !ok {
+		standIn.mutex.Unlock()
+		http.Error(writer, "unknown order", http.StatusNotFound)
+		return
+	}
+	if request.URL.Query().Get("cancel") != "" {
+		standIn.mutex.Unlock()
+		http.Redirect(writer, request, order.cancelURL, http.StatusFound)
+		return
+	}
+	if order.order.Status == "PAYER_ACTION_REQUIRED" {
+		order.order.Status = "APPROVED"
+	}
+	approved := standIn.public(order)
+	returnURL := order.returnURL
+	standIn.mutex.Unlock()
+
+	standIn.sendEvent("CHECKOUT.ORDER.APPROVED", approved)
+	if returnURL == "" {
+		writer.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		writer.Write([]byte("Approved PayPal order " + id + ".\n"))
+		return
+	}
+	target, err := url.Parse(returnURL)
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusBadRequest)
+		return
+	}
+	query := target.Query()
+	query.Set("token", id)
+	query.Set("PayerID", "STANDINPAYER")
+	target.RawQuery = query.Encode()
+	http.Redirect(writer, request, target.String(), http.StatusFound)
+}
+
+func (standIn *PayPalStandIn) captureOrder(writer http.ResponseWriter, request *http.Request) {
+	standIn.mutex.Lock()
+	order, ok := standIn.orders[mux.Vars(request)["id"]]
+	if !ok {
+		standIn.mutex.Unlock()
+		writePayPalError(writer, http.StatusNotFound, "RESOURCE_NOT_FOUND", "INVALID_RESOURCE_ID")
+		return
+	}
+	switch order.order.Status {
+	case "COMPLETED":
+		standIn.mutex.Unlock()
+		writePayPalError(writer, http.StatusUnprocessableEntity, "UNPROCESSABLE_ENTITY", "ORDER_ALREADY_CAPTURED")
+		return
+	case "APPROVED":
+	default:
+		standIn.mutex.Unlock()
+		writePayPalError(writer, http.StatusUnprocessableEntity, "UNPROCESSABLE_ENTITY", "ORDER_NOT_APPROVED")
+		return
+	}
+	order.order.Status = "COMPLETED"
+	var captures []PayPalCapture
+	for i := range order.order.PurchaseUnits {
+		unit := &order.order.PurchaseUnits[i]
+		capture := PayPalCapture{ID: standInID(), Status: "COMPLETED", Amount: unit.Amount, InvoiceID: unit.InvoiceID, CustomID: unit.CustomID}
+		capture.SupplementaryData.RelatedIDs.OrderID = order.order.ID
+		unit.Payments = &struct {
+			Captures []PayPalCapture `json:"captures"`
+		}{[]PayPalCapture{capture}}
+		captures = append(captures, capture)
+	}
+	captured := standIn.public(order)
+	standIn.mutex.Unlock()
+
+	for _, capture := range captures {
+		standIn.sendEvent("PAYMENT.CAPTURE.COMPLETED", capture)
+	}
+	writePayPalJSON(writer, http.StatusCreated, captured)
+}
+
+func (standIn *PayPalStandIn) verifyWebhook(writer http.ResponseWriter, request *http.Request) {
+	var body struct {
+		TransmissionSig string `json:"transmission_sig"`
+	}
+	err := json.NewDecoder(request.Body).Decode(&body)
+	if err != nil {
+		writePayPalError(writer, http.StatusBadRequest, "INVALID_REQUEST", "MALFORMED_REQUEST_JSON")
+		return
+	}
+	status := "FAILURE"
+	if body.TransmissionSig == PayPalStandInSignature {
+		status = "SUCCESS"
+	}
+	writePayPalJSON(writer, http.StatusOK, map[string]string{"verification_status": status})
+}
+
+// sendEvent sends a webhook event in the background, like PayPal does after answering the request.
+func (standIn *PayPalStandIn) sendEvent(eventType string, resource interface{}) {
+	if standIn.webhookURL == "" {
+		return
+	}
+	event, err := json.Marshal(map[string]interface{}{
+		"id":            "WH-" + standInID(),
+		"event_version": "1.0",
+		"create_time":   time.Now().UTC().Format(time.RFC3339),
+		"resource_type": strings.ToLower(strings.SplitN(eventType, ".", 2)[0]),
+		"event_type":    eventType,
+		"resource":      resource,
+	})
+	if err != nil {
+		logging.Error("PayPal stand-in could not encode event", logging.Fields{"error": err})
+		return
+	}
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		request, err := http.NewRequest("POST", standIn.webhookURL, bytes.NewReader(event))
+		if err != nil {
+			logging.Error("PayPal stand-in could not send event", logging.Fields{"error": err})
+			return
+		}
+		request.Header.Set("Content-Type", "application/json")
+		request.Header.Set("PAYPAL-AUTH-ALGO", "SHA256withRSA")
+		request.Header.Set("PAYPAL-CERT-URL", standIn.base+"/v1/notifications/certs/stand-in")
+		request.Header.Set("PAYPAL-TRANSMISSION-ID", standInID())
+		request.Header.Set("PAYPAL-TRANSMISSION-SIG", PayPalStandInSignature)
+		request.Header.Set("PAYPAL-TRANSMISSION-TIME", time.Now().UTC().Format(time.RFC3339))
+		response, err := standIn.client.Do(request)
+		if err != nil {
+			logging.Error("PayPal stand-in could not send event", logging.Fields{"error": err, "event_type": eventType})
+			return
+		}
+		response.Body.Close()
+		logging.Info("PayPal stand-in sent event", logging.Fields{"event_type": eventType, "status": response.StatusCode})
+	}()
+}
@@ -0,0 +1,230 @@
+package controller
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/kunterbunt/calendarium-server/model"
+)
+
+// payPalTest is a server with an order paid by PayPal, talking to a PayPal stand-in.
+type payPalTest struct {
+	server  *Server
+	api     *httptest.Server
+	standIn *httptest.Server
+	order   *model.Order
+}
+
+// newPayPalTest starts the server and the stand-in. With webhooks, the stand-in sends its events to the server.
+func newPayPalTest(t *testing.T, webhooks bool) *payPalTest {
+	db, err := model.OpenDb(filepath.Join(t.TempDir(), "calendarium.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	var test payPalTest
+	test.server = NewServer(db, "", "")
+	_, err = model.Migrate(db, &test.server.Mutex)
+	if err != nil {
+		t.Fatal(err)
+	}
+	test.api = httptest.NewServer(test.server.handler)
+	t.Cleanup(test.api.Close)
+
+	var standIn *PayPalStandIn
+	test.standIn = httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		standIn.ServeHTTP(writer, request)
+	}))
+	t.Cleanup(test.standIn.Close)
+	webhookURL := ""
+	if webhooks {
+		webhookURL = test.api.URL + "/api/payments/paypal/webhook"
+	}
+	standIn = NewPayPalStandIn(test.standIn.URL, webhookURL)
+	test.server.AttachPayPal(NewPayPalClient(test.standIn.URL, "client", "secret", "WH-TEST", "https://example.com/paid", "https://example.com/cancelled"))
+
+	test.order = &model.Order{ProductID: 1, Amount: 3, Date: time.Now().UTC().Format(time.RFC3339), FirstNameInvoice: "Erika", LastNameInvoice: "Mustermann", Email: "erika@example.com", Payment: "paypal", Locale: "de"}
+	err = model.AddOrder(db, test.order, &test.server.Mutex)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &test
+}
+
+// createAndApprove creates the PayPal order of the test order and approves it like the buyer would.
+func (test *payPalTest) createAndApprove(t *testing.T) {
+	approvalURL, err := test.server.createPayPalPayment(context.Background(), test.order)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buyer := http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	response, err := buyer.Get(approvalURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusFound {
+		t.Fatalf("approval returned HTTP status %d", response.StatusCode)
+	}
+}
+
+// getOrder reads the test order from the database.
+func (test *payPalTest) getOrder(t *testing.T) *model.Order {
+	order, err := model.GetOrder(test.server.Db, test.order.ID, &test.server.Mutex)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return order
+}
+
+// paidEntries counts the audit entries that marked the test order paid.
+func (test *payPalTest) paidEntries(t *testing.T) int {
+	entries, err := model.GetAuditEntries(test.server.Db, model.AuditFilter{Action: "order.paid", TargetType: AuditTargetOrder, Limit: MaxAuditEntries}, &test.server.Mutex)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(entries)
+}
+
+// postWebhook sends a webhook event with the given signature to the server and returns the HTTP status.
+func (test *payPalTest) postWebhook(t *testing.T, signature string, eventType string, resource interface{}) int {
+	event, err := json.Marshal(map[string]interface{}{"id": "WH-" + standInID(), "event_type": eventType, "resource": resource})
+	if err != nil {
+		t.Fatal(err)
+	}
+	request, err := http.NewRequest("POST", test.api.URL+"/api/payments/paypal/webhook", bytes.NewReader(event))
+	if err != nil {
+		t.Fatal(err)
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("PAYPAL-TRANSMISSION-ID", standInID())
+	request.Header.Set("PAYPAL-TRANSMISSION-SIG", signature)
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	return response.StatusCode
+}
+
+func TestPayPalWebhookMarksOrderPaid(t *testing.T) {
+	test := newPayPalTest(t, true)
+	test.createAndApprove(t)
+
+	// The approval event makes the server capture the payment, the capture event completes it.
+	deadline := time.Now().Add(5 * time.Second)
+	order := test.getOrder(t)
+	for order.PaidAt == "" && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+		order = test.getOrder(t)
+	}
+	if order.PaidAt == "" {
+		t.Fatal("order was not marked paid")
+	}
+	if order.PaymentReference == "" || order.PayPalOrderID == "" {
+		t.Errorf("payment reference %q, PayPal order %q", order.PaymentReference, order.PayPalOrderID)
+	}
+	if count := test.paidEntries(t); count != 1 {
+		t.Errorf("%d order.paid audit entries, want 1", count)
+	}
+}
+
+func TestPayPalCaptureAmountMismatch(t *testing.T) {
+	test := newPayPalTest(t, false)
+	test.createAndApprove(t)
+	// The order changes after its PayPal order was created for the old total.
+	_, err := test.server.Db.Exec("UPDATE orders SET amount = 5 WHERE id = ?", test.order.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = test.server.CapturePayPalOrder(context.Background(), test.order.PayPalOrderID)
+	if err == nil {
+		t.Fatal("capture of a different amount succeeded")
+	}
+	if order := test.getOrder(t); order.PaidAt != "" {
+		t.Errorf("order marked paid at %s", order.PaidAt)
+	}
+}
+
+func TestPayPalWebhookInvalidSignature(t *testing.T) {
+	test := newPayPalTest(t, false)
+	test.createAndApprove(t)
+
+	status := test.postWebhook(t, "forged-signature", "CHECKOUT.ORDER.APPROVED", PayPalOrder{ID: test.order.PayPalOrderID, Status: "APPROVED"})
+	if status != http.StatusUnauthorized {
+		t.Errorf("webhook with invalid signature returned HTTP status %d, want %d", status, http.StatusUnauthorized)
+	}
+	if order := test.getOrder(t); order.PaidAt != "" {
+		t.Errorf("order marked paid at %s", order.PaidAt)
+	}
+}
+
+func TestPayPalReplayedCapture(t *testing.T) {
+	test := newPayPalTest(t, false)
+	test.createAndApprove(t)
+
+	paid, err := test.server.CapturePayPalOrder(context.Background(), test.order.PayPalOrderID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if paid.PaidAt == "" {
+		t.Fatal("order was not marked paid")
+	}
+
+	// The frontend retries the capture, and PayPal delivers the capture event afterwards.
+	replayed, err := test.server.CapturePayPalOrder(context.Background(), test.order.PayPalOrderID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	capture := PayPalCapture{ID: "CAPTURE", Status: "COMPLETED", Amount: PayPalAmount{CurrencyCode: "EUR", Value: formatAmount(model.ComputePrice(paid))}}
+	capture.SupplementaryData.RelatedIDs.OrderID = test.order.PayPalOrderID
+	status := test.postWebhook(t, PayPalStandInSignature, "PAYMENT.CAPTURE.COMPLETED", capture)
+	if status != http.StatusNoContent {
+		t.Errorf("replayed capture event returned HTTP status %d, want %d", status, http.StatusNoContent)
+	}
+
+	order := test.getOrder(t)
+	if replayed.PaidAt != paid.PaidAt || order.PaidAt != paid.PaidAt || order.PaymentReference != paid.PaymentReference {
+		t.Errorf("replay changed the payment from %s %s to %s %s", paid.PaidAt, paid.PaymentReference, order.PaidAt, order.PaymentReference)
+	}
+	if count := test.paidEntries(t); count != 1 {
+		t.Errorf("%d order.paid audit entries, want 1", count)
+	}
+}
+
+func TestPayPalCaptureOfCancelledOrder(t *testing.T) {
+	test := newPayPalTest(t, false)
+	test.createAndApprove(t)
+	// The dunning policy cancelled the order before the buyer approved the payment.
+	_, err := model.CancelOrder(test.server.Db, test.order.ID, time.Now().UTC().Format(time.RFC3339), &test.server.Mutex)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = test.server.CapturePayPalOrder(context.Background(), test.order.PayPalOrderID)
+	if err != ErrOrderCancelled {
+		t.Fatalf("capture of cancelled order returned %v, want %v", err, ErrOrderCancelled)
+	}
+	order := test.getOrder(t)
+	if order.PaidAt != "" {
+		t.Errorf("order marked paid at %s", order.PaidAt)
+	}
+	if order.ReviewReason == "" {
+		t.Error("order was not flagged for review")
+	}
+
+	_, err = test.server.ResolveOrderReview(context.Background(), test.order.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if order := test.getOrder(t); order.ReviewReason != "" {
+		t.Errorf("review reason %q after resolving", order.ReviewReason)
+	}
+}
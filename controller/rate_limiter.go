@@ -0,0 +1,258 @@
+package controller
+
+import (
+	"errors"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kunterbunt/calendarium-server/logging"
+	"github.com/kunterbunt/calendarium-server/model"
+)
+
+// maxBlockedClients bounds the memory used to remember blocked clients until they are saved.
+const maxBlockedClients = 1000
+
+// BlockedClientRetention is how long the blocks of a client are kept, the IP addresses are personal data.
+const BlockedClientRetention = 30 * 24 * time.Hour
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// refill adds the tokens that accrued since the last request and returns how long to wait for the next token,
+// 0 if one is available.
+func (bucket *tokenBucket) refill(now time.Time, rate float64, burst float64) time.Duration {
+	if bucket.last.IsZero() {
+		bucket.tokens = burst
+	} else {
+		bucket.tokens = math.Min(burst, bucket.tokens+now.Sub(bucket.last).Seconds()*rate)
+	}
+	bucket.last = now
+	if bucket.tokens >= 1 {
+		return 0
+	}
+	return time.Duration((1 - bucket.tokens) / rate * float64(time.Second))
+}
+
+// RateLimiter limits requests per client IP and in total using token buckets.
+// A rate of 0 disables the corresponding limit.
+type RateLimiter struct {
+	mutex          sync.Mutex
+	perIPRate      float64
+	perIPBurst     float64
+	globalRate     float64
+	globalBurst    float64
+	trustedProxies []*net.IPNet
+	buckets        map[string]*tokenBucket
+	global         tokenBucket
+	lastPrune      time.Time
+	// blocked holds the blocks since they were last taken to be saved.
+	blocked map[string]*model.BlockedClient
+}
+
+// NewRateLimiter instantiates a rate limiter. Rates are in requests per second.
+// X-Forwarded-For and X-Real-IP are only honored for requests from the given trusted proxy addresses or CIDR ranges.
+func NewRateLimiter(perIPRate float64, perIPBurst float64, globalRate float64, globalBurst float64, trustedProxies []string) (*RateLimiter, error) {
+	var limiter RateLimiter
+	limiter.perIPRate = perIPRate
+	limiter.perIPBurst = math.Max(1, perIPBurst)
+	limiter.globalRate = globalRate
+	limiter.globalBurst = math.Max(1, globalBurst)
+	for _, proxy := range trustedProxies {
+		if !strings.Contains(proxy, "/") {
+			if strings.Contains(proxy, ":") {
+				proxy = proxy + "/128"
+			} else {
+				proxy = proxy + "/32"
+			}
+		}
+		_, network, err := net.ParseCIDR(proxy)
+		if err != nil {
+			return nil, errors.New("invalid trusted proxy '" + proxy + "': " + err.Error())
+		}
+		limiter.trustedProxies = append(limiter.trustedProxies, network)
+	}
+	limiter.buckets = make(map[string]*tokenBucket)
+	limiter.blocked = make(map[string]*model.BlockedClient)
+	limiter.lastPrune = time.Now()
+	return &limiter, nil
+}
+
+func (limiter *RateLimiter) isTrustedProxy(ip string) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, network := range limiter.trustedProxies {
+		if network.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientIP returns the IP address of the client, looking through trusted reverse proxies.
+func (limiter *RateLimiter) ClientIP(request *http.Request) string {
+	ip, _, err := net.SplitHostPort(request.RemoteAddr)
+	if err != nil {
+		ip = request.RemoteAddr
+	}
+	if !limiter.isTrustedProxy(ip) {
+		return ip
+	}
+	// The right-most address that is not one of our proxies is the client.
+	forwarded := strings.Split(request.Header.Get("X-Forwarded-For"), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(forwarded[i])
+		if hop == "" {
+			continue
+		}
+		if !limiter.isTrustedProxy(hop) {
+			return hop
+		}
+		ip = hop
+	}
+	if realIP := strings.TrimSpace(request.Header.Get("X-Real-IP")); realIP != "" && forwarded[0] == "" {
+		return realIP
+	}
+	return ip
+}
+
+// allow decides whether a request from ip may pass and otherwise returns the reason and when to retry.
+// A token is only taken if both limits let the request pass.
+func (limiter *RateLimiter) allow(ip string, now time.Time) (bool, string, time.Duration) {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+	limiter.prune(now)
+	var bucket *tokenBucket
+	if limiter.perIPRate > 0 {
+		var exists bool
+		bucket, exists = limiter.buckets[ip]
+		if !exists {
+			bucket = &tokenBucket{}
+			limiter.buckets[ip] = bucket
+		}
+		if retryAfter := bucket.refill(now, limiter.perIPRate, limiter.perIPBurst); retryAfter > 0 {
+			return false, "per-ip", retryAfter
+		}
+	}
+	if limiter.globalRate > 0 {
+		if retryAfter := limiter.global.refill(now, limiter.globalRate, limiter.globalBurst); retryAfter > 0 {
+			return false, "global", retryAfter
+		}
+		limiter.global.tokens--
+	}
+	if bucket != nil {
+		bucket.tokens--
+	}
+	return true, "", 0
+}
+
+// prune forgets buckets that have refilled completely, at most once per minute.
+func (limiter *RateLimiter) prune(now time.Time) {
+	if limiter.perIPRate <= 0 || now.Sub(limiter.lastPrune) < time.Minute {
+		return
+	}
+	limiter.lastPrune = now
+	refillTime := time.Duration(limiter.perIPBurst / limiter.perIPRate * float64(time.Second))
+	for ip, bucket := range limiter.buckets {
+		if now.Sub(bucket.last) > refillTime {
+			delete(limiter.buckets, ip)
+		}
+	}
+}
+
+func (limiter *RateLimiter) recordBlocked(ip string, path string, reason string, now time.Time) {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+	date := now.UTC().Format(time.RFC3339)
+	client, exists := limiter.blocked[ip]
+	if !exists {
+		if len(limiter.blocked) >= maxBlockedClients {
+			// Forget the client that was blocked longest ago.
+			var oldest *model.BlockedClient
+			for _, candidate := range limiter.blocked {
+				if oldest == nil || candidate.LastBlocked < oldest.LastBlocked {
+					oldest = candidate
+				}
+			}
+			delete(limiter.blocked, oldest.IP)
+		}
+		client = &model.BlockedClient{IP: ip, FirstBlocked: date}
+		limiter.blocked[ip] = client
+	}
+	client.Count++
+	client.LastBlocked = date
+	client.LastPath = path
+	client.LastReason = reason
+}
+
+// takeBlockedClients returns the clients that were blocked since the last call.
+func (limiter *RateLimiter) takeBlockedClients() []model.BlockedClient {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+	clients := make([]model.BlockedClient, 0, len(limiter.blocked))
+	for _, client := range limiter.blocked {
+		clients = append(clients, *client)
+	}
+	limiter.blocked = make(map[string]*model.BlockedClient)
+	return clients
+}
+
+// Limit wraps a handler and answers with 429 Too Many Requests if a limit is exceeded.
+func (limiter *RateLimiter) Limit(handler http.HandlerFunc) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		now := time.Now()
+		ip := limiter.ClientIP(request)
+		ok, reason, retryAfter := limiter.allow(ip, now)
+		if !ok {
+			limiter.recordBlocked(ip, request.URL.Path, reason, now)
+			// The IP address is personal data, admins find it in the blocked clients.
+			logging.FromContext(request.Context()).Warn("rate limited", logging.Fields{"method": request.Method, "path": request.URL.Path, "limit": reason})
+			writer.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+			writeError(writer, http.StatusTooManyRequests, ErrorRateLimited, model.Message(model.NegotiateLocale(request.Header.Get("Accept-Language")), "rate_limited"))
+			return
+		}
+		handler(writer, request)
+	}
+}
+
+// saveBlockedClients saves the clients blocked since the last save and deletes the blocks that are older than
+// BlockedClientRetention.
+func (server *Server) saveBlockedClients(now time.Time) error {
+	err := model.SaveBlockedClients(server.Db, server.RateLimiter.takeBlockedClients(), &server.Mutex)
+	if err != nil {
+		return err
+	}
+	return model.DeleteBlockedClientsBefore(server.Db, now.Add(-BlockedClientRetention).UTC().Format(time.RFC3339), &server.Mutex)
+}
+
+// ScheduleSavingBlockedClients saves the clients blocked by the attached rate limiter every interval and when the
+// server shuts down.
+func (server *Server) ScheduleSavingBlockedClients(interval time.Duration) {
+	server.Go(func(stop <-chan struct{}) {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				err := server.saveBlockedClients(time.Now())
+				if err != nil {
+					logging.Error("saving blocked clients failed", logging.Fields{"error": err})
+				}
+				return
+			case <-ticker.C:
+				err := server.saveBlockedClients(time.Now())
+				if err != nil {
+					logging.Error("saving blocked clients failed", logging.Fields{"error": err})
+				}
+			}
+		}
+	})
+}
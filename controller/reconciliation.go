@@ -0,0 +1,374 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kunterbunt/calendarium-server/logging"
+	"github.com/kunterbunt/calendarium-server/model"
+)
+
+// maxStatementSize limits uploaded bank statements.
+const maxStatementSize = 10 << 20
+
+// orderNumberPattern finds order numbers in remittance texts. Customers and banks often drop the
+// dash or the leading zeros, or break the number with a space, e.g. "CC 000042", "cc42".
+var orderNumberPattern = regexp.MustCompile(`(?i)\bCC[\s\-_.]?(\d{1,6})\b`)
+
+// findOrderIDs returns the IDs of the distinct order numbers in a remittance text.
+func findOrderIDs(reference string) []int64 {
+	ids := make([]int64, 0)
+	for _, match := range orderNumberPattern.FindAllStringSubmatch(reference, -1) {
+		id, err := strconv.ParseInt(match[1], 10, 64)
+		if err != nil || id == 0 {
+			continue
+		}
+		found := false
+		for _, existing := range ids {
+			found = found || existing == id
+		}
+		if !found {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// priceCents returns the total price of an order in cents.
+func priceCents(order *model.Order) int64 {
+	return int64(math.Round(model.ComputePrice(order) * 100))
+}
+
+// ReconciledPayment is a bank payment with the state of its order.
+type ReconciledPayment struct {
+	model.BankPayment
+	OrderNumber string `json:"order_number,omitempty"`
+	// TotalCents is the price of the order, PaidCents the sum of its bank payments including this one.
+	TotalCents       int64 `json:"total_cents,omitempty"`
+	PaidCents        int64 `json:"paid_cents,omitempty"`
+	OutstandingCents int64 `json:"outstanding_cents,omitempty"`
+}
+
+// ReconciliationReport lists the payments of an imported bank statement by their status.
+type ReconciliationReport struct {
+	DryRun bool `json:"dry_run"`
+	// Credits counts the credits of the statement, Skipped those that were imported before.
+	Credits   int                 `json:"credits"`
+	Skipped   int                 `json:"skipped"`
+	Matched   []ReconciledPayment `json:"matched"`
+	Partial   []ReconciledPayment `json:"partial"`
+	Overpaid  []ReconciledPayment `json:"overpaid"`
+	Duplicate []ReconciledPayment `json:"duplicate"`
+	Unmatched []ReconciledPayment `json:"unmatched"`
+}
+
+func (report *ReconciliationReport) add(payment ReconciledPayment) {
+	switch payment.Status {
+	case model.BankPaymentMatched:
+		report.Matched = append(report.Matched, payment)
+	case model.BankPaymentPartial:
+		report.Partial = append(report.Partial, payment)
+	case model.BankPaymentOverpaid:
+		report.Overpaid = append(report.Overpaid, payment)
+	case model.BankPaymentDuplicate:
+		report.Duplicate = append(report.Duplicate, payment)
+	default:
+		report.Unmatched = append(report.Unmatched, payment)
+	}
+}
+
+// ImportBankStatement matches the credits of a bank statement to orders by the order number in their
+// remittance text and by amount. Orders whose payments add up to their total price are marked paid.
+// Credits that were imported before are skipped. With dryRun, nothing is saved.
+func (server *Server) ImportBankStatement(ctx context.Context, credits []BankCredit, now time.Time, dryRun bool) (*ReconciliationReport, error) {
+	report := ReconciliationReport{
+		DryRun:    dryRun,
+		Credits:   len(credits),
+		Matched:   make([]ReconciledPayment, 0),
+		Partial:   make([]ReconciledPayment, 0),
+		Overpaid:  make([]ReconciledPayment, 0),
+		Duplicate: make([]ReconciledPayment, 0),
+		Unmatched: make([]ReconciledPayment, 0),
+	}
+	if server.SEPACreditor != nil && !dryRun {
+		// Direct debits show up as one credit for the whole file, so their orders are not matched here.
+		_, err := server.SettleDirectDebits(ctx, now)
+		if err != nil {
+			return &report, err
+		}
+	}
+	// In a dry run, payments of the same order within the statement still add up.
+	pending := make(map[int64]int64)
+	for _, credit := range credits {
+		key := credit.Key()
+		exists, err := model.BankPaymentExists(server.Db, key, &server.Mutex)
+		if err != nil {
+			return &report, err
+		}
+		if exists {
+			report.Skipped++
+			continue
+		}
+		payment := ReconciledPayment{BankPayment: model.BankPayment{
+			Key:           key,
+			BookingDate:   credit.BookingDate,
+			AmountCents:   credit.AmountCents,
+			Currency:      credit.Currency,
+			Reference:     credit.Reference,
+			Counterparty:  credit.Counterparty,
+			IBAN:          credit.IBAN,
+			BankReference: credit.BankReference,
+			Status:        model.BankPaymentUnmatched,
+			ImportedAt:    now.UTC().Format(time.RFC3339),
+		}}
+		order, err := server.matchOrder(&payment)
+		if err != nil {
+			return &report, err
+		}
+		if order != nil {
+			previous, err := model.GetBankPaymentsOfOrder(server.Db, order.ID, &server.Mutex)
+			if err != nil {
+				return &report, err
+			}
+			paid := pending[order.ID]
+			for _, earlier := range previous {
+				paid += earlier.AmountCents
+			}
+			payment.PaidCents = paid + payment.AmountCents
+			payment.OutstandingCents = payment.TotalCents - payment.PaidCents
+			switch {
+			case order.PaidAt != "":
+				payment.Status = model.BankPaymentDuplicate
+				payment.Note = "order was paid " + order.PaidAt
+				if order.PaymentReference != "" {
+					payment.Note += " with " + order.PaymentReference
+				}
+			case payment.OutstandingCents > 0:
+				payment.Status = model.BankPaymentPartial
+			case payment.OutstandingCents < 0:
+				payment.Status = model.BankPaymentOverpaid
+			default:
+				payment.Status = model.BankPaymentMatched
+			}
+			pending[order.ID] += payment.AmountCents
+		}
+		if !dryRun {
+			// A payment that is saved but did not mark its order paid would be skipped by the next import.
+			err = model.Transaction(server.Db, &server.Mutex, func(tx model.Queryer) error {
+				err := model.AddBankPayment(tx, &payment.BankPayment, nil)
+				if err != nil {
+					return err
+				}
+				if order != nil && (payment.Status == model.BankPaymentMatched || payment.Status == model.BankPaymentOverpaid) {
+					return server.markPaidByBank(ctx, tx, order, &payment.BankPayment)
+				}
+				return nil
+			})
+			if err != nil {
+				return &report, err
+			}
+		}
+		report.add(payment)
+	}
+	logging.FromContext(ctx).Info("imported bank statement", logging.Fields{"dry_run": dryRun, "credits": report.Credits, "skipped": report.Skipped,
+		"matched": len(report.Matched), "partial": len(report.Partial), "overpaid": len(report.Overpaid), "duplicate": len(report.Duplicate), "unmatched": len(report.Unmatched)})
+	return &report, nil
+}
+
+// matchOrder returns the order that a payment is meant for, or nil with a note on the payment why there is none.
+func (server *Server) matchOrder(payment *ReconciledPayment) (*model.Order, error) {
+	if payment.Currency != "EUR" {
+		payment.Note = "currency is not EUR"
+		return nil, nil
+	}
+	var orders []*model.Order
+	for _, id := range findOrderIDs(payment.Reference) {
+		order, err := model.GetOrder(server.Db, id, &server.Mutex)
+		if err != nil {
+			return nil, err
+		}
+		if order.ID != int64(model.InvalidID) {
+			orders = append(orders, order)
+		}
+	}
+	switch len(orders) {
+	case 0:
+		if len(findOrderIDs(payment.Reference)) > 0 {
+			payment.Note = "unknown order number in reference"
+			return nil, nil
+		}
+		return server.matchOrderByPayer(payment)
+	case 1:
+	default:
+		// E.g. a typo in one of the numbers, or several orders paid at once. The amount decides.
+		var matching []*model.Order
+		for _, order := range orders {
+			if priceCents(order) == payment.AmountCents {
+				matching = append(matching, order)
+			}
+		}
+		if len(matching) != 1 {
+			payment.Note = "several order numbers in reference"
+			return nil, nil
+		}
+		orders = matching
+	}
+	order := orders[0]
+	if order.Quarantined {
+		// Spam orders are not shipped, a payment for one needs a look before it is released.
+		payment.Note = "order " + ToOrderId(order.ID) + " is quarantined"
+		return nil, nil
+	}
+	if order.CancelledAt != "" {
+		// The payment is booked either way, marking the order paid flags it for review.
+		payment.Note = "order was cancelled " + order.CancelledAt
+	}
+	assignOrder(payment, order)
+	return order, nil
+}
+
+// matchOrderByPayer matches a payment without an order number in its reference to the only unpaid
+// bank transfer order with the payment's amount whose invoice name is the counterparty.
+func (server *Server) matchOrderByPayer(payment *ReconciledPayment) (*model.Order, error) {
+	payment.Note = "no order number in reference"
+	unpaid, err := model.GetUnpaidOrders(server.Db, payment.ImportedAt, []string{PaymentBankTransfer}, &server.Mutex)
+	if err != nil {
+		return nil, err
+	}
+	counterparty := strings.ToLower(payment.Counterparty)
+	var byAmount, byPayer []model.Order
+	for _, order := range unpaid {
+		if priceCents(&order) != payment.AmountCents {
+			continue
+		}
+		byAmount = append(byAmount, order)
+		first := strings.ToLower(strings.TrimSpace(order.FirstNameInvoice))
+		last := strings.ToLower(strings.TrimSpace(order.LastNameInvoice))
+		if first != "" && last != "" && strings.Contains(counterparty, first) && strings.Contains(counterparty, last) {
+			byPayer = append(byPayer, order)
+		}
+	}
+	if len(byPayer) == 1 {
+		order := byPayer[0]
+		payment.Note = "matched by amount and counterparty"
+		assignOrder(payment, &order)
+		return &order, nil
+	}
+	// The amount alone is too weak for marking an order paid, but helps whoever looks at the payment.
+	if len(byAmount) == 1 {
+		payment.Note += ", amount fits order " + ToOrderId(byAmount[0].ID)
+	}
+	return nil, nil
+}
+
+// assignOrder links a payment to its order.
+func assignOrder(payment *ReconciledPayment, order *model.Order) {
+	payment.OrderID = order.ID
+	payment.OrderNumber = ToOrderId(order.ID)
+	payment.TotalCents = priceCents(order)
+}
+
+// markPaidByBank marks an order paid by a saved bank payment within a transaction and settles its earlier partial payments.
+func (server *Server) markPaidByBank(ctx context.Context, tx model.Queryer, order *model.Order, payment *model.BankPayment) error {
+	paidAt := payment.BookingDate + "T00:00:00Z"
+	if date, err := time.Parse("2006-01-02", payment.BookingDate); err == nil {
+		paidAt = date.Format(time.RFC3339)
+	}
+	_, err := server.markOrderPaid(ctx, tx, order, paidAt, "bank:"+strconv.FormatInt(payment.ID, 10))
+	if err != nil {
+		return err
+	}
+	return model.SetBankPaymentsOfOrderStatus(tx, order.ID, model.BankPaymentPartial, model.BankPaymentMatched, nil)
+}
+
+// OpenBankPayments returns the imported payments that need manual attention: partial, overpaid,
+// duplicate and unmatched ones, with the current state of their orders.
+func (server *Server) OpenBankPayments() ([]ReconciledPayment, error) {
+	payments, err := model.GetBankPaymentsWithStatus(server.Db, []string{model.BankPaymentPartial, model.BankPaymentOverpaid, model.BankPaymentDuplicate, model.BankPaymentUnmatched}, &server.Mutex)
+	if err != nil {
+		return nil, err
+	}
+	open := make([]ReconciledPayment, 0, len(payments))
+	for _, payment := range payments {
+		reconciled := ReconciledPayment{BankPayment: payment}
+		if payment.OrderID != 0 {
+			order, err := model.GetOrder(server.Db, payment.OrderID, &server.Mutex)
+			if err != nil {
+				return nil, err
+			}
+			ofOrder, err := model.GetBankPaymentsOfOrder(server.Db, payment.OrderID, &server.Mutex)
+			if err != nil {
+				return nil, err
+			}
+			reconciled.OrderNumber = ToOrderId(payment.OrderID)
+			if order.ID != int64(model.InvalidID) {
+				reconciled.TotalCents = priceCents(order)
+			}
+			for _, other := range ofOrder {
+				reconciled.PaidCents += other.AmountCents
+			}
+			reconciled.OutstandingCents = reconciled.TotalCents - reconciled.PaidCents
+		}
+		open = append(open, reconciled)
+	}
+	return open, nil
+}
+
+// importBankStatement imports the bank statement in the request body. The query parameter format
+// is camt053, mt940 or csv, detected from the content if missing. With dry_run=true, nothing is saved.
+func (server *Server) importBankStatement(writer http.ResponseWriter, request *http.Request) {
+	logger := logging.FromContext(request.Context())
+	logger.Debug("importBankStatement API call")
+	data, err := ioutil.ReadAll(http.MaxBytesReader(writer, request.Body, maxStatementSize))
+	if err != nil {
+		writeError(writer, http.StatusBadRequest, ErrorInvalidRequest, err.Error())
+		return
+	}
+	credits, err := ParseBankStatement(data, request.URL.Query().Get("format"))
+	if err != nil {
+		logger.Info("invalid bank statement", logging.Fields{"error": err})
+		writeError(writer, http.StatusBadRequest, ErrorInvalidRequest, err.Error())
+		return
+	}
+	report, err := server.ImportBankStatement(request.Context(), credits, time.Now(), request.URL.Query().Get("dry_run") == "true")
+	if err != nil {
+		logger.Error("importBankStatement failed", logging.Fields{"error": err})
+		writeError(writer, http.StatusInternalServerError, ErrorInternal, err.Error())
+		return
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	writer.Header().Set("Cache-Control", "no-store")
+	err = json.NewEncoder(writer).Encode(report)
+	if err != nil {
+		logger.Error("importBankStatement failed", logging.Fields{"error": err})
+		return
+	}
+	logger.Debug("sent reply")
+}
+
+// getOpenBankPayments returns the report of partial, overpaid, duplicate and unmatched bank payments.
+func (server *Server) getOpenBankPayments(writer http.ResponseWriter, request *http.Request) {
+	logger := logging.FromContext(request.Context())
+	logger.Debug("getOpenBankPayments API call")
+	payments, err := server.OpenBankPayments()
+	if err != nil {
+		logger.Error("getOpenBankPayments failed", logging.Fields{"error": err})
+		writeError(writer, http.StatusInternalServerError, ErrorInternal, err.Error())
+		return
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	writer.Header().Set("Cache-Control", "no-store")
+	err = json.NewEncoder(writer).Encode(visibleTo(request, payments))
+	if err != nil {
+		logger.Error("getOpenBankPayments failed", logging.Fields{"error": err})
+		return
+	}
+	logger.Debug("sent reply")
+}
@@ -0,0 +1,249 @@
+package controller
+
+import (
+	"context"
+	"time"
+
+	"github.com/kunterbunt/calendarium-server/logging"
+	"github.com/kunterbunt/calendarium-server/model"
+)
+
+// RetentionPolicy says when stored personal data is removed. Zero values disable a rule.
+type RetentionPolicy struct {
+	// AnonymizeAfterMonths removes the personal data that is not needed for accounting, see model.AnonymizeOrder.
+	AnonymizeAfterMonths int
+	// PurgeSpamAfterDays deletes quarantined orders.
+	PurgeSpamAfterDays int
+	// EraseAfterRetention pseudonymizes orders once their statutory retention period ended, see Server.RetentionYears.
+	EraseAfterRetention bool
+}
+
+// Enabled reports whether any rule of the policy is enabled.
+func (policy RetentionPolicy) Enabled() bool {
+	return policy.AnonymizeAfterMonths > 0 || policy.PurgeSpamAfterDays > 0 || policy.EraseAfterRetention
+}
+
+// RetentionReport lists the order numbers changed by one run of the retention policy.
+type RetentionReport struct {
+	DryRun     bool     `json:"dry_run"`
+	Date       string   `json:"date"`
+	Anonymized []string `json:"anonymized"`
+	Erased     []string `json:"erased"`
+	Purged     []string `json:"purged"`
+	// ErasedBankPayments counts the bank payments whose payer was removed, including unmatched ones.
+	ErasedBankPayments int `json:"erased_bank_payments"`
+	// PurgedDirectDebitFiles counts the deleted pain.008 files.
+	PurgedDirectDebitFiles int `json:"purged_direct_debit_files"`
+}
+
+// Changes counts the changed orders, bank payments and direct debit files.
+func (report *RetentionReport) Changes() int {
+	return len(report.Anonymized) + len(report.Erased) + len(report.Purged) + report.ErasedBankPayments + report.PurgedDirectDebitFiles
+}
+
+// ApplyRetentionPolicy applies the attached retention policy. With dryRun, nothing is changed.
+func (server *Server) ApplyRetentionPolicy(ctx context.Context, now time.Time, dryRun bool) (*RetentionReport, error) {
+	policy := server.RetentionPolicy
+	report := RetentionReport{DryRun: dryRun, Date: now.UTC().Format(time.RFC3339), Anonymized: make([]string, 0), Erased: make([]string, 0), Purged: make([]string, 0)}
+	date := now.UTC().Format(time.RFC3339)
+
+	if policy.PurgeSpamAfterDays > 0 {
+		before := now.UTC().AddDate(0, 0, -policy.PurgeSpamAfterDays).Format(time.RFC3339)
+		orders, err := model.GetOrdersPlacedBefore(server.Db, before, &server.Mutex)
+		if err != nil {
+			return &report, err
+		}
+		for _, order := range orders {
+			if !order.Quarantined {
+				continue
+			}
+			if !dryRun {
+				err = model.Transaction(server.Db, &server.Mutex, func(tx model.Queryer) error {
+					err := model.DeleteOrder(tx, order.ID, nil)
+					if err != nil {
+						return err
+					}
+					return server.auditOrder(ctx, tx, "order.purge", &order)
+				})
+				if err != nil {
+					return &report, err
+				}
+			}
+			report.Purged = append(report.Purged, ToOrderId(order.ID))
+		}
+	}
+
+	if policy.EraseAfterRetention {
+		// Orders placed before this year ended their retention period by now.
+		before := time.Date(now.UTC().Year()-server.RetentionYears, time.January, 1, 0, 0, 0, 0, time.UTC).Format(time.RFC3339)
+		orders, err := model.GetOrdersPlacedBefore(server.Db, before, &server.Mutex)
+		if err != nil {
+			return &report, err
+		}
+		for _, order := range orders {
+			if order.ErasedAt != "" || order.Quarantined {
+				continue
+			}
+			if !dryRun {
+				pseudonym, err := newPseudonym()
+				if err != nil {
+					return &report, err
+				}
+				err = model.Transaction(server.Db, &server.Mutex, func(tx model.Queryer) error {
+					err := model.PseudonymizeOrder(tx, order.ID, pseudonym, date, nil)
+					if err != nil {
+						return err
+					}
+					return server.auditOrder(ctx, tx, "order.erase", &order)
+				})
+				if err != nil {
+					return &report, err
+				}
+			}
+			report.Erased = append(report.Erased, ToOrderId(order.ID))
+		}
+		uzOrders, err := model.GetUzOrdersPlacedBefore(server.Db, before, &server.Mutex)
+		if err != nil {
+			return &report, err
+		}
+		for _, order := range uzOrders {
+			if order.ErasedAt != "" {
+				continue
+			}
+			if !dryRun {
+				pseudonym, err := newPseudonym()
+				if err != nil {
+					return &report, err
+				}
+				err = model.Transaction(server.Db, &server.Mutex, func(tx model.Queryer) error {
+					err := model.PseudonymizeUzOrder(tx, order.ID, pseudonym, date, nil)
+					if err != nil {
+						return err
+					}
+					return server.auditUzOrder(ctx, tx, "uz_order.erase", &order)
+				})
+				if err != nil {
+					return &report, err
+				}
+			}
+			report.Erased = append(report.Erased, ToUzOrderId(order.ID))
+		}
+		// Payments of erased orders were pseudonymized with them, this catches those without an order.
+		payments, err := model.GetBankPaymentsBookedBefore(server.Db, before[:10], &server.Mutex)
+		if err != nil {
+			return &report, err
+		}
+		for _, payment := range payments {
+			if !dryRun {
+				pseudonym, err := newPseudonym()
+				if err != nil {
+					return &report, err
+				}
+				err = model.PseudonymizeBankPayment(server.Db, payment.ID, pseudonym, &server.Mutex)
+				if err != nil {
+					return &report, err
+				}
+			}
+			report.ErasedBankPayments++
+		}
+		// Direct debit files list the names and IBANs of the debtors.
+		if dryRun {
+			exports, err := model.GetDirectDebitExports(server.Db, &server.Mutex)
+			if err != nil {
+				return &report, err
+			}
+			for _, export := range exports {
+				if export.CreatedAt < before {
+					report.PurgedDirectDebitFiles++
+				}
+			}
+		} else {
+			purged, err := model.DeleteDirectDebitExportsCreatedBefore(server.Db, before, &server.Mutex)
+			if err != nil {
+				return &report, err
+			}
+			report.PurgedDirectDebitFiles = int(purged)
+		}
+	}
+
+	if policy.AnonymizeAfterMonths > 0 {
+		before := now.UTC().AddDate(0, -policy.AnonymizeAfterMonths, 0).Format(time.RFC3339)
+		orders, err := model.GetOrdersPlacedBefore(server.Db, before, &server.Mutex)
+		if err != nil {
+			return &report, err
+		}
+		for _, order := range orders {
+			// In a dry run, orders that would have been erased above are still there.
+			if order.AnonymizedAt != "" || order.ErasedAt != "" || order.Quarantined || contains(report.Erased, ToOrderId(order.ID)) {
+				continue
+			}
+			if !dryRun {
+				err = model.Transaction(server.Db, &server.Mutex, func(tx model.Queryer) error {
+					err := model.AnonymizeOrder(tx, order.ID, date, nil)
+					if err != nil {
+						return err
+					}
+					return server.auditOrder(ctx, tx, "order.anonymize", &order)
+				})
+				if err != nil {
+					return &report, err
+				}
+			}
+			report.Anonymized = append(report.Anonymized, ToOrderId(order.ID))
+		}
+		uzOrders, err := model.GetUzOrdersPlacedBefore(server.Db, before, &server.Mutex)
+		if err != nil {
+			return &report, err
+		}
+		for _, order := range uzOrders {
+			if order.AnonymizedAt != "" || order.ErasedAt != "" || contains(report.Erased, ToUzOrderId(order.ID)) {
+				continue
+			}
+			if !dryRun {
+				err = model.Transaction(server.Db, &server.Mutex, func(tx model.Queryer) error {
+					err := model.AnonymizeUzOrder(tx, order.ID, date, nil)
+					if err != nil {
+						return err
+					}
+					return server.auditUzOrder(ctx, tx, "uz_order.anonymize", &order)
+				})
+				if err != nil {
+					return &report, err
+				}
+			}
+			report.Anonymized = append(report.Anonymized, ToUzOrderId(order.ID))
+		}
+	}
+
+	logging.FromContext(ctx).Info("applied retention policy", logging.Fields{"dry_run": dryRun, "anonymized": report.Anonymized, "erased": report.Erased, "purged": report.Purged, "erased_bank_payments": report.ErasedBankPayments, "purged_direct_debit_files": report.PurgedDirectDebitFiles})
+	return &report, nil
+}
+
+// ScheduleRetentionPolicy applies the retention policy now and then every interval until the server shuts down.
+func (server *Server) ScheduleRetentionPolicy(interval time.Duration) {
+	logging.Info("scheduled retention policy", logging.Fields{"interval": interval.String()})
+	server.Go(func(stop <-chan struct{}) {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			_, err := server.ApplyRetentionPolicy(WithActor(context.Background(), "retention"), time.Now(), false)
+			if err != nil {
+				logging.Error("retention policy failed", logging.Fields{"error": err})
+			}
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+		}
+	})
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,213 @@
+package controller
+
+import (
+	"errors"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/kunterbunt/calendarium-server/logging"
+)
+
+// Roles of admin users.
+const (
+	RoleViewer      = "viewer"
+	RoleFulfillment = "fulfillment"
+	RoleFinance     = "finance"
+	RoleAdmin       = "admin"
+)
+
+// Permission to use admin endpoints.
+type Permission string
+
+// Permissions checked by the routes registered in NewServer.
+const (
+	PermissionReadOrders    Permission = "orders:read"
+	PermissionReleaseOrders Permission = "orders:release"
+	PermissionReadMetrics   Permission = "metrics:read"
+	PermissionReadRateLimit Permission = "rate-limit:read"
+	PermissionPersonalData  Permission = "personal-data"
+	PermissionReadAudit     Permission = "audit:read"
+	PermissionReconcile     Permission = "payments:reconcile"
+	PermissionDirectDebit   Permission = "payments:debit"
+)
+
+// Field groups of the `access` tags of model.Order.
+const (
+	FieldsAddress = "address"
+	FieldsPayment = "payment"
+)
+
+// role lists what the users of a role may do and which field groups they see.
+type role struct {
+	permissions []Permission
+	fields      []string
+}
+
+var roles = map[string]role{
+	RoleViewer: {
+		permissions: []Permission{PermissionReadOrders, PermissionReadMetrics},
+	},
+	RoleFulfillment: {
+		permissions: []Permission{PermissionReadOrders, PermissionReleaseOrders, PermissionReadMetrics},
+		fields:      []string{FieldsAddress},
+	},
+	RoleFinance: {
+		permissions: []Permission{PermissionReadOrders, PermissionReadMetrics, PermissionReadAudit, PermissionReconcile, PermissionDirectDebit},
+		fields:      []string{FieldsAddress, FieldsPayment},
+	},
+	RoleAdmin: {
+		permissions: []Permission{PermissionReadOrders, PermissionReleaseOrders, PermissionReadMetrics, PermissionReadRateLimit, PermissionPersonalData, PermissionReadAudit, PermissionReconcile, PermissionDirectDebit},
+		fields:      []string{FieldsAddress, FieldsPayment},
+	},
+}
+
+// Roles returns the names of all roles.
+func Roles() []string {
+	names := make([]string, 0, len(roles))
+	for name := range roles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// checkRole returns an error if there is no role with the given name.
+func checkRole(name string) error {
+	if _, ok := roles[name]; !ok {
+		return errors.New("unknown role '" + name + "', use one of " + strings.Join(Roles(), ", "))
+	}
+	return nil
+}
+
+// HasPermission reports whether a role grants a permission. Unknown roles grant nothing.
+func HasPermission(roleName string, permission Permission) bool {
+	for _, granted := range roles[roleName].permissions {
+		if granted == permission {
+			return true
+		}
+	}
+	return false
+}
+
+// canSee reports whether a role grants access to all field groups of an `access` tag.
+func canSee(roleName string, tag string) bool {
+	for _, group := range strings.Split(tag, ",") {
+		found := false
+		for _, granted := range roles[roleName].fields {
+			if granted == group {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// requirePermission only passes requests of admin users whose role grants the permission to a handler.
+func (server *Server) requirePermission(permission Permission, handler http.HandlerFunc) http.HandlerFunc {
+	return server.requireLogin(func(writer http.ResponseWriter, request *http.Request) {
+		user := adminFromContext(request.Context())
+		if !HasPermission(user.Role, permission) {
+			logging.FromContext(request.Context()).Warn("permission denied", logging.Fields{"role": user.Role, "permission": permission})
+			writeError(writer, http.StatusForbidden, ErrorForbidden, "the role '"+user.Role+"' lacks the permission '"+string(permission)+"'")
+			return
+		}
+		handler(writer, request)
+	})
+}
+
+// filterFields prepares a response for an admin user. Structs with fields tagged `access` become maps
+// keyed by their JSON field names without the fields that the role may not see. Pointers and slices are handled as well.
+func filterFields(value interface{}, roleName string) interface{} {
+	if value == nil {
+		return nil
+	}
+	return filterValue(reflect.ValueOf(value), roleName)
+}
+
+func filterValue(value reflect.Value, roleName string) interface{} {
+	switch value.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if value.IsNil() {
+			return nil
+		}
+		return filterValue(value.Elem(), roleName)
+	case reflect.Struct:
+		if !hasAccessTags(value.Type()) {
+			return value.Interface()
+		}
+		fields := make(map[string]interface{}, value.NumField())
+		filterStruct(value, roleName, fields)
+		return fields
+	case reflect.Slice, reflect.Array:
+		if !hasAccessTags(value.Type().Elem()) {
+			return value.Interface()
+		}
+		items := make([]interface{}, value.Len())
+		for i := range items {
+			items[i] = filterValue(value.Index(i), roleName)
+		}
+		return items
+	}
+	return value.Interface()
+}
+
+// filterStruct adds the visible exported fields of a struct to fields, flattening embedded structs like encoding/json.
+func filterStruct(value reflect.Value, roleName string, fields map[string]interface{}) {
+	structType := value.Type()
+	for i := 0; i < structType.NumField(); i++ {
+		field := structType.Field(i)
+		if field.PkgPath != "" {
+			continue // unexported
+		}
+		if field.Anonymous && field.Type.Kind() == reflect.Struct {
+			filterStruct(value.Field(i), roleName, fields)
+			continue
+		}
+		tag := strings.Split(field.Tag.Get("json"), ",")
+		name := tag[0]
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		if len(tag) > 1 && tag[1] == "omitempty" && value.Field(i).IsZero() {
+			continue
+		}
+		if access := field.Tag.Get("access"); access != "" && !canSee(roleName, access) {
+			continue
+		}
+		fields[name] = filterValue(value.Field(i), roleName)
+	}
+}
+
+// hasAccessTags reports whether values of a type can contain fields tagged `access`.
+func hasAccessTags(valueType reflect.Type) bool {
+	switch valueType.Kind() {
+	case reflect.Ptr, reflect.Slice, reflect.Array:
+		return hasAccessTags(valueType.Elem())
+	case reflect.Struct:
+		for i := 0; i < valueType.NumField(); i++ {
+			field := valueType.Field(i)
+			if field.Tag.Get("access") != "" || (field.Anonymous && hasAccessTags(field.Type)) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// visibleTo filters a response for the admin user of a request.
+func visibleTo(request *http.Request, value interface{}) interface{} {
+	user := adminFromContext(request.Context())
+	if user == nil {
+		return filterFields(value, "")
+	}
+	return filterFields(value, user.Role)
+}
@@ -0,0 +1,450 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/kunterbunt/calendarium-server/logging"
+	"github.com/kunterbunt/calendarium-server/model"
+)
+
+// SEPACreditor collects payments by SEPA direct debit onto its bank account.
+type SEPACreditor struct {
+	Name string
+	IBAN string
+	BIC  string // optional within the EEA
+	// CreditorID is the SEPA creditor identifier (Gläubiger-Identifikationsnummer), e.g. "DE98ZZZ09999999999".
+	CreditorID string
+}
+
+// AttachSEPACreditor enables payment by SEPA direct debit: mandates are recorded with orders and
+// admins export the pending debits as pain.008 file for the bank, which can be downloaded again later.
+func (server *Server) AttachSEPACreditor(creditor SEPACreditor) {
+	server.SEPACreditor = &creditor
+	server.router.HandleFunc("/api/payments/sepa/mandate", server.getMandateText).Methods("GET")
+	server.router.HandleFunc("/api/admin/payments/sepa/debits", server.requirePermission(PermissionDirectDebit, server.exportDirectDebits)).Methods("POST")
+	server.router.HandleFunc("/api/admin/payments/sepa/debits", server.requirePermission(PermissionDirectDebit, server.getDirectDebitExports)).Methods("GET")
+	server.router.HandleFunc("/api/admin/payments/sepa/debits/{message_id}", server.requirePermission(PermissionDirectDebit, server.getDirectDebitExport)).Methods("GET")
+}
+
+// MandateText returns the text of the direct debit mandate that customers agree to.
+func (creditor *SEPACreditor) MandateText(locale string) string {
+	return model.Message(locale, "sepa.mandate", creditor.Name, creditor.CreditorID)
+}
+
+// MandateReference returns the reference of the direct debit mandate of an order.
+func MandateReference(orderID int64) string {
+	return ToOrderId(orderID) + "-SEPA"
+}
+
+// DirectDebitDetails tell customers how an order paid by direct debit is collected, i.e. the pre-notification.
+type DirectDebitDetails struct {
+	AccountHolder    string `json:"account_holder"`
+	IBAN             string `json:"iban"` // masked
+	MandateReference string `json:"mandate_reference"`
+	CreditorID       string `json:"creditor_id"`
+	Amount           string `json:"amount"` // e.g. "54.00"
+	Currency         string `json:"currency"`
+}
+
+// maskIBAN hides all but the country code and the last four characters of an IBAN.
+func maskIBAN(iban string) string {
+	if len(iban) < 8 {
+		return iban
+	}
+	return iban[:2] + strings.Repeat("*", len(iban)-6) + iban[len(iban)-4:]
+}
+
+// text returns the direct debit details as shown to customers.
+func (details *DirectDebitDetails) text(locale string) string {
+	return model.Message(locale, "order.sepa", details.Amount, details.IBAN, details.MandateReference, details.CreditorID)
+}
+
+// directDebitDetails returns how an order is collected by the attached creditor.
+func (server *Server) directDebitDetails(order *model.Order) *DirectDebitDetails {
+	return &DirectDebitDetails{
+		AccountHolder:    order.SEPAAccountHolder,
+		IBAN:             maskIBAN(order.SEPAIBAN),
+		MandateReference: order.SEPAMandateReference,
+		CreditorID:       server.SEPACreditor.CreditorID,
+		Amount:           formatEuros(priceCents(order)),
+		Currency:         "EUR",
+	}
+}
+
+// sepaReplacements transliterate the characters that are common in names but not allowed in SEPA files.
+var sepaReplacements = strings.NewReplacer("Ä", "Ae", "Ö", "Oe", "Ü", "Ue", "ä", "ae", "ö", "oe", "ü", "ue", "ß", "ss", "&", "+")
+
+// sepaText restricts a text to the SEPA character set and to max characters.
+func sepaText(text string, max int) string {
+	var allowed strings.Builder
+	for _, c := range sepaReplacements.Replace(text) {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', strings.ContainsRune("/-?:().,'+ ", c):
+			allowed.WriteRune(c)
+		default:
+			allowed.WriteRune('.')
+		}
+	}
+	result := strings.TrimSpace(allowed.String())
+	if len(result) > max {
+		result = strings.TrimSpace(result[:max])
+	}
+	return result
+}
+
+// Elements of a pain.008.001.08 customer direct debit initiation.
+type pain008Document struct {
+	XMLName    xml.Name          `xml:"urn:iso:std:iso:20022:tech:xsd:pain.008.001.08 Document"`
+	Initiation pain008Initiation `xml:"CstmrDrctDbtInitn"`
+}
+
+type pain008Initiation struct {
+	GroupHeader pain008GroupHeader `xml:"GrpHdr"`
+	PaymentInfo pain008PaymentInfo `xml:"PmtInf"`
+}
+
+type pain008GroupHeader struct {
+	MessageID       string `xml:"MsgId"`
+	Created         string `xml:"CreDtTm"`
+	NumberOfTxs     int    `xml:"NbOfTxs"`
+	ControlSum      string `xml:"CtrlSum"`
+	InitiatingParty string `xml:"InitgPty>Nm"`
+}
+
+type pain008Agent struct {
+	BIC   string        `xml:"FinInstnId>BICFI,omitempty"`
+	Other *pain008Other `xml:"FinInstnId>Othr"`
+}
+
+type pain008Other struct {
+	ID string `xml:"Id"`
+}
+
+type pain008Amount struct {
+	Currency string `xml:"Ccy,attr"`
+	Value    string `xml:",chardata"`
+}
+
+type pain008PaymentInfo struct {
+	ID              string               `xml:"PmtInfId"`
+	Method          string               `xml:"PmtMtd"`
+	BatchBooking    bool                 `xml:"BtchBookg"`
+	NumberOfTxs     int                  `xml:"NbOfTxs"`
+	ControlSum      string               `xml:"CtrlSum"`
+	ServiceLevel    string               `xml:"PmtTpInf>SvcLvl>Cd"`
+	LocalInstrument string               `xml:"PmtTpInf>LclInstrm>Cd"`
+	SequenceType    string               `xml:"PmtTpInf>SeqTp"`
+	CollectionDate  string               `xml:"ReqdColltnDt"`
+	Creditor        string               `xml:"Cdtr>Nm"`
+	CreditorIBAN    string               `xml:"CdtrAcct>Id>IBAN"`
+	CreditorAgent   pain008Agent         `xml:"CdtrAgt"`
+	ChargeBearer    string               `xml:"ChrgBr"`
+	CreditorID      string               `xml:"CdtrSchmeId>Id>PrvtId>Othr>Id"`
+	Scheme          string               `xml:"CdtrSchmeId>Id>PrvtId>Othr>SchmeNm>Prtry"`
+	Transactions    []pain008Transaction `xml:"DrctDbtTxInf"`
+}
+
+type pain008Transaction struct {
+	EndToEndID  string        `xml:"PmtId>EndToEndId"`
+	Amount      pain008Amount `xml:"InstdAmt"`
+	MandateID   string        `xml:"DrctDbtTx>MndtRltdInf>MndtId"`
+	MandateDate string        `xml:"DrctDbtTx>MndtRltdInf>DtOfSgntr"`
+	DebtorAgent pain008Agent  `xml:"DbtrAgt"`
+	Debtor      string        `xml:"Dbtr>Nm"`
+	DebtorIBAN  string        `xml:"DbtrAcct>Id>IBAN"`
+	Remittance  string        `xml:"RmtInf>Ustrd"`
+}
+
+// agent identifies a bank by its BIC, which is optional within the EEA.
+func agent(bic string) pain008Agent {
+	if bic == "" {
+		return pain008Agent{Other: &pain008Other{"NOTPROVIDED"}}
+	}
+	return pain008Agent{BIC: bic}
+}
+
+// Pain008 returns the pain.008 file that collects the given orders as one-off SEPA core direct debits.
+func Pain008(creditor SEPACreditor, orders []model.Order, messageID string, collectionDate time.Time, now time.Time) ([]byte, error) {
+	info := pain008PaymentInfo{
+		ID:              messageID + "-1",
+		Method:          "DD",
+		BatchBooking:    true,
+		NumberOfTxs:     len(orders),
+		ServiceLevel:    "SEPA",
+		LocalInstrument: "CORE",
+		SequenceType:    "OOFF",
+		CollectionDate:  collectionDate.Format("2006-01-02"),
+		Creditor:        sepaText(creditor.Name, 70),
+		CreditorIBAN:    model.NormalizeIBAN(creditor.IBAN),
+		CreditorAgent:   agent(model.NormalizeIBAN(creditor.BIC)),
+		ChargeBearer:    "SLEV",
+		CreditorID:      model.NormalizeIBAN(creditor.CreditorID),
+		Scheme:          "SEPA",
+	}
+	var sum int64
+	for _, order := range orders {
+		cents := priceCents(&order)
+		sum += cents
+		info.Transactions = append(info.Transactions, pain008Transaction{
+			EndToEndID:  ToOrderId(order.ID),
+			Amount:      pain008Amount{"EUR", formatEuros(cents)},
+			MandateID:   order.SEPAMandateReference,
+			MandateDate: order.SEPAMandateDate,
+			DebtorAgent: agent(order.SEPABIC),
+			Debtor:      sepaText(order.SEPAAccountHolder, 70),
+			DebtorIBAN:  order.SEPAIBAN,
+			Remittance:  sepaText(ToOrderId(order.ID)+" Calendarium Culinarium", 140),
+		})
+	}
+	info.ControlSum = formatEuros(sum)
+	document := pain008Document{Initiation: pain008Initiation{
+		GroupHeader: pain008GroupHeader{
+			MessageID:       messageID,
+			Created:         now.Format("2006-01-02T15:04:05"),
+			NumberOfTxs:     len(orders),
+			ControlSum:      formatEuros(sum),
+			InitiatingParty: sepaText(creditor.Name, 70),
+		},
+		PaymentInfo: info,
+	}}
+	data, err := xml.MarshalIndent(document, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(xml.Header), data...), nil
+}
+
+// DirectDebitExport is a pain.008 file of direct debits.
+type DirectDebitExport struct {
+	model.DirectDebitExport
+	OrderNumbers []string
+}
+
+// ExportDirectDebits returns the pain.008 file of the direct debits that were not exported yet, saves it
+// under its message ID and marks the debits exported. Their orders are marked paid on the collection date,
+// see SettleDirectDebits. Debits that are returned by the bank have to be handled manually. With dryRun,
+// nothing is saved or marked and the debits are exported again the next time.
+func (server *Server) ExportDirectDebits(ctx context.Context, collectionDate time.Time, now time.Time, dryRun bool) (*DirectDebitExport, error) {
+	export := DirectDebitExport{
+		DirectDebitExport: model.DirectDebitExport{
+			MessageID:      "CC-SEPA-" + now.UTC().Format("20060102150405"),
+			CreatedAt:      now.UTC().Format(time.RFC3339),
+			CollectionDate: collectionDate.Format("2006-01-02"),
+		},
+		OrderNumbers: make([]string, 0),
+	}
+	// The file is built from the orders it marks, all of them or none.
+	build := func(db model.Queryer, mutex *sync.Mutex) ([]model.Order, error) {
+		orders, err := model.GetPendingDirectDebits(db, mutex)
+		if err != nil || len(orders) == 0 {
+			return orders, err
+		}
+		export.XML, err = Pain008(*server.SEPACreditor, orders, export.MessageID, collectionDate, now)
+		if err != nil {
+			return nil, err
+		}
+		export.OrderCount = len(orders)
+		for _, order := range orders {
+			export.ControlSumCents += priceCents(&order)
+			export.OrderNumbers = append(export.OrderNumbers, ToOrderId(order.ID))
+		}
+		return orders, nil
+	}
+	var err error
+	if dryRun {
+		_, err = build(server.Db, &server.Mutex)
+	} else {
+		err = model.Transaction(server.Db, &server.Mutex, func(tx model.Queryer) error {
+			orders, err := build(tx, nil)
+			if err != nil || len(orders) == 0 {
+				return err
+			}
+			for _, order := range orders {
+				order := order
+				marked, err := model.MarkDirectDebitExported(tx, order.ID, export.CreatedAt, export.MessageID, export.CollectionDate, nil)
+				if err != nil {
+					return err
+				}
+				if !marked {
+					return errors.New(ToOrderId(order.ID) + " changed during the export")
+				}
+				err = server.auditOrder(ctx, tx, "order.debit_export", &order)
+				if err != nil {
+					return err
+				}
+			}
+			return model.AddDirectDebitExport(tx, &export.DirectDebitExport, nil)
+		})
+	}
+	if err != nil {
+		return nil, err
+	}
+	logging.FromContext(ctx).Info("exported direct debits", logging.Fields{"dry_run": dryRun, "message_id": export.MessageID, "collection_date": export.CollectionDate, "orders": export.OrderNumbers})
+	return &export, nil
+}
+
+// SettleDirectDebits marks the orders paid whose exported direct debits reached their collection date,
+// and returns their order numbers.
+func (server *Server) SettleDirectDebits(ctx context.Context, now time.Time) ([]string, error) {
+	orders, err := model.GetDueDirectDebits(server.Db, now.UTC().Format("2006-01-02"), &server.Mutex)
+	if err != nil {
+		return nil, err
+	}
+	settled := make([]string, 0)
+	for _, order := range orders {
+		order := order
+		paidAt := order.SEPACollectionDate + "T00:00:00Z"
+		err = model.Transaction(server.Db, &server.Mutex, func(tx model.Queryer) error {
+			_, err := server.markOrderPaid(ctx, tx, &order, paidAt, "sepa:"+order.SEPAMessageID)
+			return err
+		})
+		if err != nil {
+			return settled, err
+		}
+		settled = append(settled, ToOrderId(order.ID))
+	}
+	if len(settled) > 0 {
+		logging.FromContext(ctx).Info("settled direct debits", logging.Fields{"orders": settled})
+	}
+	return settled, nil
+}
+
+// ScheduleDirectDebitSettlement settles the collected direct debits now and then every interval until the server shuts down.
+func (server *Server) ScheduleDirectDebitSettlement(interval time.Duration) {
+	logging.Info("scheduled direct debit settlement", logging.Fields{"interval": interval.String()})
+	server.Go(func(stop <-chan struct{}) {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			_, err := server.SettleDirectDebits(WithActor(context.Background(), "sepa"), time.Now())
+			if err != nil {
+				logging.Error("direct debit settlement failed", logging.Fields{"error": err})
+			}
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+		}
+	})
+}
+
+// nextCollectionDate returns the earliest collection date of one-off core direct debits submitted now,
+// which is the next weekday after tomorrow so that the bank receives them a business day before.
+func nextCollectionDate(now time.Time) time.Time {
+	date := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC).AddDate(0, 0, 2)
+	for date.Weekday() == time.Saturday || date.Weekday() == time.Sunday {
+		date = date.AddDate(0, 0, 1)
+	}
+	return date
+}
+
+// getMandateText returns the direct debit mandate that the order form shows, in the locale
+// of the query parameter locale or the Accept-Language header.
+func (server *Server) getMandateText(writer http.ResponseWriter, request *http.Request) {
+	logger := logging.FromContext(request.Context())
+	logger.Debug("getMandateText API call")
+	locale := requestLocale(request)
+	mandate := struct {
+		CreditorName string `json:"creditor_name"`
+		CreditorID   string `json:"creditor_id"`
+		Text         string `json:"text"`
+	}{server.SEPACreditor.Name, server.SEPACreditor.CreditorID, server.SEPACreditor.MandateText(locale)}
+	writer.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(writer).Encode(mandate)
+	if err != nil {
+		logger.Error("getMandateText failed", logging.Fields{"error": err})
+		return
+	}
+	logger.Debug("sent reply")
+}
+
+// exportDirectDebits returns the pain.008 file of the pending direct debits. The query parameter
+// collection_date (YYYY-MM-DD) defaults to the earliest possible one. With dry_run=true, the debits are
+// not marked exported and the file is not saved.
+func (server *Server) exportDirectDebits(writer http.ResponseWriter, request *http.Request) {
+	logger := logging.FromContext(request.Context())
+	logger.Debug("exportDirectDebits API call")
+	now := time.Now()
+	collectionDate := nextCollectionDate(now)
+	if value := request.URL.Query().Get("collection_date"); value != "" {
+		date, err := time.Parse("2006-01-02", value)
+		if err != nil {
+			writeError(writer, http.StatusBadRequest, ErrorInvalidRequest, "collection_date must be a date like 2006-01-02")
+			return
+		}
+		if date.Before(collectionDate) {
+			writeError(writer, http.StatusBadRequest, ErrorInvalidRequest, "collection_date must not be before "+collectionDate.Format("2006-01-02"))
+			return
+		}
+		collectionDate = date
+	}
+	export, err := server.ExportDirectDebits(request.Context(), collectionDate, now, request.URL.Query().Get("dry_run") == "true")
+	if err != nil {
+		logger.Error("exportDirectDebits failed", logging.Fields{"error": err})
+		writeError(writer, http.StatusInternalServerError, ErrorInternal, err.Error())
+		return
+	}
+	if len(export.OrderNumbers) == 0 {
+		writeError(writer, http.StatusNotFound, ErrorNotFound, "there are no direct debits to export")
+		return
+	}
+	writeDirectDebitFile(writer, &export.DirectDebitExport)
+	logger.Debug("sent reply")
+}
+
+// writeDirectDebitFile sends a pain.008 file as download.
+func writeDirectDebitFile(writer http.ResponseWriter, export *model.DirectDebitExport) {
+	writer.Header().Set("Content-Type", "application/xml")
+	writer.Header().Set("Content-Disposition", `attachment; filename="`+export.MessageID+`.xml"`)
+	writer.Header().Set("Cache-Control", "no-store")
+	_, err := writer.Write(export.XML)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// getDirectDebitExports lists the exported pain.008 files.
+func (server *Server) getDirectDebitExports(writer http.ResponseWriter, request *http.Request) {
+	logger := logging.FromContext(request.Context())
+	logger.Debug("getDirectDebitExports API call")
+	exports, err := model.GetDirectDebitExports(server.Db, &server.Mutex)
+	if err != nil {
+		logger.Error("getDirectDebitExports failed", logging.Fields{"error": err})
+		writeError(writer, http.StatusInternalServerError, ErrorInternal, err.Error())
+		return
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(writer).Encode(exports)
+	if err != nil {
+		logger.Error("getDirectDebitExports failed", logging.Fields{"error": err})
+		return
+	}
+	logger.Debug("sent reply")
+}
+
+// getDirectDebitExport downloads an exported pain.008 file again, e.g. after the first download failed.
+func (server *Server) getDirectDebitExport(writer http.ResponseWriter, request *http.Request) {
+	logger := logging.FromContext(request.Context())
+	logger.Debug("getDirectDebitExport API call")
+	export, err := model.GetDirectDebitExport(server.Db, mux.Vars(request)["message_id"], &server.Mutex)
+	if err != nil {
+		logger.Error("getDirectDebitExport failed", logging.Fields{"error": err})
+		writeError(writer, http.StatusInternalServerError, ErrorInternal, err.Error())
+		return
+	}
+	if export == nil {
+		writeError(writer, http.StatusNotFound, ErrorNotFound, "direct debit file not found")
+		return
+	}
+	writeDirectDebitFile(writer, export)
+	logger.Debug("sent reply")
+}
@@ -0,0 +1,184 @@
+package controller
+
+import (
+	"testing"
+	"time"
+
+	"github.com/kunterbunt/calendarium-server/model"
+)
+
+func TestSEPAText(t *testing.T) {
+	tests := []struct {
+		text string
+		max  int
+		want string
+	}{
+		{"Erika Mustermann", 70, "Erika Mustermann"},
+		{"Jürgen Müller & Söhne", 70, "Juergen Mueller + Soehne"},
+		{"ÄÖÜ äöü ß", 70, "AeOeUe aeoeue ss"},
+		{"Café «Zum Ochsen»", 70, "Caf. .Zum Ochsen."},
+		{"  padded  ", 70, "padded"},
+		{"CC-000042 Calendarium Culinarium", 9, "CC-000042"},
+		{"Müller", 4, "Muel"},
+		{"ab cd", 3, "ab"},
+	}
+	for _, test := range tests {
+		if text := sepaText(test.text, test.max); text != test.want {
+			t.Errorf("sepaText(%q, %d) = %q, want %q", test.text, test.max, text, test.want)
+		}
+	}
+}
+
+func TestNextCollectionDate(t *testing.T) {
+	tests := []struct {
+		now, want string
+	}{
+		{"2023-10-16T09:30:00Z", "2023-10-18"}, // Monday
+		{"2023-10-18T23:59:00Z", "2023-10-20"}, // Wednesday
+		{"2023-10-19T09:30:00Z", "2023-10-23"}, // Thursday, rolled over the weekend
+		{"2023-10-20T09:30:00Z", "2023-10-23"}, // Friday
+		{"2023-10-21T09:30:00Z", "2023-10-23"}, // Saturday
+		{"2023-10-22T09:30:00Z", "2023-10-24"}, // Sunday
+	}
+	for _, test := range tests {
+		now, err := time.Parse(time.RFC3339, test.now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if date := nextCollectionDate(now).Format("2006-01-02"); date != test.want {
+			t.Errorf("nextCollectionDate(%s) = %s, want %s", test.now, date, test.want)
+		}
+	}
+}
+
+func TestPain008(t *testing.T) {
+	creditor := SEPACreditor{Name: "Slow Food Youth Deutschland e.V.", IBAN: "DE89 3704 0044 0532 0130 00", BIC: "COBADEFFXXX", CreditorID: "DE98ZZZ09999999999"}
+	orders := []model.Order{
+		{ID: 42, Amount: 1, SEPAAccountHolder: "Jürgen Müller & Söhne", SEPAIBAN: "DE02120300000000202051", SEPAMandateReference: "CC-000042", SEPAMandateDate: "2023-10-14"},
+		{ID: 43, Amount: 3, SEPAAccountHolder: "Hans Meier", SEPAIBAN: "CH9300762011623852957", SEPABIC: "UBSWCHZH80A", SEPAMandateReference: "CC-000043", SEPAMandateDate: "2023-10-15"},
+	}
+	data, err := Pain008(creditor, orders, "CC-SEPA-20231016093000", time.Date(2023, 10, 18, 0, 0, 0, 0, time.UTC), time.Date(2023, 10, 16, 9, 30, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != pain008Golden {
+		t.Errorf("got pain.008 file\n%s\nwant\n%s", data, pain008Golden)
+	}
+}
+
+// pain008Golden collects 20.00 EUR from a debtor in the EEA without BIC and 54.00 EUR from one outside with BIC.
+const pain008Golden = `<?xml version="1.0" encoding="UTF-8"?>
+<Document xmlns="urn:iso:std:iso:20022:tech:xsd:pain.008.001.08">
+  <CstmrDrctDbtInitn>
+    <GrpHdr>
+      <MsgId>CC-SEPA-20231016093000</MsgId>
+      <CreDtTm>2023-10-16T09:30:00</CreDtTm>
+      <NbOfTxs>2</NbOfTxs>
+      <CtrlSum>74.00</CtrlSum>
+      <InitgPty>
+        <Nm>Slow Food Youth Deutschland e.V.</Nm>
+      </InitgPty>
+    </GrpHdr>
+    <PmtInf>
+      <PmtInfId>CC-SEPA-20231016093000-1</PmtInfId>
+      <PmtMtd>DD</PmtMtd>
+      <BtchBookg>true</BtchBookg>
+      <NbOfTxs>2</NbOfTxs>
+      <CtrlSum>74.00</CtrlSum>
+      <PmtTpInf>
+        <SvcLvl>
+          <Cd>SEPA</Cd>
+        </SvcLvl>
+        <LclInstrm>
+          <Cd>CORE</Cd>
+        </LclInstrm>
+        <SeqTp>OOFF</SeqTp>
+      </PmtTpInf>
+      <ReqdColltnDt>2023-10-18</ReqdColltnDt>
+      <Cdtr>
+        <Nm>Slow Food Youth Deutschland e.V.</Nm>
+      </Cdtr>
+      <CdtrAcct>
+        <Id>
+          <IBAN>DE89370400440532013000</IBAN>
+        </Id>
+      </CdtrAcct>
+      <CdtrAgt>
+        <FinInstnId>
+          <BICFI>COBADEFFXXX</BICFI>
+        </FinInstnId>
+      </CdtrAgt>
+      <ChrgBr>SLEV</ChrgBr>
+      <CdtrSchmeId>
+        <Id>
+          <PrvtId>
+            <Othr>
+              <Id>DE98ZZZ09999999999</Id>
+              <SchmeNm>
+                <Prtry>SEPA</Prtry>
+              </SchmeNm>
+            </Othr>
+          </PrvtId>
+        </Id>
+      </CdtrSchmeId>
+      <DrctDbtTxInf>
+        <PmtId>
+          <EndToEndId>CC-000042</EndToEndId>
+        </PmtId>
+        <InstdAmt Ccy="EUR">20.00</InstdAmt>
+        <DrctDbtTx>
+          <MndtRltdInf>
+            <MndtId>CC-000042</MndtId>
+            <DtOfSgntr>2023-10-14</DtOfSgntr>
+          </MndtRltdInf>
+        </DrctDbtTx>
+        <DbtrAgt>
+          <FinInstnId>
+            <Othr>
+              <Id>NOTPROVIDED</Id>
+            </Othr>
+          </FinInstnId>
+        </DbtrAgt>
+        <Dbtr>
+          <Nm>Juergen Mueller + Soehne</Nm>
+        </Dbtr>
+        <DbtrAcct>
+          <Id>
+            <IBAN>DE02120300000000202051</IBAN>
+          </Id>
+        </DbtrAcct>
+        <RmtInf>
+          <Ustrd>CC-000042 Calendarium Culinarium</Ustrd>
+        </RmtInf>
+      </DrctDbtTxInf>
+      <DrctDbtTxInf>
+        <PmtId>
+          <EndToEndId>CC-000043</EndToEndId>
+        </PmtId>
+        <InstdAmt Ccy="EUR">54.00</InstdAmt>
+        <DrctDbtTx>
+          <MndtRltdInf>
+            <MndtId>CC-000043</MndtId>
+            <DtOfSgntr>2023-10-15</DtOfSgntr>
+          </MndtRltdInf>
+        </DrctDbtTx>
+        <DbtrAgt>
+          <FinInstnId>
+            <BICFI>UBSWCHZH80A</BICFI>
+          </FinInstnId>
+        </DbtrAgt>
+        <Dbtr>
+          <Nm>Hans Meier</Nm>
+        </Dbtr>
+        <DbtrAcct>
+          <Id>
+            <IBAN>CH9300762011623852957</IBAN>
+          </Id>
+        </DbtrAcct>
+        <RmtInf>
+          <Ustrd>CC-000043 Calendarium Culinarium</Ustrd>
+        </RmtInf>
+      </DrctDbtTxInf>
+    </PmtInf>
+  </CstmrDrctDbtInitn>
+</Document>`
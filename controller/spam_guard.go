@@ -0,0 +1,148 @@
+package controller
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kunterbunt/calendarium-server/model"
+)
+
+// FormToken is handed to the order form and has to be sent back with the order.
+type FormToken struct {
+	Token          string `json:"token"`
+	MinFillSeconds int    `json:"min_fill_seconds"`
+	// PowDifficulty is the number of leading zero bits of SHA-256(token + ":" + pow_nonce), 0 if no proof of work is needed.
+	PowDifficulty int `json:"pow_difficulty"`
+}
+
+// SpamGuard detects bot orders without any third-party service:
+// a honeypot field, a minimum time between issuing the form token and submitting the order, and an optional proof of work.
+type SpamGuard struct {
+	secret        []byte
+	minFillTime   time.Duration
+	maxTokenAge   time.Duration
+	powDifficulty int
+	requireToken  bool
+	mutex         sync.Mutex
+	usedTokens    map[string]time.Time
+}
+
+// minSecretLength is the minimum length of the secret that signs form tokens.
+const minSecretLength = 16
+
+// NewSpamGuard instantiates a spam guard. Orders without a form token are quarantined, or rejected with requireToken.
+func NewSpamGuard(secret string, minFillTime time.Duration, maxTokenAge time.Duration, powDifficulty int, requireToken bool) (*SpamGuard, error) {
+	if powDifficulty < 0 || powDifficulty > 32 {
+		return nil, errors.New("proof of work difficulty must be between 0 and 32 bits")
+	}
+	if len(secret) < minSecretLength {
+		return nil, errors.New("the spam guard needs a secret of at least " + strconv.Itoa(minSecretLength) + " characters, e.g. from 'openssl rand -hex 32'")
+	}
+	var guard SpamGuard
+	guard.secret = []byte(secret)
+	guard.minFillTime = minFillTime
+	guard.maxTokenAge = maxTokenAge
+	guard.powDifficulty = powDifficulty
+	guard.requireToken = requireToken
+	guard.usedTokens = make(map[string]time.Time)
+	return &guard, nil
+}
+
+func (guard *SpamGuard) sign(payload string) string {
+	mac := hmac.New(sha256.New, guard.secret)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// IssueToken creates a signed token that records when the form was loaded.
+func (guard *SpamGuard) IssueToken(now time.Time) (FormToken, error) {
+	nonce := make([]byte, 12)
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return FormToken{}, err
+	}
+	payload := strconv.FormatInt(now.Unix(), 10) + "." + hex.EncodeToString(nonce)
+	return FormToken{
+		Token:          payload + "." + guard.sign(payload),
+		MinFillSeconds: int(guard.minFillTime.Seconds()),
+		PowDifficulty:  guard.powDifficulty,
+	}, nil
+}
+
+// RejectsMissingToken reports whether orders without a form token are rejected instead of quarantined.
+func (guard *SpamGuard) RejectsMissingToken() bool {
+	return guard.requireToken
+}
+
+// hasLeadingZeroBits checks that the first n bits of hash are zero.
+func hasLeadingZeroBits(hash []byte, n int) bool {
+	for i := 0; i < n; i++ {
+		if hash[i/8]&(0x80>>(uint(i)%8)) != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Check returns why the order looks like spam, or "" if it looks legitimate.
+func (guard *SpamGuard) Check(order *model.Order, now time.Time) string {
+	if strings.TrimSpace(order.Website) != "" {
+		return "honeypot field filled"
+	}
+	if order.FormToken == "" {
+		// Without a token, neither the fill time nor the proof of work can be checked.
+		return "missing form token"
+	}
+	parts := strings.Split(order.FormToken, ".")
+	if len(parts) != 3 || !hmac.Equal([]byte(guard.sign(parts[0]+"."+parts[1])), []byte(parts[2])) {
+		return "invalid form token"
+	}
+	issued, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return "invalid form token"
+	}
+	age := now.Sub(time.Unix(issued, 0))
+	if age < guard.minFillTime {
+		return "form filled in " + age.Round(time.Millisecond).String()
+	}
+	if age > guard.maxTokenAge {
+		return "form token expired"
+	}
+	if guard.powDifficulty > 0 {
+		if order.ProofOfWork == "" {
+			return "missing proof of work"
+		}
+		hash := sha256.Sum256([]byte(order.FormToken + ":" + order.ProofOfWork))
+		if !hasLeadingZeroBits(hash[:], guard.powDifficulty) {
+			return "invalid proof of work"
+		}
+	}
+	if guard.markUsed(order.FormToken, now) {
+		return "form token reused"
+	}
+	return ""
+}
+
+// markUsed remembers a token until it expires and returns whether it was used before.
+func (guard *SpamGuard) markUsed(token string, now time.Time) bool {
+	guard.mutex.Lock()
+	defer guard.mutex.Unlock()
+	for usedToken, usedAt := range guard.usedTokens {
+		if now.Sub(usedAt) > guard.maxTokenAge {
+			delete(guard.usedTokens, usedToken)
+		}
+	}
+	if _, used := guard.usedTokens[token]; used {
+		return true
+	}
+	guard.usedTokens[token] = now
+	return false
+}
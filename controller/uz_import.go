@@ -0,0 +1,354 @@
+package controller
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kunterbunt/calendarium-server/logging"
+	"github.com/kunterbunt/calendarium-server/model"
+)
+
+// DefaultUzColumns describes the column layout of the Unterstützer CSV export we usually receive.
+const DefaultUzColumns = "convivium=0,company=2,name=3+4+5,street=6,code=7,city=8,country=9,member_no=10"
+
+var uzColumnFields = map[string]bool{
+	"convivium":  true,
+	"company":    true,
+	"name":       true,
+	"first_name": true,
+	"last_name":  true,
+	"email":      true,
+	"street":     true,
+	"street_no":  true,
+	"code":       true,
+	"city":       true,
+	"country":    true,
+	"member_no":  true,
+	"amount":     true,
+}
+
+// UzColumns maps the fields of an Unterstützer order to one or more CSV column indexes.
+// Several columns are joined by ", ".
+type UzColumns map[string][]int
+
+// ParseUzColumns parses a column mapping of the form "field=index,field=index+index,...".
+func ParseUzColumns(spec string) (UzColumns, error) {
+	columns := make(UzColumns)
+	for _, entry := range strings.Split(spec, ",") {
+		parts := strings.SplitN(strings.TrimSpace(entry), "=", 2)
+		if len(parts) != 2 {
+			return nil, errors.New("invalid column mapping '" + entry + "', expected field=index")
+		}
+		field := parts[0]
+		if !uzColumnFields[field] {
+			return nil, errors.New("unknown column field '" + field + "'")
+		}
+		for _, index := range strings.Split(parts[1], "+") {
+			i, err := strconv.Atoi(index)
+			if err != nil || i < 0 {
+				return nil, errors.New("invalid column index '" + index + "' for field '" + field + "'")
+			}
+			columns[field] = append(columns[field], i)
+		}
+	}
+	if len(columns["name"]) == 0 && len(columns["last_name"]) == 0 {
+		return nil, errors.New("column mapping needs either 'name' or 'last_name'")
+	}
+	return columns, nil
+}
+
+func (columns UzColumns) value(line []string, field string) string {
+	var values []string
+	for _, i := range columns[field] {
+		if i < len(line) && strings.TrimSpace(line[i]) != "" {
+			values = append(values, strings.TrimSpace(line[i]))
+		}
+	}
+	return strings.Join(values, ", ")
+}
+
+// UzImportOptions configures ImportUzOrders.
+type UzImportOptions struct {
+	Columns        UzColumns
+	SkipHeader     bool
+	Rows           map[int]bool // only import these rows, all if empty
+	DefaultCountry string
+	DefaultEmail   string
+	DryRun         bool
+	DryRunOutput   io.Writer // receives the billbee bodies that would be sent
+}
+
+// Statuses of an imported row.
+const (
+	UzStatusInvalid          = "invalid"
+	UzStatusWouldForward     = "would-forward"
+	UzStatusAlreadyForwarded = "already-forwarded"
+	UzStatusSaved            = "saved"
+	UzStatusForwarded        = "forwarded"
+	UzStatusFailed           = "failed"
+)
+
+// UzImportResult reports what happened to a single CSV row.
+type UzImportResult struct {
+	Row         int
+	ImportKey   string
+	OrderNumber string
+	Status      string
+	Message     string
+}
+
+var streetNumberPattern = regexp.MustCompile(`^(.*?)[\s,]*(\d+\s*[a-zA-Z]?(\s*[-/]\s*\d+\s*[a-zA-Z]?)?)$`)
+
+// splitStreet splits "Hauptstraße 12a" into "Hauptstraße" and "12a".
+func splitStreet(street string) (string, string) {
+	match := streetNumberPattern.FindStringSubmatch(street)
+	if match == nil || match[1] == "" {
+		return street, ""
+	}
+	return match[1], match[2]
+}
+
+// nameParticles start a last name, e.g. "von" in "Hans von Müller".
+var nameParticles = map[string]bool{
+	"von": true, "vom": true, "zu": true, "zum": true, "zur": true, "van": true, "ten": true, "ter": true,
+	"de": true, "del": true, "der": true, "den": true, "di": true, "da": true, "du": true, "la": true, "le": true,
+}
+
+// splitName splits a full name into first and last name. The last name is the last word or starts at a name
+// particle, so "Anna Maria von der Heide" is split into "Anna Maria" and "von der Heide". A single word, e.g. the
+// name of an association, is a last name. Parts joined from further name columns are kept with the last name.
+func splitName(name string) (string, string) {
+	parts := strings.SplitN(name, ", ", 2)
+	words := strings.Fields(parts[0])
+	if len(words) == 0 {
+		return "", name
+	}
+	last := len(words) - 1
+	for i := 1; i < last; i++ {
+		if nameParticles[strings.ToLower(words[i])] {
+			last = i
+			break
+		}
+	}
+	lastName := strings.Join(words[last:], " ")
+	if len(parts) == 2 {
+		lastName += ", " + parts[1]
+	}
+	return strings.Join(words[:last], " "), lastName
+}
+
+// uzImportKey identifies a supporter independently of its row, so that re-sorted CSV files can be imported again.
+func uzImportKey(order *model.UzOrder) string {
+	parts := []string{order.Convivium, order.MemberNo, order.CompanyInvoice, order.FirstNameInvoice, order.LastNameInvoice, order.AddressCodeInvoice}
+	return strings.ToLower(strings.Join(parts, "|"))
+}
+
+func newUzOrderFromLine(row int, line []string, options *UzImportOptions) (*model.UzOrder, error) {
+	columns := options.Columns
+	var order model.UzOrder
+	order.Row = row
+	order.Convivium = columns.value(line, "convivium")
+	order.MemberNo = columns.value(line, "member_no")
+	order.Amount = 1
+	if amount := columns.value(line, "amount"); amount != "" {
+		var err error
+		order.Amount, err = strconv.Atoi(amount)
+		if err != nil {
+			return nil, errors.New("invalid amount '" + amount + "'")
+		}
+	}
+	order.Date = time.Now().Format(time.RFC3339)
+	order.CompanyInvoice = columns.value(line, "company")
+	if len(columns["last_name"]) > 0 {
+		order.FirstNameInvoice = columns.value(line, "first_name")
+		order.LastNameInvoice = columns.value(line, "last_name")
+	} else {
+		order.FirstNameInvoice, order.LastNameInvoice = splitName(columns.value(line, "name"))
+	}
+	order.Email = columns.value(line, "email")
+	if order.Email == "" {
+		order.Email = options.DefaultEmail
+	}
+	order.AddressStreetInvoice = columns.value(line, "street")
+	order.AddressStreetNoInvoice = columns.value(line, "street_no")
+	if len(columns["street_no"]) == 0 {
+		order.AddressStreetInvoice, order.AddressStreetNoInvoice = splitStreet(order.AddressStreetInvoice)
+	}
+	order.AddressCodeInvoice = columns.value(line, "code")
+	order.AddressCityInvoice = columns.value(line, "city")
+	order.AddressCountryInvoice = columns.value(line, "country")
+	if order.AddressCountryInvoice == "" {
+		order.AddressCountryInvoice = options.DefaultCountry
+	}
+	order.CompanyDelivery = order.CompanyInvoice
+	order.FirstNameDelivery = order.FirstNameInvoice
+	order.LastNameDelivery = order.LastNameInvoice
+	order.AddressStreetDelivery = order.AddressStreetInvoice
+	order.AddressStreetNoDelivery = order.AddressStreetNoInvoice
+	order.AddressCodeDelivery = order.AddressCodeInvoice
+	order.AddressCityDelivery = order.AddressCityInvoice
+	order.AddressCountryDelivery = order.AddressCountryInvoice
+	order.Payment = PaymentBankTransfer
+	order.AgreesAGB = true
+	order.AgreesPrivacy = true
+	order.SlowFoodMember = true
+	if order.MemberNo != "" {
+		order.Message = "Mitgliedsnummer " + order.MemberNo
+	}
+	order.ImportKey = uzImportKey(&order)
+	return &order, nil
+}
+
+// verifyUzOrder verifies an Unterstützer order like an order, except that a last name suffices.
+func verifyUzOrder(order *model.UzOrder) error {
+	err := model.VerifyOrder(&order.Order)
+	invalid, ok := err.(*model.ValidationError)
+	if !ok || order.LastNameInvoice == "" {
+		return err
+	}
+	fields := invalid.Fields[:0]
+	for _, field := range invalid.Fields {
+		if field.Field != "first_name_invoice" && field.Field != "first_name_delivery" {
+			fields = append(fields, field)
+		}
+	}
+	if len(fields) == 0 {
+		return nil
+	}
+	invalid.Fields = fields
+	return invalid
+}
+
+// ImportUzOrders validates the given CSV lines, saves them as Unterstützer orders and forwards them to billbee if a forwarder is attached.
+// Rows that were forwarded before are skipped, so an interrupted import can simply be run again.
+func ImportUzOrders(ctx context.Context, server *Server, lines [][]string, options UzImportOptions) ([]UzImportResult, error) {
+	results := make([]UzImportResult, 0, len(lines))
+	for i, line := range lines {
+		if i == 0 && options.SkipHeader {
+			continue
+		}
+		if len(options.Rows) > 0 && !options.Rows[i] {
+			continue
+		}
+		result := UzImportResult{Row: i}
+		order, err := newUzOrderFromLine(i, line, &options)
+		if err == nil {
+			result.ImportKey = order.ImportKey
+			err = verifyUzOrder(order)
+		}
+		if err != nil {
+			result.Status = UzStatusInvalid
+			result.Message = err.Error()
+			results = append(results, result)
+			continue
+		}
+		existing, err := model.GetUzOrderByImportKey(server.Db, order.ImportKey, &server.Mutex)
+		if err != nil {
+			return results, err
+		}
+		if existing.ID != int64(model.InvalidID) {
+			order = existing
+			result.OrderNumber = ToUzOrderId(order.ID)
+		}
+		if order.Forwarded {
+			result.Status = UzStatusAlreadyForwarded
+			results = append(results, result)
+			continue
+		}
+		if options.DryRun {
+			result.Status = UzStatusWouldForward
+			if options.DryRunOutput != nil {
+				jsonContent, err := json.MarshalIndent(newBillbeeUzOrderBody(&order.Order, order.Convivium), "", "  ")
+				if err != nil {
+					return results, err
+				}
+				fmt.Fprintf(options.DryRunOutput, "Row %d:\n%s\n", i, jsonContent)
+			}
+			results = append(results, result)
+			continue
+		}
+		if order.ID == 0 {
+			err = model.Transaction(server.Db, &server.Mutex, func(tx model.Queryer) error {
+				err := model.AddUzOrder(tx, order, nil)
+				if err != nil {
+					return err
+				}
+				return server.audit(ctx, tx, "uz_order.create", AuditTargetUzOrder, order.ID, nil, order)
+			})
+			if err != nil {
+				return results, err
+			}
+			result.OrderNumber = ToUzOrderId(order.ID)
+		}
+		if server.BillbeeForwarder == nil {
+			result.Status = UzStatusSaved
+			results = append(results, result)
+			continue
+		}
+		logging.Info("forwarding uz order", logging.Fields{"order_number": result.OrderNumber, "row": i, "rows": len(lines)})
+		billbeeResponse, err := server.BillbeeForwarder.ForwardUzOrder(&order.Order, order.Convivium)
+		if err != nil {
+			result.Status = UzStatusFailed
+			result.Message = err.Error()
+			billbeeResponse = err.Error()
+		} else {
+			result.Status = UzStatusForwarded
+		}
+		err = model.Transaction(server.Db, &server.Mutex, func(tx model.Queryer) error {
+			err := model.SetUzOrderForwarded(order.ID, result.Status == UzStatusForwarded, billbeeResponse, tx, nil)
+			if err != nil {
+				return err
+			}
+			return server.auditUzOrder(ctx, tx, "uz_order.forward", order)
+		})
+		if err != nil {
+			return results, err
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+// WriteUzImportReport writes one CSV line per imported row.
+func WriteUzImportReport(writer io.Writer, results []UzImportResult) error {
+	csvWriter := csv.NewWriter(writer)
+	err := csvWriter.Write([]string{"row", "import_key", "order_number", "status", "message"})
+	if err != nil {
+		return err
+	}
+	for _, result := range results {
+		err = csvWriter.Write([]string{strconv.Itoa(result.Row), result.ImportKey, result.OrderNumber, result.Status, result.Message})
+		if err != nil {
+			return err
+		}
+	}
+	csvWriter.Flush()
+	return csvWriter.Error()
+}
+
+// SummarizeUzImport counts the results per status, e.g. "forwarded=12 invalid=2".
+func SummarizeUzImport(results []UzImportResult) string {
+	counts := make(map[string]int)
+	for _, result := range results {
+		counts[result.Status]++
+	}
+	statuses := make([]string, 0, len(counts))
+	for status := range counts {
+		statuses = append(statuses, status)
+	}
+	sort.Strings(statuses)
+	summary := make([]string, 0, len(statuses))
+	for _, status := range statuses {
+		summary = append(summary, status+"="+strconv.Itoa(counts[status]))
+	}
+	return strings.Join(summary, " ")
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/kunterbunt/calendarium-server/logging"
+)
+
+// exportPersonalData writes every record stored about an email address as JSON.
+func exportPersonalData(args []string) int {
+	flags := flag.NewFlagSet("gdpr export", flag.ContinueOnError)
+	email := flags.String("email", "", "email address of the data subject (required)")
+	outFile := flags.String("out", "", "output file (default: stdout)")
+	config, code := parseFlags(flags, args)
+	if code != exitOK {
+		return code
+	}
+	if *email == "" {
+		fmt.Fprintln(os.Stderr, "-email is required")
+		return exitUsage
+	}
+	server, err := setup(config, false)
+	if err != nil {
+		logging.Error(err.Error())
+		return exitFailure
+	}
+	export, err := server.ExportPersonalData(*email, time.Now())
+	if err != nil {
+		logging.Error(err.Error())
+		return exitFailure
+	}
+	var out io.Writer = os.Stdout
+	if *outFile != "" {
+		file, err := os.Create(*outFile)
+		if err != nil {
+			logging.Error(err.Error())
+			return exitFailure
+		}
+		defer file.Close()
+		out = file
+	}
+	encoder := json.NewEncoder(out)
+	encoder.SetIndent("", "  ")
+	err = encoder.Encode(export)
+	if err != nil {
+		logging.Error(err.Error())
+		return exitFailure
+	}
+	logging.Info("exported personal data", logging.Fields{"orders": len(export.Orders), "uz_orders": len(export.UzOrders)})
+	return exitOK
+}
+
+// erasePersonalData pseudonymizes the orders of an email address whose retention period ended.
+func erasePersonalData(args []string) int {
+	flags := flag.NewFlagSet("gdpr erase", flag.ContinueOnError)
+	email := flags.String("email", "", "email address of the data subject (required)")
+	dryRun := flags.Bool("dry-run", false, "only list the orders that would be pseudonymized")
+	config, code := parseFlags(flags, args)
+	if code != exitOK {
+		return code
+	}
+	if *email == "" {
+		fmt.Fprintln(os.Stderr, "-email is required")
+		return exitUsage
+	}
+	server, err := setup(config, false)
+	if err != nil {
+		logging.Error(err.Error())
+		return exitFailure
+	}
+	result, err := server.ErasePersonalData(cliContext(), *email, time.Now(), *dryRun)
+	if err != nil {
+		logging.Error(err.Error())
+		return exitFailure
+	}
+	for _, orderNumber := range result.Erased {
+		if *dryRun {
+			fmt.Println(orderNumber + ": would be pseudonymized.")
+		} else {
+			fmt.Println(orderNumber + ": pseudonymized.")
+		}
+	}
+	for _, retained := range result.Retained {
+		fmt.Println(retained.OrderNumber + ": retained until " + retained.RetainedUntil + ".")
+	}
+	if len(result.Erased) == 0 && len(result.Retained) == 0 {
+		fmt.Println("No orders found.")
+	}
+	return exitOK
+}
+
+// applyRetention applies the data retention policy.
+func applyRetention(args []string) int {
+	flags := flag.NewFlagSet("retention apply", flag.ContinueOnError)
+	dryRun := flags.Bool("dry-run", false, "only list the orders that would be changed")
+	config, code := parseFlags(flags, args)
+	if code != exitOK {
+		return code
+	}
+	server, err := setup(config, false)
+	if err != nil {
+		logging.Error(err.Error())
+		return exitFailure
+	}
+	if !server.RetentionPolicy.Enabled() {
+		fmt.Println("No retention rules are configured.")
+		return exitOK
+	}
+	report, err := server.ApplyRetentionPolicy(cliContext(), time.Now(), *dryRun)
+	prefix := ""
+	if *dryRun {
+		prefix = "would be "
+	}
+	for _, orderNumber := range report.Purged {
+		fmt.Println(orderNumber + ": " + prefix + "purged as spam.")
+	}
+	for _, orderNumber := range report.Erased {
+		fmt.Println(orderNumber + ": " + prefix + "pseudonymized.")
+	}
+	for _, orderNumber := range report.Anonymized {
+		fmt.Println(orderNumber + ": " + prefix + "anonymized.")
+	}
+	if report.ErasedBankPayments > 0 {
+		fmt.Println(strconv.Itoa(report.ErasedBankPayments) + " bank payments " + prefix + "pseudonymized.")
+	}
+	if report.PurgedDirectDebitFiles > 0 {
+		fmt.Println(strconv.Itoa(report.PurgedDirectDebitFiles) + " direct debit files " + prefix + "deleted.")
+	}
+	if err != nil {
+		logging.Error(err.Error())
+		return exitFailure
+	}
+	fmt.Println(strconv.Itoa(len(report.Purged)+len(report.Erased)+len(report.Anonymized)) + " orders " + prefix + "changed.")
+	return exitOK
+}
@@ -0,0 +1,207 @@
+// Package logging writes structured JSON log entries with levels and redacts personal data.
+package logging
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Level of a log entry.
+type Level int
+
+// Levels in increasing severity.
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+func (level Level) String() string {
+	return levelNames[level]
+}
+
+// ParseLevel parses "debug", "info", "warn" or "error".
+func ParseLevel(name string) (Level, error) {
+	for level, levelName := range levelNames {
+		if strings.EqualFold(name, levelName) {
+			return Level(level), nil
+		}
+	}
+	return LevelInfo, errors.New("unknown log level '" + name + "'")
+}
+
+// Fields are attached to a log entry. Values are redacted, see Redact.
+type Fields map[string]interface{}
+
+// output is shared by a logger and the loggers derived from it.
+type output struct {
+	mutex  sync.Mutex
+	writer io.Writer
+	level  Level
+}
+
+// Logger writes one JSON object per line with the time, level, message and fields.
+type Logger struct {
+	output *output
+	fields Fields
+}
+
+var std = &Logger{output: &output{writer: os.Stderr, level: LevelInfo}}
+
+// Default returns the logger that the package-level functions use.
+func Default() *Logger {
+	return std
+}
+
+// Configure sets where and from which level on entries are written,
+// and routes the standard log package, e.g. errors of net/http, through the default logger.
+func Configure(writer io.Writer, level Level) {
+	std.output.mutex.Lock()
+	std.output.writer = writer
+	std.output.level = level
+	std.output.mutex.Unlock()
+	log.SetFlags(0)
+	log.SetOutput(Writer(LevelWarn))
+}
+
+// Writer returns a writer that logs every write to the default logger, e.g. for a *log.Logger.
+func Writer(level Level) io.Writer {
+	return levelWriter(level)
+}
+
+type levelWriter Level
+
+func (level levelWriter) Write(line []byte) (int, error) {
+	std.log(Level(level), strings.TrimSpace(string(line)), nil)
+	return len(line), nil
+}
+
+// With returns a logger that adds fields to every entry.
+func (logger *Logger) With(fields Fields) *Logger {
+	merged := make(Fields, len(logger.fields)+len(fields))
+	for key, value := range logger.fields {
+		merged[key] = value
+	}
+	for key, value := range fields {
+		merged[key] = value
+	}
+	return &Logger{output: logger.output, fields: merged}
+}
+
+func (logger *Logger) log(level Level, message string, fields []Fields) {
+	if level < logger.output.level {
+		return
+	}
+	entry := make(map[string]interface{}, len(logger.fields)+4)
+	for key, value := range logger.fields {
+		entry[key] = Redact(value)
+	}
+	for _, extra := range fields {
+		for key, value := range extra {
+			entry[key] = Redact(value)
+		}
+	}
+	entry["time"] = time.Now().UTC().Format(time.RFC3339Nano)
+	entry["level"] = level.String()
+	entry["msg"] = message
+	line, err := json.Marshal(entry)
+	if err != nil {
+		line, _ = json.Marshal(map[string]string{"time": entry["time"].(string), "level": "error", "msg": "unloggable entry: " + err.Error()})
+	}
+	logger.output.mutex.Lock()
+	defer logger.output.mutex.Unlock()
+	logger.output.writer.Write(append(line, '\n'))
+}
+
+// Debug logs details that are only needed when tracking down a problem.
+func (logger *Logger) Debug(message string, fields ...Fields) {
+	logger.log(LevelDebug, message, fields)
+}
+
+// Info logs normal operation.
+func (logger *Logger) Info(message string, fields ...Fields) {
+	logger.log(LevelInfo, message, fields)
+}
+
+// Warn logs problems that are handled.
+func (logger *Logger) Warn(message string, fields ...Fields) {
+	logger.log(LevelWarn, message, fields)
+}
+
+// Error logs problems that need attention.
+func (logger *Logger) Error(message string, fields ...Fields) {
+	logger.log(LevelError, message, fields)
+}
+
+// Fatal logs an error and exits.
+func (logger *Logger) Fatal(message string, fields ...Fields) {
+	logger.log(LevelError, message, fields)
+	os.Exit(1)
+}
+
+type contextKey int
+
+const (
+	loggerKey contextKey = iota
+	requestIDKey
+)
+
+// NewRequestContext returns a context that carries the request ID and a logger adding it to every entry.
+func NewRequestContext(ctx context.Context, requestID string) context.Context {
+	ctx = context.WithValue(ctx, requestIDKey, requestID)
+	return context.WithValue(ctx, loggerKey, FromContext(ctx).With(Fields{"request_id": requestID}))
+}
+
+// NewLoggerContext returns a context that carries a logger, e.g. one with additional fields.
+func NewLoggerContext(ctx context.Context, logger *Logger) context.Context {
+	return context.WithValue(ctx, loggerKey, logger)
+}
+
+// FromContext returns the logger of the context, or the default logger.
+func FromContext(ctx context.Context) *Logger {
+	if logger, ok := ctx.Value(loggerKey).(*Logger); ok {
+		return logger
+	}
+	return std
+}
+
+// RequestID returns the request ID of the context, or "".
+func RequestID(ctx context.Context) string {
+	requestID, _ := ctx.Value(requestIDKey).(string)
+	return requestID
+}
+
+// Debug logs to the default logger.
+func Debug(message string, fields ...Fields) {
+	std.log(LevelDebug, message, fields)
+}
+
+// Info logs to the default logger.
+func Info(message string, fields ...Fields) {
+	std.log(LevelInfo, message, fields)
+}
+
+// Warn logs to the default logger.
+func Warn(message string, fields ...Fields) {
+	std.log(LevelWarn, message, fields)
+}
+
+// Error logs to the default logger.
+func Error(message string, fields ...Fields) {
+	std.log(LevelError, message, fields)
+}
+
+// Fatal logs to the default logger and exits.
+func Fatal(message string, fields ...Fields) {
+	std.Fatal(message, fields...)
+}
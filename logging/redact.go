@@ -0,0 +1,123 @@
+package logging
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// Redacted replaces personal data in log entries.
+const Redacted = "[redacted]"
+
+// RedactedError is implemented by errors whose message can contain personal data, e.g. a response body that
+// echoes an order. They are logged by their redacted message.
+type RedactedError interface {
+	error
+	RedactedError() string
+}
+
+// Redact prepares a value for logging. Structs become maps keyed by their JSON field names,
+// in which non-empty fields tagged `log:"redact"` are replaced by Redacted.
+// Pointers, slices and maps of structs are handled as well, errors become their (redacted) message.
+func Redact(value interface{}) interface{} {
+	if err, isRedacted := value.(RedactedError); isRedacted {
+		return err.RedactedError()
+	}
+	if err, isError := value.(error); isError {
+		return err.Error()
+	}
+	if value == nil {
+		return nil
+	}
+	return redactValue(reflect.ValueOf(value))
+}
+
+func redactValue(value reflect.Value) interface{} {
+	switch value.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if value.IsNil() {
+			return nil
+		}
+		return redactValue(value.Elem())
+	case reflect.Struct:
+		if !hasRedactedFields(value.Type()) {
+			return value.Interface()
+		}
+		fields := make(map[string]interface{}, value.NumField())
+		redactStruct(value, fields)
+		return fields
+	case reflect.Slice, reflect.Array:
+		if !hasRedactedFields(value.Type().Elem()) {
+			return value.Interface()
+		}
+		items := make([]interface{}, value.Len())
+		for i := range items {
+			items[i] = redactValue(value.Index(i))
+		}
+		return items
+	case reflect.Map:
+		if !hasRedactedFields(value.Type().Elem()) {
+			return value.Interface()
+		}
+		items := make(map[string]interface{}, value.Len())
+		iter := value.MapRange()
+		for iter.Next() {
+			items[fmt.Sprint(iter.Key().Interface())] = redactValue(iter.Value())
+		}
+		return items
+	}
+	return value.Interface()
+}
+
+// redactStruct adds the exported fields of a struct to fields, flattening embedded structs like encoding/json.
+func redactStruct(value reflect.Value, fields map[string]interface{}) {
+	structType := value.Type()
+	for i := 0; i < structType.NumField(); i++ {
+		field := structType.Field(i)
+		if field.PkgPath != "" {
+			continue // unexported
+		}
+		if field.Anonymous && field.Type.Kind() == reflect.Struct {
+			redactStruct(value.Field(i), fields)
+			continue
+		}
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		if field.Tag.Get("log") == "redact" {
+			if !value.Field(i).IsZero() {
+				fields[name] = Redacted
+			}
+			continue
+		}
+		fields[name] = redactValue(value.Field(i))
+	}
+}
+
+// hasRedactedFields reports whether values of a type can contain fields tagged `log:"redact"`.
+func hasRedactedFields(valueType reflect.Type) bool {
+	return checkRedactedFields(valueType, make(map[reflect.Type]bool))
+}
+
+func checkRedactedFields(valueType reflect.Type, seen map[reflect.Type]bool) bool {
+	if seen[valueType] {
+		return false
+	}
+	seen[valueType] = true
+	switch valueType.Kind() {
+	case reflect.Ptr, reflect.Slice, reflect.Array, reflect.Map:
+		return checkRedactedFields(valueType.Elem(), seen)
+	case reflect.Struct:
+		for i := 0; i < valueType.NumField(); i++ {
+			field := valueType.Field(i)
+			if field.Tag.Get("log") == "redact" || checkRedactedFields(field.Type, seen) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,62 @@
+package model
+
+import (
+	_ "embed" // embed the country table
+	"strings"
+)
+
+// countriesCsv lists every ISO 3166-1 country with its German and English name and common aliases.
+//
+//go:embed countries.csv
+var countriesCsv string
+
+// Country of the embedded country table.
+type Country struct {
+	Code        string `json:"code"`
+	NameGerman  string `json:"name_de"`
+	NameEnglish string `json:"name_en"`
+}
+
+var countriesByCode = make(map[string]Country)
+var countryCodesByName = make(map[string]string)
+
+func init() {
+	for _, line := range strings.Split(countriesCsv, "\n") {
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Split(line, ";")
+		if len(fields) != 4 {
+			panic("invalid line in countries.csv: " + line)
+		}
+		country := Country{fields[0], fields[1], fields[2]}
+		countriesByCode[country.Code] = country
+		names := []string{country.Code, country.NameGerman, country.NameEnglish}
+		if fields[3] != "" {
+			names = append(names, strings.Split(fields[3], "|")...)
+		}
+		for _, name := range names {
+			countryCodesByName[countryKey(name)] = country.Code
+		}
+	}
+}
+
+// countryKey simplifies a country name for lookups, e.g. " Vereinigte  Staaten. " and "vereinigte staaten" are identical.
+func countryKey(name string) string {
+	name = strings.ToLower(strings.Replace(name, ".", "", -1))
+	name = strings.Replace(name, "’", "'", -1)
+	return strings.Join(strings.Fields(name), " ")
+}
+
+// NormalizeCountry maps a country code, German or English name or alias to its ISO 3166-1 alpha-2 code.
+// It returns false if the country is unknown.
+func NormalizeCountry(country string) (string, bool) {
+	code, known := countryCodesByName[countryKey(country)]
+	return code, known
+}
+
+// GetCountry returns the country with the given ISO 3166-1 alpha-2 code.
+func GetCountry(code string) (Country, bool) {
+	country, known := countriesByCode[code]
+	return country, known
+}
@@ -1,6 +1,6 @@
 package model
 
-import "errors"
+import "encoding/json"
 
 // InvalidID corresponds to the ID that is returned when something is *not* found in the database.
 var InvalidID = -1
@@ -15,36 +15,210 @@ type Product struct {
 }
 
 // Order database entry.
+// Fields tagged `access` are only shown to admin users whose role grants access to all listed field groups.
 type Order struct {
 	ID                      int64  `json:"id"`
 	ProductID               int    `json:"product_id"`
 	Amount                  int    `json:"amount"`
 	Date                    string `json:"date"`
-	CompanyInvoice	        string `json:"company_invoice"`
-	FirstNameInvoice        string `json:"first_name_invoice"`
-	LastNameInvoice         string `json:"last_name_invoice"`
-	CompanyDelivery	        string `json:"company_delivery"`
-	FirstNameDelivery       string `json:"first_name_delivery"`
-	LastNameDelivery        string `json:"last_name_delivery"`
-	Email                   string `json:"email"`
-	AddressStreetInvoice    string `json:"address_street_invoice"`
-	AddressStreetNoInvoice  string `json:"address_street_no_invoice"`
-	AddressCodeInvoice      string `json:"address_code_invoice"`
-	AddressCityInvoice      string `json:"address_city_invoice"`
+	CompanyInvoice	        string `json:"company_invoice" log:"redact" access:"address"`
+	FirstNameInvoice        string `json:"first_name_invoice" log:"redact" access:"address"`
+	LastNameInvoice         string `json:"last_name_invoice" log:"redact" access:"address"`
+	CompanyDelivery	        string `json:"company_delivery" log:"redact" access:"address"`
+	FirstNameDelivery       string `json:"first_name_delivery" log:"redact" access:"address"`
+	LastNameDelivery        string `json:"last_name_delivery" log:"redact" access:"address"`
+	Email                   string `json:"email" log:"redact" access:"address"`
+	AddressStreetInvoice    string `json:"address_street_invoice" log:"redact" access:"address"`
+	AddressStreetNoInvoice  string `json:"address_street_no_invoice" log:"redact" access:"address"`
+	AddressCodeInvoice      string `json:"address_code_invoice" log:"redact" access:"address"`
+	AddressCityInvoice      string `json:"address_city_invoice" log:"redact" access:"address"`
 	AddressCountryInvoice   string `json:"address_country_invoice"`
-	AddressStreetDelivery   string `json:"address_street_delivery"`
-	AddressStreetNoDelivery string `json:"address_street_no_delivery"`
-	AddressCodeDelivery     string `json:"address_code_delivery"`
-	AddressCityDelivery     string `json:"address_city_delivery"`
+	AddressStreetDelivery   string `json:"address_street_delivery" log:"redact" access:"address"`
+	AddressStreetNoDelivery string `json:"address_street_no_delivery" log:"redact" access:"address"`
+	AddressCodeDelivery     string `json:"address_code_delivery" log:"redact" access:"address"`
+	AddressCityDelivery     string `json:"address_city_delivery" log:"redact" access:"address"`
 	AddressCountryDelivery  string `json:"address_country_delivery"`
-	Payment                 string `json:"payment"`
+	Payment                 string `json:"payment" access:"payment"`
 	Premium                 string `json:"premium"`
 	Reseller                bool   `json:"is_reseller"`
 	SlowFoodMember          bool   `json:"slow_food_member"`
 	AgreesAGB               bool   `json:"agrees_agb"`
 	AgreesPrivacy           bool   `json:"agrees_data_privacy"`
-	Message                 string `json:"message"`
-	BillbeeResponse         string `json:"billbee_api_response"`
+	Message                 string `json:"message" log:"redact" access:"address"`
+	BillbeeResponse         string `json:"billbee_api_response" log:"redact" access:"address,payment"`
+	Quarantined             bool   `json:"quarantined"`
+	SpamReason              string `json:"spam_reason"`
+	// Locale of the customer, used for all messages about the order.
+	Locale string `json:"locale"`
+	// PayPalOrderID of the PayPal order created for the payment, if any.
+	PayPalOrderID string `json:"paypal_order_id" access:"payment"`
+	// PaidAt is set once the payment was confirmed, PaymentReference identifies the payment, e.g. the PayPal capture ID.
+	PaidAt           string `json:"paid_at" access:"payment"`
+	PaymentReference string `json:"payment_reference" access:"payment"`
+	// ReminderLevel counts the payment reminders sent for an unpaid order, RemindedAt is the date of the last one.
+	ReminderLevel int    `json:"reminder_level" access:"payment"`
+	RemindedAt    string `json:"reminded_at" access:"payment"`
+	// CancelledAt is set once an unpaid order was cancelled, ReviewReason once it was flagged for manual review instead.
+	// ReviewResolvedAt is set once the review was resolved, the dunning policy leaves such orders alone.
+	CancelledAt      string `json:"cancelled_at" access:"payment"`
+	ReviewReason     string `json:"review_reason" access:"payment"`
+	ReviewResolvedAt string `json:"review_resolved_at" access:"payment"`
+	// SEPA direct debit mandate of orders paid with "sepa". SEPAMandateText is what the customer agreed to on SEPAMandateDate.
+	SEPAAccountHolder    string `json:"sepa_account_holder" log:"redact" access:"payment"`
+	SEPAIBAN             string `json:"sepa_iban" log:"redact" access:"payment"`
+	SEPABIC              string `json:"sepa_bic" log:"redact" access:"payment"`
+	SEPAMandateReference string `json:"sepa_mandate_reference" access:"payment"`
+	SEPAMandateDate      string `json:"sepa_mandate_date" access:"payment"`
+	SEPAMandateText      string `json:"sepa_mandate_text" access:"payment"`
+	// SEPAExportedAt is set once the direct debit was exported for the bank in the file SEPAMessageID.
+	// The order is marked paid on SEPACollectionDate (YYYY-MM-DD).
+	SEPAExportedAt     string `json:"sepa_exported_at" access:"payment"`
+	SEPAMessageID      string `json:"sepa_message_id" access:"payment"`
+	SEPACollectionDate string `json:"sepa_collection_date" access:"payment"`
+	// AnonymizedAt is set once the personal data that is not needed for accounting was removed.
+	AnonymizedAt string `json:"anonymized_at"`
+	// ErasedAt is set once the personal data of the order was pseudonymized.
+	ErasedAt string `json:"erased_at"`
+	// SEPAMandateConsent is sent by the order form, the consent is saved as SEPAMandateText.
+	SEPAMandateConsent bool `json:"sepa_mandate_consent,omitempty"`
+	// EmailConfirmed is sent by the order form once the customer confirmed an email address that looks misspelled, not saved.
+	EmailConfirmed bool `json:"email_confirmed,omitempty"`
+	// Spam defense fields sent by the order form, not saved.
+	Website     string `json:"website,omitempty"` // honeypot, hidden from humans
+	FormToken   string `json:"form_token,omitempty"`
+	ProofOfWork string `json:"pow_nonce,omitempty"`
+}
+
+// UzOrder database entry for an order of an Unterstützer (supporter) imported from a CSV file.
+// Invoice and delivery address of the embedded order are identical.
+type UzOrder struct {
+	Order
+	ImportKey string `json:"import_key" log:"redact" access:"address"`
+	Row       int    `json:"row"`
+	Convivium string `json:"convivium"`
+	MemberNo  string `json:"member_no" log:"redact" access:"address"`
+	Forwarded bool   `json:"forwarded"`
+}
+
+// BlockedClient database entry, summarizing the requests of a client that were rejected by the rate limiter.
+type BlockedClient struct {
+	IP           string `json:"ip"`
+	Count        int    `json:"count"`
+	FirstBlocked string `json:"first_blocked"`
+	LastBlocked  string `json:"last_blocked"`
+	LastPath     string `json:"last_path"`
+	LastReason   string `json:"last_reason"`
+}
+
+// OrderForward database entry, recording one attempt to hand an order to an order sink.
+type OrderForward struct {
+	ID       int64  `json:"id"`
+	OrderID  int64  `json:"order_id"`
+	Sink     string `json:"sink"`
+	Date     string `json:"date"`
+	Success  bool   `json:"success"`
+	Response string `json:"response"`
+}
+
+// ForwardStatus summarizes how well orders are forwarded to a sink.
+type ForwardStatus struct {
+	Sink string `json:"sink"`
+	// Backlog counts the orders whose latest forward failed or that were never forwarded although they should have been.
+	Backlog     int    `json:"backlog"`
+	LastSuccess string `json:"last_success"` // "" if there was none
+}
+
+// IdempotencyRecord database entry, remembering the response to a POST request with an Idempotency-Key header.
+// Status is 0 while the request is still being processed.
+type IdempotencyRecord struct {
+	Key      string
+	BodyHash string
+	Date     string
+	OrderID  int64
+	Status   int
+	Response string
+}
+
+// AdminUser database entry, a person that may use the admin endpoints.
+type AdminUser struct {
+	ID           int64  `json:"id"`
+	Username     string `json:"username"`
+	PasswordHash string `json:"-"`
+	Role         string `json:"role"`
+	Disabled     bool   `json:"disabled"`
+	Created      string `json:"created"`
+	LastLogin    string `json:"last_login"`    // "" if the user never logged in
+	FailedLogins int    `json:"failed_logins"` // since the last successful login
+	LockedUntil  string `json:"locked_until"`  // "" if the user was never locked out
+}
+
+// AdminSession database entry. Only the SHA-256 hash of the bearer token is stored.
+type AdminSession struct {
+	TokenHash string
+	UserID    int64
+	Created   string
+	Expires   string
+}
+
+// AuditEntry database entry, recording one change of an order, product or admin user.
+// Changes is a JSON object mapping each changed field to its "before" and "after" values.
+type AuditEntry struct {
+	ID         int64           `json:"id"`
+	Date       string          `json:"date"`
+	Actor      string          `json:"actor"`
+	Action     string          `json:"action"`
+	TargetType string          `json:"target_type"`
+	TargetID   int64           `json:"target_id"`
+	Changes    json.RawMessage `json:"changes"`
+	RequestID  string          `json:"request_id,omitempty"`
+}
+
+// Statuses of imported bank payments.
+const (
+	BankPaymentMatched   = "matched"   // paid an order in full, possibly with earlier partial payments
+	BankPaymentPartial   = "partial"   // less than the outstanding total of its order
+	BankPaymentOverpaid  = "overpaid"  // paid an order, but more than its outstanding total
+	BankPaymentDuplicate = "duplicate" // for an order that was already paid
+	BankPaymentUnmatched = "unmatched" // no order could be determined
+)
+
+// BankPayment database entry, a credit booked on our bank account and imported from a bank statement.
+// Key identifies the booking so that importing overlapping statements adds each payment once.
+type BankPayment struct {
+	ID            int64  `json:"id"`
+	Key           string `json:"-"`
+	BookingDate   string `json:"booking_date"`
+	AmountCents   int64  `json:"amount_cents"`
+	Currency      string `json:"currency"`
+	Reference     string `json:"reference" log:"redact" access:"payment"`
+	Counterparty  string `json:"counterparty" log:"redact" access:"payment"`
+	IBAN          string `json:"iban" log:"redact" access:"payment"`
+	BankReference string `json:"bank_reference"`
+	OrderID       int64  `json:"order_id"` // 0 if unmatched
+	Status        string `json:"status"`
+	Note          string `json:"note"`
+	ImportedAt    string `json:"imported_at"`
+}
+
+// DirectDebitExport is an exported pain.008 file of direct debits. XML holds the names and IBANs of the debtors.
+type DirectDebitExport struct {
+	MessageID       string `json:"message_id"`
+	CreatedAt       string `json:"created_at"`
+	CollectionDate  string `json:"collection_date"`
+	OrderCount      int    `json:"order_count"`
+	ControlSumCents int64  `json:"control_sum_cents"`
+	XML             []byte `json:"-"`
+}
+
+// AuditFilter selects audit entries. Empty fields match everything, Since and Until are RFC 3339 dates.
+type AuditFilter struct {
+	Actor      string
+	Action     string
+	TargetType string
+	TargetID   int64 // 0 matches every target
+	Since      string
+	Until      string
+	Limit      int
 }
 
 // ComputePrice applies our discount model.
@@ -64,61 +238,90 @@ func ComputePrice(order *Order) float64 {
 	return priceAfterDiscount
 }
 
-// VerifyOrder verifies that an order is valid.
+// VerifyOrder verifies that an order is valid and normalizes its countries to ISO 3166-1 alpha-2 codes.
+// The payment method depends on the server and is verified by its payment method registry.
+// If it is not, a *ValidationError lists every invalid field in the order's locale.
 func VerifyOrder(order *Order) error {
+	order.Locale = NormalizeLocale(order.Locale)
+	if order.Locale == "" {
+		order.Locale = DefaultLocale
+	}
+	locale := order.Locale
+	var invalid ValidationError
 	if order.Amount <= 0 {
-		return errors.New("Bitte bestellen Sie mindestens ein Produkt!")
+		invalid.Add("amount", CodeTooSmall, Message(locale, "amount.too_small"))
 	}
-	if order.Email == "" { // @todo verify email integrity
-		return errors.New("Bitte geben Sie gültige Emailadresse an!")
+	if order.Email == "" {
+		invalid.Add("email", CodeRequired, Message(locale, "email.required"))
+	} else if !ValidEmail(order.Email) {
+		invalid.Add("email", CodeInvalid, Message(locale, "email.invalid"))
 	}
-	// Invoice.
-	if order.FirstNameInvoice == "" || order.LastNameInvoice == "" {
-		return errors.New("Bitte geben Sie einen Namen an (Rechnungsanschrift)!")
+	verifyAddress(&invalid, locale, "invoice", order.FirstNameInvoice, order.LastNameInvoice, order.AddressStreetInvoice,
+		order.AddressStreetNoInvoice, order.AddressCodeInvoice, order.AddressCityInvoice, &order.AddressCountryInvoice)
+	verifyAddress(&invalid, locale, "delivery", order.FirstNameDelivery, order.LastNameDelivery, order.AddressStreetDelivery,
+		order.AddressStreetNoDelivery, order.AddressCodeDelivery, order.AddressCityDelivery, &order.AddressCountryDelivery)
+	// Misc.
+	if order.AgreesAGB == false {
+		invalid.Add("agrees_agb", CodeNotAccepted, Message(locale, "agb.not_accepted"))
 	}
-	if order.AddressStreetInvoice == "" {
-		return errors.New("Bitte geben Sie eine gültigen Straßennamen an (Rechnungsanschrift)!")
+	if order.AgreesPrivacy == false {
+		invalid.Add("agrees_data_privacy", CodeNotAccepted, Message(locale, "privacy.not_accepted"))
 	}
-	if order.AddressStreetNoInvoice == "" {
-		return errors.New("Bitte geben Sie eine gültige Straßennummer an (Rechnungsanschrift)!")
+	if len(invalid.Fields) > 0 {
+		return &invalid
 	}
-	if order.AddressCodeInvoice == "" {
-		return errors.New("Bitte geben Sie eine gültige Postleitzahl an (Rechnungsanschrift)!")
+	return nil
+}
+
+// EmailWarning returns a warning with the corrected address if the email address of an order looks misspelled
+// and the customer did not confirm it, or nil. The address may be right, e.g. "live.be", so it is no error.
+func EmailWarning(order *Order) *FieldError {
+	if !EmailTypoCheck || order.EmailConfirmed || !ValidEmail(order.Email) {
+		return nil
 	}
-	if order.AddressCityInvoice == "" {
-		return errors.New("Bitte geben Sie eine gültige Stadt an (Rechnungsanschrift)!")
+	suggestion := EmailTypoSuggestion(order.Email)
+	if suggestion == "" {
+		return nil
 	}
-	if order.AddressCountryInvoice == "" {
-		return errors.New("Bitte geben Sie ein gültiges Land an (Rechnungsanschrift)!")
+	return &FieldError{Field: "email", Code: CodeTypo, Message: Message(order.Locale, "email.typo", suggestion), Suggestion: suggestion}
+}
+
+// verifyAddress checks the invoice or delivery address and replaces the country by its ISO code if it is known.
+func verifyAddress(invalid *ValidationError, locale string, suffix string, firstName string, lastName string, street string,
+	streetNo string, code string, city string, country *string) {
+	address := Message(locale, "address."+suffix)
+	if firstName == "" {
+		invalid.Add("first_name_"+suffix, CodeRequired, Message(locale, "first_name.required", address))
 	}
-	// Delivery.
-	if order.FirstNameDelivery == "" || order.LastNameDelivery == "" {
-		return errors.New("Bitte geben Sie einen Namen an (Versandanschrift)!")
+	if lastName == "" {
+		invalid.Add("last_name_"+suffix, CodeRequired, Message(locale, "last_name.required", address))
 	}
-	if order.AddressStreetDelivery == "" {
-		return errors.New("Bitte geben Sie eine gültigen Straßennamen an (Versandanschrift)!")
+	if street == "" {
+		invalid.Add("address_street_"+suffix, CodeRequired, Message(locale, "street.required", address))
 	}
-	if order.AddressStreetNoDelivery == "" {
-		return errors.New("Bitte geben Sie eine gültige Straßennummer an (Versandanschrift)!")
+	if streetNo == "" {
+		invalid.Add("address_street_no_"+suffix, CodeRequired, Message(locale, "street_no.required", address))
 	}
-	if order.AddressCodeDelivery == "" {
-		return errors.New("Bitte geben Sie eine gültige Postleitzahl an (Versandanschrift)!")
+	if code == "" {
+		invalid.Add("address_code_"+suffix, CodeRequired, Message(locale, "postal_code.required", address))
 	}
-	if order.AddressCityDelivery == "" {
-		return errors.New("Bitte geben Sie eine gültige Stadt an (Versandanschrift)!")
+	if city == "" {
+		invalid.Add("address_city_"+suffix, CodeRequired, Message(locale, "city.required", address))
 	}
-	if order.AddressCountryDelivery == "" {
-		return errors.New("Bitte geben Sie ein gültiges Land an (Versandanschrift)!")
+	if *country == "" {
+		invalid.Add("address_country_"+suffix, CodeRequired, Message(locale, "country.required", address))
+		return
 	}
-	// Misc.
-	if order.Payment == "" || (order.Payment != "banktransfer" && order.Payment != "paypal") {
-		return errors.New("Bitte wählen Sie eine gültige Zahlart aus (banktransfer oder paypal)!")
+	isoCode, known := NormalizeCountry(*country)
+	if !known {
+		invalid.Add("address_country_"+suffix, CodeUnknown, Message(locale, "country.unknown", address, *country))
+		return
 	}
-	if order.AgreesAGB == false {
-		return errors.New("Sie müssen für eine Bestellung die AGBs unter https://calendariumculinarium.de/agb akzeptieren!")
+	*country = isoCode
+	if code == "" {
+		return
 	}
-	if order.AgreesPrivacy == false {
-		return errors.New("Sie müssen für eine Bestellung die Datenschutzerklärung unter https://calendariumculinarium.de/datenschutz akzeptieren!")
+	if message := postalCodeError(code, isoCode, address, locale); message != "" {
+		invalid.Add("address_code_"+suffix, CodeInvalidFormat, message)
 	}
-	return nil
 }
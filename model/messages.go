@@ -0,0 +1,202 @@
+package model
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// DefaultLocale is used if neither the order nor the Accept-Language header names a supported locale.
+const DefaultLocale = "de"
+
+// messages is the catalog of texts shown to customers and admins, by locale and key.
+// Texts are fmt format strings; every locale has the same keys with the same verbs.
+var messages = map[string]map[string]string{
+	"de": {
+		"address.invoice":            "Rechnungsanschrift",
+		"address.delivery":           "Versandanschrift",
+		"amount.too_small":           "Bitte bestellen Sie mindestens ein Produkt!",
+		"email.required":             "Bitte geben Sie eine Emailadresse an!",
+		"email.invalid":              "Bitte geben Sie eine gültige Emailadresse an!",
+		"email.typo":                 "Bitte prüfen Sie Ihre Emailadresse: Meinten Sie %s?",
+		"first_name.required":        "Bitte geben Sie einen Vornamen an (%s)!",
+		"last_name.required":         "Bitte geben Sie einen Nachnamen an (%s)!",
+		"street.required":            "Bitte geben Sie eine gültigen Straßennamen an (%s)!",
+		"street_no.required":         "Bitte geben Sie eine gültige Straßennummer an (%s)!",
+		"postal_code.required":       "Bitte geben Sie eine gültige Postleitzahl an (%s)!",
+		"postal_code.invalid_format": "Bitte geben Sie eine gültige Postleitzahl an (%s)! Postleitzahlen in %s haben das Format %s.",
+		"city.required":              "Bitte geben Sie eine gültige Stadt an (%s)!",
+		"country.required":           "Bitte geben Sie ein gültiges Land an (%s)!",
+		"country.unknown":            "Bitte geben Sie ein gültiges Land an (%s)! Das Land '%s' kennen wir leider nicht.",
+		"payment.required":           "Bitte wählen Sie eine Zahlart aus (%s)!",
+		"payment.invalid_choice":     "Bitte wählen Sie eine gültige Zahlart aus (%s)!",
+		"payment.banktransfer":       "Überweisung",
+		"payment.paypal":             "PayPal",
+		"payment.sepa":               "SEPA-Lastschrift",
+		"payment.voucher":            "Gutschein",
+		"sepa.holder.required":       "Bitte geben Sie den Kontoinhaber für die Lastschrift an!",
+		"sepa.iban.required":         "Bitte geben Sie die IBAN des Kontos für die Lastschrift an!",
+		"sepa.iban.invalid":          "Bitte geben Sie eine gültige IBAN an!",
+		"sepa.iban.unsupported":      "Lastschriften sind nur von Konten im SEPA-Raum möglich.",
+		"sepa.bic.required":          "Bitte geben Sie für Konten außerhalb des EWR die BIC an!",
+		"sepa.bic.invalid":           "Bitte geben Sie eine gültige BIC an!",
+		"sepa.mandate.not_accepted":  "Sie müssen für eine Zahlung per Lastschrift das SEPA-Lastschriftmandat erteilen!",
+		"sepa.mandate":               "Ich ermächtige %[1]s, Gläubiger-Identifikationsnummer %[2]s, Zahlungen von meinem Konto mittels Lastschrift einzuziehen. Zugleich weise ich mein Kreditinstitut an, die von %[1]s auf mein Konto gezogenen Lastschriften einzulösen. Die Vorabankündigung erfolgt spätestens einen Tag vor der Belastung.\n\nHinweis: Ich kann innerhalb von acht Wochen, beginnend mit dem Belastungsdatum, die Erstattung des belasteten Betrages verlangen. Es gelten dabei die mit meinem Kreditinstitut vereinbarten Bedingungen.",
+		"agb.not_accepted":           "Sie müssen für eine Bestellung die AGBs unter https://calendariumculinarium.de/agb akzeptieren!",
+		"privacy.not_accepted":       "Sie müssen für eine Bestellung die Datenschutzerklärung unter https://calendariumculinarium.de/datenschutz akzeptieren!",
+		"product.unknown":            "Bitte wählen Sie ein existierendes Produkt.",
+		"form_token.required":        "Bitte laden Sie das Bestellformular neu und senden Sie die Bestellung erneut ab.",
+		"order.thanks":               "Vielen Dank für Deine Bestellung mit Bestellnr. '%s'.",
+		"order.paypal":               "Bitte bezahle Deine Bestellung bei PayPal: %s",
+		"order.banktransfer":         "Bitte überweise %s EUR an %s (%s) mit dem Verwendungszweck '%s'.",
+		"order.sepa":                 "Wir ziehen %s EUR in den nächsten Tagen von Deinem Konto %s ein, mit der Mandatsreferenz '%s' und unserer Gläubiger-ID %s.",
+		"confirmation.subject":       "Deine Bestellung %s",
+		"confirmation.body":          "Hallo,\r\n\r\n%s\r\n\r\nDeine Bestellung: %d x Calendarium Culinarium für insgesamt %s EUR.\r\n\r\nViele Grüße\r\nDein Calendarium-Culinarium-Team",
+		"confirmation.girocode":      "Mit dem GiroCode im Anhang kannst Du die Überweisung in Deiner Banking-App scannen.",
+		"reminder.subject.first":     "Zahlungserinnerung zu Deiner Bestellung %s",
+		"reminder.subject.again":     "Erneute Zahlungserinnerung zu Deiner Bestellung %s",
+		"reminder.subject.last":      "Letzte Zahlungserinnerung zu Deiner Bestellung %s",
+		"reminder.body.first":        "Hallo,\r\n\r\nfür Deine Bestellung %s vom %s über %s EUR haben wir noch keine Zahlung erhalten. Vielleicht ist sie im Alltag untergegangen?\r\n\r\n%s\r\n\r\nFalls Du inzwischen bezahlt hast, betrachte diese Email bitte als gegenstandslos.\r\n\r\nViele Grüße\r\nDein Calendarium-Culinarium-Team",
+		"reminder.body.again":        "Hallo,\r\n\r\nfür Deine Bestellung %s vom %s über %s EUR haben wir trotz unserer Erinnerung noch keine Zahlung erhalten.\r\n\r\n%s\r\n\r\nFalls Du inzwischen bezahlt hast, betrachte diese Email bitte als gegenstandslos.\r\n\r\nViele Grüße\r\nDein Calendarium-Culinarium-Team",
+		"reminder.body.last":         "Hallo,\r\n\r\nfür Deine Bestellung %s vom %s über %s EUR haben wir trotz mehrerer Erinnerungen noch keine Zahlung erhalten. Dies ist unsere letzte Erinnerung.\r\n\r\n%s\r\n\r\nFalls Du inzwischen bezahlt hast, betrachte diese Email bitte als gegenstandslos.\r\n\r\nViele Grüße\r\nDein Calendarium-Culinarium-Team",
+		"reminder.reference":         "Bitte überweise den Betrag mit dem Verwendungszweck '%s'.",
+		"reminder.cancel_notice":     "Geht die Zahlung nicht bis zum %s ein, stornieren wir die Bestellung.",
+		"cancellation.subject":       "Stornierung Deiner Bestellung %s",
+		"cancellation.body":          "Hallo,\r\n\r\nda wir für Deine Bestellung %s vom %s trotz mehrerer Erinnerungen keine Zahlung erhalten haben, haben wir sie storniert. Falls Du bereits bezahlt hast oder weiterhin bestellen möchtest, antworte bitte einfach auf diese Email.\r\n\r\nViele Grüße\r\nDein Calendarium-Culinarium-Team",
+		"date.format":                "02.01.2006",
+		"idempotency.too_long":       "Idempotency-Key darf höchstens 255 Zeichen lang sein.",
+		"idempotency.reused":         "Dieser Idempotency-Key wurde bereits für eine andere Bestellung verwendet.",
+		"idempotency.in_progress":    "Diese Bestellung wird gerade bearbeitet.",
+		"rate_limited":               "Zu viele Anfragen, bitte versuche es später noch einmal.",
+		"billbee.subject.create":     "Fehler beim Bestellung erstellen",
+		"billbee.subject.forward":    "Fehler beim Bestellung weiterleiten",
+		"billbee.subject.status":     "Fehler bei billbee",
+		"billbee.subject.response":   "Fehler beim Response lesen",
+		"billbee.body":               "%s\r\n\r\nBei Bestellung mit ID %d\r\nHier Bestelldetails einsehen: https://calendariumculinarium.de/api/orders",
+	},
+	"en": {
+		"address.invoice":            "invoice address",
+		"address.delivery":           "delivery address",
+		"amount.too_small":           "Please order at least one product!",
+		"email.required":             "Please enter an email address!",
+		"email.invalid":              "Please enter a valid email address!",
+		"email.typo":                 "Please check your email address: Did you mean %s?",
+		"first_name.required":        "Please enter a first name (%s)!",
+		"last_name.required":         "Please enter a last name (%s)!",
+		"street.required":            "Please enter a valid street name (%s)!",
+		"street_no.required":         "Please enter a valid house number (%s)!",
+		"postal_code.required":       "Please enter a valid postal code (%s)!",
+		"postal_code.invalid_format": "Please enter a valid postal code (%s)! Postal codes in %s have the format %s.",
+		"city.required":              "Please enter a valid city (%s)!",
+		"country.required":           "Please enter a valid country (%s)!",
+		"country.unknown":            "Please enter a valid country (%s)! We do not know the country '%s'.",
+		"payment.required":           "Please choose a payment method (%s)!",
+		"payment.invalid_choice":     "Please choose a valid payment method (%s)!",
+		"payment.banktransfer":       "Bank transfer",
+		"payment.paypal":             "PayPal",
+		"payment.sepa":               "SEPA direct debit",
+		"payment.voucher":            "Voucher",
+		"sepa.holder.required":       "Please enter the account holder for the direct debit!",
+		"sepa.iban.required":         "Please enter the IBAN of the account for the direct debit!",
+		"sepa.iban.invalid":          "Please enter a valid IBAN!",
+		"sepa.iban.unsupported":      "Direct debits are only possible from accounts in the SEPA area.",
+		"sepa.bic.required":          "Please enter the BIC for accounts outside the EEA!",
+		"sepa.bic.invalid":           "Please enter a valid BIC!",
+		"sepa.mandate.not_accepted":  "To pay by direct debit you have to grant the SEPA direct debit mandate!",
+		"sepa.mandate":               "I authorise %[1]s, creditor identifier %[2]s, to collect payments from my account by direct debit. At the same time I instruct my bank to honour the direct debits drawn on my account by %[1]s. The pre-notification is sent at least one day before the debit.\n\nNote: I can demand a refund of the debited amount within eight weeks, starting with the date of the debit. The conditions agreed with my bank apply.",
+		"agb.not_accepted":           "To place an order you have to accept the terms and conditions at https://calendariumculinarium.de/agb!",
+		"privacy.not_accepted":       "To place an order you have to accept the privacy policy at https://calendariumculinarium.de/datenschutz!",
+		"product.unknown":            "Please choose an existing product.",
+		"form_token.required":        "Please reload the order form and submit the order again.",
+		"order.thanks":               "Thank you for your order with order number '%s'.",
+		"order.paypal":               "Please pay for your order at PayPal: %s",
+		"order.banktransfer":         "Please transfer %s EUR to %s (%s) with the reference '%s'.",
+		"order.sepa":                 "We will debit %s EUR from your account %s in the next days, with the mandate reference '%s' and our creditor identifier %s.",
+		"confirmation.subject":       "Your order %s",
+		"confirmation.body":          "Hello,\r\n\r\n%s\r\n\r\nYour order: %d x Calendarium Culinarium for a total of %s EUR.\r\n\r\nBest regards\r\nYour Calendarium Culinarium team",
+		"confirmation.girocode":      "Scan the attached GiroCode with your banking app to make the transfer.",
+		"reminder.subject.first":     "Payment reminder for your order %s",
+		"reminder.subject.again":     "Second payment reminder for your order %s",
+		"reminder.subject.last":      "Final payment reminder for your order %s",
+		"reminder.body.first":        "Hello,\r\n\r\nwe have not yet received the payment for your order %s of %s over %s EUR. Maybe it slipped your mind?\r\n\r\n%s\r\n\r\nIf you have paid in the meantime, please disregard this email.\r\n\r\nBest regards\r\nYour Calendarium Culinarium team",
+		"reminder.body.again":        "Hello,\r\n\r\ndespite our reminder, we have not yet received the payment for your order %s of %s over %s EUR.\r\n\r\n%s\r\n\r\nIf you have paid in the meantime, please disregard this email.\r\n\r\nBest regards\r\nYour Calendarium Culinarium team",
+		"reminder.body.last":         "Hello,\r\n\r\ndespite several reminders, we have not yet received the payment for your order %s of %s over %s EUR. This is our final reminder.\r\n\r\n%s\r\n\r\nIf you have paid in the meantime, please disregard this email.\r\n\r\nBest regards\r\nYour Calendarium Culinarium team",
+		"reminder.reference":         "Please transfer the amount with the reference '%s'.",
+		"reminder.cancel_notice":     "If we do not receive the payment by %s, we will cancel the order.",
+		"cancellation.subject":       "Cancellation of your order %s",
+		"cancellation.body":          "Hello,\r\n\r\nas we have not received the payment for your order %s of %s despite several reminders, we have cancelled it. If you have already paid or still want to order, please simply reply to this email.\r\n\r\nBest regards\r\nYour Calendarium Culinarium team",
+		"date.format":                "2006-01-02",
+		"idempotency.too_long":       "Idempotency-Key must be at most 255 characters long.",
+		"idempotency.reused":         "This Idempotency-Key was already used for a different order.",
+		"idempotency.in_progress":    "This order is being processed.",
+		"rate_limited":               "Too many requests, please try again later.",
+		"billbee.subject.create":     "Error while creating order",
+		"billbee.subject.forward":    "Error while forwarding order",
+		"billbee.subject.status":     "Error at billbee",
+		"billbee.subject.response":   "Error while reading response",
+		"billbee.body":               "%s\r\n\r\nFor order with ID %d\r\nSee order details here: https://calendariumculinarium.de/api/orders",
+	},
+}
+
+// Message looks up a text in the catalog and formats it with args.
+// Unsupported locales fall back to DefaultLocale.
+func Message(locale string, key string, args ...interface{}) string {
+	catalog, supported := messages[locale]
+	if !supported {
+		catalog = messages[DefaultLocale]
+	}
+	text, exists := catalog[key]
+	if !exists {
+		text = messages[DefaultLocale][key]
+	}
+	return fmt.Sprintf(text, args...)
+}
+
+// NormalizeLocale reduces a language tag like "en-US" to a supported locale, or returns "" if it is unsupported.
+func NormalizeLocale(locale string) string {
+	locale = strings.ToLower(strings.TrimSpace(locale))
+	if i := strings.IndexAny(locale, "-_"); i >= 0 {
+		locale = locale[:i]
+	}
+	if _, supported := messages[locale]; !supported {
+		return ""
+	}
+	return locale
+}
+
+// NegotiateLocale picks the supported locale the client prefers most according to an Accept-Language header.
+func NegotiateLocale(acceptLanguage string) string {
+	type candidate struct {
+		locale  string
+		quality float64
+	}
+	candidates := make([]candidate, 0)
+	for _, part := range strings.Split(acceptLanguage, ",") {
+		fields := strings.Split(part, ";")
+		locale := NormalizeLocale(fields[0])
+		if locale == "" {
+			continue
+		}
+		quality := 1.0
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				q, err := strconv.ParseFloat(param[2:], 64)
+				if err == nil {
+					quality = q
+				}
+			}
+		}
+		if quality > 0 {
+			candidates = append(candidates, candidate{locale, quality})
+		}
+	}
+	if len(candidates) == 0 {
+		return DefaultLocale
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].quality > candidates[j].quality
+	})
+	return candidates[0].locale
+}
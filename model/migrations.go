@@ -0,0 +1,301 @@
+package model
+
+import (
+	"database/sql"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kunterbunt/calendarium-server/logging"
+)
+
+// Migration changes the database schema from Version-1 to Version.
+type Migration struct {
+	Version     int
+	Description string
+	statements  []string
+	// migrate runs after the statements, for changes that need Go code.
+	migrate func(tx *sql.Tx) error
+}
+
+// migrations lists all schema changes in order. Never edit a released migration, append a new one instead.
+// The first migrations use CREATE TABLE IF NOT EXISTS because databases created before versioning already have these tables.
+var migrations = []Migration{
+	{1, "create products and orders tables", []string{
+		"CREATE TABLE IF NOT EXISTS products (id INTEGER PRIMARY KEY, name TEXT NOT NULL UNIQUE, description TEXT, price REAL, shipping REAL)",
+		"CREATE TABLE IF NOT EXISTS orders (id INTEGER PRIMARY KEY, product_id INTEGER NOT NULL, amount INTEGER NOT NULL, date INTEGER NOT NULL, first_name_invoice TEXT NOT NULL, last_name_invoice TEXT NOT NULL, first_name_delivery TEXT NOT NULL, last_name_delivery TEXT NOT NULL, email TEXT NOT NULL, address_street_invoice TEXT NOT NULL, address_street_no_invoice TEXT NOT NULL, address_code_invoice TEXT NOT NULL, address_country_invoice TEXT NOT NULL, address_city_invoice TEXT NOT NULL, address_street_delivery TEXT NOT NULL, address_street_no_delivery TEXT NOT NULL, address_code_delivery TEXT NOT NULL, address_city_delivery TEXT NOT NULL, address_country_delivery TEXT NOT NULL, payment TEXT, premium TEXT, is_reseller BOOLEAN, slow_food_member BOOLEAN, agrees_agbs BOOLEAN, agrees_data_privacy BOOLEAN, message TEXT, billbee_api_response TEXT, FOREIGN KEY (product_id) REFERENCES products (id))",
+	}, nil},
+	{2, "create order_forwards table", []string{
+		"CREATE TABLE IF NOT EXISTS order_forwards (id INTEGER PRIMARY KEY, order_id INTEGER NOT NULL, sink TEXT NOT NULL, date TEXT NOT NULL, success BOOLEAN NOT NULL, response TEXT, FOREIGN KEY (order_id) REFERENCES orders (id))",
+	}, nil},
+	{3, "create uz_orders table", []string{
+		"CREATE TABLE IF NOT EXISTS uz_orders (id INTEGER PRIMARY KEY, import_key TEXT NOT NULL UNIQUE, row INTEGER NOT NULL, convivium TEXT NOT NULL, member_no TEXT NOT NULL, amount INTEGER NOT NULL, date TEXT NOT NULL, company TEXT NOT NULL, first_name TEXT NOT NULL, last_name TEXT NOT NULL, email TEXT NOT NULL, address_street TEXT NOT NULL, address_street_no TEXT NOT NULL, address_code TEXT NOT NULL, address_city TEXT NOT NULL, address_country TEXT NOT NULL, message TEXT, forwarded BOOLEAN NOT NULL, billbee_api_response TEXT)",
+	}, nil},
+	{4, "create idempotency_keys table", []string{
+		"CREATE TABLE idempotency_keys (key TEXT PRIMARY KEY, body_hash TEXT NOT NULL, date TEXT NOT NULL, order_id INTEGER, status INTEGER NOT NULL, response TEXT)",
+	}, nil},
+	{5, "add spam quarantine to orders", []string{
+		"ALTER TABLE orders ADD COLUMN quarantined BOOLEAN NOT NULL DEFAULT 0",
+		"ALTER TABLE orders ADD COLUMN spam_reason TEXT NOT NULL DEFAULT ''",
+	}, nil},
+	{6, "normalize countries to ISO 3166 codes", nil, normalizeCountries},
+	{7, "add customer locale to orders", []string{
+		"ALTER TABLE orders ADD COLUMN locale TEXT NOT NULL DEFAULT 'de'",
+	}, nil},
+	{8, "add erasure date to orders", []string{
+		"ALTER TABLE orders ADD COLUMN erased_at TEXT NOT NULL DEFAULT ''",
+		"ALTER TABLE uz_orders ADD COLUMN erased_at TEXT NOT NULL DEFAULT ''",
+	}, nil},
+	{9, "add anonymization date to orders", []string{
+		"ALTER TABLE orders ADD COLUMN anonymized_at TEXT NOT NULL DEFAULT ''",
+		"ALTER TABLE uz_orders ADD COLUMN anonymized_at TEXT NOT NULL DEFAULT ''",
+	}, nil},
+	{10, "create admin_users and admin_sessions tables", []string{
+		"CREATE TABLE admin_users (id INTEGER PRIMARY KEY, username TEXT NOT NULL UNIQUE, password_hash TEXT NOT NULL, disabled BOOLEAN NOT NULL DEFAULT 0, created TEXT NOT NULL, last_login TEXT NOT NULL DEFAULT '')",
+		"CREATE TABLE admin_sessions (token_hash TEXT PRIMARY KEY, user_id INTEGER NOT NULL REFERENCES admin_users(id), created TEXT NOT NULL, expires TEXT NOT NULL)",
+		"CREATE INDEX admin_sessions_user_id ON admin_sessions (user_id)",
+	}, nil},
+	{11, "add roles to admin users", []string{
+		"ALTER TABLE admin_users ADD COLUMN role TEXT NOT NULL DEFAULT 'admin'",
+	}, nil},
+	{12, "create append-only audit_log table", []string{
+		"CREATE TABLE audit_log (id INTEGER PRIMARY KEY, date TEXT NOT NULL, actor TEXT NOT NULL, action TEXT NOT NULL, target_type TEXT NOT NULL, target_id INTEGER NOT NULL, changes TEXT NOT NULL, request_id TEXT NOT NULL)",
+		"CREATE INDEX audit_log_target ON audit_log (target_type, target_id)",
+		"CREATE TRIGGER audit_log_no_update BEFORE UPDATE ON audit_log BEGIN SELECT RAISE(ABORT, 'audit_log is append-only'); END",
+		"CREATE TRIGGER audit_log_no_delete BEFORE DELETE ON audit_log BEGIN SELECT RAISE(ABORT, 'audit_log is append-only'); END",
+	}, nil},
+	{13, "add payment state to orders", []string{
+		"ALTER TABLE orders ADD COLUMN paypal_order_id TEXT NOT NULL DEFAULT ''",
+		"ALTER TABLE orders ADD COLUMN paid_at TEXT NOT NULL DEFAULT ''",
+		"ALTER TABLE orders ADD COLUMN payment_reference TEXT NOT NULL DEFAULT ''",
+		"CREATE INDEX orders_paypal_order_id ON orders (paypal_order_id)",
+	}, nil},
+	{14, "add bank_payments table", []string{
+		`CREATE TABLE bank_payments (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			key TEXT NOT NULL UNIQUE,
+			booking_date TEXT NOT NULL,
+			amount_cents INTEGER NOT NULL,
+			currency TEXT NOT NULL,
+			reference TEXT NOT NULL,
+			counterparty TEXT NOT NULL,
+			iban TEXT NOT NULL,
+			bank_reference TEXT NOT NULL,
+			order_id INTEGER NOT NULL DEFAULT 0,
+			status TEXT NOT NULL,
+			note TEXT NOT NULL DEFAULT '',
+			imported_at TEXT NOT NULL
+		)`,
+		"CREATE INDEX bank_payments_order_id ON bank_payments (order_id)",
+		"CREATE INDEX bank_payments_status ON bank_payments (status)",
+	}, nil},
+	{15, "add dunning state to orders", []string{
+		"ALTER TABLE orders ADD COLUMN reminder_level INTEGER NOT NULL DEFAULT 0",
+		"ALTER TABLE orders ADD COLUMN reminded_at TEXT NOT NULL DEFAULT ''",
+		"ALTER TABLE orders ADD COLUMN cancelled_at TEXT NOT NULL DEFAULT ''",
+		"ALTER TABLE orders ADD COLUMN review_reason TEXT NOT NULL DEFAULT ''",
+	}, nil},
+	{16, "add SEPA direct debit mandates to orders", []string{
+		"ALTER TABLE orders ADD COLUMN sepa_account_holder TEXT NOT NULL DEFAULT ''",
+		"ALTER TABLE orders ADD COLUMN sepa_iban TEXT NOT NULL DEFAULT ''",
+		"ALTER TABLE orders ADD COLUMN sepa_bic TEXT NOT NULL DEFAULT ''",
+		"ALTER TABLE orders ADD COLUMN sepa_mandate_reference TEXT NOT NULL DEFAULT ''",
+		"ALTER TABLE orders ADD COLUMN sepa_mandate_date TEXT NOT NULL DEFAULT ''",
+		"ALTER TABLE orders ADD COLUMN sepa_mandate_text TEXT NOT NULL DEFAULT ''",
+		"ALTER TABLE orders ADD COLUMN sepa_exported_at TEXT NOT NULL DEFAULT ''",
+	}, nil},
+	{17, "create rate_limit_blocks table", []string{
+		"CREATE TABLE rate_limit_blocks (ip TEXT PRIMARY KEY, count INTEGER NOT NULL, first_blocked TEXT NOT NULL, last_blocked TEXT NOT NULL, last_path TEXT NOT NULL, last_reason TEXT NOT NULL)",
+		"CREATE INDEX rate_limit_blocks_last_blocked ON rate_limit_blocks (last_blocked)",
+	}, nil},
+	{18, "split companies out of order messages and add email hashes", []string{
+		"ALTER TABLE orders ADD COLUMN company_invoice TEXT NOT NULL DEFAULT ''",
+		"ALTER TABLE orders ADD COLUMN company_delivery TEXT NOT NULL DEFAULT ''",
+		"ALTER TABLE orders ADD COLUMN email_hash TEXT NOT NULL DEFAULT ''",
+		"ALTER TABLE uz_orders ADD COLUMN email_hash TEXT NOT NULL DEFAULT ''",
+		"CREATE INDEX orders_email_hash ON orders (email_hash)",
+		"CREATE INDEX uz_orders_email_hash ON uz_orders (email_hash)",
+	}, splitOrderCompanies},
+	{19, "add login lockout to admin users", []string{
+		"ALTER TABLE admin_users ADD COLUMN failed_logins INTEGER NOT NULL DEFAULT 0",
+		"ALTER TABLE admin_users ADD COLUMN locked_until TEXT NOT NULL DEFAULT ''",
+	}, nil},
+	{20, "keep exported direct debit files and mark debits paid on their collection date", []string{
+		"CREATE TABLE sepa_exports (message_id TEXT PRIMARY KEY, created_at TEXT NOT NULL, collection_date TEXT NOT NULL, order_count INTEGER NOT NULL, control_sum_cents INTEGER NOT NULL, xml BLOB NOT NULL)",
+		"ALTER TABLE orders ADD COLUMN sepa_message_id TEXT NOT NULL DEFAULT ''",
+		"ALTER TABLE orders ADD COLUMN sepa_collection_date TEXT NOT NULL DEFAULT ''",
+		// Debits exported before were marked paid on their collection date.
+		"UPDATE orders SET sepa_collection_date = substr(paid_at, 1, 10), sepa_message_id = substr(payment_reference, 6) WHERE sepa_exported_at != '' AND payment_reference LIKE 'sepa:%'",
+	}, nil},
+	{21, "remember resolved order reviews", []string{
+		"ALTER TABLE orders ADD COLUMN review_resolved_at TEXT NOT NULL DEFAULT ''",
+	}, nil},
+}
+
+// splitOrderCompanies moves the companies that AddOrder used to append to the message into their own columns.
+func splitOrderCompanies(tx *sql.Tx) error {
+	rows, err := tx.Query("SELECT id, message FROM orders WHERE message LIKE '%company_invoice=''%' OR message LIKE '%company_delivery=''%'")
+	if err != nil {
+		return err
+	}
+	type split struct {
+		id                                       int64
+		message, companyInvoice, companyDelivery string
+	}
+	splits := make([]split, 0)
+	for rows.Next() {
+		var id int64
+		var message string
+		err = rows.Scan(&id, &message)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		message, companyInvoice, companyDelivery := splitCompanies(message)
+		splits = append(splits, split{id, message, companyInvoice, companyDelivery})
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	for _, split := range splits {
+		_, err = tx.Exec("UPDATE orders SET message = ?, company_invoice = ?, company_delivery = ? WHERE id = ?", split.message, split.companyInvoice, split.companyDelivery, split.id)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// splitCompanies splits a message of the form "<message> company_invoice='<company>' company_delivery='<company>'"
+// into the message and the companies. Either company may be missing.
+func splitCompanies(message string) (string, string, string) {
+	message, companyDelivery := cutQuotedSuffix(message, " company_delivery='")
+	message, companyInvoice := cutQuotedSuffix(message, " company_invoice='")
+	return message, companyInvoice, companyDelivery
+}
+
+func cutQuotedSuffix(message string, marker string) (string, string) {
+	index := strings.LastIndex(message, marker)
+	if index < 0 || !strings.HasSuffix(message, "'") || index+len(marker) > len(message)-1 {
+		return message, ""
+	}
+	return message[:index], message[index+len(marker) : len(message)-1]
+}
+
+// schemaVersion returns the version of the database schema without changing the database, 0 for a new database.
+func schemaVersion(db *sql.DB) (int, error) {
+	var tables int
+	err := db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'schema_migrations'").Scan(&tables)
+	if err != nil || tables == 0 {
+		return 0, err
+	}
+	var version sql.NullInt64
+	err = db.QueryRow("SELECT MAX(version) FROM schema_migrations").Scan(&version)
+	if err != nil {
+		return 0, err
+	}
+	return int(version.Int64), nil
+}
+
+// PendingMigrations returns the migrations that have not been applied to the database yet.
+func PendingMigrations(db *sql.DB, mutex *sync.Mutex) ([]Migration, error) {
+	defer lock(mutex, "PendingMigrations")()
+	version, err := schemaVersion(db)
+	if err != nil {
+		return nil, err
+	}
+	pending := make([]Migration, 0)
+	for _, migration := range migrations {
+		if migration.Version > version {
+			pending = append(pending, migration)
+		}
+	}
+	return pending, nil
+}
+
+// Migrate applies all pending migrations, each in its own transaction, and returns the applied ones.
+func Migrate(db *sql.DB, mutex *sync.Mutex) ([]Migration, error) {
+	pending, err := PendingMigrations(db, mutex)
+	if err != nil {
+		return nil, err
+	}
+	defer lock(mutex, "Migrate")()
+	_, err = db.Exec("CREATE TABLE IF NOT EXISTS schema_migrations (version INTEGER PRIMARY KEY, description TEXT NOT NULL, applied_at TEXT NOT NULL)")
+	if err != nil {
+		return nil, err
+	}
+	applied := make([]Migration, 0, len(pending))
+	for _, migration := range pending {
+		tx, err := db.Begin()
+		if err != nil {
+			return applied, err
+		}
+		for _, statement := range migration.statements {
+			_, err = tx.Exec(statement)
+			if err != nil {
+				tx.Rollback()
+				return applied, err
+			}
+		}
+		if migration.migrate != nil {
+			err = migration.migrate(tx)
+			if err != nil {
+				tx.Rollback()
+				return applied, err
+			}
+		}
+		_, err = tx.Exec("INSERT INTO schema_migrations (version, description, applied_at) VALUES (?, ?, ?)", migration.Version, migration.Description, time.Now().Format(time.RFC3339))
+		if err != nil {
+			tx.Rollback()
+			return applied, err
+		}
+		err = tx.Commit()
+		if err != nil {
+			return applied, err
+		}
+		applied = append(applied, migration)
+	}
+	return applied, nil
+}
+
+// normalizeCountries replaces free-text countries by ISO codes. Unknown countries are kept and logged.
+func normalizeCountries(tx *sql.Tx) error {
+	columns := [][2]string{
+		{"orders", "address_country_invoice"},
+		{"orders", "address_country_delivery"},
+		{"uz_orders", "address_country"},
+	}
+	for _, column := range columns {
+		rows, err := tx.Query("SELECT DISTINCT " + column[1] + " FROM " + column[0])
+		if err != nil {
+			return err
+		}
+		var values []string
+		for rows.Next() {
+			var value string
+			err = rows.Scan(&value)
+			if err != nil {
+				rows.Close()
+				return err
+			}
+			values = append(values, value)
+		}
+		rows.Close()
+		for _, value := range values {
+			code, known := NormalizeCountry(value)
+			if !known {
+				logging.Warn("unknown country is kept as-is", logging.Fields{"country": value, "column": column[0] + "." + column[1]})
+				continue
+			}
+			if code == value {
+				continue
+			}
+			_, err = tx.Exec("UPDATE "+column[0]+" SET "+column[1]+" = ? WHERE "+column[1]+" = ?", code, value)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
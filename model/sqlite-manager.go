@@ -1,9 +1,15 @@
 package model
 
 import (
+	"crypto/sha256"
 	"database/sql"
+	"encoding/hex"
+	"encoding/json"
 	_ "github.com/mattn/go-sqlite3" // init driver
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 )
 
 // OpenDb opens the database with the given filename and returns a pointer to it.
@@ -15,32 +21,73 @@ func OpenDb(filename string) (*sql.DB, error) {
 	return db, nil
 }
 
-// Validate the content of the provided database and creates tables if-need-be.
-func Validate(db *sql.DB, mutex *sync.Mutex) error {
-	mutex.Lock()
-	defer mutex.Unlock()
-	// PRODUCTS table.
-	statement, err := db.Prepare("CREATE TABLE IF NOT EXISTS products (id INTEGER PRIMARY KEY, name TEXT NOT NULL UNIQUE, description TEXT, price REAL, shipping REAL)")
-	if err != nil {
-		return err
+// OpenDbReadOnly opens an existing database without allowing any changes to it, e.g. for dry runs.
+func OpenDbReadOnly(filename string) (*sql.DB, error) {
+	return OpenDb("file:" + filename + "?mode=ro")
+}
+
+// ObserveMutexWait and ObserveQuery are called, if set, with the time spent waiting for the database mutex
+// and the time the named database operation held it.
+var (
+	ObserveMutexWait func(wait time.Duration)
+	ObserveQuery     func(operation string, duration time.Duration)
+)
+
+// Queryer is a database or a transaction started by Transaction.
+type Queryer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+	Prepare(query string) (*sql.Stmt, error)
+}
+
+// Transaction runs change in a transaction that holds the database mutex, and commits it if change returns nil.
+// The functions of this package called by change get the transaction and a nil mutex, since it is held already.
+func Transaction(db *sql.DB, mutex *sync.Mutex, change func(tx Queryer) error) error {
+	defer lock(mutex, "Transaction")()
+	return inTransaction(db, change)
+}
+
+// inTransaction runs change in a new transaction, or in the transaction db if it is one already.
+func inTransaction(db Queryer, change func(tx Queryer) error) error {
+	if tx, ok := db.(*sql.Tx); ok {
+		return change(tx)
 	}
-	statement.Exec()
-	// ORDERS table.
-	statement, err = db.Prepare("CREATE TABLE IF NOT EXISTS orders (id INTEGER PRIMARY KEY, product_id INTEGER NOT NULL, amount INTEGER NOT NULL, date INTEGER NOT NULL, first_name_invoice TEXT NOT NULL, last_name_invoice TEXT NOT NULL, first_name_delivery TEXT NOT NULL, last_name_delivery TEXT NOT NULL, email TEXT NOT NULL, address_street_invoice TEXT NOT NULL, address_street_no_invoice TEXT NOT NULL, address_code_invoice TEXT NOT NULL, address_country_invoice TEXT NOT NULL, address_city_invoice TEXT NOT NULL, address_street_delivery TEXT NOT NULL, address_street_no_delivery TEXT NOT NULL, address_code_delivery TEXT NOT NULL, address_city_delivery TEXT NOT NULL, address_country_delivery TEXT NOT NULL, payment TEXT, premium TEXT, is_reseller BOOLEAN, slow_food_member BOOLEAN, agrees_agbs BOOLEAN, agrees_data_privacy BOOLEAN, message TEXT, billbee_api_response TEXT, FOREIGN KEY (product_id) REFERENCES products (id))")
+	tx, err := db.(*sql.DB).Begin()
 	if err != nil {
 		return err
 	}
-	_, err = statement.Exec()
+	err = change(tx)
 	if err != nil {
+		tx.Rollback()
 		return err
 	}
-	return nil
+	return tx.Commit()
 }
 
-// AddProduct adds a product to the database.
-func AddProduct(db *sql.DB, product *Product, mutex *sync.Mutex) error {
+// lock acquires the database mutex and returns the function that releases it.
+// A nil mutex is not locked, for calls within a Transaction.
+func lock(mutex *sync.Mutex, operation string) func() {
+	if mutex == nil {
+		return func() {}
+	}
+	start := time.Now()
 	mutex.Lock()
-	defer mutex.Unlock()
+	acquired := time.Now()
+	if ObserveMutexWait != nil {
+		ObserveMutexWait(acquired.Sub(start))
+	}
+	return func() {
+		mutex.Unlock()
+		if ObserveQuery != nil {
+			ObserveQuery(operation, time.Since(acquired))
+		}
+	}
+}
+
+// AddProduct adds a product to the database.
+func AddProduct(db Queryer, product *Product, mutex *sync.Mutex) error {
+	defer lock(mutex, "AddProduct")()
 	statement, err := db.Prepare("INSERT INTO products (name, description, price, shipping) VALUES (?, ?, ?, ?)")
 	if err != nil {
 		return err
@@ -50,9 +97,8 @@ func AddProduct(db *sql.DB, product *Product, mutex *sync.Mutex) error {
 }
 
 // GetProducts returns all products in the database.
-func GetProducts(db *sql.DB, mutex *sync.Mutex) ([]Product, error) {
-	mutex.Lock()
-	defer mutex.Unlock()
+func GetProducts(db Queryer, mutex *sync.Mutex) ([]Product, error) {
+	defer lock(mutex, "GetProducts")()
 	query := "SELECT id, name, description, price, shipping FROM products"
 	rows, err := db.Query(query)
 	if err != nil {
@@ -72,9 +118,8 @@ func GetProducts(db *sql.DB, mutex *sync.Mutex) ([]Product, error) {
 
 // GetProduct queries the database for a product with the given name.
 // If the returned product's ID is identical to model.InvalidID, then the corresponding product was not found.
-func GetProduct(db *sql.DB, name string, mutex *sync.Mutex) (*Product, error) {
-	mutex.Lock()
-	defer mutex.Unlock()
+func GetProduct(db Queryer, name string, mutex *sync.Mutex) (*Product, error) {
+	defer lock(mutex, "GetProduct")()
 	statement := "SELECT id, description, price, shipping FROM products WHERE name=?"
 	row := db.QueryRow(statement, name)
 	product := Product{InvalidID, name, "", 0.0, 0.0}
@@ -91,9 +136,8 @@ func GetProduct(db *sql.DB, name string, mutex *sync.Mutex) (*Product, error) {
 
 // GetProductByID queries the database for a product with the given ID.
 // If the returned product's ID is identical to model.InvalidID, then the corresponding product was not found.
-func GetProductByID(db *sql.DB, id int, mutex *sync.Mutex) (*Product, error) {
-	mutex.Lock()
-	defer mutex.Unlock()
+func GetProductByID(db Queryer, id int, mutex *sync.Mutex) (*Product, error) {
+	defer lock(mutex, "GetProductByID")()
 	statement := "SELECT id, name, description, price, shipping FROM products WHERE id=?"
 	row := db.QueryRow(statement, id)
 	product := Product{InvalidID, "", "", 0.0, 0.0}
@@ -109,22 +153,14 @@ func GetProductByID(db *sql.DB, id int, mutex *sync.Mutex) (*Product, error) {
 }
 
 // AddOrder adds an order to the database and sets the ID in the order.
-func AddOrder(db *sql.DB, order *Order, mutex *sync.Mutex) error {
-	mutex.Lock()
-	defer mutex.Unlock()
+func AddOrder(db Queryer, order *Order, mutex *sync.Mutex) error {
+	defer lock(mutex, "AddOrder")()
 
-	statement, err := db.Prepare("INSERT INTO orders (product_id, amount, date, first_name_invoice, last_name_invoice, first_name_delivery, last_name_delivery, email, address_street_invoice, address_street_no_invoice, address_code_invoice, address_city_invoice, address_country_invoice, address_street_delivery, address_street_no_delivery, address_code_delivery, address_city_delivery, address_country_delivery, payment , premium, is_reseller, slow_food_member, agrees_agbs, agrees_data_privacy, message, billbee_api_response) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)")
+	statement, err := db.Prepare("INSERT INTO orders (product_id, amount, date, first_name_invoice, last_name_invoice, first_name_delivery, last_name_delivery, email, address_street_invoice, address_street_no_invoice, address_code_invoice, address_city_invoice, address_country_invoice, address_street_delivery, address_street_no_delivery, address_code_delivery, address_city_delivery, address_country_delivery, payment , premium, is_reseller, slow_food_member, agrees_agbs, agrees_data_privacy, message, billbee_api_response, quarantined, spam_reason, locale, sepa_account_holder, sepa_iban, sepa_bic, sepa_mandate_date, sepa_mandate_text, company_invoice, company_delivery) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)")
 	if err != nil {
 		return err
 	}
-	message := order.Message
-	if order.CompanyInvoice != "" {
-		message = message + " company_invoice='" + order.CompanyInvoice + "'"
-	}
-	if order.CompanyDelivery != "" {
-		message = message + " company_delivery='" + order.CompanyDelivery + "'"
-	}
-	result, err := statement.Exec(order.ProductID, order.Amount, order.Date, order.FirstNameInvoice, order.LastNameInvoice, order.FirstNameDelivery, order.LastNameDelivery, order.Email, order.AddressStreetInvoice, order.AddressStreetNoInvoice, order.AddressCodeInvoice, order.AddressCityInvoice, order.AddressCountryInvoice, order.AddressStreetDelivery, order.AddressStreetNoDelivery, order.AddressCodeDelivery, order.AddressCityDelivery, order.AddressCountryDelivery, order.Payment, order.Premium, order.Reseller, order.SlowFoodMember, order.AgreesAGB, order.AgreesPrivacy, message, order.BillbeeResponse)
+	result, err := statement.Exec(order.ProductID, order.Amount, order.Date, order.FirstNameInvoice, order.LastNameInvoice, order.FirstNameDelivery, order.LastNameDelivery, order.Email, order.AddressStreetInvoice, order.AddressStreetNoInvoice, order.AddressCodeInvoice, order.AddressCityInvoice, order.AddressCountryInvoice, order.AddressStreetDelivery, order.AddressStreetNoDelivery, order.AddressCodeDelivery, order.AddressCityDelivery, order.AddressCountryDelivery, order.Payment, order.Premium, order.Reseller, order.SlowFoodMember, order.AgreesAGB, order.AgreesPrivacy, order.Message, order.BillbeeResponse, order.Quarantined, order.SpamReason, order.Locale, order.SEPAAccountHolder, order.SEPAIBAN, order.SEPABIC, order.SEPAMandateDate, order.SEPAMandateText, order.CompanyInvoice, order.CompanyDelivery)
 	if err != nil {
 		return err
 	}
@@ -136,10 +172,16 @@ func AddOrder(db *sql.DB, order *Order, mutex *sync.Mutex) error {
 	return nil
 }
 
+// ReleaseOrder lifts the spam quarantine of an order.
+func ReleaseOrder(id int64, db Queryer, mutex *sync.Mutex) error {
+	defer lock(mutex, "ReleaseOrder")()
+	_, err := db.Exec("UPDATE orders SET quarantined = 0 WHERE id = ?", id)
+	return err
+}
+
 // GetNumOrders returns the number of orders currently saved in the database.
-func GetNumOrders(db *sql.DB, mutex *sync.Mutex) (int, error) {
-	mutex.Lock()
-	defer mutex.Unlock()
+func GetNumOrders(db Queryer, mutex *sync.Mutex) (int, error) {
+	defer lock(mutex, "GetNumOrders")()
 	statement, err := db.Prepare("SELECT COUNT(*) FROM orders")
 	if err != nil {
 		return 0, err
@@ -157,9 +199,8 @@ func GetNumOrders(db *sql.DB, mutex *sync.Mutex) (int, error) {
 }
 
 // AddBillbeeResponseToOrder saves the API response from forwarding an order to billbee for later debugging purposes.
-func AddBillbeeResponseToOrder(id int64, billbeeResponse string, db *sql.DB, mutex *sync.Mutex) error {
-	mutex.Lock()
-	defer mutex.Unlock()
+func AddBillbeeResponseToOrder(id int64, billbeeResponse string, db Queryer, mutex *sync.Mutex) error {
+	defer lock(mutex, "AddBillbeeResponseToOrder")()
 	statement, err := db.Prepare("UPDATE orders SET billbee_api_response = ? where id = ?")
 	if err != nil {
 		return err
@@ -171,23 +212,1040 @@ func AddBillbeeResponseToOrder(id int64, billbeeResponse string, db *sql.DB, mut
 	return nil
 }
 
+const orderColumns = "id, product_id, amount, date, first_name_invoice, last_name_invoice, first_name_delivery, last_name_delivery, email, address_street_invoice, address_street_no_invoice, address_code_invoice, address_city_invoice, address_country_invoice, address_street_delivery, address_street_no_delivery, address_code_delivery, address_city_delivery, address_country_delivery, payment, premium, is_reseller, slow_food_member, agrees_agbs, agrees_data_privacy, message, billbee_api_response, quarantined, spam_reason, locale, paypal_order_id, paid_at, payment_reference, reminder_level, reminded_at, cancelled_at, review_reason, sepa_account_holder, sepa_iban, sepa_bic, sepa_mandate_reference, sepa_mandate_date, sepa_mandate_text, sepa_exported_at, anonymized_at, erased_at, company_invoice, company_delivery, sepa_message_id, sepa_collection_date, review_resolved_at"
+
+func scanOrder(row scanner) (*Order, error) {
+	var order Order
+	err := row.Scan(&order.ID, &order.ProductID, &order.Amount, &order.Date, &order.FirstNameInvoice, &order.LastNameInvoice, &order.FirstNameDelivery, &order.LastNameDelivery, &order.Email, &order.AddressStreetInvoice, &order.AddressStreetNoInvoice, &order.AddressCodeInvoice, &order.AddressCityInvoice, &order.AddressCountryInvoice, &order.AddressStreetDelivery, &order.AddressStreetNoDelivery, &order.AddressCodeDelivery, &order.AddressCityDelivery, &order.AddressCountryDelivery, &order.Payment, &order.Premium, &order.Reseller, &order.SlowFoodMember, &order.AgreesAGB, &order.AgreesPrivacy, &order.Message, &order.BillbeeResponse, &order.Quarantined, &order.SpamReason, &order.Locale, &order.PayPalOrderID, &order.PaidAt, &order.PaymentReference, &order.ReminderLevel, &order.RemindedAt, &order.CancelledAt, &order.ReviewReason, &order.SEPAAccountHolder, &order.SEPAIBAN, &order.SEPABIC, &order.SEPAMandateReference, &order.SEPAMandateDate, &order.SEPAMandateText, &order.SEPAExportedAt, &order.AnonymizedAt, &order.ErasedAt, &order.CompanyInvoice, &order.CompanyDelivery, &order.SEPAMessageID, &order.SEPACollectionDate, &order.ReviewResolvedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &order, nil
+}
+
+// GetOrderByPayPalOrderID queries the database for the order paid with the given PayPal order.
+// If the returned order's ID is identical to model.InvalidID, then the corresponding order was not found.
+func GetOrderByPayPalOrderID(db Queryer, paypalOrderID string, mutex *sync.Mutex) (*Order, error) {
+	defer lock(mutex, "GetOrderByPayPalOrderID")()
+	order, err := scanOrder(db.QueryRow("SELECT "+orderColumns+" FROM orders WHERE paypal_order_id = ? AND paypal_order_id != ''", paypalOrderID))
+	switch err {
+	case sql.ErrNoRows:
+		return &Order{ID: int64(InvalidID)}, nil
+	case nil:
+		return order, nil
+	default:
+		return nil, err
+	}
+}
+
+// SetOrderPayPalOrderID records the PayPal order created for the payment of an order.
+func SetOrderPayPalOrderID(db Queryer, id int64, paypalOrderID string, mutex *sync.Mutex) error {
+	defer lock(mutex, "SetOrderPayPalOrderID")()
+	_, err := db.Exec("UPDATE orders SET paypal_order_id = ? WHERE id = ?", paypalOrderID, id)
+	return err
+}
+
+// MarkOrderPaid records the payment of an order. It returns false if the order was already marked paid.
+func MarkOrderPaid(db Queryer, id int64, paidAt string, reference string, mutex *sync.Mutex) (bool, error) {
+	defer lock(mutex, "MarkOrderPaid")()
+	result, err := db.Exec("UPDATE orders SET paid_at = ?, payment_reference = ? WHERE id = ? AND paid_at = ''", paidAt, reference, id)
+	if err != nil {
+		return false, err
+	}
+	affected, err := result.RowsAffected()
+	return affected == 1, err
+}
+
+// GetUnpaidOrders returns the orders placed before the given RFC 3339 date that are neither paid, cancelled,
+// flagged for review, quarantined, anonymized nor awaiting their direct debit, paid with one of the given payment methods.
+func GetUnpaidOrders(db Queryer, before string, payments []string, mutex *sync.Mutex) ([]Order, error) {
+	defer lock(mutex, "GetUnpaidOrders")()
+	if len(payments) == 0 {
+		return []Order{}, nil
+	}
+	args := []interface{}{before}
+	for _, payment := range payments {
+		args = append(args, payment)
+	}
+	rows, err := db.Query("SELECT "+orderColumns+" FROM orders WHERE datetime(date) < datetime(?) AND paid_at = '' AND cancelled_at = '' AND review_reason = '' AND quarantined = 0 AND anonymized_at = '' AND erased_at = '' AND sepa_exported_at = '' AND payment IN (?"+strings.Repeat(", ?", len(payments)-1)+") ORDER BY id", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	orders := make([]Order, 0)
+	for rows.Next() {
+		order, err := scanOrder(rows)
+		if err != nil {
+			return nil, err
+		}
+		orders = append(orders, *order)
+	}
+	return orders, rows.Err()
+}
+
+// SetOrderReminder records that the payment reminder of the given level was sent for an order.
+func SetOrderReminder(db Queryer, id int64, level int, remindedAt string, mutex *sync.Mutex) error {
+	defer lock(mutex, "SetOrderReminder")()
+	_, err := db.Exec("UPDATE orders SET reminder_level = ?, reminded_at = ? WHERE id = ?", level, remindedAt, id)
+	return err
+}
+
+// CancelOrder cancels an unpaid order. It returns false if the order was paid or cancelled meanwhile.
+func CancelOrder(db Queryer, id int64, cancelledAt string, mutex *sync.Mutex) (bool, error) {
+	defer lock(mutex, "CancelOrder")()
+	result, err := db.Exec("UPDATE orders SET cancelled_at = ? WHERE id = ? AND paid_at = '' AND cancelled_at = ''", cancelledAt, id)
+	if err != nil {
+		return false, err
+	}
+	affected, err := result.RowsAffected()
+	return affected == 1, err
+}
+
+// FlagOrderForReview records why an order needs manual attention. The reason is appended to the reasons of an order
+// that is already flagged.
+func FlagOrderForReview(db Queryer, id int64, reason string, mutex *sync.Mutex) error {
+	defer lock(mutex, "FlagOrderForReview")()
+	_, err := db.Exec("UPDATE orders SET review_reason = CASE WHEN review_reason = '' THEN ? ELSE review_reason || '; ' || ? END WHERE id = ?", reason, reason, id)
+	return err
+}
+
+// ClearOrderReview removes the review flag of an order once it was handled and records when. It returns false if the
+// order was not flagged.
+func ClearOrderReview(db Queryer, id int64, resolvedAt string, mutex *sync.Mutex) (bool, error) {
+	defer lock(mutex, "ClearOrderReview")()
+	result, err := db.Exec("UPDATE orders SET review_reason = '', review_resolved_at = ? WHERE id = ? AND review_reason != ''", resolvedAt, id)
+	if err != nil {
+		return false, err
+	}
+	affected, err := result.RowsAffected()
+	return affected == 1, err
+}
+
+// SetOrderMandateReference records the reference of the SEPA direct debit mandate of an order.
+func SetOrderMandateReference(db Queryer, id int64, reference string, mutex *sync.Mutex) error {
+	defer lock(mutex, "SetOrderMandateReference")()
+	_, err := db.Exec("UPDATE orders SET sepa_mandate_reference = ? WHERE id = ?", reference, id)
+	return err
+}
+
+// GetPendingDirectDebits returns the orders paid by SEPA direct debit whose debit was not exported yet.
+func GetPendingDirectDebits(db Queryer, mutex *sync.Mutex) ([]Order, error) {
+	defer lock(mutex, "GetPendingDirectDebits")()
+	rows, err := db.Query("SELECT " + orderColumns + " FROM orders WHERE payment = 'sepa' AND sepa_exported_at = '' AND paid_at = '' AND cancelled_at = '' AND quarantined = 0 AND erased_at = '' AND sepa_iban != '' ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	orders := make([]Order, 0)
+	for rows.Next() {
+		order, err := scanOrder(rows)
+		if err != nil {
+			return nil, err
+		}
+		orders = append(orders, *order)
+	}
+	return orders, rows.Err()
+}
+
+// MarkDirectDebitExported records that the direct debit of an order was exported for the bank in the file
+// messageID, to be collected on collectionDate (YYYY-MM-DD). It returns false if the debit was exported or
+// the order paid meanwhile.
+func MarkDirectDebitExported(db Queryer, id int64, exportedAt string, messageID string, collectionDate string, mutex *sync.Mutex) (bool, error) {
+	defer lock(mutex, "MarkDirectDebitExported")()
+	result, err := db.Exec("UPDATE orders SET sepa_exported_at = ?, sepa_message_id = ?, sepa_collection_date = ? WHERE id = ? AND sepa_exported_at = '' AND paid_at = ''", exportedAt, messageID, collectionDate, id)
+	if err != nil {
+		return false, err
+	}
+	affected, err := result.RowsAffected()
+	return affected == 1, err
+}
+
+// GetDueDirectDebits returns the unpaid orders whose direct debit was exported and collected on or before the given date (YYYY-MM-DD).
+func GetDueDirectDebits(db Queryer, date string, mutex *sync.Mutex) ([]Order, error) {
+	defer lock(mutex, "GetDueDirectDebits")()
+	rows, err := db.Query("SELECT "+orderColumns+" FROM orders WHERE payment = 'sepa' AND sepa_exported_at != '' AND paid_at = '' AND sepa_collection_date != '' AND sepa_collection_date <= ? ORDER BY id", date)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	orders := make([]Order, 0)
+	for rows.Next() {
+		order, err := scanOrder(rows)
+		if err != nil {
+			return nil, err
+		}
+		orders = append(orders, *order)
+	}
+	return orders, rows.Err()
+}
+
+const directDebitExportColumns = "message_id, created_at, collection_date, order_count, control_sum_cents"
+
+// AddDirectDebitExport saves an exported pain.008 file.
+func AddDirectDebitExport(db Queryer, export *DirectDebitExport, mutex *sync.Mutex) error {
+	defer lock(mutex, "AddDirectDebitExport")()
+	_, err := db.Exec("INSERT INTO sepa_exports (message_id, created_at, collection_date, order_count, control_sum_cents, xml) VALUES (?, ?, ?, ?, ?, ?)",
+		export.MessageID, export.CreatedAt, export.CollectionDate, export.OrderCount, export.ControlSumCents, export.XML)
+	return err
+}
+
+// GetDirectDebitExports returns the exported pain.008 files without their content, newest first.
+func GetDirectDebitExports(db Queryer, mutex *sync.Mutex) ([]DirectDebitExport, error) {
+	defer lock(mutex, "GetDirectDebitExports")()
+	rows, err := db.Query("SELECT " + directDebitExportColumns + " FROM sepa_exports ORDER BY created_at DESC, message_id DESC")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	exports := make([]DirectDebitExport, 0)
+	for rows.Next() {
+		var export DirectDebitExport
+		err = rows.Scan(&export.MessageID, &export.CreatedAt, &export.CollectionDate, &export.OrderCount, &export.ControlSumCents)
+		if err != nil {
+			return nil, err
+		}
+		exports = append(exports, export)
+	}
+	return exports, rows.Err()
+}
+
+// GetDirectDebitExport returns an exported pain.008 file with its content, or nil if there is none with the message ID.
+func GetDirectDebitExport(db Queryer, messageID string, mutex *sync.Mutex) (*DirectDebitExport, error) {
+	defer lock(mutex, "GetDirectDebitExport")()
+	var export DirectDebitExport
+	err := db.QueryRow("SELECT "+directDebitExportColumns+", xml FROM sepa_exports WHERE message_id = ?", messageID).
+		Scan(&export.MessageID, &export.CreatedAt, &export.CollectionDate, &export.OrderCount, &export.ControlSumCents, &export.XML)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &export, nil
+}
+
+// DeleteDirectDebitExportsCreatedBefore deletes the pain.008 files created before the given RFC 3339 date and returns their number.
+func DeleteDirectDebitExportsCreatedBefore(db Queryer, before string, mutex *sync.Mutex) (int64, error) {
+	defer lock(mutex, "DeleteDirectDebitExportsCreatedBefore")()
+	result, err := db.Exec("DELETE FROM sepa_exports WHERE datetime(created_at) < datetime(?)", before)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
 // GetOrders returns all orders.
-func GetOrders(db *sql.DB, mutex *sync.Mutex) ([]Order, error) {
-	mutex.Lock()
-	defer mutex.Unlock()
-	query := "SELECT * FROM orders"
+func GetOrders(db Queryer, mutex *sync.Mutex) ([]Order, error) {
+	defer lock(mutex, "GetOrders")()
+	query := "SELECT " + orderColumns + " FROM orders"
 	rows, err := db.Query(query)
 	if err != nil {
 		return nil, err
 	}
+	defer rows.Close()
+	orders := make([]Order, 0)
+	for rows.Next() {
+		order, err := scanOrder(rows)
+		if err != nil {
+			return nil, err
+		}
+		orders = append(orders, *order)
+	}
+	return orders, rows.Err()
+}
+
+// GetOrder queries the database for the order with the given ID.
+// If the returned order's ID is identical to model.InvalidID, then the corresponding order was not found.
+func GetOrder(db Queryer, id int64, mutex *sync.Mutex) (*Order, error) {
+	defer lock(mutex, "GetOrder")()
+	row := db.QueryRow("SELECT "+orderColumns+" FROM orders WHERE id = ?", id)
+	order, err := scanOrder(row)
+	switch err {
+	case sql.ErrNoRows:
+		return &Order{ID: int64(InvalidID)}, nil
+	case nil:
+		return order, nil
+	default:
+		return nil, err
+	}
+}
+
+// AddOrderForward records the outcome of forwarding an order to an order sink.
+func AddOrderForward(db Queryer, forward *OrderForward, mutex *sync.Mutex) error {
+	defer lock(mutex, "AddOrderForward")()
+	statement, err := db.Prepare("INSERT INTO order_forwards (order_id, sink, date, success, response) VALUES (?, ?, ?, ?, ?)")
+	if err != nil {
+		return err
+	}
+	result, err := statement.Exec(forward.OrderID, forward.Sink, forward.Date, forward.Success, forward.Response)
+	if err != nil {
+		return err
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return err
+	}
+	forward.ID = id
+	return nil
+}
+
+// GetFailedOrderForwards returns the latest forward of every order and sink if it was not successful.
+func GetFailedOrderForwards(db Queryer, mutex *sync.Mutex) ([]OrderForward, error) {
+	defer lock(mutex, "GetFailedOrderForwards")()
+	rows, err := db.Query("SELECT id, order_id, sink, date, success, response FROM order_forwards WHERE id IN (SELECT MAX(id) FROM order_forwards GROUP BY order_id, sink) AND success = 0 ORDER BY order_id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	forwards := make([]OrderForward, 0)
+	for rows.Next() {
+		var forward OrderForward
+		err = rows.Scan(&forward.ID, &forward.OrderID, &forward.Sink, &forward.Date, &forward.Success, &forward.Response)
+		if err != nil {
+			return nil, err
+		}
+		forwards = append(forwards, forward)
+	}
+	return forwards, rows.Err()
+}
+
+// GetForwardStatus summarizes the forwards to a sink.
+// Orders that are older than the first recorded forward to the sink, or quarantined, are not part of the backlog.
+func GetForwardStatus(db Queryer, sink string, mutex *sync.Mutex) (*ForwardStatus, error) {
+	defer lock(mutex, "GetForwardStatus")()
+	status := ForwardStatus{Sink: sink}
+	err := db.QueryRow("SELECT COUNT(*) FROM order_forwards WHERE id IN (SELECT MAX(id) FROM order_forwards WHERE sink = ? GROUP BY order_id) AND success = 0", sink).Scan(&status.Backlog)
+	if err != nil {
+		return nil, err
+	}
+	var neverForwarded int
+	err = db.QueryRow("SELECT COUNT(*) FROM orders WHERE quarantined = 0 AND id > (SELECT MIN(order_id) FROM order_forwards WHERE sink = ?) AND id NOT IN (SELECT order_id FROM order_forwards WHERE sink = ?)", sink, sink).Scan(&neverForwarded)
+	if err != nil {
+		return nil, err
+	}
+	status.Backlog += neverForwarded
+	var lastSuccess sql.NullString
+	err = db.QueryRow("SELECT MAX(date) FROM order_forwards WHERE sink = ? AND success = 1", sink).Scan(&lastSuccess)
+	if err != nil {
+		return nil, err
+	}
+	status.LastSuccess = lastSuccess.String
+	return &status, nil
+}
+
+// Ping checks that the database answers queries.
+func Ping(db Queryer, mutex *sync.Mutex) error {
+	defer lock(mutex, "Ping")()
+	var one int
+	return db.QueryRow("SELECT 1").Scan(&one)
+}
+
+// GetOrderForwards returns all recorded forwards of the order with the given ID, oldest first.
+func GetOrderForwards(db Queryer, orderID int64, mutex *sync.Mutex) ([]OrderForward, error) {
+	defer lock(mutex, "GetOrderForwards")()
+	rows, err := db.Query("SELECT id, order_id, sink, date, success, response FROM order_forwards WHERE order_id = ? ORDER BY id", orderID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	forwards := make([]OrderForward, 0)
+	for rows.Next() {
+		var forward OrderForward
+		err = rows.Scan(&forward.ID, &forward.OrderID, &forward.Sink, &forward.Date, &forward.Success, &forward.Response)
+		if err != nil {
+			return nil, err
+		}
+		forwards = append(forwards, forward)
+	}
+	return forwards, rows.Err()
+}
+
+// FirstUzOrderID is the lowest ID of a saved Unterstützer order. Before Unterstützer orders were saved, they were
+// forwarded to billbee with their CSV row as ID, so the IDs start above all rows to keep the order numbers unique.
+const FirstUzOrderID = 100000
+
+// AddUzOrder adds an Unterstützer order to the database and sets the ID in the order.
+func AddUzOrder(db Queryer, order *UzOrder, mutex *sync.Mutex) error {
+	defer lock(mutex, "AddUzOrder")()
+	statement, err := db.Prepare("INSERT INTO uz_orders (id, import_key, row, convivium, member_no, amount, date, company, first_name, last_name, email, address_street, address_street_no, address_code, address_city, address_country, message, forwarded, billbee_api_response) VALUES (MAX((SELECT COALESCE(MAX(id), 0) + 1 FROM uz_orders), ?), ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)")
+	if err != nil {
+		return err
+	}
+	result, err := statement.Exec(FirstUzOrderID, order.ImportKey, order.Row, order.Convivium, order.MemberNo, order.Amount, order.Date, order.CompanyInvoice, order.FirstNameInvoice, order.LastNameInvoice, order.Email, order.AddressStreetInvoice, order.AddressStreetNoInvoice, order.AddressCodeInvoice, order.AddressCityInvoice, order.AddressCountryInvoice, order.Message, order.Forwarded, order.BillbeeResponse)
+	if err != nil {
+		return err
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return err
+	}
+	order.ID = id
+	return nil
+}
+
+const uzOrderColumns = "id, import_key, row, convivium, member_no, amount, date, company, first_name, last_name, email, address_street, address_street_no, address_code, address_city, address_country, message, forwarded, billbee_api_response, anonymized_at, erased_at"
+
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanUzOrder(row scanner) (*UzOrder, error) {
+	var order UzOrder
+	var message, billbeeResponse sql.NullString
+	err := row.Scan(&order.ID, &order.ImportKey, &order.Row, &order.Convivium, &order.MemberNo, &order.Amount, &order.Date, &order.CompanyInvoice, &order.FirstNameInvoice, &order.LastNameInvoice, &order.Email, &order.AddressStreetInvoice, &order.AddressStreetNoInvoice, &order.AddressCodeInvoice, &order.AddressCityInvoice, &order.AddressCountryInvoice, &message, &order.Forwarded, &billbeeResponse, &order.AnonymizedAt, &order.ErasedAt)
+	if err != nil {
+		return nil, err
+	}
+	order.Message = message.String
+	order.BillbeeResponse = billbeeResponse.String
+	// The delivery address is the invoice address.
+	order.CompanyDelivery = order.CompanyInvoice
+	order.FirstNameDelivery = order.FirstNameInvoice
+	order.LastNameDelivery = order.LastNameInvoice
+	order.AddressStreetDelivery = order.AddressStreetInvoice
+	order.AddressStreetNoDelivery = order.AddressStreetNoInvoice
+	order.AddressCodeDelivery = order.AddressCodeInvoice
+	order.AddressCityDelivery = order.AddressCityInvoice
+	order.AddressCountryDelivery = order.AddressCountryInvoice
+	return &order, nil
+}
+
+// GetUzOrderByImportKey queries the database for an Unterstützer order with the given import key.
+// If the returned order's ID is identical to model.InvalidID, then the corresponding order was not found.
+func GetUzOrderByImportKey(db Queryer, importKey string, mutex *sync.Mutex) (*UzOrder, error) {
+	defer lock(mutex, "GetUzOrderByImportKey")()
+	row := db.QueryRow("SELECT "+uzOrderColumns+" FROM uz_orders WHERE import_key = ?", importKey)
+	order, err := scanUzOrder(row)
+	switch err {
+	case sql.ErrNoRows:
+		return &UzOrder{Order: Order{ID: int64(InvalidID)}, ImportKey: importKey}, nil
+	case nil:
+		return order, nil
+	default:
+		return nil, err
+	}
+}
+
+// GetUzOrder queries the database for the Unterstützer order with the given ID.
+// If the returned order's ID is identical to model.InvalidID, then the corresponding order was not found.
+func GetUzOrder(db Queryer, id int64, mutex *sync.Mutex) (*UzOrder, error) {
+	defer lock(mutex, "GetUzOrder")()
+	order, err := scanUzOrder(db.QueryRow("SELECT "+uzOrderColumns+" FROM uz_orders WHERE id = ?", id))
+	switch err {
+	case sql.ErrNoRows:
+		return &UzOrder{Order: Order{ID: int64(InvalidID)}}, nil
+	case nil:
+		return order, nil
+	default:
+		return nil, err
+	}
+}
+
+// GetUzOrders returns all Unterstützer orders.
+func GetUzOrders(db Queryer, mutex *sync.Mutex) ([]UzOrder, error) {
+	defer lock(mutex, "GetUzOrders")()
+	rows, err := db.Query("SELECT " + uzOrderColumns + " FROM uz_orders ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	orders := make([]UzOrder, 0)
+	for rows.Next() {
+		order, err := scanUzOrder(rows)
+		if err != nil {
+			return nil, err
+		}
+		orders = append(orders, *order)
+	}
+	return orders, rows.Err()
+}
+
+// SetUzOrderForwarded saves the outcome of forwarding an Unterstützer order to billbee.
+func SetUzOrderForwarded(id int64, forwarded bool, billbeeResponse string, db Queryer, mutex *sync.Mutex) error {
+	defer lock(mutex, "SetUzOrderForwarded")()
+	statement, err := db.Prepare("UPDATE uz_orders SET forwarded = ?, billbee_api_response = ? WHERE id = ?")
+	if err != nil {
+		return err
+	}
+	_, err = statement.Exec(forwarded, billbeeResponse, id)
+	return err
+}
+
+// IdempotencyKeyLifetime is how long a response is remembered for its Idempotency-Key.
+var IdempotencyKeyLifetime = 24 * time.Hour
+
+// IdempotencyReservationTimeout is how long a request may take before its reserved Idempotency-Key is released
+// for retries, e.g. because the server stopped while processing it.
+var IdempotencyReservationTimeout = 2 * time.Minute
+
+// ReserveIdempotencyKey saves a new idempotency record unless one with the same key exists.
+// It returns true if the key was reserved, otherwise the existing record.
+func ReserveIdempotencyKey(db Queryer, record *IdempotencyRecord, mutex *sync.Mutex) (*IdempotencyRecord, bool, error) {
+	defer lock(mutex, "ReserveIdempotencyKey")()
+	now := time.Now().UTC()
+	_, err := db.Exec("DELETE FROM idempotency_keys WHERE date < ? OR (status = 0 AND date < ?)",
+		now.Add(-IdempotencyKeyLifetime).Format(time.RFC3339), now.Add(-IdempotencyReservationTimeout).Format(time.RFC3339))
+	if err != nil {
+		return nil, false, err
+	}
+	record.Date = now.Format(time.RFC3339)
+	result, err := db.Exec("INSERT OR IGNORE INTO idempotency_keys (key, body_hash, date, status) VALUES (?, ?, ?, 0)", record.Key, record.BodyHash, record.Date)
+	if err != nil {
+		return nil, false, err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return nil, false, err
+	}
+	if n == 1 {
+		return record, true, nil
+	}
+	var existing IdempotencyRecord
+	var orderID sql.NullInt64
+	var response sql.NullString
+	err = db.QueryRow("SELECT key, body_hash, date, order_id, status, response FROM idempotency_keys WHERE key = ?", record.Key).Scan(&existing.Key, &existing.BodyHash, &existing.Date, &orderID, &existing.Status, &response)
+	if err != nil {
+		return nil, false, err
+	}
+	existing.OrderID = orderID.Int64
+	existing.Response = response.String
+	return &existing, false, nil
+}
+
+// CompleteIdempotencyKey saves the response to the request that reserved the key.
+func CompleteIdempotencyKey(db Queryer, key string, orderID int64, status int, response string, mutex *sync.Mutex) error {
+	defer lock(mutex, "CompleteIdempotencyKey")()
+	_, err := db.Exec("UPDATE idempotency_keys SET order_id = ?, status = ?, response = ? WHERE key = ?", orderID, status, response, key)
+	return err
+}
+
+// DeleteIdempotencyKey releases a reserved key, e.g. because the request failed and may be retried.
+func DeleteIdempotencyKey(db Queryer, key string, mutex *sync.Mutex) error {
+	defer lock(mutex, "DeleteIdempotencyKey")()
+	_, err := db.Exec("DELETE FROM idempotency_keys WHERE key = ?", key)
+	return err
+}
+
+// SaveBlockedClients adds the given blocks to the blocks saved for each client.
+func SaveBlockedClients(db Queryer, clients []BlockedClient, mutex *sync.Mutex) error {
+	defer lock(mutex, "SaveBlockedClients")()
+	return inTransaction(db, func(tx Queryer) error {
+		for _, client := range clients {
+			_, err := tx.Exec("INSERT INTO rate_limit_blocks (ip, count, first_blocked, last_blocked, last_path, last_reason) VALUES (?, ?, ?, ?, ?, ?) "+
+				"ON CONFLICT (ip) DO UPDATE SET count = count + excluded.count, last_blocked = excluded.last_blocked, last_path = excluded.last_path, last_reason = excluded.last_reason",
+				client.IP, client.Count, client.FirstBlocked, client.LastBlocked, client.LastPath, client.LastReason)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// GetBlockedClients returns the saved blocks of all clients, most recently blocked first.
+func GetBlockedClients(db Queryer, mutex *sync.Mutex) ([]BlockedClient, error) {
+	defer lock(mutex, "GetBlockedClients")()
+	rows, err := db.Query("SELECT ip, count, first_blocked, last_blocked, last_path, last_reason FROM rate_limit_blocks ORDER BY last_blocked DESC")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	clients := make([]BlockedClient, 0)
+	for rows.Next() {
+		var client BlockedClient
+		err = rows.Scan(&client.IP, &client.Count, &client.FirstBlocked, &client.LastBlocked, &client.LastPath, &client.LastReason)
+		if err != nil {
+			return nil, err
+		}
+		clients = append(clients, client)
+	}
+	return clients, rows.Err()
+}
+
+// DeleteBlockedClientsBefore deletes the blocks of clients that were last blocked before the given RFC 3339 date.
+func DeleteBlockedClientsBefore(db Queryer, before string, mutex *sync.Mutex) error {
+	defer lock(mutex, "DeleteBlockedClientsBefore")()
+	_, err := db.Exec("DELETE FROM rate_limit_blocks WHERE last_blocked < ?", before)
+	return err
+}
+
+// EmailHash returns the key under which orders stay findable by their email address once it was removed by anonymization.
+func EmailHash(email string) string {
+	hash := sha256.Sum256([]byte(strings.ToLower(strings.TrimSpace(email))))
+	return hex.EncodeToString(hash[:])
+}
+
+// GetOrdersByEmail returns the orders placed with an email address, ignoring case, including anonymized orders.
+func GetOrdersByEmail(db Queryer, email string, mutex *sync.Mutex) ([]Order, error) {
+	defer lock(mutex, "GetOrdersByEmail")()
+	rows, err := db.Query("SELECT "+orderColumns+" FROM orders WHERE lower(email) = lower(?) OR email_hash = ? ORDER BY id", email, EmailHash(email))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	orders := make([]Order, 0)
+	for rows.Next() {
+		order, err := scanOrder(rows)
+		if err != nil {
+			return nil, err
+		}
+		orders = append(orders, *order)
+	}
+	return orders, rows.Err()
+}
+
+// GetUzOrdersByEmail returns the Unterstützer orders imported with an email address, ignoring case, including anonymized orders.
+func GetUzOrdersByEmail(db Queryer, email string, mutex *sync.Mutex) ([]UzOrder, error) {
+	defer lock(mutex, "GetUzOrdersByEmail")()
+	rows, err := db.Query("SELECT "+uzOrderColumns+" FROM uz_orders WHERE lower(email) = lower(?) OR email_hash = ? ORDER BY id", email, EmailHash(email))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	orders := make([]UzOrder, 0)
+	for rows.Next() {
+		order, err := scanUzOrder(rows)
+		if err != nil {
+			return nil, err
+		}
+		orders = append(orders, *order)
+	}
+	return orders, rows.Err()
+}
+
+// PseudonymizeOrder replaces the personal data of an order and its forwards by a pseudonym.
+// Amounts, dates, countries, payment and the order number are kept for accounting.
+func PseudonymizeOrder(db Queryer, id int64, pseudonym string, erasedAt string, mutex *sync.Mutex) error {
+	defer lock(mutex, "PseudonymizeOrder")()
+	return inTransaction(db, func(tx Queryer) error {
+		_, err := tx.Exec("UPDATE orders SET first_name_invoice = ?, last_name_invoice = ?, first_name_delivery = ?, last_name_delivery = ?, email = ?, address_street_invoice = '', address_street_no_invoice = '', address_code_invoice = '', address_city_invoice = '', address_street_delivery = '', address_street_no_delivery = '', address_code_delivery = '', address_city_delivery = '', company_invoice = '', company_delivery = '', email_hash = '', message = '', billbee_api_response = '', sepa_account_holder = '', sepa_iban = '', sepa_bic = '', erased_at = ? WHERE id = ?",
+			pseudonym, pseudonym, pseudonym, pseudonym, pseudonym+"@erased.invalid", erasedAt, id)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec("UPDATE order_forwards SET response = '' WHERE order_id = ?", id)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec("UPDATE bank_payments SET counterparty = ?, iban = '', reference = '' WHERE order_id = ?", pseudonym, id)
+		return err
+	})
+}
+
+// PseudonymizeUzOrder replaces the personal data of an Unterstützer order by a pseudonym.
+func PseudonymizeUzOrder(db Queryer, id int64, pseudonym string, erasedAt string, mutex *sync.Mutex) error {
+	defer lock(mutex, "PseudonymizeUzOrder")()
+	_, err := db.Exec("UPDATE uz_orders SET import_key = ?, member_no = '', company = '', first_name = ?, last_name = ?, email = ?, address_street = '', address_street_no = '', address_code = '', address_city = '', message = '', billbee_api_response = '', email_hash = '', erased_at = ? WHERE id = ?",
+		"erased-"+strconv.FormatInt(id, 10), pseudonym, pseudonym, pseudonym+"@erased.invalid", erasedAt, id)
+	return err
+}
+
+// GetOrdersPlacedBefore returns the orders whose date is before the given RFC 3339 date.
+// Dates are compared in UTC, whatever their offsets.
+func GetOrdersPlacedBefore(db Queryer, before string, mutex *sync.Mutex) ([]Order, error) {
+	defer lock(mutex, "GetOrdersPlacedBefore")()
+	rows, err := db.Query("SELECT "+orderColumns+" FROM orders WHERE datetime(date) < datetime(?) ORDER BY id", before)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
 	orders := make([]Order, 0)
 	for rows.Next() {
-		var order Order
-		err = rows.Scan(&order.ID, &order.ProductID, &order.Amount, &order.Date, &order.FirstNameInvoice, &order.LastNameInvoice, &order.FirstNameDelivery, &order.LastNameDelivery, &order.Email, &order.AddressStreetInvoice, &order.AddressStreetNoInvoice, &order.AddressCodeInvoice, &order.AddressCityInvoice, &order.AddressCountryInvoice, &order.AddressStreetDelivery, &order.AddressStreetNoDelivery, &order.AddressCodeDelivery, &order.AddressCityDelivery, &order.AddressCountryDelivery, &order.Payment, &order.Premium, &order.Reseller, &order.SlowFoodMember, &order.AgreesAGB, &order.AgreesPrivacy, &order.Message, &order.BillbeeResponse)
+		order, err := scanOrder(rows)
+		if err != nil {
+			return nil, err
+		}
+		orders = append(orders, *order)
+	}
+	return orders, rows.Err()
+}
+
+// GetUzOrdersPlacedBefore returns the Unterstützer orders whose date is before the given RFC 3339 date.
+// Dates are compared in UTC, whatever their offsets.
+func GetUzOrdersPlacedBefore(db Queryer, before string, mutex *sync.Mutex) ([]UzOrder, error) {
+	defer lock(mutex, "GetUzOrdersPlacedBefore")()
+	rows, err := db.Query("SELECT "+uzOrderColumns+" FROM uz_orders WHERE datetime(date) < datetime(?) ORDER BY id", before)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	orders := make([]UzOrder, 0)
+	for rows.Next() {
+		order, err := scanUzOrder(rows)
+		if err != nil {
+			return nil, err
+		}
+		orders = append(orders, *order)
+	}
+	return orders, rows.Err()
+}
+
+// AnonymizeOrder removes the personal data of an order that is not needed for accounting:
+// the email address, the delivery address, the message and the responses of the order sinks.
+// The invoice address and company are kept until the order is pseudonymized, and the email address is replaced by
+// its EmailHash so that GetOrdersByEmail still finds the order for an export or erasure request.
+func AnonymizeOrder(db Queryer, id int64, anonymizedAt string, mutex *sync.Mutex) error {
+	defer lock(mutex, "AnonymizeOrder")()
+	return inTransaction(db, func(tx Queryer) error {
+		var email string
+		err := tx.QueryRow("SELECT email FROM orders WHERE id = ?", id).Scan(&email)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec("UPDATE orders SET email = '', email_hash = ?, first_name_delivery = '', last_name_delivery = '', company_delivery = '', address_street_delivery = '', address_street_no_delivery = '', address_code_delivery = '', address_city_delivery = '', message = '', billbee_api_response = '', anonymized_at = ? WHERE id = ?", EmailHash(email), anonymizedAt, id)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec("UPDATE order_forwards SET response = '' WHERE order_id = ?", id)
+		return err
+	})
+}
+
+// AnonymizeUzOrder removes the personal data of an Unterstützer order that is not needed for accounting.
+// Like AnonymizeOrder, it keeps the EmailHash of the removed email address.
+func AnonymizeUzOrder(db Queryer, id int64, anonymizedAt string, mutex *sync.Mutex) error {
+	defer lock(mutex, "AnonymizeUzOrder")()
+	var email string
+	err := db.QueryRow("SELECT email FROM uz_orders WHERE id = ?", id).Scan(&email)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec("UPDATE uz_orders SET member_no = '', email = '', email_hash = ?, message = '', billbee_api_response = '', anonymized_at = ? WHERE id = ?", EmailHash(email), anonymizedAt, id)
+	return err
+}
+
+// DeleteOrder deletes an order together with its forwards and idempotency keys.
+func DeleteOrder(db Queryer, id int64, mutex *sync.Mutex) error {
+	defer lock(mutex, "DeleteOrder")()
+	return inTransaction(db, func(tx Queryer) error {
+		for _, statement := range []string{
+			"DELETE FROM order_forwards WHERE order_id = ?",
+			"DELETE FROM idempotency_keys WHERE order_id = ?",
+			"DELETE FROM orders WHERE id = ?",
+		} {
+			_, err := tx.Exec(statement, id)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// AddAdminUser adds an admin user and sets its ID.
+func AddAdminUser(db Queryer, user *AdminUser, mutex *sync.Mutex) error {
+	defer lock(mutex, "AddAdminUser")()
+	result, err := db.Exec("INSERT INTO admin_users (username, password_hash, role, disabled, created) VALUES (?, ?, ?, ?, ?)", user.Username, user.PasswordHash, user.Role, user.Disabled, user.Created)
+	if err != nil {
+		return err
+	}
+	user.ID, err = result.LastInsertId()
+	return err
+}
+
+const adminUserColumns = "id, username, password_hash, role, disabled, created, last_login, failed_logins, locked_until"
+
+func scanAdminUser(row scanner) (*AdminUser, error) {
+	var user AdminUser
+	err := row.Scan(&user.ID, &user.Username, &user.PasswordHash, &user.Role, &user.Disabled, &user.Created, &user.LastLogin, &user.FailedLogins, &user.LockedUntil)
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// GetAdminUser queries the database for the admin user with the given username.
+// If the returned user's ID is identical to model.InvalidID, then the user was not found.
+func GetAdminUser(db Queryer, username string, mutex *sync.Mutex) (*AdminUser, error) {
+	defer lock(mutex, "GetAdminUser")()
+	user, err := scanAdminUser(db.QueryRow("SELECT "+adminUserColumns+" FROM admin_users WHERE username = ?", username))
+	switch err {
+	case sql.ErrNoRows:
+		return &AdminUser{ID: int64(InvalidID), Username: username}, nil
+	case nil:
+		return user, nil
+	default:
+		return nil, err
+	}
+}
+
+// GetAdminUsers returns all admin users.
+func GetAdminUsers(db Queryer, mutex *sync.Mutex) ([]AdminUser, error) {
+	defer lock(mutex, "GetAdminUsers")()
+	rows, err := db.Query("SELECT " + adminUserColumns + " FROM admin_users ORDER BY username")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	users := make([]AdminUser, 0)
+	for rows.Next() {
+		user, err := scanAdminUser(rows)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, *user)
+	}
+	return users, rows.Err()
+}
+
+// CountAdminUsers counts the admin users, including disabled ones.
+func CountAdminUsers(db Queryer, mutex *sync.Mutex) (int, error) {
+	defer lock(mutex, "CountAdminUsers")()
+	var count int
+	err := db.QueryRow("SELECT COUNT(*) FROM admin_users").Scan(&count)
+	return count, err
+}
+
+// AddFailedAdminLogin counts a failed login of an admin user and locks the user out until lockedUntil
+// once maxFailures logins failed in a row. It returns true if the user is locked out now.
+func AddFailedAdminLogin(db Queryer, id int64, maxFailures int, lockedUntil string, mutex *sync.Mutex) (bool, error) {
+	defer lock(mutex, "AddFailedAdminLogin")()
+	locked := false
+	err := inTransaction(db, func(tx Queryer) error {
+		var failures int
+		err := tx.QueryRow("SELECT failed_logins + 1 FROM admin_users WHERE id = ?", id).Scan(&failures)
+		if err != nil {
+			return err
+		}
+		locked = failures >= maxFailures
+		if locked {
+			_, err = tx.Exec("UPDATE admin_users SET failed_logins = ?, locked_until = ? WHERE id = ?", failures, lockedUntil, id)
+		} else {
+			_, err = tx.Exec("UPDATE admin_users SET failed_logins = ? WHERE id = ?", failures, id)
+		}
+		return err
+	})
+	return locked, err
+}
+
+// SetAdminUserPassword replaces the password hash of an admin user, lifts its lockout and ends all of its sessions.
+func SetAdminUserPassword(db Queryer, id int64, passwordHash string, mutex *sync.Mutex) error {
+	defer lock(mutex, "SetAdminUserPassword")()
+	return inTransaction(db, func(tx Queryer) error {
+		_, err := tx.Exec("UPDATE admin_users SET password_hash = ?, failed_logins = 0, locked_until = '' WHERE id = ?", passwordHash, id)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec("DELETE FROM admin_sessions WHERE user_id = ?", id)
+		return err
+	})
+}
+
+// SetAdminUserRole changes the role of an admin user.
+func SetAdminUserRole(db Queryer, id int64, role string, mutex *sync.Mutex) error {
+	defer lock(mutex, "SetAdminUserRole")()
+	_, err := db.Exec("UPDATE admin_users SET role = ? WHERE id = ?", role, id)
+	return err
+}
+
+// SetAdminUserDisabled disables or enables an admin user. Disabling ends all of its sessions.
+func SetAdminUserDisabled(db Queryer, id int64, disabled bool, mutex *sync.Mutex) error {
+	defer lock(mutex, "SetAdminUserDisabled")()
+	return inTransaction(db, func(tx Queryer) error {
+		_, err := tx.Exec("UPDATE admin_users SET disabled = ? WHERE id = ?", disabled, id)
+		if err != nil {
+			return err
+		}
+		if disabled {
+			_, err = tx.Exec("DELETE FROM admin_sessions WHERE user_id = ?", id)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// AddAdminSession stores a new session, records the login of its user and resets its failed logins.
+func AddAdminSession(db Queryer, session *AdminSession, mutex *sync.Mutex) error {
+	defer lock(mutex, "AddAdminSession")()
+	return inTransaction(db, func(tx Queryer) error {
+		_, err := tx.Exec("INSERT INTO admin_sessions (token_hash, user_id, created, expires) VALUES (?, ?, ?, ?)", session.TokenHash, session.UserID, session.Created, session.Expires)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec("UPDATE admin_users SET last_login = ?, failed_logins = 0 WHERE id = ?", session.Created, session.UserID)
+		return err
+	})
+}
+
+// GetAdminSessionUser returns the enabled admin user of the session with the given token hash that expires after now.
+// If the returned user's ID is identical to model.InvalidID, then there is no such session.
+func GetAdminSessionUser(db Queryer, tokenHash string, now string, mutex *sync.Mutex) (*AdminUser, error) {
+	defer lock(mutex, "GetAdminSessionUser")()
+	row := db.QueryRow("SELECT admin_users.id, username, password_hash, role, disabled, admin_users.created, last_login, failed_logins, locked_until FROM admin_sessions JOIN admin_users ON admin_users.id = admin_sessions.user_id WHERE token_hash = ? AND expires > ? AND disabled = 0", tokenHash, now)
+	user, err := scanAdminUser(row)
+	switch err {
+	case sql.ErrNoRows:
+		return &AdminUser{ID: int64(InvalidID)}, nil
+	case nil:
+		return user, nil
+	default:
+		return nil, err
+	}
+}
+
+// DeleteAdminSession ends a session.
+func DeleteAdminSession(db Queryer, tokenHash string, mutex *sync.Mutex) error {
+	defer lock(mutex, "DeleteAdminSession")()
+	_, err := db.Exec("DELETE FROM admin_sessions WHERE token_hash = ?", tokenHash)
+	return err
+}
+
+// DeleteExpiredAdminSessions removes the sessions that expired before now.
+func DeleteExpiredAdminSessions(db Queryer, now string, mutex *sync.Mutex) error {
+	defer lock(mutex, "DeleteExpiredAdminSessions")()
+	_, err := db.Exec("DELETE FROM admin_sessions WHERE expires <= ?", now)
+	return err
+}
+
+// AddAuditEntry appends an entry to the audit log and sets its ID.
+func AddAuditEntry(db Queryer, entry *AuditEntry, mutex *sync.Mutex) error {
+	defer lock(mutex, "AddAuditEntry")()
+	result, err := db.Exec("INSERT INTO audit_log (date, actor, action, target_type, target_id, changes, request_id) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		entry.Date, entry.Actor, entry.Action, entry.TargetType, entry.TargetID, string(entry.Changes), entry.RequestID)
+	if err != nil {
+		return err
+	}
+	entry.ID, err = result.LastInsertId()
+	return err
+}
+
+// GetAuditEntries returns the audit entries matching a filter, newest first.
+func GetAuditEntries(db Queryer, filter AuditFilter, mutex *sync.Mutex) ([]AuditEntry, error) {
+	defer lock(mutex, "GetAuditEntries")()
+	query := "SELECT id, date, actor, action, target_type, target_id, changes, request_id FROM audit_log WHERE 1 = 1"
+	args := make([]interface{}, 0)
+	for _, condition := range []struct {
+		sql   string
+		value string
+	}{
+		{" AND actor = ?", filter.Actor},
+		{" AND action = ?", filter.Action},
+		{" AND target_type = ?", filter.TargetType},
+		{" AND date >= ?", filter.Since},
+		{" AND date < ?", filter.Until},
+	} {
+		if condition.value != "" {
+			query += condition.sql
+			args = append(args, condition.value)
+		}
+	}
+	if filter.TargetID != 0 {
+		query += " AND target_id = ?"
+		args = append(args, filter.TargetID)
+	}
+	query += " ORDER BY id DESC"
+	if filter.Limit > 0 {
+		query += " LIMIT " + strconv.Itoa(filter.Limit)
+	}
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	entries := make([]AuditEntry, 0)
+	for rows.Next() {
+		var entry AuditEntry
+		var changes string
+		err = rows.Scan(&entry.ID, &entry.Date, &entry.Actor, &entry.Action, &entry.TargetType, &entry.TargetID, &changes, &entry.RequestID)
 		if err != nil {
 			return nil, err
 		}
-		orders = append(orders, order)
+		entry.Changes = json.RawMessage(changes)
+		entries = append(entries, entry)
 	}
-	return orders, nil
+	return entries, rows.Err()
+}
+
+const bankPaymentColumns = "id, key, booking_date, amount_cents, currency, reference, counterparty, iban, bank_reference, order_id, status, note, imported_at"
+
+func scanBankPayment(row scanner) (*BankPayment, error) {
+	var payment BankPayment
+	err := row.Scan(&payment.ID, &payment.Key, &payment.BookingDate, &payment.AmountCents, &payment.Currency, &payment.Reference,
+		&payment.Counterparty, &payment.IBAN, &payment.BankReference, &payment.OrderID, &payment.Status, &payment.Note, &payment.ImportedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &payment, nil
+}
+
+// queryBankPayments returns the bank payments selected by a query of bankPaymentColumns. The caller holds the mutex.
+func queryBankPayments(db Queryer, query string, args ...interface{}) ([]BankPayment, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	payments := make([]BankPayment, 0)
+	for rows.Next() {
+		payment, err := scanBankPayment(rows)
+		if err != nil {
+			return nil, err
+		}
+		payments = append(payments, *payment)
+	}
+	return payments, rows.Err()
+}
+
+// BankPaymentExists reports whether a bank payment with the given key was imported.
+func BankPaymentExists(db Queryer, key string, mutex *sync.Mutex) (bool, error) {
+	defer lock(mutex, "BankPaymentExists")()
+	var count int
+	err := db.QueryRow("SELECT COUNT(*) FROM bank_payments WHERE key = ?", key).Scan(&count)
+	return count > 0, err
+}
+
+// AddBankPayment saves an imported bank payment and sets its ID.
+func AddBankPayment(db Queryer, payment *BankPayment, mutex *sync.Mutex) error {
+	defer lock(mutex, "AddBankPayment")()
+	result, err := db.Exec("INSERT INTO bank_payments (key, booking_date, amount_cents, currency, reference, counterparty, iban, bank_reference, order_id, status, note, imported_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		payment.Key, payment.BookingDate, payment.AmountCents, payment.Currency, payment.Reference, payment.Counterparty,
+		payment.IBAN, payment.BankReference, payment.OrderID, payment.Status, payment.Note, payment.ImportedAt)
+	if err != nil {
+		return err
+	}
+	payment.ID, err = result.LastInsertId()
+	return err
+}
+
+// GetBankPaymentsOfOrder returns the bank payments matched to an order, oldest first.
+func GetBankPaymentsOfOrder(db Queryer, orderID int64, mutex *sync.Mutex) ([]BankPayment, error) {
+	defer lock(mutex, "GetBankPaymentsOfOrder")()
+	return queryBankPayments(db, "SELECT "+bankPaymentColumns+" FROM bank_payments WHERE order_id = ? ORDER BY booking_date, id", orderID)
+}
+
+// GetBankPaymentsWithStatus returns the bank payments with any of the given statuses, oldest first.
+func GetBankPaymentsWithStatus(db Queryer, statuses []string, mutex *sync.Mutex) ([]BankPayment, error) {
+	defer lock(mutex, "GetBankPaymentsWithStatus")()
+	if len(statuses) == 0 {
+		return make([]BankPayment, 0), nil
+	}
+	placeholders := "?" + strings.Repeat(", ?", len(statuses)-1)
+	args := make([]interface{}, len(statuses))
+	for i, status := range statuses {
+		args[i] = status
+	}
+	return queryBankPayments(db, "SELECT "+bankPaymentColumns+" FROM bank_payments WHERE status IN ("+placeholders+") ORDER BY booking_date, id", args...)
+}
+
+// SetBankPaymentsOfOrderStatus changes the status of the bank payments of an order that have the status from.
+func SetBankPaymentsOfOrderStatus(db Queryer, orderID int64, from string, to string, mutex *sync.Mutex) error {
+	defer lock(mutex, "SetBankPaymentsOfOrderStatus")()
+	_, err := db.Exec("UPDATE bank_payments SET status = ? WHERE order_id = ? AND status = ?", to, orderID, from)
+	return err
+}
+
+// GetBankPaymentsBookedBefore returns the bank payments booked before the given date (YYYY-MM-DD) that still hold
+// the name, IBAN or remittance text of the payer.
+func GetBankPaymentsBookedBefore(db Queryer, before string, mutex *sync.Mutex) ([]BankPayment, error) {
+	defer lock(mutex, "GetBankPaymentsBookedBefore")()
+	return queryBankPayments(db, "SELECT "+bankPaymentColumns+" FROM bank_payments WHERE booking_date < ? AND (iban != '' OR reference != '' OR (counterparty != '' AND counterparty NOT LIKE 'erased-%')) ORDER BY booking_date, id", before)
+}
+
+// PseudonymizeBankPayment replaces the payer of a bank payment by a pseudonym and removes its IBAN and remittance text.
+func PseudonymizeBankPayment(db Queryer, id int64, pseudonym string, mutex *sync.Mutex) error {
+	defer lock(mutex, "PseudonymizeBankPayment")()
+	_, err := db.Exec("UPDATE bank_payments SET counterparty = ?, iban = '', reference = '' WHERE id = ?", pseudonym, id)
+	return err
 }
@@ -0,0 +1,290 @@
+package model
+
+import (
+	"net/mail"
+	"regexp"
+	"strings"
+)
+
+// Machine-readable codes of field errors.
+const (
+	CodeRequired      = "required"
+	CodeInvalid       = "invalid"
+	CodeTypo          = "typo"
+	CodeUnknown       = "unknown"
+	CodeInvalidFormat = "invalid_format"
+	CodeTooSmall      = "too_small"
+	CodeNotAccepted   = "not_accepted"
+	CodeInvalidChoice = "invalid_choice"
+)
+
+// FieldError describes why a single field is invalid. Field is the JSON name of the field, e.g. "address_code_delivery".
+type FieldError struct {
+	Field   string `json:"field"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	// Suggestion is a corrected value, if there is one.
+	Suggestion string `json:"suggestion,omitempty"`
+}
+
+// ValidationError lists every invalid field of a request.
+type ValidationError struct {
+	Fields []FieldError
+}
+
+// Add records that a field is invalid.
+func (err *ValidationError) Add(field string, code string, message string) {
+	err.Fields = append(err.Fields, FieldError{Field: field, Code: code, Message: message})
+}
+
+// Error joins the messages of all fields.
+func (err *ValidationError) Error() string {
+	messages := make([]string, len(err.Fields))
+	for i, field := range err.Fields {
+		messages[i] = field.Message
+	}
+	return strings.Join(messages, " ")
+}
+
+// EmailTypoCheck enables warning about email addresses whose domain is a likely typo of a common mail provider.
+// It works offline, without any MX lookup.
+var EmailTypoCheck = true
+
+var emailDomainLabel = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?$`)
+
+// ValidEmail checks that address is a plain RFC 5322 address (no display name) with a fully qualified domain.
+func ValidEmail(address string) bool {
+	parsed, err := mail.ParseAddress(address)
+	if err != nil || parsed.Address != address || parsed.Name != "" {
+		return false
+	}
+	at := strings.LastIndex(address, "@")
+	local, domain := address[:at], strings.ToLower(address[at+1:])
+	if len(local) > 64 || len(domain) > 253 {
+		return false
+	}
+	labels := strings.Split(domain, ".")
+	if len(labels) < 2 {
+		return false
+	}
+	for _, label := range labels {
+		if !emailDomainLabel.MatchString(label) {
+			return false
+		}
+	}
+	tld := labels[len(labels)-1]
+	return len(tld) >= 2 && strings.Trim(tld, "0123456789") != ""
+}
+
+// commonEmailDomains are the providers our customers use most, typos of these are reported as warnings that the customer can confirm.
+var commonEmailDomains = []string{
+	"gmail.com", "googlemail.com", "web.de", "gmx.de", "gmx.net", "gmx.at", "gmx.ch", "t-online.de",
+	"outlook.com", "outlook.de", "hotmail.com", "hotmail.de", "live.de", "yahoo.com", "yahoo.de",
+	"icloud.com", "me.com", "posteo.de", "mailbox.org", "freenet.de", "aol.com", "bluewin.ch", "arcor.de",
+}
+
+// editDistance returns the optimal string alignment distance, i.e. Levenshtein distance with transpositions.
+func editDistance(a string, b string) int {
+	d := make([][]int, len(a)+1)
+	for i := range d {
+		d[i] = make([]int, len(b)+1)
+		d[i][0] = i
+	}
+	for j := range d[0] {
+		d[0][j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			d[i][j] = min3(d[i-1][j]+1, d[i][j-1]+1, d[i-1][j-1]+cost)
+			if i > 1 && j > 1 && a[i-1] == b[j-2] && a[i-2] == b[j-1] && d[i-2][j-2]+1 < d[i][j] {
+				d[i][j] = d[i-2][j-2] + 1
+			}
+		}
+	}
+	return d[len(a)][len(b)]
+}
+
+func min3(a int, b int, c int) int {
+	if b < a {
+		a = b
+	}
+	if c < a {
+		a = c
+	}
+	return a
+}
+
+// EmailTypoSuggestion returns the corrected address if the domain is one typo away from a common provider, e.g. "gmial.com".
+func EmailTypoSuggestion(address string) string {
+	at := strings.LastIndex(address, "@")
+	if at < 0 {
+		return ""
+	}
+	domain := strings.ToLower(address[at+1:])
+	suggestion := ""
+	for _, common := range commonEmailDomains {
+		if domain == common {
+			return ""
+		}
+		if suggestion == "" && editDistance(domain, common) == 1 {
+			suggestion = common
+		}
+	}
+	if suggestion == "" {
+		return ""
+	}
+	return address[:at+1] + suggestion
+}
+
+// postalCodeFormat describes the postal codes of a country.
+type postalCodeFormat struct {
+	name    string // German name of the country with article, used in German error messages
+	pattern *regexp.Regexp
+	example string
+}
+
+func digits(n string) *regexp.Regexp {
+	return regexp.MustCompile(`^\d{` + n + `}$`)
+}
+
+// postalCodeFormats by ISO 3166-1 alpha-2 code, for Germany, Austria, Switzerland, Liechtenstein and the EU.
+var postalCodeFormats = map[string]postalCodeFormat{
+	"DE": {"Deutschland", digits("5"), "12345"},
+	"AT": {"Österreich", digits("4"), "1234"},
+	"CH": {"der Schweiz", digits("4"), "1234"},
+	"LI": {"Liechtenstein", regexp.MustCompile(`^94(8[5-9]|9[0-8])$`), "9490"},
+	"BE": {"Belgien", digits("4"), "1234"},
+	"BG": {"Bulgarien", digits("4"), "1234"},
+	"CY": {"Zypern", digits("4"), "1234"},
+	"CZ": {"Tschechien", regexp.MustCompile(`^\d{3} ?\d{2}$`), "123 45"},
+	"DK": {"Dänemark", digits("4"), "1234"},
+	"EE": {"Estland", digits("5"), "12345"},
+	"ES": {"Spanien", digits("5"), "12345"},
+	"FI": {"Finnland", digits("5"), "12345"},
+	"FR": {"Frankreich", digits("5"), "12345"},
+	"GR": {"Griechenland", regexp.MustCompile(`^\d{3} ?\d{2}$`), "123 45"},
+	"HR": {"Kroatien", digits("5"), "12345"},
+	"HU": {"Ungarn", digits("4"), "1234"},
+	"IE": {"Irland", regexp.MustCompile(`^(?i)[a-z]\d[\dw] ?[\da-z]{4}$`), "D02 X285"},
+	"IT": {"Italien", digits("5"), "12345"},
+	"LT": {"Litauen", regexp.MustCompile(`^(?i)(LT-)?\d{5}$`), "LT-12345"},
+	"LU": {"Luxemburg", regexp.MustCompile(`^(?i)(L-)?\d{4}$`), "L-1234"},
+	"LV": {"Lettland", regexp.MustCompile(`^(?i)(LV-)?\d{4}$`), "LV-1234"},
+	"MT": {"Malta", regexp.MustCompile(`^(?i)[a-z]{3} ?\d{4}$`), "VLT 1117"},
+	"NL": {"den Niederlanden", regexp.MustCompile(`^(?i)\d{4} ?[a-z]{2}$`), "1234 AB"},
+	"PL": {"Polen", regexp.MustCompile(`^\d{2}-\d{3}$`), "12-345"},
+	"PT": {"Portugal", regexp.MustCompile(`^\d{4}-\d{3}$`), "1234-567"},
+	"RO": {"Rumänien", digits("6"), "123456"},
+	"SE": {"Schweden", regexp.MustCompile(`^\d{3} ?\d{2}$`), "123 45"},
+	"SI": {"Slowenien", digits("4"), "1234"},
+	"SK": {"der Slowakei", regexp.MustCompile(`^\d{3} ?\d{2}$`), "123 45"},
+}
+
+// postalCodeError returns an error message if code is not a valid postal code in the country with the given ISO code,
+// or "" if it is valid or the country's format is unknown.
+func postalCodeError(code string, country string, address string, locale string) string {
+	format, known := postalCodeFormats[country]
+	if !known || format.pattern.MatchString(strings.TrimSpace(code)) {
+		return ""
+	}
+	name := format.name
+	if locale != "de" {
+		if details, exists := GetCountry(country); exists {
+			name = details.NameEnglish
+		}
+	}
+	return Message(locale, "postal_code.invalid_format", address, name, format.example)
+}
+
+// sepaIBANLengths are the IBAN lengths of the countries in the SEPA scheme, by ISO 3166-1 alpha-2 code.
+var sepaIBANLengths = map[string]int{
+	"AD": 24, "AT": 20, "BE": 16, "BG": 22, "CH": 21, "CY": 28, "CZ": 24, "DE": 22, "DK": 18, "EE": 20,
+	"ES": 24, "FI": 18, "FR": 27, "GB": 22, "GI": 23, "GR": 27, "HR": 21, "HU": 28, "IE": 22, "IS": 26,
+	"IT": 27, "LI": 21, "LT": 20, "LU": 20, "LV": 21, "MC": 27, "MT": 31, "NL": 18, "NO": 15, "PL": 28,
+	"PT": 25, "RO": 24, "SE": 24, "SI": 19, "SK": 24, "SM": 27, "VA": 22,
+}
+
+// sepaOutsideEEA are the SEPA countries outside the EEA, whose direct debits need the BIC of the debtor.
+var sepaOutsideEEA = map[string]bool{"AD": true, "CH": true, "GB": true, "GI": true, "MC": true, "SM": true, "VA": true}
+
+var (
+	alphanumeric = regexp.MustCompile(`^[A-Z0-9]+$`)
+	bicPattern   = regexp.MustCompile(`^[A-Z]{6}[A-Z2-9][A-NP-Z0-9]([A-Z0-9]{3})?$`)
+)
+
+// NormalizeIBAN removes the spaces from an IBAN or BIC and converts it to upper case.
+func NormalizeIBAN(iban string) string {
+	return strings.ToUpper(strings.Join(strings.Fields(iban), ""))
+}
+
+// mod97 returns the remainder of the number that results from replacing the letters of an
+// alphanumeric string by 10 to 35, as used by the check digits of ISO 13616 and ISO 7064.
+func mod97(value string) int {
+	remainder := 0
+	for _, c := range value {
+		if c >= 'A' && c <= 'Z' {
+			remainder = (remainder*100 + int(c-'A') + 10) % 97
+		} else {
+			remainder = (remainder*10 + int(c-'0')) % 97
+		}
+	}
+	return remainder
+}
+
+// ValidIBAN checks the length and the check digits of a normalized IBAN.
+func ValidIBAN(iban string) bool {
+	if len(iban) < 15 || len(iban) > 34 || !alphanumeric.MatchString(iban) {
+		return false
+	}
+	return mod97(iban[4:]+iban[:4]) == 1
+}
+
+// ValidBIC checks the format of a normalized BIC with 8 or 11 characters.
+func ValidBIC(bic string) bool {
+	return bicPattern.MatchString(bic)
+}
+
+// ValidCreditorID checks the SEPA creditor identifier, e.g. "DE98ZZZ09999999999". Its check digits
+// are computed like those of an IBAN, but without the creditor business code in positions 5 to 7.
+func ValidCreditorID(id string) bool {
+	id = NormalizeIBAN(id)
+	if len(id) < 8 || len(id) > 35 || !alphanumeric.MatchString(id) {
+		return false
+	}
+	return mod97(id[7:]+id[:4]) == 1
+}
+
+// VerifyDirectDebit checks and normalizes the bank account and the mandate consent of an order paid by direct debit.
+func VerifyDirectDebit(invalid *ValidationError, locale string, order *Order) {
+	order.SEPAIBAN = NormalizeIBAN(order.SEPAIBAN)
+	order.SEPABIC = NormalizeIBAN(order.SEPABIC)
+	if strings.TrimSpace(order.SEPAAccountHolder) == "" {
+		invalid.Add("sepa_account_holder", CodeRequired, Message(locale, "sepa.holder.required"))
+	}
+	country := ""
+	if order.SEPAIBAN == "" {
+		invalid.Add("sepa_iban", CodeRequired, Message(locale, "sepa.iban.required"))
+	} else if !ValidIBAN(order.SEPAIBAN) {
+		invalid.Add("sepa_iban", CodeInvalid, Message(locale, "sepa.iban.invalid"))
+	} else if length, sepa := sepaIBANLengths[order.SEPAIBAN[:2]]; !sepa {
+		invalid.Add("sepa_iban", CodeUnknown, Message(locale, "sepa.iban.unsupported"))
+	} else if length != len(order.SEPAIBAN) {
+		invalid.Add("sepa_iban", CodeInvalid, Message(locale, "sepa.iban.invalid"))
+	} else {
+		country = order.SEPAIBAN[:2]
+	}
+	if order.SEPABIC == "" {
+		if sepaOutsideEEA[country] {
+			invalid.Add("sepa_bic", CodeRequired, Message(locale, "sepa.bic.required"))
+		}
+	} else if !ValidBIC(order.SEPABIC) {
+		invalid.Add("sepa_bic", CodeInvalid, Message(locale, "sepa.bic.invalid"))
+	}
+	if !order.SEPAMandateConsent {
+		invalid.Add("sepa_mandate_consent", CodeNotAccepted, Message(locale, "sepa.mandate.not_accepted"))
+	}
+}
@@ -0,0 +1,90 @@
+package model
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestValidIBAN(t *testing.T) {
+	tests := []struct {
+		iban  string
+		valid bool
+	}{
+		{"DE89370400440532013000", true},
+		{"DE02120300000000202051", true},
+		{"CH9300762011623852957", true},
+		{"GB29NWBK60161331926819", true},
+		{"BR1800360305000010009795493C1", true},
+		{"DE89370400440532013001", false}, // check digits do not match
+		{"DE98370400440532013000", false}, // check digits swapped
+		{"DE8937040044", false},           // too short
+		{"DE89 3704 0044 0532 0130 00", false},
+		{"de89370400440532013000", false},
+		{"", false},
+	}
+	for _, test := range tests {
+		if valid := ValidIBAN(test.iban); valid != test.valid {
+			t.Errorf("ValidIBAN(%q) = %t, want %t", test.iban, valid, test.valid)
+		}
+	}
+}
+
+func TestValidCreditorID(t *testing.T) {
+	tests := []struct {
+		id    string
+		valid bool
+	}{
+		{"DE98ZZZ09999999999", true},
+		{"de98 zzz 0999 9999 999", true},
+		{"DE98ABC09999999999", true}, // the creditor business code is not checked
+		{"DE99ZZZ09999999999", false},
+		{"DE98ZZZ0999999999", false},
+		{"DE98ZZZ", false},
+		{"", false},
+	}
+	for _, test := range tests {
+		if valid := ValidCreditorID(test.id); valid != test.valid {
+			t.Errorf("ValidCreditorID(%q) = %t, want %t", test.id, valid, test.valid)
+		}
+	}
+}
+
+func TestVerifyDirectDebit(t *testing.T) {
+	tests := []struct {
+		name      string
+		iban, bic string
+		errors    []string
+	}{
+		{"EEA without BIC", "DE89 3704 0044 0532 0130 00", "", nil},
+		{"EEA with BIC", "DE89370400440532013000", "cobadeffxxx", nil},
+		{"outside the EEA without BIC", "CH9300762011623852957", "", []string{"sepa_bic:" + CodeRequired}},
+		{"outside the EEA with BIC", "CH9300762011623852957", "UBSWCHZH80A", nil},
+		{"UK without BIC", "GB29NWBK60161331926819", "", []string{"sepa_bic:" + CodeRequired}},
+		{"invalid BIC", "DE89370400440532013000", "COBA1EFF", []string{"sepa_bic:" + CodeInvalid}},
+		{"invalid check digits", "DE89370400440532013001", "", []string{"sepa_iban:" + CodeInvalid}},
+		{"outside SEPA", "BR1800360305000010009795493C1", "", []string{"sepa_iban:" + CodeUnknown}},
+		{"missing IBAN", "", "", []string{"sepa_iban:" + CodeRequired}},
+	}
+	for _, test := range tests {
+		order := Order{SEPAAccountHolder: "Erika Mustermann", SEPAIBAN: test.iban, SEPABIC: test.bic, SEPAMandateConsent: true}
+		var invalid ValidationError
+		VerifyDirectDebit(&invalid, DefaultLocale, &order)
+		var errors []string
+		for _, field := range invalid.Fields {
+			errors = append(errors, field.Field+":"+field.Code)
+		}
+		if !reflect.DeepEqual(errors, test.errors) {
+			t.Errorf("%s: got errors %v, want %v", test.name, errors, test.errors)
+		}
+	}
+
+	order := Order{SEPAIBAN: "de89 3704 0044 0532 0130 00", SEPABIC: "cobadeff xxx"}
+	var invalid ValidationError
+	VerifyDirectDebit(&invalid, DefaultLocale, &order)
+	if order.SEPAIBAN != "DE89370400440532013000" || order.SEPABIC != "COBADEFFXXX" {
+		t.Errorf("IBAN and BIC were normalized to %q and %q", order.SEPAIBAN, order.SEPABIC)
+	}
+	if len(invalid.Fields) != 2 || invalid.Fields[0].Field != "sepa_account_holder" || invalid.Fields[1].Field != "sepa_mandate_consent" {
+		t.Errorf("got errors %+v, want the account holder and the mandate consent", invalid.Fields)
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kunterbunt/calendarium-server/controller"
+	"github.com/kunterbunt/calendarium-server/logging"
+)
+
+// formatCents formats an amount in cents as euros, e.g. "51.00 EUR".
+func formatCents(cents int64) string {
+	sign := ""
+	if cents < 0 {
+		sign, cents = "-", -cents
+	}
+	return fmt.Sprintf("%s%d.%02d EUR", sign, cents/100, cents%100)
+}
+
+// printPayments lists bank payments, one per line.
+func printPayments(title string, payments []controller.ReconciledPayment) {
+	if len(payments) == 0 {
+		return
+	}
+	fmt.Println(title + ":")
+	for _, payment := range payments {
+		line := fmt.Sprintf("  %s %12s  %-9s %-9s", payment.BookingDate, formatCents(payment.AmountCents), payment.Status, payment.OrderNumber)
+		if payment.OrderNumber != "" {
+			line += fmt.Sprintf(" total %s, outstanding %s", formatCents(payment.TotalCents), formatCents(payment.OutstandingCents))
+		}
+		if payment.Note != "" {
+			line += " (" + payment.Note + ")"
+		}
+		fmt.Println(line + "  " + payment.Counterparty + ": " + payment.Reference)
+	}
+}
+
+// importBankStatement matches the credits of a bank statement to orders and marks the paid orders.
+func importBankStatement(args []string) int {
+	flags := flag.NewFlagSet("payments import", flag.ContinueOnError)
+	file := flags.String("file", "", "bank statement file (required)")
+	format := flags.String("format", "", "statement format: "+controller.FormatCAMT053+", "+controller.FormatMT940+" or "+controller.FormatCSV+" (default: detected)")
+	dryRun := flags.Bool("dry-run", false, "only report the matches, do not mark orders paid")
+	jsonOutput := flags.Bool("json", false, "write the report as JSON")
+	config, code := parseFlags(flags, args)
+	if code != exitOK {
+		return code
+	}
+	if *file == "" {
+		fmt.Fprintln(os.Stderr, "-file is required")
+		return exitUsage
+	}
+	data, err := ioutil.ReadFile(*file)
+	if err != nil {
+		logging.Error(err.Error())
+		return exitFailure
+	}
+	credits, err := controller.ParseBankStatement(data, *format)
+	if err != nil {
+		logging.Error(err.Error())
+		return exitFailure
+	}
+	server, err := setup(config, false)
+	if err != nil {
+		logging.Error(err.Error())
+		return exitFailure
+	}
+	report, err := server.ImportBankStatement(cliContext(), credits, time.Now(), *dryRun)
+	if err != nil {
+		logging.Error(err.Error())
+		return exitFailure
+	}
+	if *jsonOutput {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		err = encoder.Encode(report)
+		if err != nil {
+			logging.Error(err.Error())
+			return exitFailure
+		}
+		return exitOK
+	}
+	printPayments("Matched", report.Matched)
+	printPayments("Partial", report.Partial)
+	printPayments("Overpaid", report.Overpaid)
+	printPayments("Already paid", report.Duplicate)
+	printPayments("Unmatched", report.Unmatched)
+	verb := "Imported"
+	if *dryRun {
+		verb = "Would import"
+	}
+	fmt.Printf("%s %d of %d credits, %d were imported before. %d orders paid.\n", verb, report.Credits-report.Skipped, report.Credits, report.Skipped, len(report.Matched)+len(report.Overpaid))
+	return exitOK
+}
+
+// reportOpenPayments lists the partial, overpaid, duplicate and unmatched bank payments.
+func reportOpenPayments(args []string) int {
+	flags := flag.NewFlagSet("payments report", flag.ContinueOnError)
+	config, code := parseFlags(flags, args)
+	if code != exitOK {
+		return code
+	}
+	server, err := setup(config, false)
+	if err != nil {
+		logging.Error(err.Error())
+		return exitFailure
+	}
+	payments, err := server.OpenBankPayments()
+	if err != nil {
+		logging.Error(err.Error())
+		return exitFailure
+	}
+	printPayments("Open bank payments", payments)
+	if len(payments) == 0 {
+		fmt.Println("All bank payments are reconciled.")
+	}
+	return exitOK
+}
+
+// applyDunning sends the due payment reminders and cancels or flags orders that stay unpaid.
+func applyDunning(args []string) int {
+	flags := flag.NewFlagSet("payments remind", flag.ContinueOnError)
+	dryRun := flags.Bool("dry-run", false, "only list the orders that would be reminded, cancelled or flagged")
+	config, code := parseFlags(flags, args)
+	if code != exitOK {
+		return code
+	}
+	server, err := setup(config, false)
+	if err != nil {
+		logging.Error(err.Error())
+		return exitFailure
+	}
+	if !server.DunningPolicy.Enabled() {
+		fmt.Println("Payment reminders are not configured.")
+		return exitOK
+	}
+	report, err := server.ApplyDunning(cliContext(), time.Now(), *dryRun)
+	prefix := ""
+	if *dryRun {
+		prefix = "would be "
+	}
+	for _, reminder := range report.Reminded {
+		fmt.Printf("%s: reminder %d %ssent.\n", reminder.OrderNumber, reminder.Level, prefix)
+	}
+	for _, orderNumber := range report.Cancelled {
+		fmt.Println(orderNumber + ": " + prefix + "cancelled.")
+	}
+	for _, orderNumber := range report.Review {
+		fmt.Println(orderNumber + ": " + prefix + "flagged for review.")
+	}
+	for _, orderNumber := range report.Failed {
+		fmt.Println(orderNumber + ": reminder could not be sent.")
+	}
+	if err != nil {
+		logging.Error(err.Error())
+		return exitFailure
+	}
+	fmt.Printf("%d orders %shandled.\n", report.Changes(), prefix)
+	if len(report.Failed) > 0 {
+		return exitFailure
+	}
+	return exitOK
+}
+
+// resolveOrderReview clears the review flag of an order that was handled by hand.
+func resolveOrderReview(args []string) int {
+	flags := flag.NewFlagSet("payments resolve", flag.ContinueOnError)
+	orderNumber := flags.String("order", "", "order number, e.g. CC-000042 (required)")
+	config, code := parseFlags(flags, args)
+	if code != exitOK {
+		return code
+	}
+	id, err := strconv.ParseInt(strings.TrimLeft(strings.TrimPrefix(strings.ToUpper(*orderNumber), "CC-"), "0"), 10, 64)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "-order must be an order number like CC-000042")
+		return exitUsage
+	}
+	server, err := setup(config, false)
+	if err != nil {
+		logging.Error(err.Error())
+		return exitFailure
+	}
+	order, err := server.ResolveOrderReview(cliContext(), id)
+	if err != nil {
+		logging.Error(err.Error())
+		return exitFailure
+	}
+	fmt.Println(controller.ToOrderId(order.ID) + " resolved.")
+	return exitOK
+}
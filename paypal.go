@@ -0,0 +1,37 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/kunterbunt/calendarium-server/controller"
+	"github.com/kunterbunt/calendarium-server/logging"
+)
+
+// servePayPalStandIn serves a stand-in of the PayPal API. Point the "paypal" url of the configuration to it,
+// with any client ID and secret.
+func servePayPalStandIn(args []string) int {
+	flags := flag.NewFlagSet("paypal stand-in", flag.ContinueOnError)
+	listen := flags.String("listen", "127.0.0.1:8099", "address to listen on")
+	webhook := flags.String("webhook", "", "URL to send webhook events to, e.g. http://127.0.0.1:8000/api/payments/paypal/webhook")
+	err := flags.Parse(args)
+	if err != nil {
+		return exitUsage
+	}
+	if flags.NArg() > 0 {
+		fmt.Fprintln(os.Stderr, "unexpected arguments")
+		return exitUsage
+	}
+	standIn := controller.NewPayPalStandIn("http://"+*listen, *webhook)
+	logging.Info("serving PayPal stand-in", logging.Fields{"address": *listen, "webhook": *webhook})
+	server := &http.Server{Addr: *listen, Handler: standIn, ReadHeaderTimeout: 5 * time.Second}
+	err = server.ListenAndServe()
+	if err != nil {
+		logging.Error(err.Error())
+		return exitFailure
+	}
+	return exitOK
+}
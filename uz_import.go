@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/csv"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/kunterbunt/calendarium-server/controller"
+
+	"github.com/kunterbunt/calendarium-server/logging"
+)
+
+// importUz imports Unterstützer orders from a CSV file, saves them and forwards them to billbee if billbee forwarding is enabled.
+func importUz(args []string) int {
+	flags := flag.NewFlagSet("uz import", flag.ContinueOnError)
+	csvFile := flags.String("csv", "", "Unterstützer CSV file")
+	columnSpec := flags.String("columns", controller.DefaultUzColumns, "column mapping field=index[+index],...; fields: convivium, company, name, first_name, last_name, email, street, street_no, code, city, country, member_no, amount")
+	noHeader := flags.Bool("no-header", false, "the CSV file has no header line")
+	rowSpec := flags.String("rows", "", "comma-separated row indexes to import (default: all rows)")
+	defaultCountry := flags.String("default-country", "DE", "country of rows without one")
+	defaultEmail := flags.String("default-email", "hallo@calendariumculinarium.de", "email address of rows without one")
+	dryRun := flags.Bool("dry-run", false, "only validate and print what would be sent to billbee")
+	reportFile := flags.String("report", "", "write a per-row CSV report to this file")
+	config, code := parseFlags(flags, args)
+	if code != exitOK {
+		return code
+	}
+	if *csvFile == "" {
+		fmt.Fprintln(os.Stderr, "Please provide -csv.")
+		flags.Usage()
+		return exitUsage
+	}
+	columns, err := controller.ParseUzColumns(*columnSpec)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitUsage
+	}
+	rows := make(map[int]bool)
+	if *rowSpec != "" {
+		for _, row := range strings.Split(*rowSpec, ",") {
+			i, err := strconv.Atoi(strings.TrimSpace(row))
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "invalid row '"+row+"'")
+				return exitUsage
+			}
+			rows[i] = true
+		}
+	}
+
+	file, err := os.Open(*csvFile)
+	if err != nil {
+		logging.Error(err.Error())
+		return exitFailure
+	}
+	defer file.Close()
+	lines, err := csv.NewReader(file).ReadAll()
+	if err != nil {
+		logging.Error(err.Error())
+		return exitFailure
+	}
+
+	var server *controller.Server
+	if *dryRun {
+		server, err = setupReadOnly(config)
+	} else {
+		server, err = setup(config, false)
+	}
+	if err != nil {
+		logging.Error(err.Error())
+		return exitFailure
+	}
+
+	results, err := controller.ImportUzOrders(cliContext(), server, lines, controller.UzImportOptions{
+		Columns:        columns,
+		SkipHeader:     !*noHeader,
+		Rows:           rows,
+		DefaultCountry: *defaultCountry,
+		DefaultEmail:   *defaultEmail,
+		DryRun:         *dryRun,
+		DryRunOutput:   os.Stdout,
+	})
+	for _, result := range results {
+		if result.Status == controller.UzStatusInvalid || result.Status == controller.UzStatusFailed {
+			fmt.Println("Row " + strconv.Itoa(result.Row) + ": " + result.Status + ": " + result.Message)
+		}
+	}
+	fmt.Println("Imported " + strconv.Itoa(len(results)) + " rows: " + controller.SummarizeUzImport(results))
+	if *reportFile != "" {
+		report, err2 := os.Create(*reportFile)
+		if err2 != nil {
+			logging.Error(err2.Error())
+			return exitFailure
+		}
+		defer report.Close()
+		err2 = controller.WriteUzImportReport(report, results)
+		if err2 != nil {
+			logging.Error(err2.Error())
+			return exitFailure
+		}
+	}
+	if err != nil {
+		logging.Error(err.Error())
+		return exitFailure
+	}
+	for _, result := range results {
+		if result.Status == controller.UzStatusInvalid || result.Status == controller.UzStatusFailed {
+			return exitFailure
+		}
+	}
+	return exitOK
+}